@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redactedSecret replaces secrets in GET /v1/config
+const redactedSecret = "[redacted]"
+
+// secretConfigFields are configuration fields, at any depth, whose values
+// GET /v1/config never shows
+var secretConfigFields = map[string]bool{
+	"api_key":           true,
+	"previous_api_key":  true,
+	"admin_token":       true,
+	"token_signing_key": true,
+	"secret_access_key": true,
+	"headers":           true,
+}
+
+// urlConfigFields are configuration fields holding URLs, whose passwords
+// GET /v1/config removes
+var urlConfigFields = map[string]bool{
+	"redis_url":            true,
+	"revocation_redis_url": true,
+	"upstream_proxy":       true,
+	"url":                  true,
+}
+
+// parseAdminListener checks admin_listen, admin_grpc_listen, and their
+// TLS settings, loading the certificates they name
+func parseAdminListener(cfg *AnthropicConfig) error {
+	if cfg.AdminListen == "" && cfg.AdminGRPCListen == "" {
+		if cfg.AdminTLSCertFile != "" || cfg.AdminTLSKeyFile != "" || cfg.AdminClientCAFile != "" {
+			return errors.New("admin_tls_cert_file, admin_tls_key_file, and admin_client_ca_file require admin_listen or admin_grpc_listen")
+		}
+		return nil
+	}
+	for _, l := range []struct{ name, addr string }{{"admin_listen", cfg.AdminListen}, {"admin_grpc_listen", cfg.AdminGRPCListen}} {
+		if l.addr == "" {
+			continue
+		}
+		if err := checkListenAddr(l.name, l.addr); err != nil {
+			return err
+		}
+		if cfg.AdminToken == "" && cfg.AdminClientCAFile == "" {
+			return fmt.Errorf("%s requires admin_token or admin_client_ca_file to authenticate admins", l.name)
+		}
+	}
+	if cfg.AdminGRPCListen == cfg.AdminListen {
+		return errors.New("admin_grpc_listen and admin_listen must be different addresses")
+	}
+
+	if (cfg.AdminTLSCertFile == "") != (cfg.AdminTLSKeyFile == "") {
+		return errors.New("admin_tls_cert_file and admin_tls_key_file must be set together")
+	}
+	if cfg.AdminTLSCertFile == "" {
+		if cfg.AdminClientCAFile != "" {
+			return errors.New("admin_client_ca_file requires admin_tls_cert_file and admin_tls_key_file")
+		}
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.AdminTLSCertFile, cfg.AdminTLSKeyFile)
+	if err != nil {
+		return fmt.Errorf("admin_tls_cert_file: %w", err)
+	}
+	cfg.adminTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.AdminClientCAFile != "" {
+		pool, err := loadCertPool(cfg.AdminClientCAFile)
+		if err != nil {
+			return fmt.Errorf("admin_client_ca_file: %w", err)
+		}
+		cfg.adminTLS.ClientCAs = pool
+		// Without an admin token, a certificate is the only way in
+		cfg.adminTLS.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.AdminToken == "" {
+			cfg.adminTLS.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return nil
+}
+
+// checkListenAddr checks that addr, the setting name, is host:port or
+// unix:/path
+func checkListenAddr(name, addr string) error {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return fmt.Errorf("%s: unix: must be followed by a socket path", name)
+		}
+	} else if _, port, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%s must be host:port or unix:/path, got %q", name, addr)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%s: invalid port %q", name, port)
+	}
+	return nil
+}
+
+// listenAdmin binds admin_listen or admin_grpc_listen: a TCP address, or a Unix socket that
+// only the plugin's user may connect to
+func listenAdmin(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// A socket left behind by a process that exited uncleanly would fail
+	// the bind, but one still accepting connections is in use
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// tlsListener accepts connections with TLS as currently configured, so
+// reloading the configuration renews certificates, or turns TLS on or
+// off, without rebinding
+type tlsListener struct {
+	net.Listener
+	config func() *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if cfg := l.config(); cfg != nil {
+		return tls.Server(conn, cfg), nil
+	}
+	return conn, nil
+}
+
+// configResponse is returned by GET /v1/config
+type configResponse struct {
+	Fingerprint string         `json:"fingerprint"`
+	Config      map[string]any `json:"config"`
+}
+
+// handleConfig shows admins the configuration in effect, with defaults
+// applied and secrets redacted
+func (ps *ProxyServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	ps.plugin.mu.RLock()
+	cfg := ps.plugin.config
+	ps.plugin.mu.RUnlock()
+	if cfg == nil {
+		writeError(w, http.StatusServiceUnavailable, "api_error", "plugin not configured")
+		return
+	}
+	redacted, err := redactConfig(cfg)
+	if err != nil {
+		slog.Error("Failed to encode configuration", "error", err)
+		writeError(w, http.StatusInternalServerError, "api_error", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, configResponse{Fingerprint: cfg.fingerprint, Config: redacted})
+}
+
+// rotateKeyResponse is returned by POST /admin/rotate-key
+type rotateKeyResponse struct {
+	// PreviousKeyExpiresAt is when the replaced key stops being used
+	PreviousKeyExpiresAt time.Time `json:"previous_key_expires_at"`
+	Fingerprint          string    `json:"fingerprint"`
+}
+
+// handleRotateAPIKey replaces api_key with a new key once Anthropic
+// accepts it, keeping the old key as previous_api_key for its grace period
+func (ps *ProxyServer) handleRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	var req struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.APIKey == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "expected {\"api_key\": \"sk-ant-...\"}")
+		return
+	}
+	expires, err := ps.plugin.RotateAPIKey(r.Context(), req.APIKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	slog.Warn("Upstream API key rotated", "previous_key_expires_at", expires)
+	ps.plugin.auditLog(AuditEvent{
+		Event:    AuditKeyRotation,
+		Caller:   "admin",
+		ClientIP: clientIP(r, ps.plugin.TrustedProxies()),
+	})
+	writeJSON(w, http.StatusOK, rotateKeyResponse{PreviousKeyExpiresAt: expires, Fingerprint: ps.plugin.ConfigFingerprint()})
+}
+
+// redactConfig returns cfg as a JSON object without its secrets
+func redactConfig(cfg *AnthropicConfig) (map[string]any, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	redactFields(fields)
+	return fields, nil
+}
+
+// redactFields redacts secrets in a decoded JSON value, in place
+func redactFields(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for name, field := range v {
+			switch {
+			case secretConfigFields[name]:
+				if field != nil && field != "" {
+					v[name] = redactedSecret
+				}
+			case urlConfigFields[name]:
+				if s, ok := field.(string); ok {
+					v[name] = redactURL(s)
+				}
+			default:
+				redactFields(field)
+			}
+		}
+	case []any:
+		for _, item := range v {
+			redactFields(item)
+		}
+	}
+}
+
+// redactURL removes the password from a URL, redacting all of a URL it
+// cannot parse
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactedSecret
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,1329 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: adminpb/admin.proto
+
+package adminpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Bucket int32
+
+const (
+	Bucket_BUCKET_UNSPECIFIED Bucket = 0
+	Bucket_BUCKET_HOUR        Bucket = 1
+	Bucket_BUCKET_DAY         Bucket = 2
+)
+
+// Enum value maps for Bucket.
+var (
+	Bucket_name = map[int32]string{
+		0: "BUCKET_UNSPECIFIED",
+		1: "BUCKET_HOUR",
+		2: "BUCKET_DAY",
+	}
+	Bucket_value = map[string]int32{
+		"BUCKET_UNSPECIFIED": 0,
+		"BUCKET_HOUR":        1,
+		"BUCKET_DAY":         2,
+	}
+)
+
+func (x Bucket) Enum() *Bucket {
+	p := new(Bucket)
+	*p = x
+	return p
+}
+
+func (x Bucket) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Bucket) Descriptor() protoreflect.EnumDescriptor {
+	return file_adminpb_admin_proto_enumTypes[0].Descriptor()
+}
+
+func (Bucket) Type() protoreflect.EnumType {
+	return &file_adminpb_admin_proto_enumTypes[0]
+}
+
+func (x Bucket) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Bucket.Descriptor instead.
+func (Bucket) EnumDescriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{0}
+}
+
+// Token describes an active token, never its value
+type Token struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	AgentId       string                 `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	AgentName     string                 `protobuf:"bytes,3,opt,name=agent_name,json=agentName,proto3" json:"agent_name,omitempty"`
+	Scope         string                 `protobuf:"bytes,4,opt,name=scope,proto3" json:"scope,omitempty"`
+	ClientIp      string                 `protobuf:"bytes,5,opt,name=client_ip,json=clientIp,proto3" json:"client_ip,omitempty"`
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	LastUsedAt    *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=last_used_at,json=lastUsedAt,proto3" json:"last_used_at,omitempty"`
+	RequestCount  int64                  `protobuf:"varint,9,opt,name=request_count,json=requestCount,proto3" json:"request_count,omitempty"`
+	MaxUses       int64                  `protobuf:"varint,10,opt,name=max_uses,json=maxUses,proto3" json:"max_uses,omitempty"`
+	SpentUsd      float64                `protobuf:"fixed64,11,opt,name=spent_usd,json=spentUsd,proto3" json:"spent_usd,omitempty"`
+	BudgetUsd     float64                `protobuf:"fixed64,12,opt,name=budget_usd,json=budgetUsd,proto3" json:"budget_usd,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Token) Reset() {
+	*x = Token{}
+	mi := &file_adminpb_admin_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Token) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Token) ProtoMessage() {}
+
+func (x *Token) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Token.ProtoReflect.Descriptor instead.
+func (*Token) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Token) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Token) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *Token) GetAgentName() string {
+	if x != nil {
+		return x.AgentName
+	}
+	return ""
+}
+
+func (x *Token) GetScope() string {
+	if x != nil {
+		return x.Scope
+	}
+	return ""
+}
+
+func (x *Token) GetClientIp() string {
+	if x != nil {
+		return x.ClientIp
+	}
+	return ""
+}
+
+func (x *Token) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Token) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+func (x *Token) GetLastUsedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastUsedAt
+	}
+	return nil
+}
+
+func (x *Token) GetRequestCount() int64 {
+	if x != nil {
+		return x.RequestCount
+	}
+	return 0
+}
+
+func (x *Token) GetMaxUses() int64 {
+	if x != nil {
+		return x.MaxUses
+	}
+	return 0
+}
+
+func (x *Token) GetSpentUsd() float64 {
+	if x != nil {
+		return x.SpentUsd
+	}
+	return 0
+}
+
+func (x *Token) GetBudgetUsd() float64 {
+	if x != nil {
+		return x.BudgetUsd
+	}
+	return 0
+}
+
+type ListTokensRequest struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	AgentId string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	// Base scope, e.g. anthropic:messages
+	Scope string `protobuf:"bytes,2,opt,name=scope,proto3" json:"scope,omitempty"`
+	// Only tokens expiring within this long
+	ExpiringWithin *durationpb.Duration `protobuf:"bytes,3,opt,name=expiring_within,json=expiringWithin,proto3" json:"expiring_within,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *ListTokensRequest) Reset() {
+	*x = ListTokensRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListTokensRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListTokensRequest) ProtoMessage() {}
+
+func (x *ListTokensRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListTokensRequest.ProtoReflect.Descriptor instead.
+func (*ListTokensRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ListTokensRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *ListTokensRequest) GetScope() string {
+	if x != nil {
+		return x.Scope
+	}
+	return ""
+}
+
+func (x *ListTokensRequest) GetExpiringWithin() *durationpb.Duration {
+	if x != nil {
+		return x.ExpiringWithin
+	}
+	return nil
+}
+
+type ListTokensResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tokens        []*Token               `protobuf:"bytes,1,rep,name=tokens,proto3" json:"tokens,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListTokensResponse) Reset() {
+	*x = ListTokensResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListTokensResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListTokensResponse) ProtoMessage() {}
+
+func (x *ListTokensResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListTokensResponse.ProtoReflect.Descriptor instead.
+func (*ListTokensResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListTokensResponse) GetTokens() []*Token {
+	if x != nil {
+		return x.Tokens
+	}
+	return nil
+}
+
+type IssueTokenRequest struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	AgentId string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	// Default: agent_id
+	AgentName     string               `protobuf:"bytes,2,opt,name=agent_name,json=agentName,proto3" json:"agent_name,omitempty"`
+	Scope         string               `protobuf:"bytes,3,opt,name=scope,proto3" json:"scope,omitempty"`
+	Ttl           *durationpb.Duration `protobuf:"bytes,4,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	MaxUses       int64                `protobuf:"varint,5,opt,name=max_uses,json=maxUses,proto3" json:"max_uses,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IssueTokenRequest) Reset() {
+	*x = IssueTokenRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IssueTokenRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IssueTokenRequest) ProtoMessage() {}
+
+func (x *IssueTokenRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IssueTokenRequest.ProtoReflect.Descriptor instead.
+func (*IssueTokenRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *IssueTokenRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *IssueTokenRequest) GetAgentName() string {
+	if x != nil {
+		return x.AgentName
+	}
+	return ""
+}
+
+func (x *IssueTokenRequest) GetScope() string {
+	if x != nil {
+		return x.Scope
+	}
+	return ""
+}
+
+func (x *IssueTokenRequest) GetTtl() *durationpb.Duration {
+	if x != nil {
+		return x.Ttl
+	}
+	return nil
+}
+
+func (x *IssueTokenRequest) GetMaxUses() int64 {
+	if x != nil {
+		return x.MaxUses
+	}
+	return 0
+}
+
+type IssueTokenResponse struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Token   string                 `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	Id      string                 `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	AgentId string                 `protobuf:"bytes,3,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Scope   string                 `protobuf:"bytes,4,opt,name=scope,proto3" json:"scope,omitempty"`
+	// Set when scope_narrowing issued a different scope than requested
+	RequestedScope string                 `protobuf:"bytes,5,opt,name=requested_scope,json=requestedScope,proto3" json:"requested_scope,omitempty"`
+	ExpiresAt      *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *IssueTokenResponse) Reset() {
+	*x = IssueTokenResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IssueTokenResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IssueTokenResponse) ProtoMessage() {}
+
+func (x *IssueTokenResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IssueTokenResponse.ProtoReflect.Descriptor instead.
+func (*IssueTokenResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *IssueTokenResponse) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *IssueTokenResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *IssueTokenResponse) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *IssueTokenResponse) GetScope() string {
+	if x != nil {
+		return x.Scope
+	}
+	return ""
+}
+
+func (x *IssueTokenResponse) GetRequestedScope() string {
+	if x != nil {
+		return x.RequestedScope
+	}
+	return ""
+}
+
+func (x *IssueTokenResponse) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+type RevokeTokenRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The token's value or ID
+	Token         string `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RevokeTokenRequest) Reset() {
+	*x = RevokeTokenRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RevokeTokenRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RevokeTokenRequest) ProtoMessage() {}
+
+func (x *RevokeTokenRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RevokeTokenRequest.ProtoReflect.Descriptor instead.
+func (*RevokeTokenRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *RevokeTokenRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+type RevokeAgentTokensRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RevokeAgentTokensRequest) Reset() {
+	*x = RevokeAgentTokensRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RevokeAgentTokensRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RevokeAgentTokensRequest) ProtoMessage() {}
+
+func (x *RevokeAgentTokensRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RevokeAgentTokensRequest.ProtoReflect.Descriptor instead.
+func (*RevokeAgentTokensRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *RevokeAgentTokensRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type RevokeResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Active tokens revoked
+	Revoked       int32 `protobuf:"varint,1,opt,name=revoked,proto3" json:"revoked,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RevokeResponse) Reset() {
+	*x = RevokeResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RevokeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RevokeResponse) ProtoMessage() {}
+
+func (x *RevokeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RevokeResponse.ProtoReflect.Descriptor instead.
+func (*RevokeResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *RevokeResponse) GetRevoked() int32 {
+	if x != nil {
+		return x.Revoked
+	}
+	return 0
+}
+
+type GetUsageRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The range, to the hour; either may be unset
+	Start *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=start,proto3" json:"start,omitempty"`
+	End   *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=end,proto3" json:"end,omitempty"`
+	// Unspecified totals the range; hours and days break it down
+	Bucket        Bucket `protobuf:"varint,3,opt,name=bucket,proto3,enum=creddy.anthropic.admin.v1.Bucket" json:"bucket,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetUsageRequest) Reset() {
+	*x = GetUsageRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetUsageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetUsageRequest) ProtoMessage() {}
+
+func (x *GetUsageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetUsageRequest.ProtoReflect.Descriptor instead.
+func (*GetUsageRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *GetUsageRequest) GetStart() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Start
+	}
+	return nil
+}
+
+func (x *GetUsageRequest) GetEnd() *timestamppb.Timestamp {
+	if x != nil {
+		return x.End
+	}
+	return nil
+}
+
+func (x *GetUsageRequest) GetBucket() Bucket {
+	if x != nil {
+		return x.Bucket
+	}
+	return Bucket_BUCKET_UNSPECIFIED
+}
+
+type SpendTotals struct {
+	state                    protoimpl.MessageState `protogen:"open.v1"`
+	Requests                 int64                  `protobuf:"varint,1,opt,name=requests,proto3" json:"requests,omitempty"`
+	InputTokens              int64                  `protobuf:"varint,2,opt,name=input_tokens,json=inputTokens,proto3" json:"input_tokens,omitempty"`
+	OutputTokens             int64                  `protobuf:"varint,3,opt,name=output_tokens,json=outputTokens,proto3" json:"output_tokens,omitempty"`
+	CacheCreationInputTokens int64                  `protobuf:"varint,4,opt,name=cache_creation_input_tokens,json=cacheCreationInputTokens,proto3" json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int64                  `protobuf:"varint,5,opt,name=cache_read_input_tokens,json=cacheReadInputTokens,proto3" json:"cache_read_input_tokens,omitempty"`
+	CostUsd                  float64                `protobuf:"fixed64,6,opt,name=cost_usd,json=costUsd,proto3" json:"cost_usd,omitempty"`
+	unknownFields            protoimpl.UnknownFields
+	sizeCache                protoimpl.SizeCache
+}
+
+func (x *SpendTotals) Reset() {
+	*x = SpendTotals{}
+	mi := &file_adminpb_admin_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SpendTotals) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SpendTotals) ProtoMessage() {}
+
+func (x *SpendTotals) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SpendTotals.ProtoReflect.Descriptor instead.
+func (*SpendTotals) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *SpendTotals) GetRequests() int64 {
+	if x != nil {
+		return x.Requests
+	}
+	return 0
+}
+
+func (x *SpendTotals) GetInputTokens() int64 {
+	if x != nil {
+		return x.InputTokens
+	}
+	return 0
+}
+
+func (x *SpendTotals) GetOutputTokens() int64 {
+	if x != nil {
+		return x.OutputTokens
+	}
+	return 0
+}
+
+func (x *SpendTotals) GetCacheCreationInputTokens() int64 {
+	if x != nil {
+		return x.CacheCreationInputTokens
+	}
+	return 0
+}
+
+func (x *SpendTotals) GetCacheReadInputTokens() int64 {
+	if x != nil {
+		return x.CacheReadInputTokens
+	}
+	return 0
+}
+
+func (x *SpendTotals) GetCostUsd() float64 {
+	if x != nil {
+		return x.CostUsd
+	}
+	return 0
+}
+
+// SpendRow is usage by one agent on one model, in one bucket if requested
+type SpendRow struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Time          *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
+	AgentId       string                 `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Model         string                 `protobuf:"bytes,3,opt,name=model,proto3" json:"model,omitempty"`
+	Totals        *SpendTotals           `protobuf:"bytes,4,opt,name=totals,proto3" json:"totals,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SpendRow) Reset() {
+	*x = SpendRow{}
+	mi := &file_adminpb_admin_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SpendRow) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SpendRow) ProtoMessage() {}
+
+func (x *SpendRow) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SpendRow.ProtoReflect.Descriptor instead.
+func (*SpendRow) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *SpendRow) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *SpendRow) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *SpendRow) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *SpendRow) GetTotals() *SpendTotals {
+	if x != nil {
+		return x.Totals
+	}
+	return nil
+}
+
+type GetUsageResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Total         *SpendTotals           `protobuf:"bytes,1,opt,name=total,proto3" json:"total,omitempty"`
+	Rows          []*SpendRow            `protobuf:"bytes,2,rep,name=rows,proto3" json:"rows,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetUsageResponse) Reset() {
+	*x = GetUsageResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetUsageResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetUsageResponse) ProtoMessage() {}
+
+func (x *GetUsageResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetUsageResponse.ProtoReflect.Descriptor instead.
+func (*GetUsageResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *GetUsageResponse) GetTotal() *SpendTotals {
+	if x != nil {
+		return x.Total
+	}
+	return nil
+}
+
+func (x *GetUsageResponse) GetRows() []*SpendRow {
+	if x != nil {
+		return x.Rows
+	}
+	return nil
+}
+
+// AgentPolicy overrides one agent's configured limits
+type AgentPolicy struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Replaces the agent's requests per minute limit; 0 exempts the agent
+	RequestsPerMinute *int32 `protobuf:"varint,1,opt,name=requests_per_minute,json=requestsPerMinute,proto3,oneof" json:"requests_per_minute,omitempty"`
+	// Model glob patterns the agent may use, narrowing its scopes
+	Models []string `protobuf:"bytes,2,rep,name=models,proto3" json:"models,omitempty"`
+	// Replaces the agent's budget per budget_window; 0 removes it
+	BudgetUsd     *float64               `protobuf:"fixed64,3,opt,name=budget_usd,json=budgetUsd,proto3,oneof" json:"budget_usd,omitempty"`
+	UpdatedAt     *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentPolicy) Reset() {
+	*x = AgentPolicy{}
+	mi := &file_adminpb_admin_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentPolicy) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentPolicy) ProtoMessage() {}
+
+func (x *AgentPolicy) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentPolicy.ProtoReflect.Descriptor instead.
+func (*AgentPolicy) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *AgentPolicy) GetRequestsPerMinute() int32 {
+	if x != nil && x.RequestsPerMinute != nil {
+		return *x.RequestsPerMinute
+	}
+	return 0
+}
+
+func (x *AgentPolicy) GetModels() []string {
+	if x != nil {
+		return x.Models
+	}
+	return nil
+}
+
+func (x *AgentPolicy) GetBudgetUsd() float64 {
+	if x != nil && x.BudgetUsd != nil {
+		return *x.BudgetUsd
+	}
+	return 0
+}
+
+func (x *AgentPolicy) GetUpdatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return nil
+}
+
+type GetAgentPolicyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetAgentPolicyRequest) Reset() {
+	*x = GetAgentPolicyRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetAgentPolicyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetAgentPolicyRequest) ProtoMessage() {}
+
+func (x *GetAgentPolicyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetAgentPolicyRequest.ProtoReflect.Descriptor instead.
+func (*GetAgentPolicyRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *GetAgentPolicyRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type SetAgentPolicyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Policy        *AgentPolicy           `protobuf:"bytes,2,opt,name=policy,proto3" json:"policy,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetAgentPolicyRequest) Reset() {
+	*x = SetAgentPolicyRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetAgentPolicyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetAgentPolicyRequest) ProtoMessage() {}
+
+func (x *SetAgentPolicyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetAgentPolicyRequest.ProtoReflect.Descriptor instead.
+func (*SetAgentPolicyRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *SetAgentPolicyRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *SetAgentPolicyRequest) GetPolicy() *AgentPolicy {
+	if x != nil {
+		return x.Policy
+	}
+	return nil
+}
+
+type DeleteAgentPolicyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteAgentPolicyRequest) Reset() {
+	*x = DeleteAgentPolicyRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteAgentPolicyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteAgentPolicyRequest) ProtoMessage() {}
+
+func (x *DeleteAgentPolicyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteAgentPolicyRequest.ProtoReflect.Descriptor instead.
+func (*DeleteAgentPolicyRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *DeleteAgentPolicyRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type DeleteAgentPolicyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteAgentPolicyResponse) Reset() {
+	*x = DeleteAgentPolicyResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteAgentPolicyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteAgentPolicyResponse) ProtoMessage() {}
+
+func (x *DeleteAgentPolicyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteAgentPolicyResponse.ProtoReflect.Descriptor instead.
+func (*DeleteAgentPolicyResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{16}
+}
+
+var File_adminpb_admin_proto protoreflect.FileDescriptor
+
+const file_adminpb_admin_proto_rawDesc = "" +
+	"\n" +
+	"\x13adminpb/admin.proto\x12\x19creddy.anthropic.admin.v1\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xb4\x03\n" +
+	"\x05Token\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\x12\x1d\n" +
+	"\n" +
+	"agent_name\x18\x03 \x01(\tR\tagentName\x12\x14\n" +
+	"\x05scope\x18\x04 \x01(\tR\x05scope\x12\x1b\n" +
+	"\tclient_ip\x18\x05 \x01(\tR\bclientIp\x129\n" +
+	"\n" +
+	"created_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x129\n" +
+	"\n" +
+	"expires_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\x12<\n" +
+	"\flast_used_at\x18\b \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"lastUsedAt\x12#\n" +
+	"\rrequest_count\x18\t \x01(\x03R\frequestCount\x12\x19\n" +
+	"\bmax_uses\x18\n" +
+	" \x01(\x03R\amaxUses\x12\x1b\n" +
+	"\tspent_usd\x18\v \x01(\x01R\bspentUsd\x12\x1d\n" +
+	"\n" +
+	"budget_usd\x18\f \x01(\x01R\tbudgetUsd\"\x88\x01\n" +
+	"\x11ListTokensRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x14\n" +
+	"\x05scope\x18\x02 \x01(\tR\x05scope\x12B\n" +
+	"\x0fexpiring_within\x18\x03 \x01(\v2\x19.google.protobuf.DurationR\x0eexpiringWithin\"N\n" +
+	"\x12ListTokensResponse\x128\n" +
+	"\x06tokens\x18\x01 \x03(\v2 .creddy.anthropic.admin.v1.TokenR\x06tokens\"\xab\x01\n" +
+	"\x11IssueTokenRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1d\n" +
+	"\n" +
+	"agent_name\x18\x02 \x01(\tR\tagentName\x12\x14\n" +
+	"\x05scope\x18\x03 \x01(\tR\x05scope\x12+\n" +
+	"\x03ttl\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\x03ttl\x12\x19\n" +
+	"\bmax_uses\x18\x05 \x01(\x03R\amaxUses\"\xcf\x01\n" +
+	"\x12IssueTokenResponse\x12\x14\n" +
+	"\x05token\x18\x01 \x01(\tR\x05token\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\tR\x02id\x12\x19\n" +
+	"\bagent_id\x18\x03 \x01(\tR\aagentId\x12\x14\n" +
+	"\x05scope\x18\x04 \x01(\tR\x05scope\x12'\n" +
+	"\x0frequested_scope\x18\x05 \x01(\tR\x0erequestedScope\x129\n" +
+	"\n" +
+	"expires_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\"*\n" +
+	"\x12RevokeTokenRequest\x12\x14\n" +
+	"\x05token\x18\x01 \x01(\tR\x05token\"5\n" +
+	"\x18RevokeAgentTokensRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"*\n" +
+	"\x0eRevokeResponse\x12\x18\n" +
+	"\arevoked\x18\x01 \x01(\x05R\arevoked\"\xac\x01\n" +
+	"\x0fGetUsageRequest\x120\n" +
+	"\x05start\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x05start\x12,\n" +
+	"\x03end\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x03end\x129\n" +
+	"\x06bucket\x18\x03 \x01(\x0e2!.creddy.anthropic.admin.v1.BucketR\x06bucket\"\x82\x02\n" +
+	"\vSpendTotals\x12\x1a\n" +
+	"\brequests\x18\x01 \x01(\x03R\brequests\x12!\n" +
+	"\finput_tokens\x18\x02 \x01(\x03R\vinputTokens\x12#\n" +
+	"\routput_tokens\x18\x03 \x01(\x03R\foutputTokens\x12=\n" +
+	"\x1bcache_creation_input_tokens\x18\x04 \x01(\x03R\x18cacheCreationInputTokens\x125\n" +
+	"\x17cache_read_input_tokens\x18\x05 \x01(\x03R\x14cacheReadInputTokens\x12\x19\n" +
+	"\bcost_usd\x18\x06 \x01(\x01R\acostUsd\"\xab\x01\n" +
+	"\bSpendRow\x12.\n" +
+	"\x04time\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\x12\x14\n" +
+	"\x05model\x18\x03 \x01(\tR\x05model\x12>\n" +
+	"\x06totals\x18\x04 \x01(\v2&.creddy.anthropic.admin.v1.SpendTotalsR\x06totals\"\x89\x01\n" +
+	"\x10GetUsageResponse\x12<\n" +
+	"\x05total\x18\x01 \x01(\v2&.creddy.anthropic.admin.v1.SpendTotalsR\x05total\x127\n" +
+	"\x04rows\x18\x02 \x03(\v2#.creddy.anthropic.admin.v1.SpendRowR\x04rows\"\xe0\x01\n" +
+	"\vAgentPolicy\x123\n" +
+	"\x13requests_per_minute\x18\x01 \x01(\x05H\x00R\x11requestsPerMinute\x88\x01\x01\x12\x16\n" +
+	"\x06models\x18\x02 \x03(\tR\x06models\x12\"\n" +
+	"\n" +
+	"budget_usd\x18\x03 \x01(\x01H\x01R\tbudgetUsd\x88\x01\x01\x129\n" +
+	"\n" +
+	"updated_at\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\tupdatedAtB\x16\n" +
+	"\x14_requests_per_minuteB\r\n" +
+	"\v_budget_usd\"2\n" +
+	"\x15GetAgentPolicyRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"r\n" +
+	"\x15SetAgentPolicyRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12>\n" +
+	"\x06policy\x18\x02 \x01(\v2&.creddy.anthropic.admin.v1.AgentPolicyR\x06policy\"5\n" +
+	"\x18DeleteAgentPolicyRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"\x1b\n" +
+	"\x19DeleteAgentPolicyResponse*A\n" +
+	"\x06Bucket\x12\x16\n" +
+	"\x12BUCKET_UNSPECIFIED\x10\x00\x12\x0f\n" +
+	"\vBUCKET_HOUR\x10\x01\x12\x0e\n" +
+	"\n" +
+	"BUCKET_DAY\x10\x022\xf8\x06\n" +
+	"\x05Admin\x12i\n" +
+	"\n" +
+	"ListTokens\x12,.creddy.anthropic.admin.v1.ListTokensRequest\x1a-.creddy.anthropic.admin.v1.ListTokensResponse\x12i\n" +
+	"\n" +
+	"IssueToken\x12,.creddy.anthropic.admin.v1.IssueTokenRequest\x1a-.creddy.anthropic.admin.v1.IssueTokenResponse\x12g\n" +
+	"\vRevokeToken\x12-.creddy.anthropic.admin.v1.RevokeTokenRequest\x1a).creddy.anthropic.admin.v1.RevokeResponse\x12s\n" +
+	"\x11RevokeAgentTokens\x123.creddy.anthropic.admin.v1.RevokeAgentTokensRequest\x1a).creddy.anthropic.admin.v1.RevokeResponse\x12c\n" +
+	"\bGetUsage\x12*.creddy.anthropic.admin.v1.GetUsageRequest\x1a+.creddy.anthropic.admin.v1.GetUsageResponse\x12j\n" +
+	"\x0eGetAgentPolicy\x120.creddy.anthropic.admin.v1.GetAgentPolicyRequest\x1a&.creddy.anthropic.admin.v1.AgentPolicy\x12j\n" +
+	"\x0eSetAgentPolicy\x120.creddy.anthropic.admin.v1.SetAgentPolicyRequest\x1a&.creddy.anthropic.admin.v1.AgentPolicy\x12~\n" +
+	"\x11DeleteAgentPolicy\x123.creddy.anthropic.admin.v1.DeleteAgentPolicyRequest\x1a4.creddy.anthropic.admin.v1.DeleteAgentPolicyResponseB/Z-github.com/getcreddy/creddy-anthropic/adminpbb\x06proto3"
+
+var (
+	file_adminpb_admin_proto_rawDescOnce sync.Once
+	file_adminpb_admin_proto_rawDescData []byte
+)
+
+func file_adminpb_admin_proto_rawDescGZIP() []byte {
+	file_adminpb_admin_proto_rawDescOnce.Do(func() {
+		file_adminpb_admin_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_adminpb_admin_proto_rawDesc), len(file_adminpb_admin_proto_rawDesc)))
+	})
+	return file_adminpb_admin_proto_rawDescData
+}
+
+var file_adminpb_admin_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_adminpb_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 17)
+var file_adminpb_admin_proto_goTypes = []any{
+	(Bucket)(0),                       // 0: creddy.anthropic.admin.v1.Bucket
+	(*Token)(nil),                     // 1: creddy.anthropic.admin.v1.Token
+	(*ListTokensRequest)(nil),         // 2: creddy.anthropic.admin.v1.ListTokensRequest
+	(*ListTokensResponse)(nil),        // 3: creddy.anthropic.admin.v1.ListTokensResponse
+	(*IssueTokenRequest)(nil),         // 4: creddy.anthropic.admin.v1.IssueTokenRequest
+	(*IssueTokenResponse)(nil),        // 5: creddy.anthropic.admin.v1.IssueTokenResponse
+	(*RevokeTokenRequest)(nil),        // 6: creddy.anthropic.admin.v1.RevokeTokenRequest
+	(*RevokeAgentTokensRequest)(nil),  // 7: creddy.anthropic.admin.v1.RevokeAgentTokensRequest
+	(*RevokeResponse)(nil),            // 8: creddy.anthropic.admin.v1.RevokeResponse
+	(*GetUsageRequest)(nil),           // 9: creddy.anthropic.admin.v1.GetUsageRequest
+	(*SpendTotals)(nil),               // 10: creddy.anthropic.admin.v1.SpendTotals
+	(*SpendRow)(nil),                  // 11: creddy.anthropic.admin.v1.SpendRow
+	(*GetUsageResponse)(nil),          // 12: creddy.anthropic.admin.v1.GetUsageResponse
+	(*AgentPolicy)(nil),               // 13: creddy.anthropic.admin.v1.AgentPolicy
+	(*GetAgentPolicyRequest)(nil),     // 14: creddy.anthropic.admin.v1.GetAgentPolicyRequest
+	(*SetAgentPolicyRequest)(nil),     // 15: creddy.anthropic.admin.v1.SetAgentPolicyRequest
+	(*DeleteAgentPolicyRequest)(nil),  // 16: creddy.anthropic.admin.v1.DeleteAgentPolicyRequest
+	(*DeleteAgentPolicyResponse)(nil), // 17: creddy.anthropic.admin.v1.DeleteAgentPolicyResponse
+	(*timestamppb.Timestamp)(nil),     // 18: google.protobuf.Timestamp
+	(*durationpb.Duration)(nil),       // 19: google.protobuf.Duration
+}
+var file_adminpb_admin_proto_depIdxs = []int32{
+	18, // 0: creddy.anthropic.admin.v1.Token.created_at:type_name -> google.protobuf.Timestamp
+	18, // 1: creddy.anthropic.admin.v1.Token.expires_at:type_name -> google.protobuf.Timestamp
+	18, // 2: creddy.anthropic.admin.v1.Token.last_used_at:type_name -> google.protobuf.Timestamp
+	19, // 3: creddy.anthropic.admin.v1.ListTokensRequest.expiring_within:type_name -> google.protobuf.Duration
+	1,  // 4: creddy.anthropic.admin.v1.ListTokensResponse.tokens:type_name -> creddy.anthropic.admin.v1.Token
+	19, // 5: creddy.anthropic.admin.v1.IssueTokenRequest.ttl:type_name -> google.protobuf.Duration
+	18, // 6: creddy.anthropic.admin.v1.IssueTokenResponse.expires_at:type_name -> google.protobuf.Timestamp
+	18, // 7: creddy.anthropic.admin.v1.GetUsageRequest.start:type_name -> google.protobuf.Timestamp
+	18, // 8: creddy.anthropic.admin.v1.GetUsageRequest.end:type_name -> google.protobuf.Timestamp
+	0,  // 9: creddy.anthropic.admin.v1.GetUsageRequest.bucket:type_name -> creddy.anthropic.admin.v1.Bucket
+	18, // 10: creddy.anthropic.admin.v1.SpendRow.time:type_name -> google.protobuf.Timestamp
+	10, // 11: creddy.anthropic.admin.v1.SpendRow.totals:type_name -> creddy.anthropic.admin.v1.SpendTotals
+	10, // 12: creddy.anthropic.admin.v1.GetUsageResponse.total:type_name -> creddy.anthropic.admin.v1.SpendTotals
+	11, // 13: creddy.anthropic.admin.v1.GetUsageResponse.rows:type_name -> creddy.anthropic.admin.v1.SpendRow
+	18, // 14: creddy.anthropic.admin.v1.AgentPolicy.updated_at:type_name -> google.protobuf.Timestamp
+	13, // 15: creddy.anthropic.admin.v1.SetAgentPolicyRequest.policy:type_name -> creddy.anthropic.admin.v1.AgentPolicy
+	2,  // 16: creddy.anthropic.admin.v1.Admin.ListTokens:input_type -> creddy.anthropic.admin.v1.ListTokensRequest
+	4,  // 17: creddy.anthropic.admin.v1.Admin.IssueToken:input_type -> creddy.anthropic.admin.v1.IssueTokenRequest
+	6,  // 18: creddy.anthropic.admin.v1.Admin.RevokeToken:input_type -> creddy.anthropic.admin.v1.RevokeTokenRequest
+	7,  // 19: creddy.anthropic.admin.v1.Admin.RevokeAgentTokens:input_type -> creddy.anthropic.admin.v1.RevokeAgentTokensRequest
+	9,  // 20: creddy.anthropic.admin.v1.Admin.GetUsage:input_type -> creddy.anthropic.admin.v1.GetUsageRequest
+	14, // 21: creddy.anthropic.admin.v1.Admin.GetAgentPolicy:input_type -> creddy.anthropic.admin.v1.GetAgentPolicyRequest
+	15, // 22: creddy.anthropic.admin.v1.Admin.SetAgentPolicy:input_type -> creddy.anthropic.admin.v1.SetAgentPolicyRequest
+	16, // 23: creddy.anthropic.admin.v1.Admin.DeleteAgentPolicy:input_type -> creddy.anthropic.admin.v1.DeleteAgentPolicyRequest
+	3,  // 24: creddy.anthropic.admin.v1.Admin.ListTokens:output_type -> creddy.anthropic.admin.v1.ListTokensResponse
+	5,  // 25: creddy.anthropic.admin.v1.Admin.IssueToken:output_type -> creddy.anthropic.admin.v1.IssueTokenResponse
+	8,  // 26: creddy.anthropic.admin.v1.Admin.RevokeToken:output_type -> creddy.anthropic.admin.v1.RevokeResponse
+	8,  // 27: creddy.anthropic.admin.v1.Admin.RevokeAgentTokens:output_type -> creddy.anthropic.admin.v1.RevokeResponse
+	12, // 28: creddy.anthropic.admin.v1.Admin.GetUsage:output_type -> creddy.anthropic.admin.v1.GetUsageResponse
+	13, // 29: creddy.anthropic.admin.v1.Admin.GetAgentPolicy:output_type -> creddy.anthropic.admin.v1.AgentPolicy
+	13, // 30: creddy.anthropic.admin.v1.Admin.SetAgentPolicy:output_type -> creddy.anthropic.admin.v1.AgentPolicy
+	17, // 31: creddy.anthropic.admin.v1.Admin.DeleteAgentPolicy:output_type -> creddy.anthropic.admin.v1.DeleteAgentPolicyResponse
+	24, // [24:32] is the sub-list for method output_type
+	16, // [16:24] is the sub-list for method input_type
+	16, // [16:16] is the sub-list for extension type_name
+	16, // [16:16] is the sub-list for extension extendee
+	0,  // [0:16] is the sub-list for field type_name
+}
+
+func init() { file_adminpb_admin_proto_init() }
+func file_adminpb_admin_proto_init() {
+	if File_adminpb_admin_proto != nil {
+		return
+	}
+	file_adminpb_admin_proto_msgTypes[12].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_adminpb_admin_proto_rawDesc), len(file_adminpb_admin_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   17,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_adminpb_admin_proto_goTypes,
+		DependencyIndexes: file_adminpb_admin_proto_depIdxs,
+		EnumInfos:         file_adminpb_admin_proto_enumTypes,
+		MessageInfos:      file_adminpb_admin_proto_msgTypes,
+	}.Build()
+	File_adminpb_admin_proto = out.File
+	file_adminpb_admin_proto_goTypes = nil
+	file_adminpb_admin_proto_depIdxs = nil
+}
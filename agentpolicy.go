@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// agentPolicyRefresh bounds how long agent policies are cached, so a
+// change made through another replica sharing the token store applies
+// within it
+const agentPolicyRefresh = 5 * time.Second
+
+// AgentPolicy overrides one agent's configured limits at runtime. It is
+// set with PUT /admin/agents/{agent_id}/policy and kept in the token store.
+type AgentPolicy struct {
+	RequestsPerMinute *int       `json:"requests_per_minute,omitempty"` // Replaces agent_rate_limits for the agent (0 = unlimited)
+	Models            []string   `json:"models,omitempty"`              // Model glob patterns the agent may use, on top of its scopes' limits
+	BudgetUSD         *usdAmount `json:"budget_usd,omitempty"`          // Replaces budgets for the agent, per budget_window (0 = unlimited)
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// validate checks the policy's limits and model patterns
+func (pol *AgentPolicy) validate() error {
+	if pol.RequestsPerMinute != nil && *pol.RequestsPerMinute < 0 {
+		return errors.New("requests_per_minute must not be negative")
+	}
+	for _, pattern := range pol.Models {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid model pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// empty reports whether the policy overrides nothing
+func (pol *AgentPolicy) empty() bool {
+	return pol.RequestsPerMinute == nil && len(pol.Models) == 0 && pol.BudgetUSD == nil
+}
+
+// agentPolicyCache holds the agent policies last read from a token store
+type agentPolicyCache struct {
+	mu       sync.Mutex
+	store    TokenStore
+	loaded   time.Time
+	policies map[string]*AgentPolicy
+}
+
+// get returns agentID's policy in store, or nil if it has none, reading
+// store again if the cache is older than agentPolicyRefresh
+func (c *agentPolicyCache) get(store TokenStore, agentID string) *AgentPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store != store || time.Since(c.loaded) > agentPolicyRefresh {
+		policies, err := store.AgentPolicies()
+		if err != nil {
+			// Keep enforcing the policies last read rather than none
+			slog.Error("Failed to read agent policies", "error", err)
+			if c.store != store {
+				return nil
+			}
+		} else {
+			c.store, c.loaded, c.policies = store, time.Now(), policies
+		}
+	}
+	return c.policies[agentID]
+}
+
+// invalidate makes the next get read the store
+func (c *agentPolicyCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded = time.Time{}
+}
+
+// AgentPolicy returns agentID's policy override, or nil if it has none
+func (p *AnthropicPlugin) AgentPolicy(agentID string) *AgentPolicy {
+	return p.agentPolicies.get(p.tokenStore(), agentID)
+}
+
+// SetAgentPolicy stores agentID's policy override, replacing any previous
+// one, or removes it if policy is nil
+func (p *AnthropicPlugin) SetAgentPolicy(agentID string, policy *AgentPolicy) error {
+	defer p.agentPolicies.invalidate()
+	return p.tokenStore().SetAgentPolicy(agentID, policy)
+}
+
+// handleAgentPolicy shows, sets, or removes an agent's policy override.
+// PUT replaces the whole override; limits it omits follow the
+// configuration again.
+func (ps *ProxyServer) handleAgentPolicy(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	agentID := r.PathValue("agent_id")
+	switch r.Method {
+	case http.MethodPut:
+		var policy AgentPolicy
+		dec := json.NewDecoder(io.LimitReader(r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&policy); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON body: "+err.Error())
+			return
+		}
+		if err := policy.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		policy.UpdatedAt = time.Now().UTC()
+		stored := &policy
+		if policy.empty() {
+			stored = nil
+		}
+		if !ps.setAgentPolicy(w, r, agentID, stored) {
+			return
+		}
+		writeJSON(w, http.StatusOK, policy)
+	case http.MethodDelete:
+		if ps.setAgentPolicy(w, r, agentID, nil) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		policy := ps.plugin.AgentPolicy(agentID)
+		if policy == nil {
+			writeError(w, http.StatusNotFound, "not_found_error", fmt.Sprintf("agent %s has no policy override", agentID))
+			return
+		}
+		writeJSON(w, http.StatusOK, policy)
+	}
+}
+
+// setAgentPolicy stores and audits an admin's change to an agent's policy,
+// reporting failure to the client
+func (ps *ProxyServer) setAgentPolicy(w http.ResponseWriter, r *http.Request, agentID string, policy *AgentPolicy) bool {
+	if err := ps.plugin.SetAgentPolicy(agentID, policy); err != nil {
+		slog.Error("Failed to store agent policy", "agent", agentID, "error", err)
+		writeError(w, http.StatusInternalServerError, "api_error", "internal error")
+		return false
+	}
+	ps.plugin.auditLog(AuditEvent{
+		Event:    AuditAgentPolicy,
+		AgentID:  agentID,
+		Caller:   "admin",
+		ClientIP: clientIP(r, ps.plugin.TrustedProxies()),
+	})
+	return true
+}
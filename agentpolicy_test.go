@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentPolicyEndpoint(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19591, "admin_token": "admin-secret", "budgets": {"*": 100}}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+		})
+	const policy = "/admin/agents/agent-1/policy"
+	call := func(method, path, token, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("x-api-key", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if status, _ := call(http.MethodGet, policy, "admin-secret", ""); status != http.StatusNotFound {
+		t.Errorf("GET without a policy: status %d, want 404", status)
+	}
+	if status, _ := call(http.MethodPut, policy, "wrong", `{"requests_per_minute": 1}`); status != http.StatusUnauthorized {
+		t.Errorf("PUT without the admin token: status %d, want 401", status)
+	}
+	for _, body := range []string{`{"requests_per_minute": -1}`, `{"models": ["["]}`, `{"budget_usd": "lots"}`, `{"rpm": 1}`} {
+		if status, _ := call(http.MethodPut, policy, "admin-secret", body); status != http.StatusBadRequest {
+			t.Errorf("PUT %s: status %d, want 400", body, status)
+		}
+	}
+
+	status, body := call(http.MethodPut, policy, "admin-secret", `{"requests_per_minute": 1, "models": ["claude-haiku-*"], "budget_usd": "0.50"}`)
+	if status != http.StatusOK || !strings.Contains(body, `"budget_usd":0.5`) {
+		t.Fatalf("PUT = %d %s", status, body)
+	}
+	for _, path := range []string{policy, "/v1/agents/agent-1/policy"} {
+		if status, body := call(http.MethodGet, path, "admin-secret", ""); status != http.StatusOK || !strings.Contains(body, `"models":["claude-haiku-*"]`) {
+			t.Errorf("GET %s = %d %s", path, status, body)
+		}
+	}
+
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	other := issueToken(t, plugin, "agent-2", "anthropic", 10*time.Minute)
+	for i, tc := range []struct {
+		token, body string
+		want        int
+	}{
+		{cred.Value, `{"model":"claude-sonnet-4-5"}`, http.StatusForbidden},
+		{cred.Value, `{"model":"claude-haiku-4-5"}`, http.StatusOK},
+		{cred.Value, `{"model":"claude-haiku-4-5"}`, http.StatusTooManyRequests},
+		{other.Value, `{"model":"claude-sonnet-4-5"}`, http.StatusOK},
+	} {
+		resp := proxyRequest(t, srv, tc.token, tc.body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("request %d: status %d, want %d", i+1, resp.StatusCode, tc.want)
+		}
+	}
+	if limit, _, _ := plugin.AgentBudget("agent-1"); limit != 0.5 {
+		t.Errorf("agent-1 budget = %v, want the override 0.5", limit)
+	}
+
+	if status, _ := call(http.MethodDelete, policy, "admin-secret", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE: status %d, want 204", status)
+	}
+	if plugin.AgentPolicy("agent-1") != nil || plugin.AgentRequestsPerMinute("agent-1") != 0 {
+		t.Error("agent-1 still has a policy override after DELETE")
+	}
+	if limit, _, _ := plugin.AgentBudget("agent-1"); limit != 100 {
+		t.Errorf("agent-1 budget after DELETE = %v, want the configured 100", limit)
+	}
+}
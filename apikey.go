@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// keyringTimeout bounds a keyring lookup, which may wait on a locked
+// keychain
+const keyringTimeout = 10 * time.Second
+
+// resolveAPIKey sets cfg.APIKey from whichever one of api_key,
+// api_key_file, api_key_env, and api_key_keyring is configured, so the key
+// itself need not appear in the backend configuration
+func resolveAPIKey(ctx context.Context, cfg *AnthropicConfig) error {
+	key, err := readAPIKey(ctx, cfg.APIKey, cfg.APIKeyFile, cfg.APIKeyEnv, cfg.APIKeyKeyring)
+	if err != nil {
+		return err
+	}
+	cfg.APIKey = key
+	return nil
+}
+
+// readAPIKey returns the API key given directly as key, or read from
+// whichever one of file, env, and keyring is set
+func readAPIKey(ctx context.Context, key, file, env, keyring string) (string, error) {
+	sources := 0
+	for _, s := range []string{key, file, env, keyring} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources == 0 {
+		return "", errors.New("api_key is required (or api_key_file, api_key_env, or api_key_keyring)")
+	}
+	if sources > 1 {
+		return "", errors.New("only one of api_key, api_key_file, api_key_env, and api_key_keyring may be set")
+	}
+
+	switch {
+	case file != "":
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", fmt.Errorf("api_key_file: %w", err)
+		}
+		if info.Mode().Perm()&0o077 != 0 {
+			slog.Warn("API key file is readable by other users", "path", file, "mode", info.Mode().Perm().String())
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("api_key_file: %w", err)
+		}
+		if key = strings.TrimSpace(string(data)); key == "" {
+			return "", fmt.Errorf("api_key_file: %s is empty", file)
+		}
+	case env != "":
+		if key = strings.TrimSpace(os.Getenv(env)); key == "" {
+			return "", fmt.Errorf("api_key_env: $%s is not set", env)
+		}
+	case keyring != "":
+		service, account, ok := strings.Cut(keyring, "/")
+		if !ok || service == "" || account == "" {
+			return "", errors.New("api_key_keyring must be \"service/account\"")
+		}
+		ctx, cancel := context.WithTimeout(ctx, keyringTimeout)
+		defer cancel()
+		secret, err := keyringLookup(ctx, service, account)
+		if err != nil {
+			return "", fmt.Errorf("api_key_keyring: %w", err)
+		}
+		if key = strings.TrimSpace(secret); key == "" {
+			return "", fmt.Errorf("api_key_keyring: %s has an empty secret", keyring)
+		}
+	}
+	return key, nil
+}
+
+// keyringLookup reads a generic password from the OS keyring with the
+// platform's own tool: the login keychain on macOS, and the Secret Service
+// (GNOME Keyring, KWallet) through secret-tool elsewhere
+var keyringLookup = func(ctx context.Context, service, account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.CommandContext(ctx, "secret-tool", "lookup", "service", service, "account", account)
+	default:
+		return "", fmt.Errorf("no keyring support on %s", runtime.GOOS)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", cmd.Path, msg)
+		}
+		return "", fmt.Errorf("%s: %w", cmd.Path, err)
+	}
+	return string(out), nil
+}
+
+// keyRotation is an API key rotated in by RotateAPIKey, replacing the
+// configured one without a change to the configuration
+type keyRotation struct {
+	configured string // api_key as configured
+	key        string // api_key in use
+	previous   string // the key key replaced, kept for its grace period
+}
+
+// RotateAPIKey checks that Anthropic accepts key and makes it api_key,
+// keeping the key it replaces in use as previous_api_key for
+// previous_api_key_grace_minutes. Reconfiguring keeps key in use until the
+// configuration names another api_key. It returns when the previous key's
+// grace period ends.
+func (p *AnthropicPlugin) RotateAPIKey(ctx context.Context, key string) (time.Time, error) {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	p.mu.RLock()
+	cfg := p.config
+	p.mu.RUnlock()
+	if cfg == nil {
+		return time.Time{}, errors.New("plugin not configured")
+	}
+	if key == cfg.APIKey {
+		return time.Time{}, errors.New("api_key is already in use")
+	}
+	if err := checkAPIKey(ctx, p.UpstreamClient(), p.upstreamURL, key, cfg.AnthropicVersion); err != nil {
+		return time.Time{}, err
+	}
+
+	rotated := *cfg
+	rotated.APIKey, rotated.PreviousAPIKey, rotated.previousKeySince = key, cfg.APIKey, time.Now()
+	rotated.fingerprint = configFingerprint(&rotated)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	configured := cfg.APIKey
+	if p.rotation != nil {
+		configured = p.rotation.configured
+	}
+	p.rotation = &keyRotation{configured: configured, key: key, previous: cfg.APIKey}
+	p.config = &rotated
+	return rotated.previousKeySince.Add(time.Duration(rotated.PreviousKeyGrace) * time.Minute), nil
+}
+
+// applyKeyRotation puts a rotated API key into cfg if cfg still configures
+// the key it replaced, and otherwise forgets the rotation. Called with p.mu
+// held.
+func (p *AnthropicPlugin) applyKeyRotation(cfg *AnthropicConfig) {
+	r := p.rotation
+	if r == nil {
+		return
+	}
+	if cfg.APIKey != r.configured {
+		p.rotation = nil
+		return
+	}
+	cfg.APIKey, cfg.PreviousAPIKey = r.key, r.previous
+	cfg.fingerprint = configFingerprint(cfg)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("sk-ant-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDDY_TEST_ANTHROPIC_KEY", " sk-ant-env ")
+
+	orig := keyringLookup
+	t.Cleanup(func() { keyringLookup = orig })
+	keyringLookup = func(ctx context.Context, service, account string) (string, error) {
+		if service == "creddy" && account == "anthropic" {
+			return "sk-ant-keyring\n", nil
+		}
+		return "", errors.New("not found")
+	}
+
+	tests := []struct {
+		name    string
+		cfg     AnthropicConfig
+		want    string
+		wantErr string
+	}{
+		{name: "inline", cfg: AnthropicConfig{APIKey: "sk-ant-inline"}, want: "sk-ant-inline"},
+		{name: "file", cfg: AnthropicConfig{APIKeyFile: keyFile}, want: "sk-ant-file"},
+		{name: "env", cfg: AnthropicConfig{APIKeyEnv: "CREDDY_TEST_ANTHROPIC_KEY"}, want: "sk-ant-env"},
+		{name: "keyring", cfg: AnthropicConfig{APIKeyKeyring: "creddy/anthropic"}, want: "sk-ant-keyring"},
+		{name: "none", wantErr: "api_key is required"},
+		{name: "two sources", cfg: AnthropicConfig{APIKey: "sk-ant-inline", APIKeyEnv: "CREDDY_TEST_ANTHROPIC_KEY"}, wantErr: "only one of"},
+		{name: "missing file", cfg: AnthropicConfig{APIKeyFile: filepath.Join(dir, "nope")}, wantErr: "api_key_file"},
+		{name: "empty file", cfg: AnthropicConfig{APIKeyFile: emptyFile}, wantErr: "is empty"},
+		{name: "unset env", cfg: AnthropicConfig{APIKeyEnv: "CREDDY_TEST_UNSET_KEY"}, wantErr: "is not set"},
+		{name: "bad keyring reference", cfg: AnthropicConfig{APIKeyKeyring: "creddy"}, wantErr: "service/account"},
+		{name: "keyring miss", cfg: AnthropicConfig{APIKeyKeyring: "creddy/other"}, wantErr: "not found"},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		err := resolveAPIKey(context.Background(), &cfg)
+		switch {
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		case tt.wantErr == "" && (err != nil || cfg.APIKey != tt.want):
+			t.Errorf("%s: key = %q, %v; want %q", tt.name, cfg.APIKey, err, tt.want)
+		}
+	}
+}
+
+func TestConfigure_APIKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("sk-ant-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	plugin := newTestPlugin(t)
+	config := `{"api_key_file": "` + keyFile + `", "proxy_port": 19568}`
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if got := plugin.GetAPIKey(); got != "sk-ant-file" {
+		t.Errorf("GetAPIKey() = %q, want the key from the file", got)
+	}
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	config := `{"api_key": "sk-ant-old", "proxy_port": 19589, "admin_token": "admin-secret"}`
+	plugin, srv := newTestProxy(t, config)
+	anthropic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") == "sk-ant-revoked" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`))
+			return
+		}
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	t.Cleanup(anthropic.Close)
+	plugin.upstreamURL = anthropic.URL
+	rotate := func(path, token, body string) (int, rotateKeyResponse) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("x-api-key", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out rotateKeyResponse
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	for token, body := range map[string]string{
+		"wrong":        `{"api_key": "sk-ant-new"}`,
+		"admin-secret": `{"api_key": "sk-ant-revoked"}`,
+		"":             `{}`,
+	} {
+		if status, _ := rotate("/admin/rotate-key", token, body); status == http.StatusOK {
+			t.Errorf("rotating with %q, %s succeeded", token, body)
+		}
+	}
+	for _, path := range []string{"/admin/rotate-key", "/v1/api-key/rotate"} {
+		if status, _ := rotate(path, "admin-secret", `{"api_key": "sk-ant-old"}`); status != http.StatusBadRequest {
+			t.Errorf("rotating to the current key at %s: status %d, want 400", path, status)
+		}
+	}
+	if plugin.WorkspaceAPIKey("") != "sk-ant-old" {
+		t.Fatalf("failed rotations changed api_key to %q", plugin.WorkspaceAPIKey(""))
+	}
+
+	before := plugin.ConfigFingerprint()
+	status, out := rotate("/admin/rotate-key", "admin-secret", `{"api_key": "sk-ant-new"}`)
+	if status != http.StatusOK || time.Until(out.PreviousKeyExpiresAt) < 59*time.Minute || out.Fingerprint == before {
+		t.Fatalf("rotate = %d, %+v", status, out)
+	}
+	if plugin.WorkspaceAPIKey("") != "sk-ant-new" || plugin.PreviousAPIKey() != "sk-ant-old" {
+		t.Errorf("after rotation: api_key %q, previous %q", plugin.WorkspaceAPIKey(""), plugin.PreviousAPIKey())
+	}
+
+	// Reloading the configuration that still names the old key keeps the
+	// rotated one; naming another key ends the rotation
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.WorkspaceAPIKey("") != "sk-ant-new" || plugin.PreviousAPIKey() != "sk-ant-old" {
+		t.Errorf("after reload: api_key %q, previous %q", plugin.WorkspaceAPIKey(""), plugin.PreviousAPIKey())
+	}
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-newer", "proxy_port": 19589, "admin_token": "admin-secret"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.WorkspaceAPIKey("") != "sk-ant-old" || plugin.PreviousAPIKey() != "" {
+		t.Errorf("after the configuration changed key: api_key %q, previous %q", plugin.WorkspaceAPIKey(""), plugin.PreviousAPIKey())
+	}
+}
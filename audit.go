@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditIssue  = "issue"
+	AuditRevoke = "revoke"
+	AuditRenew  = "renew"
+	// AuditKeyRotation records an admin rotating the upstream API key
+	AuditKeyRotation = "api_key_rotation"
+	// AuditAgentPolicy records an admin setting or removing an agent's
+	// policy override
+	AuditAgentPolicy = "agent_policy"
+	// AuditRequest records a request proxied with a token
+	AuditRequest = "request"
+)
+
+// AuditEvent is one record in the audit log. Tokens are identified by ID
+// (their SHA-256 hash in store mode), never by value.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	TokenID   string    `json:"token_id"`
+	AgentID   string    `json:"agent_id,omitempty"`
+	AgentName string    `json:"agent_name,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
+	// RequestedScope is set on issuance when the scope was narrowed
+	RequestedScope string    `json:"requested_scope,omitempty"`
+	TTLSeconds     int64     `json:"ttl_seconds,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at,omitzero"`
+	MaxUses        int64     `json:"max_uses,omitempty"`
+	Caller         string    `json:"caller"` // creddy, holder, admin, or peer
+	ClientIP       string    `json:"client_ip,omitempty"`
+
+	// Request events describe the proxied call and its outcome
+	RequestID                string  `json:"request_id,omitempty"`
+	UpstreamRequestID        string  `json:"upstream_request_id,omitempty"` // Anthropic's request-id
+	UpstreamKey              string  `json:"upstream_key,omitempty"`        // current, previous, or secondary, during a key rotation or with failover
+	Backend                  string  `json:"backend,omitempty"`             // vertex, or a routed base URL, for requests not sent to Anthropic
+	Method                   string  `json:"method,omitempty"`
+	Path                     string  `json:"path,omitempty"`
+	Model                    string  `json:"model,omitempty"`
+	Status                   int     `json:"status,omitempty"`
+	StopReason               string  `json:"stop_reason,omitempty"`         // why the model stopped, e.g. end_turn
+	ClientDisconnected       bool    `json:"client_disconnected,omitempty"` // the client left before the response was complete
+	StreamLimit              string  `json:"stream_limit,omitempty"`        // the scope limit that ended a stream
+	StreamResumes            int     `json:"stream_resumes,omitempty"`      // retries of a stream upstream dropped
+	InputTokens              int64   `json:"input_tokens,omitempty"`
+	OutputTokens             int64   `json:"output_tokens,omitempty"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens,omitempty"`
+	CostUSD                  float64 `json:"cost_usd,omitempty"`
+	LatencyMS                int64   `json:"latency_ms,omitempty"`
+	TTFTMS                   int64   `json:"ttft_ms,omitempty"` // time to first token of streamed responses
+	// ToolCalls are the tools the model called, by name and ID; their
+	// inputs are only recorded in transcripts
+	ToolCalls []*ToolCall `json:"tool_calls,omitempty"`
+	// Transcript is the streamed response as the agent received it, for
+	// scopes whose policy enables transcripts
+	Transcript *streamTranscript `json:"transcript,omitempty"`
+}
+
+// AuditLogger appends audit events to a JSONL file, optionally rotating
+// it by size
+type AuditLogger struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+	// maxSize is the size in bytes at which the file is rotated (0 = never);
+	// maxBackups rotated files are kept as path.1 (newest) to path.N
+	maxSize    int64
+	maxBackups int
+}
+
+// OpenAuditLog opens (or creates) an append-only audit log at path
+func OpenAuditLog(path string) (*AuditLogger, error) {
+	a := &AuditLogger{path: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open opens the file at a.path for appending
+func (a *AuditLogger) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	a.file, a.size = f, st.Size()
+	return nil
+}
+
+// SetRotation rotates the log once it reaches maxSize bytes (0 disables
+// rotation), keeping maxBackups old files
+func (a *AuditLogger) SetRotation(maxSize int64, maxBackups int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.maxSize, a.maxBackups = maxSize, maxBackups
+}
+
+// rotate shifts path.N-1 to path.N and so on, moves the current file to
+// path.1, and starts a new file. If no file can be opened afterwards,
+// a.file is nil. The caller must hold a.mu.
+func (a *AuditLogger) rotate() error {
+	a.file.Close()
+	var err error
+	if a.maxBackups > 0 {
+		for i := a.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		}
+		err = os.Rename(a.path, a.path+".1")
+	} else {
+		err = os.Remove(a.path)
+	}
+	if openErr := a.open(); openErr != nil {
+		a.file = nil
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// Log appends an event, stamping its time if unset. A nil logger discards
+// events, so callers don't need to check whether auditing is enabled.
+func (a *AuditLogger) Log(ev AuditEvent) {
+	if a == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Failed to encode audit event", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			slog.Error("Failed to rotate audit log", "error", err)
+		}
+	}
+	if a.file == nil {
+		return
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		slog.Error("Failed to write audit event", "error", err)
+	}
+}
+
+// Close closes the underlying file
+func (a *AuditLogger) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// issueEvent describes caller issuing info for a request for requestedScope
+func issueEvent(info *TokenInfo, requestedScope, caller string) AuditEvent {
+	ev := auditEventFor(AuditIssue, caller, info)
+	if requestedScope != info.Scope {
+		ev.RequestedScope = requestedScope
+	}
+	return ev
+}
+
+// auditEventFor builds an event describing info
+func auditEventFor(event, caller string, info *TokenInfo) AuditEvent {
+	ev := AuditEvent{Event: event, Caller: caller}
+	if info != nil {
+		ev.TokenID = info.ID
+		ev.AgentID = info.AgentID
+		ev.AgentName = info.AgentName
+		ev.Scope = info.Scope
+		ev.ExpiresAt = info.ExpiresAt
+		ev.MaxUses = info.MaxUses
+		ev.ClientIP = info.ClientIP
+		if !info.ExpiresAt.IsZero() && !info.CreatedAt.IsZero() {
+			ev.TTLSeconds = int64(info.ExpiresAt.Sub(info.CreatedAt).Seconds())
+		}
+	}
+	return ev
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Sink writes each batch of audit events as a JSONL object to an
+// S3-compatible bucket, using path-style URLs and AWS Signature Version 4
+type s3Sink struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	prefix          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+func newS3Sink(cfg AuditSinkConfig) (*s3Sink, error) {
+	if cfg.Bucket == "" || cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("bucket, access_key_id, and secret_access_key are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	if err := checkSinkURL(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("endpoint: %w", err)
+	}
+	endpoint, _ := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	return &s3Sink{
+		endpoint:        endpoint,
+		region:          cfg.Region,
+		bucket:          cfg.Bucket,
+		prefix:          cfg.Prefix,
+		accessKeyID:     cfg.AccessKeyID,
+		secretAccessKey: cfg.SecretAccessKey,
+		client:          &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// objectKey names a batch object by date so buckets can be partitioned
+// and expired by prefix, e.g. audit/2026/03/01/120000-1a2b3c4d.jsonl
+func (s *s3Sink) objectKey(now time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return s.prefix + now.UTC().Format("2006/01/02/150405") + "-" + hex.EncodeToString(suffix) + ".jsonl"
+}
+
+func (s *s3Sink) send(ctx context.Context, events []AuditEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return &permanentError{err}
+		}
+	}
+
+	now := time.Now()
+	u := *s.endpoint
+	u.Path += "/" + s.bucket + "/" + s.objectKey(now)
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.String(), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	signV4(req, body.Bytes(), s.accessKeyID, s.secretAccessKey, s.region, "s3", now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return statusError(resp.StatusCode)
+}
+
+// signV4 signs req with AWS Signature Version 4, covering the host and
+// every header already set on req
+func signV4(req *http.Request, payload []byte, accessKeyID, secretAccessKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	credentialScope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + credentialScope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, credentialScope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
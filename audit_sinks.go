@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditSink receives audit events. Log must not block for long; sinks
+// report their own delivery failures.
+type AuditSink interface {
+	Log(ev AuditEvent)
+	Close() error
+}
+
+// AuditSinkConfig selects and configures one audit sink
+type AuditSinkConfig struct {
+	Type string `json:"type"` // file, syslog, webhook, or s3
+
+	// file
+	Path       string `json:"path"`
+	MaxSizeMB  int    `json:"max_size_mb"` // rotate at this size (0 = never)
+	MaxBackups int    `json:"max_backups"` // rotated files kept (default 5)
+
+	// syslog
+	Network string `json:"network"` // "" (local syslog), udp, or tcp
+	Address string `json:"address"`
+	Tag     string `json:"tag"` // default "creddy-anthropic"
+
+	// webhook
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"` // e.g. Authorization
+
+	// s3
+	Endpoint        string `json:"endpoint"` // default https://s3.<region>.amazonaws.com
+	Region          string `json:"region"`   // default us-east-1
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+
+	// webhook and s3 send events in batches
+	BatchSize            int `json:"batch_size"`             // events per batch (default 100, s3 1000)
+	FlushIntervalSeconds int `json:"flush_interval_seconds"` // longest an event waits (default 5, s3 60)
+}
+
+// auditSinkTypes maps audit sink types to constructors
+var auditSinkTypes = map[string]func(cfg AuditSinkConfig) (AuditSink, error){
+	"file": func(cfg AuditSinkConfig) (AuditSink, error) {
+		if cfg.Path == "" {
+			return nil, errors.New("path is required")
+		}
+		if cfg.MaxSizeMB < 0 || cfg.MaxBackups < 0 {
+			return nil, errors.New("max_size_mb and max_backups must not be negative")
+		}
+		a, err := OpenAuditLog(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.MaxBackups == 0 {
+			cfg.MaxBackups = 5
+		}
+		a.SetRotation(int64(cfg.MaxSizeMB)<<20, cfg.MaxBackups)
+		return a, nil
+	},
+	"syslog": newSyslogSink,
+	"webhook": func(cfg AuditSinkConfig) (AuditSink, error) {
+		if err := checkSinkURL(cfg.URL); err != nil {
+			return nil, err
+		}
+		w := &webhookSink{url: cfg.URL, headers: cfg.Headers, client: &http.Client{Timeout: 30 * time.Second}}
+		return newBatchSink("webhook", cfg.BatchSize, 100, cfg.FlushIntervalSeconds, 5, w.send), nil
+	},
+	"s3": func(cfg AuditSinkConfig) (AuditSink, error) {
+		s, err := newS3Sink(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newBatchSink("s3", cfg.BatchSize, 1000, cfg.FlushIntervalSeconds, 60, s.send), nil
+	},
+}
+
+// openAuditSinks opens the configured sinks, returning nil if there are
+// none and a single sink fanning out to all of them otherwise
+func openAuditSinks(configs []AuditSinkConfig) (AuditSink, error) {
+	var sinks multiSink
+	for i, cfg := range configs {
+		open, ok := auditSinkTypes[cfg.Type]
+		if !ok {
+			names := make([]string, 0, len(auditSinkTypes))
+			for name := range auditSinkTypes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			sinks.Close()
+			return nil, fmt.Errorf("audit_sinks[%d]: unknown type %q (supported: %s)", i, cfg.Type, strings.Join(names, ", "))
+		}
+		sink, err := open(cfg)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("audit_sinks[%d] (%s): %w", i, cfg.Type, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
+
+// multiSink sends each event to every sink
+type multiSink []AuditSink
+
+func (m multiSink) Log(ev AuditEvent) {
+	for _, s := range m {
+		s.Log(ev)
+	}
+}
+
+func (m multiSink) Close() error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Batched sink delivery
+const (
+	auditQueueSize     = 10000 // events buffered before new ones are dropped
+	auditSendAttempts  = 4
+	auditRetryBackoff  = time.Second // doubled after each failed attempt
+	auditSendTimeout   = 30 * time.Second
+	auditCloseDeadline = 30 * time.Second
+)
+
+// batchSink queues events and delivers them in batches from a background
+// goroutine, retrying failed batches with backoff
+type batchSink struct {
+	name      string
+	send      func(ctx context.Context, events []AuditEvent) error
+	batchSize int
+	interval  time.Duration
+	backoff   time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan AuditEvent
+	done   chan struct{}
+}
+
+// newBatchSink starts a batching sink; zero batchSize or intervalSeconds
+// take the given defaults
+func newBatchSink(name string, batchSize, defaultSize, intervalSeconds, defaultInterval int, send func(context.Context, []AuditEvent) error) *batchSink {
+	if batchSize <= 0 {
+		batchSize = defaultSize
+	}
+	if intervalSeconds <= 0 {
+		intervalSeconds = defaultInterval
+	}
+	b := &batchSink{
+		name:      name,
+		send:      send,
+		batchSize: batchSize,
+		interval:  time.Duration(intervalSeconds) * time.Second,
+		backoff:   auditRetryBackoff,
+		queue:     make(chan AuditEvent, auditQueueSize),
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batchSink) Log(ev AuditEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- ev:
+	default:
+		slog.Warn("Audit queue full; dropping event", "sink", b.name, "event", ev.Event)
+	}
+}
+
+// Close delivers queued events and stops the sink
+func (b *batchSink) Close() error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-time.After(auditCloseDeadline):
+		return fmt.Errorf("audit sink %s: timed out delivering queued events", b.name)
+	}
+}
+
+func (b *batchSink) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	batch := make([]AuditEvent, 0, b.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			b.deliver(batch)
+			batch = make([]AuditEvent, 0, b.batchSize)
+		}
+	}
+	for {
+		select {
+		case ev, ok := <-b.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= b.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// deliver sends a batch, retrying with backoff; batches that still fail
+// are dropped and logged
+func (b *batchSink) deliver(batch []AuditEvent) {
+	backoff := b.backoff
+	var err error
+	for attempt := 1; attempt <= auditSendAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), auditSendTimeout)
+		err = b.send(ctx, batch)
+		cancel()
+		var perm *permanentError
+		if err == nil || errors.As(err, &perm) {
+			break
+		}
+		if attempt < auditSendAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to deliver audit events", "sink", b.name, "events", len(batch), "error", err)
+	}
+}
+
+// permanentError is a delivery failure that retrying will not fix
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// checkSinkURL requires HTTPS, except for loopback receivers
+func checkSinkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid url %q", raw)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); u.Scheme == "http" && (u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback())) {
+		return nil
+	}
+	return fmt.Errorf("url %q must use https", raw)
+}
+
+// webhookSink POSTs batches of events as a JSON array
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (w *webhookSink) send(ctx context.Context, events []AuditEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return &permanentError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return statusError(resp.StatusCode)
+}
+
+// statusError converts an HTTP response status to a delivery error:
+// nil for 2xx, retryable for 429 and 5xx, and permanent otherwise
+func statusError(status int) error {
+	switch {
+	case status >= 200 && status < 300:
+		return nil
+	case status == http.StatusTooManyRequests || status >= 500:
+		return fmt.Errorf("receiver returned %d", status)
+	default:
+		return &permanentError{fmt.Errorf("receiver returned %d", status)}
+	}
+}
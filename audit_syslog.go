@@ -0,0 +1,44 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+)
+
+// syslogSink sends each audit event as a JSON message to syslog with the
+// auth facility
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(cfg AuditSinkConfig) (AuditSink, error) {
+	if cfg.Tag == "" {
+		cfg.Tag = "creddy-anthropic"
+	}
+	if cfg.Network != "" && cfg.Address == "" {
+		return nil, fmt.Errorf("address is required for network %q", cfg.Network)
+	}
+	w, err := syslog.Dial(cfg.Network, cfg.Address, syslog.LOG_INFO|syslog.LOG_AUTH, cfg.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("connect to syslog: %w", err)
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Log(ev AuditEvent) {
+	msg, err := json.Marshal(ev)
+	if err == nil {
+		err = s.w.Info(string(msg))
+	}
+	if err != nil {
+		slog.Error("Failed to write audit event to syslog", "error", err)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
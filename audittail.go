@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// auditFeedRecent is how many recent audit events the proxy keeps for
+	// GET /v1/audit/events
+	auditFeedRecent = 1000
+	// auditFeedBuffer is how many events a following client may fall
+	// behind before further events are dropped for it
+	auditFeedBuffer = 256
+	// auditTailPoll is how often audit tail checks a followed file
+	auditTailPoll = 250 * time.Millisecond
+	// auditStreamKeepAlive is how long an idle audit stream waits before
+	// sending a blank line, so dead clients are noticed
+	auditStreamKeepAlive = 30 * time.Second
+)
+
+// auditFeed keeps recent audit events in memory and passes new ones to
+// followers, whether or not audit sinks are configured. Transcripts are
+// left out; they are only in the audit sinks.
+type auditFeed struct {
+	mu     sync.Mutex
+	recent []AuditEvent // ring of the last auditFeedRecent events
+	next   int          // where the next event goes in recent, once full
+	subs   map[chan AuditEvent]struct{}
+}
+
+func newAuditFeed() *auditFeed {
+	return &auditFeed{subs: make(map[chan AuditEvent]struct{})}
+}
+
+// Publish records ev and sends it to followers, dropping it for any that
+// are too far behind
+func (f *auditFeed) Publish(ev AuditEvent) {
+	ev.Transcript = nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.recent) < auditFeedRecent {
+		f.recent = append(f.recent, ev)
+	} else {
+		f.recent[f.next] = ev
+		f.next = (f.next + 1) % auditFeedRecent
+	}
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the recent events, oldest first, and if follow is set
+// a channel of the events published after them and a function ending the
+// subscription
+func (f *auditFeed) Subscribe(follow bool) (recent []AuditEvent, events <-chan AuditEvent, cancel func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recent = append(append(recent, f.recent[f.next:]...), f.recent[:f.next]...)
+	if !follow {
+		return recent, nil, func() {}
+	}
+	ch := make(chan AuditEvent, auditFeedBuffer)
+	f.subs[ch] = struct{}{}
+	return recent, ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subs, ch)
+	}
+}
+
+// auditFilter selects audit events by agent, model, and response status
+type auditFilter struct {
+	AgentID string
+	Model   string // glob pattern
+	Status  string // a status code like 429, or a class like 5xx
+}
+
+// validate checks the filter's model pattern and status
+func (f auditFilter) validate() error {
+	if _, err := path.Match(f.Model, ""); err != nil {
+		return fmt.Errorf("invalid model pattern %q", f.Model)
+	}
+	if f.Status == "" {
+		return nil
+	}
+	if class, ok := strings.CutSuffix(f.Status, "xx"); ok && len(class) == 1 && class >= "1" && class <= "5" {
+		return nil
+	}
+	if code, err := strconv.Atoi(f.Status); err != nil || code < 100 || code > 599 {
+		return fmt.Errorf("invalid status %q: must be a status code like 429 or a class like 5xx", f.Status)
+	}
+	return nil
+}
+
+// match reports whether ev passes the filter
+func (f auditFilter) match(ev *AuditEvent) bool {
+	if f.AgentID != "" && ev.AgentID != f.AgentID {
+		return false
+	}
+	if f.Model != "" {
+		if ok, _ := path.Match(f.Model, ev.Model); !ok {
+			return false
+		}
+	}
+	if f.Status != "" {
+		if ev.Status == 0 {
+			return false
+		}
+		if class, ok := strings.CutSuffix(f.Status, "xx"); ok {
+			return strconv.Itoa(ev.Status/100) == class
+		}
+		return strconv.Itoa(ev.Status) == f.Status
+	}
+	return true
+}
+
+// handleAuditEvents serves recent audit events as JSON lines to admins,
+// the last n (default 10) that match the agent_id, model, and status
+// query parameters, and with follow=true keeps streaming new ones
+func (ps *ProxyServer) handleAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	q := r.URL.Query()
+	filter := auditFilter{AgentID: q.Get("agent_id"), Model: q.Get("model"), Status: q.Get("status")}
+	if err := filter.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	n := 10
+	if v := q.Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "n must be a non-negative integer")
+			return
+		}
+	}
+	follow := q.Get("follow") == "true"
+
+	recent, events, cancel := ps.plugin.feed.Subscribe(follow)
+	defer cancel()
+	var matched []AuditEvent
+	for i := range recent {
+		if filter.match(&recent[i]) {
+			matched = append(matched, recent[i])
+		}
+	}
+	matched = matched[max(0, len(matched)-n):]
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for i := range matched {
+		enc.Encode(&matched[i])
+	}
+	if !follow {
+		return
+	}
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	rc.Flush()
+	keepAlive := time.NewTicker(auditStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, "\n")
+		case ev := <-events:
+			if !filter.match(&ev) {
+				continue
+			}
+			err = enc.Encode(&ev)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// runAuditCommand runs `creddy-anthropic audit <subcommand>`
+func runAuditCommand(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "tail" {
+		return errors.New("usage: creddy-anthropic audit tail [-file PATH | -url URL -admin-token TOKEN] [-follow] [-n 10] [-agent ID] [-model GLOB] [-status CODE] [-json]")
+	}
+	return runAuditTail(ctx, args[1:], out)
+}
+
+// runAuditTail prints the last audit events, and with -follow new ones as
+// they are recorded, from an audit log file or a running proxy
+func runAuditTail(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("audit tail", flag.ContinueOnError)
+	api := adminFlags(flags)
+	file := flags.String("file", "", "audit log file to read, instead of a running proxy's admin API")
+	var follow bool
+	flags.BoolVar(&follow, "follow", false, "keep printing events as they are recorded")
+	flags.BoolVar(&follow, "f", false, "shorthand for -follow")
+	n := flags.Int("n", 10, "number of recent events to print first")
+	var filter auditFilter
+	flags.StringVar(&filter.AgentID, "agent", "", "only events of this agent ID")
+	flags.StringVar(&filter.Model, "model", "", "only requests for models matching this glob pattern")
+	flags.StringVar(&filter.Status, "status", "", "only requests with this response status, e.g. 429 or 5xx")
+	asJSON := flags.Bool("json", false, "print events as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	if *n < 0 {
+		return errors.New("-n must not be negative")
+	}
+
+	emit := func(line []byte) {
+		var ev AuditEvent
+		if json.Unmarshal(line, &ev) != nil || !filter.match(&ev) {
+			return
+		}
+		if *asJSON {
+			fmt.Fprintf(out, "%s\n", bytes.TrimSpace(line))
+		} else {
+			fmt.Fprintln(out, formatAuditEvent(&ev))
+		}
+	}
+	if *file != "" {
+		return tailAuditFile(ctx, *file, *n, follow, filter, emit)
+	}
+
+	q := url.Values{"n": {strconv.Itoa(*n)}}
+	for key, v := range map[string]string{"agent_id": filter.AgentID, "model": filter.Model, "status": filter.Status} {
+		if v != "" {
+			q.Set(key, v)
+		}
+	}
+	if follow {
+		q.Set("follow", "true")
+	}
+	resp, err := api.send(ctx, http.MethodGet, "/v1/audit/events?"+q.Encode(), nil, follow)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	lines.Buffer(nil, 16<<20)
+	for lines.Scan() {
+		if len(bytes.TrimSpace(lines.Bytes())) > 0 {
+			emit(lines.Bytes())
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return lines.Err()
+}
+
+// tailAuditFile passes the last n events in the audit log at path that
+// match filter to emit, and with follow then passes new ones until ctx
+// ends, reopening the file when it is rotated
+func tailAuditFile(ctx context.Context, path string, n int, follow bool, filter auditFilter, emit func(line []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+
+	var last [][]byte
+	lines := bufio.NewReader(f)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var ev AuditEvent
+			if json.Unmarshal(line, &ev) == nil && filter.match(&ev) {
+				last = append(last, line)
+				if len(last) > n {
+					last = last[1:]
+				}
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			// A line still being written is read again when following
+			if _, err := f.Seek(-int64(len(line)), io.SeekCurrent); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	for _, line := range last {
+		emit(line)
+	}
+	if !follow {
+		return nil
+	}
+
+	var partial []byte
+	ticker := time.NewTicker(auditTailPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		partial = append(partial, data...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				break
+			}
+			emit(partial[:i+1])
+			partial = partial[i+1:]
+		}
+
+		// Reopen a rotated log, and start over in a truncated one
+		pos, _ := f.Seek(0, io.SeekCurrent)
+		current, statErr := os.Stat(path)
+		opened, _ := f.Stat()
+		switch {
+		case statErr != nil:
+			// Between rotation's rename and the new file's creation
+		case !os.SameFile(current, opened):
+			next, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			f.Close()
+			f, partial = next, nil
+		case current.Size() < pos:
+			f.Seek(0, io.SeekStart)
+			partial = nil
+		}
+	}
+}
+
+// formatAuditEvent describes ev on one line
+func formatAuditEvent(ev *AuditEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-7s", ev.Time.Local().Format("2006-01-02T15:04:05.000"), ev.Event)
+	field := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, " %s=%s", key, value)
+		}
+	}
+	field("agent", ev.AgentID)
+	if ev.Event == AuditRequest {
+		field("model", ev.Model)
+		if ev.Status != 0 {
+			field("status", strconv.Itoa(ev.Status))
+		}
+		field("path", strings.TrimSpace(ev.Method+" "+ev.Path))
+		if ev.InputTokens != 0 || ev.OutputTokens != 0 {
+			field("tokens", fmt.Sprintf("%d/%d", ev.InputTokens, ev.OutputTokens))
+		}
+		if ev.LatencyMS != 0 {
+			field("latency", fmt.Sprintf("%dms", ev.LatencyMS))
+		}
+		if ev.CostUSD != 0 {
+			field("cost", fmt.Sprintf("$%.4f", ev.CostUSD))
+		}
+		field("stop", ev.StopReason)
+		field("request_id", ev.RequestID)
+	} else {
+		field("scope", ev.Scope)
+		if ev.TTLSeconds != 0 {
+			field("ttl", fmt.Sprintf("%ds", ev.TTLSeconds))
+		}
+		field("caller", ev.Caller)
+	}
+	if len(ev.TokenID) >= 12 {
+		field("token", ev.TokenID[:12])
+	}
+	return b.String()
+}
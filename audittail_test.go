@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a strings.Builder safe for a writer and a reader in
+// different goroutines
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+// waitForOutput waits until out contains want
+func waitForOutput(t *testing.T, out *syncBuffer, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("output lacks %q:\n%s", want, out.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	ev := &AuditEvent{Event: AuditRequest, AgentID: "ci-bot", Model: "claude-haiku-4-5", Status: 429}
+	for _, tt := range []struct {
+		filter auditFilter
+		want   bool
+	}{
+		{auditFilter{}, true},
+		{auditFilter{AgentID: "ci-bot"}, true},
+		{auditFilter{AgentID: "other"}, false},
+		{auditFilter{Model: "claude-haiku-*"}, true},
+		{auditFilter{Model: "claude-sonnet-*"}, false},
+		{auditFilter{Status: "429"}, true},
+		{auditFilter{Status: "4xx"}, true},
+		{auditFilter{Status: "5xx"}, false},
+		{auditFilter{AgentID: "ci-bot", Status: "200"}, false},
+	} {
+		if err := tt.filter.validate(); err != nil {
+			t.Errorf("%+v: %v", tt.filter, err)
+		}
+		if got := tt.filter.match(ev); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+	if (auditFilter{Status: "4x"}).validate() == nil || (auditFilter{Status: "999"}).validate() == nil || (auditFilter{Model: "["}).validate() == nil {
+		t.Error("invalid filters should fail validation")
+	}
+	if (auditFilter{Status: "4xx"}).match(&AuditEvent{Event: AuditIssue, AgentID: "ci-bot"}) {
+		t.Error("a status filter should not match events without a status")
+	}
+}
+
+func TestAuditTail_AdminAPI(t *testing.T) {
+	plugin, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19581, "admin_token": "admin-secret"}`)
+	issueToken(t, plugin, "agent-a", "anthropic", 10*time.Minute)
+	issueToken(t, plugin, "agent-b", "anthropic", 10*time.Minute)
+	args := []string{"tail", "-url", srv.URL, "-admin-token", "admin-secret", "-agent", "agent-a"}
+
+	var out strings.Builder
+	if err := runAuditCommand(context.Background(), append(args, "-json"), &out); err != nil {
+		t.Fatal(err)
+	}
+	var ev AuditEvent
+	if err := json.Unmarshal([]byte(out.String()), &ev); err != nil || ev.Event != AuditIssue || ev.AgentID != "agent-a" {
+		t.Errorf("audit tail -json = %q, %v", out.String(), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var followed syncBuffer
+	done := make(chan error)
+	go func() { done <- runAuditCommand(ctx, append(args, "-follow", "-n", "0"), &followed) }()
+	time.Sleep(100 * time.Millisecond)
+	issueToken(t, plugin, "agent-b", "anthropic:messages", 10*time.Minute)
+	issueToken(t, plugin, "agent-a", "anthropic:messages", 10*time.Minute)
+	waitForOutput(t, &followed, "scope=anthropic:messages")
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("audit tail -follow error: %v", err)
+	}
+	if got := followed.String(); strings.Count(got, "\n") != 1 || !strings.Contains(got, " issue ") || !strings.Contains(got, "agent=agent-a") {
+		t.Errorf("audit tail -follow output:\n%s", got)
+	}
+
+	if err := runAuditCommand(context.Background(), []string{"tail", "-url", srv.URL, "-admin-token", "wrong"}, &out); err == nil {
+		t.Error("audit tail with a wrong admin token should fail")
+	}
+}
+
+func TestAuditTail_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	line := func(agent string, status int) string {
+		return fmt.Sprintf(`{"time":"2026-03-01T12:00:00Z","event":"request","token_id":"t","agent_id":%q,"model":"claude-haiku-4-5","status":%d}`+"\n", agent, status)
+	}
+	if err := os.WriteFile(path, []byte(line("a", 200)+line("b", 200)+line("a", 429)+line("a", 200)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := runAuditCommand(context.Background(), []string{"tail", "-file", path, "-agent", "a", "-n", "2"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); strings.Count(got, "\n") != 2 || !strings.Contains(got, "status=429") || strings.Contains(got, "agent=b") {
+		t.Errorf("audit tail -n 2 output:\n%s", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var followed syncBuffer
+	done := make(chan error)
+	go func() {
+		done <- runAuditCommand(ctx, []string{"tail", "-file", path, "-status", "5xx", "--follow"}, &followed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	appendLine := func(s string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+	appendLine(line("c", 200) + line("c", 502))
+	waitForOutput(t, &followed, "agent=c")
+	// A rotated log is followed into the new file
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLine(line("d", 503))
+	waitForOutput(t, &followed, "agent=d")
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("audit tail -follow error: %v", err)
+	}
+	if got := followed.String(); strings.Count(got, "\n") != 2 || strings.Contains(got, "status=200") {
+		t.Errorf("audit tail -follow output:\n%s", got)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "time"
+
+// batchesPath is the Message Batches API; batches are addressed below it
+// as /v1/messages/batches/<id>[/cancel|/results]
+const batchesPath = "/v1/messages/batches"
+
+// batchOwnerRetention is how long batch ownership is kept: Anthropic keeps
+// batch results for 29 days after creation
+const batchOwnerRetention = 30 * 24 * time.Hour
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// benchRequestBody is the request bench sends; the fake upstream answers
+// every request with the same short reply
+const benchRequestBody = `{"model":"claude-haiku-4-5","max_tokens":16,"messages":[{"role":"user","content":"ping"}]`
+
+// benchReport is the result of a bench run
+type benchReport struct {
+	Requests      int64            `json:"requests"`
+	Errors        int64            `json:"errors"`
+	ErrorsByCause map[string]int64 `json:"errors_by_cause,omitempty"`
+	ElapsedSec    float64          `json:"elapsed_seconds"`
+	RequestsPerS  float64          `json:"requests_per_second"`
+	LatencyMS     benchLatency     `json:"latency_ms"`
+
+	// Allocation statistics cover the whole process, including the load
+	// generator and the fake upstream; only reported with -mock-upstream
+	AllocsPerRequest float64 `json:"allocs_per_request,omitempty"`
+	BytesPerRequest  float64 `json:"bytes_per_request,omitempty"`
+	GCCycles         uint32  `json:"gc_cycles,omitempty"`
+}
+
+// benchLatency summarizes request latencies, in milliseconds
+type benchLatency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// runBench runs `creddy-anthropic bench`, which sends synthetic traffic
+// through the proxy and reports throughput, latency, and allocations, so
+// regressions in the proxy path are measurable
+func runBench(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	mock := flags.Bool("mock-upstream", false, "run a proxy in-process against a built-in fake Anthropic API")
+	port := flags.Int("port", 8401, "port for the in-process proxy (with -mock-upstream)")
+	upstreamLatency := flags.Duration("upstream-latency", 0, "delay before the fake upstream responds (with -mock-upstream)")
+	target := flags.String("url", "", "base URL of a running proxy to drive instead of -mock-upstream; its requests reach its upstream")
+	token := flags.String("token", os.Getenv("ANTHROPIC_API_KEY"), "token for -url (env ANTHROPIC_API_KEY)")
+	concurrency := flags.Int("concurrency", 50, "concurrent clients")
+	duration := flags.Duration("duration", 10*time.Second, "how long to send requests")
+	requests := flags.Int64("requests", 0, "stop once this many requests are sent, if sooner than -duration")
+	stream := flags.Bool("stream", false, "send streaming requests")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *mock == (*target != "") {
+		return errors.New("give one of -mock-upstream or -url")
+	}
+	if *concurrency < 1 || *duration <= 0 {
+		return errors.New("-concurrency and -duration must be positive")
+	}
+
+	baseURL, bearer := strings.TrimSuffix(*target, "/"), *token
+	if *mock {
+		stop, url, tok, err := startBenchProxy(*port, *upstreamLatency)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		baseURL, bearer = url, tok
+	} else if bearer == "" {
+		return errors.New("-url needs a token: pass -token or set ANTHROPIC_API_KEY")
+	}
+
+	body := benchRequestBody + "}"
+	if *stream {
+		body = benchRequestBody + `,"stream":true}`
+	}
+	report := driveBench(baseURL, bearer, body, *concurrency, *duration, *requests, *mock)
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	printBenchReport(out, report)
+	return nil
+}
+
+// startBenchProxy configures a plugin whose proxy listens on port and
+// forwards to a fake upstream, returning its URL, a token for it, and a
+// function that stops both
+func startBenchProxy(port int, latency time.Duration) (stop func(), baseURL, token string, err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", "", err
+	}
+	upstream := &http.Server{Handler: fakeAnthropic(latency)}
+	go upstream.Serve(ln)
+
+	plugin := NewPlugin()
+	plugin.upstreamURL = "http://" + ln.Addr().String()
+	stop = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		plugin.Shutdown(ctx)
+		upstream.Shutdown(ctx)
+	}
+	config, _ := json.Marshal(map[string]any{
+		"api_key":     "sk-ant-bench",
+		"proxy_port":  port,
+		"listen_addr": "127.0.0.1",
+		"log_level":   "warn",
+	})
+	ctx := context.Background()
+	if err := plugin.Configure(ctx, string(config)); err != nil {
+		stop()
+		return nil, "", "", err
+	}
+	cred, err := plugin.GetCredential(ctx, &sdk.CredentialRequest{
+		Scope: "anthropic",
+		TTL:   maxTokenTTL,
+		Agent: sdk.Agent{ID: "bench", Name: "bench"},
+	})
+	if err != nil {
+		stop()
+		return nil, "", "", err
+	}
+	return stop, fmt.Sprintf("http://127.0.0.1:%d", port), cred.Value, nil
+}
+
+// fakeAnthropic answers Messages API requests with a fixed reply, streamed
+// if the request asks for it, after latency
+func fakeAnthropic(latency time.Duration) http.HandlerFunc {
+	const message = `{"id":"msg_bench","type":"message","role":"assistant","model":"claude-haiku-4-5","content":[{"type":"text","text":"pong"}],"stop_reason":"end_turn","usage":{"input_tokens":8,"output_tokens":2}}`
+	const stream = "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_bench\",\"type\":\"message\",\"role\":\"assistant\",\"model\":\"claude-haiku-4-5\",\"content\":[],\"usage\":{\"input_tokens\":8,\"output_tokens\":1}}}\n\n" +
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"pong\"}}\n\n" +
+		"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n" +
+		"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":2}}\n\n" +
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, stream)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, message)
+	}
+}
+
+// driveBench sends body to baseURL's Messages API from concurrency clients
+// until duration has passed or, if maxRequests is set, that many requests
+// have been sent. measureAllocs reports the process's allocations, which
+// are only meaningful when the proxy runs in-process.
+func driveBench(baseURL, token, body string, concurrency int, duration time.Duration, maxRequests int64, measureAllocs bool) *benchReport {
+	client := &http.Client{Transport: &http.Transport{
+		MaxIdleConns:        concurrency,
+		MaxIdleConnsPerHost: concurrency,
+	}}
+	defer client.CloseIdleConnections()
+	deadline := time.Now().Add(duration)
+
+	var (
+		sent     atomic.Int64
+		mu       sync.Mutex
+		all      []time.Duration
+		errs     = map[string]int64{}
+		wg       sync.WaitGroup
+		before   runtime.MemStats
+		after    runtime.MemStats
+		endpoint = baseURL + "/v1/messages"
+	)
+	if measureAllocs {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+	}
+	started := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var latencies []time.Duration
+			failed := map[string]int64{}
+			for time.Now().Before(deadline) && (maxRequests == 0 || sent.Add(1) <= maxRequests) {
+				begin := time.Now()
+				cause := sendBenchRequest(client, endpoint, token, body)
+				latencies = append(latencies, time.Since(begin))
+				if cause != "" {
+					failed[cause]++
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			all = append(all, latencies...)
+			for cause, n := range failed {
+				errs[cause] += n
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	report := &benchReport{
+		Requests:     int64(len(all)),
+		ElapsedSec:   elapsed.Seconds(),
+		RequestsPerS: float64(len(all)) / elapsed.Seconds(),
+		LatencyMS:    latencySummary(all),
+	}
+	for _, n := range errs {
+		report.Errors += n
+	}
+	if len(errs) > 0 {
+		report.ErrorsByCause = errs
+	}
+	if measureAllocs && len(all) > 0 {
+		runtime.ReadMemStats(&after)
+		report.AllocsPerRequest = float64(after.Mallocs-before.Mallocs) / float64(len(all))
+		report.BytesPerRequest = float64(after.TotalAlloc-before.TotalAlloc) / float64(len(all))
+		report.GCCycles = after.NumGC - before.NumGC
+	}
+	return report
+}
+
+// sendBenchRequest sends one request and reads the whole response,
+// returning why it failed or "" if it succeeded
+func sendBenchRequest(client *http.Client, endpoint, token, body string) string {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err.Error()
+	}
+	req.Header.Set("x-api-key", token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("anthropic-version", defaultAnthropicVersion)
+	resp, err := client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return "timeout"
+		}
+		return "connection error"
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return "incomplete response"
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return ""
+}
+
+// latencySummary returns percentiles of latencies, which it sorts
+func latencySummary(latencies []time.Duration) benchLatency {
+	if len(latencies) == 0 {
+		return benchLatency{}
+	}
+	slices.Sort(latencies)
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return benchLatency{
+		P50: ms(percentile(latencies, 0.50)),
+		P90: ms(percentile(latencies, 0.90)),
+		P99: ms(percentile(latencies, 0.99)),
+		Max: ms(latencies[len(latencies)-1]),
+	}
+}
+
+// percentile returns the p'th (0 to 1) percentile of sorted, which must
+// not be empty, by the nearest-rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(float64(len(sorted))*p+0.999999) - 1
+	return sorted[max(0, min(rank, len(sorted)-1))]
+}
+
+// printBenchReport writes report for people
+func printBenchReport(out io.Writer, report *benchReport) {
+	fmt.Fprintf(out, "Requests:    %d in %.1fs, %d failed\n", report.Requests, report.ElapsedSec, report.Errors)
+	causes := make([]string, 0, len(report.ErrorsByCause))
+	for cause := range report.ErrorsByCause {
+		causes = append(causes, cause)
+	}
+	slices.Sort(causes)
+	for _, cause := range causes {
+		fmt.Fprintf(out, "  %-18s %d\n", cause+":", report.ErrorsByCause[cause])
+	}
+	fmt.Fprintf(out, "Throughput:  %.1f requests/s\n", report.RequestsPerS)
+	l := report.LatencyMS
+	fmt.Fprintf(out, "Latency:     p50 %.2fms, p90 %.2fms, p99 %.2fms, max %.2fms\n", l.P50, l.P90, l.P99, l.Max)
+	if report.AllocsPerRequest > 0 {
+		fmt.Fprintf(out, "Allocations: %.0f allocs/request, %.1f KiB/request, %d GC cycles (whole process)\n",
+			report.AllocsPerRequest, report.BytesPerRequest/1024, report.GCCycles)
+	}
+}
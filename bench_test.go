@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	for p, want := range map[float64]time.Duration{0: time.Millisecond, 0.5: 50 * time.Millisecond, 0.99: 99 * time.Millisecond, 1: 100 * time.Millisecond} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile(%v) = %s, want %s", p, got, want)
+		}
+	}
+	if got := percentile(sorted[:1], 0.99); got != time.Millisecond {
+		t.Errorf("percentile of one = %s", got)
+	}
+}
+
+func TestBench_MockUpstream(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		args := []string{"-mock-upstream", "-port", "19578", "-concurrency", "4", "-requests", "40", "-json"}
+		if stream {
+			args = append(args, "-stream")
+		}
+		var out strings.Builder
+		if err := runBench(args, &out); err != nil {
+			t.Fatalf("bench %v error: %v", args, err)
+		}
+		var report benchReport
+		if err := json.Unmarshal([]byte(out.String()), &report); err != nil {
+			t.Fatalf("bench -json output is not JSON: %v\n%s", err, out.String())
+		}
+		if report.Requests != 40 || report.Errors != 0 || report.LatencyMS.Max <= 0 || report.LatencyMS.P50 > report.LatencyMS.P99 || report.AllocsPerRequest <= 0 {
+			t.Errorf("stream=%v: report = %+v", stream, report)
+		}
+	}
+
+	if err := runBench([]string{"-concurrency", "4"}, &strings.Builder{}); err == nil {
+		t.Error("bench without -mock-upstream or -url should fail")
+	}
+}
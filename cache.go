@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// defaultPromptCacheMinTokens is the smallest prefix the proxy marks for
+// caching; Anthropic does not cache prompts shorter than 1024 tokens
+const defaultPromptCacheMinTokens = 1024
+
+// charsPerToken approximates prompt length in tokens without a tokenizer
+const charsPerToken = 4
+
+// injectCacheControl adds cache_control breakpoints to a Messages request
+// (each item's params for a batch) whose tools or system prompt are at
+// least minTokens long. Tools come first in the cached prefix, so the last
+// tool is marked when tools alone are long enough, and the last system
+// block when tools and system together are. Requests that already set
+// cache_control anywhere are left as the client sent them.
+func injectCacheControl(body []byte, batch bool, minTokens int) ([]byte, error) {
+	if len(body) == 0 || bytes.Contains(body, []byte(`"cache_control"`)) {
+		return body, nil
+	}
+	changed := false
+	out, err := rewriteParams(body, batch, func(params map[string]any) {
+		if markCacheBreakpoints(params, minTokens) {
+			changed = true
+		}
+	})
+	if err != nil || !changed {
+		return body, err
+	}
+	return out, nil
+}
+
+// markCacheBreakpoints marks the end of params' tools and system prompt
+// for caching if they are long enough, reporting whether it changed params
+func markCacheBreakpoints(params map[string]any, minTokens int) bool {
+	ephemeral := map[string]any{"type": "ephemeral"}
+	changed := false
+
+	tools, _ := params["tools"].([]any)
+	length := estimateTokens(tools)
+	if len(tools) > 0 && length >= minTokens {
+		if last, ok := tools[len(tools)-1].(map[string]any); ok {
+			last["cache_control"] = ephemeral
+			changed = true
+		}
+	}
+
+	var blocks []any
+	switch system := params["system"].(type) {
+	case string:
+		if system != "" {
+			blocks = []any{map[string]any{"type": "text", "text": system}}
+		}
+	case []any:
+		blocks = system
+	}
+	length += estimateTokens(blocks)
+	if len(blocks) > 0 && length >= minTokens {
+		if last, ok := blocks[len(blocks)-1].(map[string]any); ok {
+			last["cache_control"] = ephemeral
+			params["system"] = blocks
+			changed = true
+		}
+	}
+	return changed
+}
+
+// estimateTokens approximates the tokens v takes up in a prompt from the
+// length of its JSON encoding
+func estimateTokens(v []any) int {
+	if len(v) == 0 {
+		return 0
+	}
+	data, _ := json.Marshal(v)
+	return len(data) / charsPerToken
+}
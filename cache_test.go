@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInjectCacheControl(t *testing.T) {
+	long := strings.Repeat("x", 4*200)
+	tests := []struct {
+		name  string
+		body  string
+		batch bool
+		want  []string // substrings of the rewritten body
+		same  bool     // body is forwarded unchanged
+	}{
+		{
+			name: "long system string",
+			body: `{"model":"m","system":"` + long + `","messages":[]}`,
+			want: []string{`"system":[{"cache_control":{"type":"ephemeral"},"text":"` + long + `","type":"text"}]`},
+		},
+		{
+			name: "long tools and short system",
+			body: `{"model":"m","system":[{"type":"text","text":"hi"}],"tools":[{"name":"a"},{"name":"b","description":"` + long + `"}]}`,
+			want: []string{`{"cache_control":{"type":"ephemeral"},"description":"` + long + `","name":"b"}`, `{"cache_control":{"type":"ephemeral"},"text":"hi","type":"text"}`},
+		},
+		{
+			name:  "batch items",
+			body:  `{"requests":[{"custom_id":"1","params":{"system":"` + long + `"}},{"custom_id":"2","params":{"system":"short"}}]}`,
+			batch: true,
+			want:  []string{`"custom_id":"1","params":{"system":[{"cache_control"`, `"custom_id":"2","params":{"system":"short"}`},
+		},
+		{name: "short prompt", body: `{"model":"m","system":"short","max_tokens":1024}`, same: true},
+		{name: "client breakpoints", body: `{"system":[{"type":"text","text":"` + long + `"},{"type":"text","text":"x","cache_control":{"type":"ephemeral"}}]}`, same: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := injectCacheControl([]byte(tt.body), tt.batch, 100)
+			if err != nil {
+				t.Fatalf("injectCacheControl() error: %v", err)
+			}
+			if tt.same && string(got) != tt.body {
+				t.Errorf("body rewritten to %s", got)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("body %s missing %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxy_PromptCaching(t *testing.T) {
+	var received map[string]any
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19550, "admin_token": "admin-secret", "prompt_caching": true}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&received)
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"model":"claude-haiku-4-5","usage":{"input_tokens":5,"output_tokens":7,"cache_read_input_tokens":1100,"cache_creation_input_tokens":0}}`)
+		})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5","max_tokens":10,"system":"`+strings.Repeat("rules ", 1000)+`","messages":[]}`)
+	resp.Body.Close()
+	system, _ := received["system"].([]any)
+	if block, _ := system[0].(map[string]any); len(system) != 1 || block["cache_control"] == nil {
+		t.Errorf("upstream system = %v, want one block with cache_control", received["system"])
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`creddy_anthropic_tokens_total{model="claude-haiku-4-5",type="input"} 5`,
+		`creddy_anthropic_tokens_total{model="claude-haiku-4-5",type="cache_read"} 1100`,
+		`creddy_anthropic_tokens_total{model="claude-haiku-4-5",type="cache_creation"} 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// captureMaxBody bounds each captured body; the rest is dropped and the
+// capture marked truncated
+const captureMaxBody = 1 << 20
+
+// redacted replaces secrets and PII in captured requests
+const redacted = "[REDACTED]"
+
+// uncapturedHeaders carry credentials and are never written, even redacted
+var uncapturedHeaders = map[string]bool{"X-Api-Key": true, "Authorization": true, "Cookie": true, "Set-Cookie": true}
+
+// builtinRedactions match credentials in any format this plugin or
+// Anthropic issues: API keys and JWTs. Opaque tokens are added per
+// configuration, since their prefix is configurable.
+var builtinRedactions = []*regexp.Regexp{
+	regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]+`),
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+}
+
+// debugCapture records sampled request and response bodies to files in dir
+// for debugging agent prompts, with secrets and PII patterns redacted
+type debugCapture struct {
+	dir     string
+	percent atomic.Int32 // PUT /admin/logging may change it until reload
+	redact  []*regexp.Regexp
+	secrets []string // configured secrets, redacted wherever they appear
+}
+
+// newDebugCapture returns the capture configured by cfg, or nil if
+// capture_dir is unset
+func newDebugCapture(cfg *AnthropicConfig) (*debugCapture, error) {
+	if cfg.CaptureDir == "" {
+		return nil, nil
+	}
+	if cfg.CaptureSamplePercent < 0 || cfg.CaptureSamplePercent > 100 {
+		return nil, errors.New("capture_sample_percent must be between 1 and 100")
+	}
+	c := &debugCapture{dir: cfg.CaptureDir}
+	c.percent.Store(int32(cfg.CaptureSamplePercent))
+	if cfg.CaptureSamplePercent == 0 {
+		c.percent.Store(100)
+	}
+	c.redact = append(c.redact, builtinRedactions...)
+	c.redact = append(c.redact, regexp.MustCompile(regexp.QuoteMeta(cfg.TokenPrefix)+`[A-Za-z0-9_=-]+`))
+	for _, pattern := range cfg.CaptureRedactPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("capture_redact_patterns: %w", err)
+		}
+		c.redact = append(c.redact, re)
+	}
+	secrets := []string{cfg.APIKey, cfg.PreviousAPIKey, cfg.AdminToken, cfg.TokenSigningKey}
+	for _, ws := range cfg.Workspaces {
+		secrets = append(secrets, ws.APIKey)
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			c.secrets = append(c.secrets, secret)
+		}
+	}
+	return c, nil
+}
+
+// Sample reports whether to capture the next request. A nil capture
+// captures nothing.
+func (c *debugCapture) Sample() bool {
+	if c == nil {
+		return false
+	}
+	percent := int(c.percent.Load())
+	return percent >= 100 || rand.IntN(100) < percent
+}
+
+// Redact replaces secrets and every redaction pattern's matches in s
+func (c *debugCapture) Redact(s string) string {
+	for _, secret := range c.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	for _, re := range c.redact {
+		s = re.ReplaceAllLiteralString(s, redacted)
+	}
+	return s
+}
+
+// captureBuffer keeps the first captureMaxBody bytes written to it
+type captureBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := captureMaxBody - b.buf.Len(); len(p) > room {
+		p, b.truncated = p[:max(room, 0)], true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// requestCapture collects a sampled request's bodies as it is proxied
+type requestCapture struct {
+	capture        *debugCapture
+	Request        captureBuffer
+	Response       captureBuffer
+	ResponseHeader http.Header
+}
+
+// capturedMessage is one side of a captured exchange
+type capturedMessage struct {
+	Headers   map[string][]string `json:"headers"`
+	Body      string              `json:"body"`
+	Truncated bool                `json:"truncated,omitempty"`
+}
+
+// capturedExchange is the file written for a captured request
+type capturedExchange struct {
+	RequestID  string          `json:"request_id"`
+	Time       time.Time       `json:"time"`
+	TokenID    string          `json:"token_id"`
+	AgentID    string          `json:"agent_id"`
+	Scope      string          `json:"scope"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Status     int             `json:"status"`
+	DurationMS int64           `json:"duration_ms"`
+	Request    capturedMessage `json:"request"`
+	Response   capturedMessage `json:"response"`
+}
+
+// message redacts headers and body for a capture
+func (c *debugCapture) message(h http.Header, body *captureBuffer) capturedMessage {
+	headers := make(map[string][]string, len(h))
+	for k, vv := range h {
+		if uncapturedHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		for _, v := range vv {
+			headers[k] = append(headers[k], c.Redact(v))
+		}
+	}
+	return capturedMessage{Headers: headers, Body: c.Redact(body.buf.String()), Truncated: body.truncated}
+}
+
+// Save writes ex to <dir>/<request_id>.json, readable by the owner only
+func (c *debugCapture) Save(ex *capturedExchange) error {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.dir, ex.RequestID+".json"), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ex)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugCapture(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "captures")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-real-key", "proxy_port": 19539, "capture_dir": %q, "capture_redact_patterns": ["[0-9]{3}-[0-9]{2}-[0-9]{4}"]}`, dir)
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","content":[{"type":"text","text":"echo ` + strings.ReplaceAll(string(body), `"`, `'`) + `"}]}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	body := `{"model":"claude-haiku-4-5","messages":[{"role":"user","content":"my SSN is 123-45-6789, key sk-ant-leaked-abc, token ` + cred.Value + `"}]}`
+	resp := proxyRequest(t, srv, cred.Value, body)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "req_*.json"))
+	if len(files) != 1 {
+		t.Fatalf("got %d capture files, want 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"123-45-6789", "sk-ant-leaked-abc", "sk-ant-real-key", cred.Value} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("capture contains %q:\n%s", secret, data)
+		}
+	}
+
+	var ex capturedExchange
+	if err := json.Unmarshal(data, &ex); err != nil {
+		t.Fatalf("invalid capture: %v", err)
+	}
+	if ex.AgentID != "agent-1" || ex.Path != "/v1/messages" || ex.Status != 200 || ex.RequestID == "" {
+		t.Errorf("capture = %+v", ex)
+	}
+	if !strings.Contains(ex.Request.Body, "my SSN is [REDACTED]") || !strings.Contains(ex.Response.Body, "echo ") {
+		t.Errorf("request body = %q, response body = %q", ex.Request.Body, ex.Response.Body)
+	}
+	if _, ok := ex.Request.Headers["X-Api-Key"]; ok {
+		t.Error("capture should not include the x-api-key header")
+	}
+}
+
+func TestDebugCapture_Sampling(t *testing.T) {
+	var c *debugCapture
+	if c.Sample() {
+		t.Error("nil capture should not sample")
+	}
+	c = &debugCapture{}
+	c.percent.Store(100)
+	if !c.Sample() {
+		t.Error("capture at 100% should always sample")
+	}
+
+	for _, config := range []string{
+		`{"api_key": "sk-ant-test", "capture_dir": "/tmp/x", "capture_sample_percent": 101}`,
+		`{"api_key": "sk-ant-test", "capture_dir": "/tmp/x", "capture_redact_patterns": ["("]}`,
+	} {
+		if err := newTestPlugin(t).Configure(context.Background(), config); err == nil {
+			t.Errorf("Configure(%s) should fail", config)
+		}
+	}
+}
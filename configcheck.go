@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// runConfigCommand runs `creddy-anthropic config <subcommand>`
+func runConfigCommand(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "validate" {
+		return errors.New("usage: creddy-anthropic config validate [-file] config.json")
+	}
+	return runConfigValidate(args[1:], out)
+}
+
+// runConfigValidate checks a configuration file the way Configure would,
+// reporting every problem it can find, without binding the proxy port or
+// opening token stores and audit sinks
+func runConfigValidate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	path := flags.String("file", "", "configuration file to check (\"-\" for standard input)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" && flags.NArg() == 1 {
+		*path = flags.Arg(0)
+	}
+	if *path == "" || flags.NArg() > 1 || (flags.NArg() == 1 && flags.Arg(0) != *path) {
+		return errors.New("usage: creddy-anthropic config validate [-file] config.json")
+	}
+
+	var data []byte
+	var err error
+	if *path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*path)
+	}
+	if err != nil {
+		return err
+	}
+	cfg, problems := validateConfig(context.Background(), data)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(out, "%s: %s\n", *path, problem)
+		}
+		return fmt.Errorf("%s: %d problem(s) found", *path, len(problems))
+	}
+	fmt.Fprintf(out, "%s: ok (fingerprint %s)\n", *path, cfg.fingerprint)
+	return nil
+}
+
+// validateConfig checks configJSON, plain or encrypted: its syntax, its
+// fields against the configuration struct and ConfigSchema, and then
+// everything Configure checks. Field problems are all reported; checks
+// beyond them stop at the first failure.
+func validateConfig(ctx context.Context, configJSON []byte) (*AnthropicConfig, []string) {
+	plain, err := decryptConfig(ctx, string(configJSON))
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	data := []byte(plain)
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, []string{describeJSONError(data, err)}
+	}
+	var problems []string
+	known := configFieldNames()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if known[name] {
+			continue
+		}
+		problem := fmt.Sprintf("unknown field %q", name)
+		if suggestion := closestName(name, known); suggestion != "" {
+			problem += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		problems = append(problems, problem)
+	}
+	schema, _ := NewPlugin().ConfigSchema(ctx)
+	for _, f := range schema {
+		if _, ok := fields[f.Name]; f.Required && !ok {
+			problems = append(problems, fmt.Sprintf("%s is required", f.Name))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	// Unknown fields inside policies, workspaces, and sinks, and values
+	// of the wrong type
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(new(AnthropicConfig)); err != nil {
+		return nil, []string{describeJSONError(data, err)}
+	}
+
+	cfg, err := parseConfig(ctx, plain)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	return cfg, nil
+}
+
+// configFieldNames returns the JSON names of the configuration's fields
+func configFieldNames() map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeOf(AnthropicConfig{})
+	for i := range t.NumField() {
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag != "" && tag != "-" {
+			names[tag] = true
+		}
+	}
+	return names
+}
+
+// describeJSONError makes a decoding error of data precise, with the line
+// and column of syntax errors and the field of type errors
+func describeJSONError(data []byte, err error) string {
+	var syntax *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		// The offset is just past the offending character
+		line, col := lineColumn(data, syntax.Offset-1)
+		return fmt.Sprintf("line %d, column %d: invalid JSON: %v", line, col, syntax)
+	case errors.As(err, &typeErr):
+		line, col := lineColumn(data, typeErr.Offset)
+		if typeErr.Field == "" {
+			return fmt.Sprintf("line %d, column %d: configuration must be a JSON object", line, col)
+		}
+		return fmt.Sprintf("line %d, column %d: %s: cannot use a JSON %s as %s", line, col, typeErr.Field, typeErr.Value, typeErr.Type)
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		return "invalid JSON: unexpected end of input"
+	default:
+		return strings.TrimPrefix(err.Error(), "json: ")
+	}
+}
+
+// lineColumn converts a byte offset into data to a 1-based line and column
+func lineColumn(data []byte, offset int64) (line, col int) {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// closestName returns the known name nearest to name, if one is close
+// enough to be a likely typo
+func closestName(name string, known map[string]bool) string {
+	best, bestDist := "", 4
+	for candidate := range known {
+		if d := editDistance(name, candidate); d < bestDist || (d == bestDist && candidate < best) {
+			best, bestDist = candidate, d
+		}
+	}
+	if bestDist > len(name)/3+1 {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
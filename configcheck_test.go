@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		want   []string // substrings of each problem, in order
+	}{
+		{`{"api_key": "sk-ant-test", "proxy_port": 9000}`, nil},
+		{"{\n  \"api_key\": \"sk-ant-test\",\n  \"proxy_prot\": 8401,\n  \"log_levl\": \"debug\"\n}", []string{
+			`unknown field "log_levl" (did you mean "log_level"?)`,
+			`unknown field "proxy_prot" (did you mean "proxy_port"?)`,
+		}},
+		{`{"api_key": "sk-ant-test", "xyzzy": true}`, []string{`unknown field "xyzzy"`}},
+		{"{\n  \"api_key\": \"sk-ant-test\",\n}", []string{"line 3, column 1: invalid JSON"}},
+		{`{"api_key": "sk-ant-test", "proxy_port": "8401"}`, []string{"proxy_port: cannot use a JSON string as int"}},
+		{`["api_key"]`, []string{"configuration must be a JSON object"}},
+		{`{"api_key": "sk-ant-test", "policies": {"anthropic:ci": {"max_tokn": 5}}}`, []string{`unknown field "max_tokn"`}},
+		{`{"api_key": "sk-ant-test", "proxy_port": 70000}`, []string{"proxy_port must be between 1 and 65535"}},
+		{`{"api_key": "sk-ant-test", "allowed_scopes": ["anthropic:nope"]}`, []string{"allowed_scopes"}},
+		{`{"api_key": "sk-ant-test", "revocation_broadcast": "webhook"}`, []string{"revocation_peers is required"}},
+		{`{"proxy_port": 9000}`, []string{"api_key is required"}},
+	} {
+		cfg, problems := validateConfig(context.Background(), []byte(tt.config))
+		if len(problems) != len(tt.want) {
+			t.Errorf("validateConfig(%s) = %q, want %d problem(s)", tt.config, problems, len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			if !strings.Contains(problems[i], want) {
+				t.Errorf("validateConfig(%s) problem %d = %q, want %q", tt.config, i, problems[i], want)
+			}
+		}
+		if len(tt.want) == 0 && (cfg == nil || cfg.fingerprint == "") {
+			t.Errorf("validateConfig(%s) = %v, want a configuration", tt.config, cfg)
+		}
+	}
+}
+
+func TestConfigValidateCommand(t *testing.T) {
+	dir := t.TempDir()
+	good, bad := filepath.Join(dir, "good.json"), filepath.Join(dir, "bad.json")
+	os.WriteFile(good, []byte(`{"api_key": "sk-ant-test", "proxy_port": 19580}`), 0o600)
+	os.WriteFile(bad, []byte(`{"api_key": "sk-ant-test", "proxy_prot": 19580}`), 0o600)
+
+	var out strings.Builder
+	if err := runConfigCommand([]string{"validate", "-file", good}, &out); err != nil || !strings.Contains(out.String(), "good.json: ok (fingerprint ") {
+		t.Errorf("config validate of a good file = %q, %v", out.String(), err)
+	}
+	out.Reset()
+	if err := runConfigCommand([]string{"validate", bad}, &out); err == nil || !strings.Contains(out.String(), `bad.json: unknown field "proxy_prot"`) {
+		t.Errorf("config validate of a bad file = %q, %v", out.String(), err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configKDFIterations is the PBKDF2 work factor for newly encrypted
+// configurations; each one records its own, up to maxConfigKDFIterations
+var configKDFIterations = 600_000
+
+const maxConfigKDFIterations = 10_000_000
+
+// configSealAD binds ciphertexts to their use, so a box sealed for another
+// purpose with the same passphrase does not open as a configuration
+var configSealAD = []byte("creddy-anthropic config v1")
+
+// encryptedConfig is the form Configure accepts in place of a plain
+// configuration: the configuration JSON encrypted with AES-256-GCM under a
+// key derived from a passphrase, and where to find the passphrase. Only
+// this is stored; the API key and other secrets exist in plaintext only in
+// the plugin's memory.
+type encryptedConfig struct {
+	Encrypted  *sealedBox `json:"encrypted_config"`
+	KeyEnv     string     `json:"config_key_env"`     // Environment variable holding the passphrase
+	KeyKeyring string     `json:"config_key_keyring"` // OS keyring entry ("service/account") holding the passphrase
+}
+
+// sealedBox is an encrypted configuration; byte fields are base64 in JSON
+type sealedBox struct {
+	KDF        string `json:"kdf"` // "pbkdf2-sha256"
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// configPassphrase reads the passphrase from whichever of keyEnv and
+// keyKeyring is set
+func configPassphrase(ctx context.Context, keyEnv, keyKeyring string) (string, error) {
+	switch {
+	case keyEnv != "" && keyKeyring != "":
+		return "", errors.New("only one of config_key_env and config_key_keyring may be set")
+	case keyEnv != "":
+		passphrase := os.Getenv(keyEnv)
+		if passphrase == "" {
+			return "", fmt.Errorf("config_key_env: $%s is not set", keyEnv)
+		}
+		return passphrase, nil
+	case keyKeyring != "":
+		service, account, ok := strings.Cut(keyKeyring, "/")
+		if !ok || service == "" || account == "" {
+			return "", errors.New("config_key_keyring must be \"service/account\"")
+		}
+		ctx, cancel := context.WithTimeout(ctx, keyringTimeout)
+		defer cancel()
+		passphrase, err := keyringLookup(ctx, service, account)
+		if err != nil {
+			return "", fmt.Errorf("config_key_keyring: %w", err)
+		}
+		if passphrase = strings.TrimRight(passphrase, "\r\n"); passphrase == "" {
+			return "", fmt.Errorf("config_key_keyring: %s has an empty secret", keyKeyring)
+		}
+		return passphrase, nil
+	default:
+		return "", errors.New("encrypted_config needs config_key_env or config_key_keyring")
+	}
+}
+
+// configAEAD returns the cipher for a box under passphrase
+func configAEAD(passphrase string, box *sealedBox) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, box.Salt, box.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptConfig encrypts a configuration under passphrase, recording where
+// Configure will find the passphrase
+func encryptConfig(configJSON []byte, passphrase, keyEnv, keyKeyring string) ([]byte, error) {
+	if !json.Valid(configJSON) {
+		return nil, errors.New("configuration is not valid JSON")
+	}
+	box := &sealedBox{KDF: "pbkdf2-sha256", Iterations: configKDFIterations, Salt: make([]byte, 16)}
+	rand.Read(box.Salt)
+	aead, err := configAEAD(passphrase, box)
+	if err != nil {
+		return nil, err
+	}
+	box.Nonce = make([]byte, aead.NonceSize())
+	rand.Read(box.Nonce)
+	box.Ciphertext = aead.Seal(nil, box.Nonce, configJSON, configSealAD)
+	return json.MarshalIndent(encryptedConfig{Encrypted: box, KeyEnv: keyEnv, KeyKeyring: keyKeyring}, "", "  ")
+}
+
+// decryptConfig returns configJSON decrypted if it is an encrypted
+// configuration, and unchanged otherwise
+func decryptConfig(ctx context.Context, configJSON string) (string, error) {
+	var enc encryptedConfig
+	if json.Unmarshal([]byte(configJSON), &enc) != nil || enc.Encrypted == nil {
+		return configJSON, nil
+	}
+	box := enc.Encrypted
+	if box.KDF != "pbkdf2-sha256" {
+		return "", fmt.Errorf("encrypted_config: unknown kdf %q", box.KDF)
+	}
+	if box.Iterations < 1 || box.Iterations > maxConfigKDFIterations || len(box.Salt) == 0 {
+		return "", errors.New("encrypted_config: invalid key derivation parameters")
+	}
+	passphrase, err := configPassphrase(ctx, enc.KeyEnv, enc.KeyKeyring)
+	if err != nil {
+		return "", err
+	}
+	aead, err := configAEAD(passphrase, box)
+	if err != nil {
+		return "", fmt.Errorf("encrypted_config: %w", err)
+	}
+	if len(box.Nonce) != aead.NonceSize() {
+		return "", errors.New("encrypted_config: invalid nonce")
+	}
+	plain, err := aead.Open(nil, box.Nonce, box.Ciphertext, configSealAD)
+	if err != nil {
+		return "", errors.New("encrypted_config: wrong passphrase, or the configuration was modified")
+	}
+	return string(plain), nil
+}
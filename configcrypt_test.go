@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEncryptConfig(t *testing.T) {
+	orig := configKDFIterations
+	configKDFIterations = 1000
+	t.Cleanup(func() { configKDFIterations = orig })
+	t.Setenv("CREDDY_TEST_CONFIG_KEY", "correct horse battery staple")
+
+	plain := `{"api_key": "sk-ant-secret", "proxy_port": 19573}`
+	sealed, err := encryptConfig([]byte(plain), "correct horse battery staple", "CREDDY_TEST_CONFIG_KEY", "")
+	if err != nil {
+		t.Fatalf("encryptConfig() error: %v", err)
+	}
+	if strings.Contains(string(sealed), "sk-ant-secret") {
+		t.Fatal("encrypted configuration contains the API key")
+	}
+	got, err := decryptConfig(context.Background(), string(sealed))
+	if err != nil || got != plain {
+		t.Fatalf("decryptConfig() = %q, %v; want the original configuration", got, err)
+	}
+
+	// Plain configurations pass through
+	if got, err := decryptConfig(context.Background(), plain); err != nil || got != plain {
+		t.Errorf("decryptConfig(plain) = %q, %v", got, err)
+	}
+
+	t.Setenv("CREDDY_TEST_CONFIG_KEY", "wrong")
+	if _, err := decryptConfig(context.Background(), string(sealed)); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("decryptConfig() with the wrong passphrase = %v", err)
+	}
+	t.Setenv("CREDDY_TEST_CONFIG_KEY", "correct horse battery staple")
+
+	var enc encryptedConfig
+	json.Unmarshal(sealed, &enc)
+	enc.Encrypted.Ciphertext[0] ^= 1
+	tampered, _ := json.Marshal(enc)
+	if _, err := decryptConfig(context.Background(), string(tampered)); err == nil {
+		t.Error("decryptConfig() accepted a modified configuration")
+	}
+
+	// Configure decrypts in memory
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), string(sealed)); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if plugin.GetAPIKey() != "sk-ant-secret" || plugin.GetProxyPort() != 19573 {
+		t.Errorf("Configure() applied key %q, port %d", plugin.GetAPIKey(), plugin.GetProxyPort())
+	}
+}
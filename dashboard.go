@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboardFiles is the admin dashboard, a page that reads the admin API
+// from the browser
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardHandler serves dashboardFiles under /dashboard/
+var dashboardHandler = func() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServerFS(files))
+}()
+
+// handleDashboard serves the admin dashboard. The page holds no data, so
+// it needs no authentication; the admin API calls it makes do.
+func (ps *ProxyServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	dashboardHandler.ServeHTTP(w, r)
+}
@@ -0,0 +1,128 @@
+// The dashboard reads the admin API with the admin token kept for the
+// browser session, or with the browser's client certificate on an admin
+// listener that verifies them.
+"use strict";
+
+const refreshInterval = 5000;
+const tokenKey = "creddy-anthropic-admin-token";
+
+const $ = (id) => document.getElementById(id);
+
+class Unauthorized extends Error {}
+
+async function api(path) {
+  const headers = {};
+  const token = sessionStorage.getItem(tokenKey);
+  if (token) {
+    headers["x-api-key"] = token;
+  }
+  const resp = await fetch(path, { headers, cache: "no-store" });
+  if (resp.status === 401) {
+    throw new Unauthorized();
+  }
+  if (!resp.ok) {
+    throw new Error(`${path}: ${resp.status} ${resp.statusText}`);
+  }
+  return resp;
+}
+
+// row appends a table row of cells, each text or [text, className]
+function row(tbody, cells) {
+  const tr = tbody.insertRow();
+  for (const cell of cells) {
+    const td = tr.insertCell();
+    const [text, className] = Array.isArray(cell) ? cell : [cell, ""];
+    td.textContent = text;
+    if (className) {
+      td.className = className;
+    }
+  }
+}
+
+function fill(tbody, rows, columns, empty) {
+  tbody.replaceChildren();
+  if (rows.length === 0) {
+    const td = tbody.insertRow().insertCell();
+    td.colSpan = columns;
+    td.className = "empty";
+    td.textContent = empty;
+  }
+  for (const cells of rows) {
+    row(tbody, cells);
+  }
+}
+
+const count = (n) => (n || 0).toLocaleString();
+const usd = (n) => "$" + (n || 0).toFixed(4);
+const time = (s) => (s ? new Date(s).toLocaleString() : "");
+
+async function refreshTokens() {
+  const { tokens } = await (await api("/admin/tokens")).json();
+  $("active-tokens").textContent = count(tokens.length);
+  tokens.sort((a, b) => (a.agent_id || "").localeCompare(b.agent_id || ""));
+  fill($("tokens"), tokens.map((t) => [
+    t.agent_id, t.scope, t.id, time(t.expires_at),
+    [count(t.request_count), "num"], [usd(t.spent_usd), "num"],
+  ]), 6, "No active tokens");
+}
+
+async function refreshSpend() {
+  const start = new Date(Date.now() - 24 * 3600 * 1000).toISOString();
+  const report = await (await api("/admin/usage?start=" + encodeURIComponent(start))).json();
+  $("spend-total").textContent = usd(report.total.cost_usd);
+  const agents = Object.entries(report.agents || {}).sort((a, b) => b[1].cost_usd - a[1].cost_usd);
+  fill($("spend"), agents.map(([agent, s]) => [
+    agent, [count(s.requests), "num"], [count(s.input_tokens), "num"],
+    [count(s.output_tokens), "num"], [usd(s.cost_usd), "num"],
+  ]), 5, "No usage");
+}
+
+// refreshRequests derives the request rate and recent errors from the
+// proxy's recent audit events
+async function refreshRequests() {
+  const text = await (await api("/v1/audit/events?n=1000")).text();
+  const events = text.split("\n").filter((line) => line.trim()).map((line) => JSON.parse(line))
+    .filter((ev) => ev.event === "request");
+  const now = Date.now();
+  const since = (ms) => events.filter((ev) => now - Date.parse(ev.time) <= ms);
+  $("rate-1m").textContent = count(since(60 * 1000).length);
+  $("rate-5m").textContent = (since(5 * 60 * 1000).length / 5).toFixed(1);
+  $("errors-5m").textContent = count(since(5 * 60 * 1000).filter((ev) => ev.status >= 400).length);
+
+  const errors = events.filter((ev) => ev.status >= 400).slice(-20).reverse();
+  fill($("errors"), errors.map((ev) => [
+    time(ev.time), ev.agent_id || "", ev.model || "", ev.path || "",
+    [String(ev.status), "num error"], ev.request_id || "",
+  ]), 6, "No recent errors");
+}
+
+async function refresh() {
+  try {
+    await Promise.all([refreshTokens(), refreshSpend(), refreshRequests()]);
+    $("login").hidden = true;
+    $("dashboard").hidden = false;
+    $("status").textContent = "Updated " + new Date().toLocaleTimeString();
+  } catch (err) {
+    if (err instanceof Unauthorized) {
+      $("dashboard").hidden = true;
+      $("login").hidden = false;
+      $("login-error").textContent = sessionStorage.getItem(tokenKey) ? "The admin token was not accepted." : "";
+      return;
+    }
+    $("status").textContent = "Update failed: " + err.message;
+  }
+}
+
+$("login").addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  sessionStorage.setItem(tokenKey, $("admin-token").value);
+  $("admin-token").value = "";
+  refresh();
+});
+
+refresh();
+setInterval(() => {
+  if ($("login").hidden) {
+    refresh();
+  }
+}, refreshInterval);
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statusOverloaded is Anthropic's status for an overloaded API
+const statusOverloaded = 529
+
+// FailoverConfig is a secondary Anthropic key for the default workspace,
+// used while api_key is being rate limited or Anthropic is overloaded
+type FailoverConfig struct {
+	APIKey          string `json:"api_key"`          // The secondary key
+	APIKeyFile      string `json:"api_key_file"`     // File holding the key, instead of api_key
+	APIKeyEnv       string `json:"api_key_env"`      // Environment variable holding the key, instead of api_key
+	APIKeyKeyring   string `json:"api_key_keyring"`  // OS keyring entry ("service/account") holding the key, instead of api_key
+	AfterErrors     int    `json:"after_errors"`     // Consecutive 429 or 529 responses to api_key before failing over (default 3)
+	CooldownSeconds int    `json:"cooldown_seconds"` // How long requests use the secondary key before api_key is tried again (default 60)
+}
+
+// setupFailover checks the failover settings, applying defaults and
+// reading the secondary key
+func (cfg *AnthropicConfig) setupFailover(ctx context.Context) error {
+	f := cfg.Failover
+	if f == nil {
+		return nil
+	}
+	key, err := readAPIKey(ctx, f.APIKey, f.APIKeyFile, f.APIKeyEnv, f.APIKeyKeyring)
+	if err != nil {
+		return fmt.Errorf("failover: %w", err)
+	}
+	if key == cfg.APIKey {
+		return errors.New("failover: api_key must differ from the primary api_key")
+	}
+	f.APIKey = key
+	if f.AfterErrors < 0 || f.CooldownSeconds < 0 {
+		return errors.New("failover: after_errors and cooldown_seconds must not be negative")
+	}
+	if f.AfterErrors == 0 {
+		f.AfterErrors = 3
+	}
+	if f.CooldownSeconds == 0 {
+		f.CooldownSeconds = 60
+	}
+	return nil
+}
+
+// keyFailover follows the primary key's rate limit and overload errors,
+// deciding when requests fail over to the secondary key
+type keyFailover struct {
+	mu sync.Mutex
+	// errors counts consecutive 429 and 529 responses to the primary key
+	errors int
+	// until is when requests go back to the primary key
+	until time.Time
+	// failovers and secondaryRequests are counted for /metrics
+	failovers         int64
+	secondaryRequests int64
+}
+
+// Active reports whether requests should use the secondary key at now
+func (f *keyFailover) Active(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return now.Before(f.until)
+}
+
+// Observe records the status of a response to the primary key. It
+// reports whether the request should be sent again with the secondary
+// key, failing over for cfg's cooldown once after_errors consecutive
+// responses were 429 or 529.
+func (f *keyFailover) Observe(cfg *FailoverConfig, status int, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if status != http.StatusTooManyRequests && status != statusOverloaded {
+		f.errors = 0
+		return false
+	}
+	f.errors++
+	if f.errors < cfg.AfterErrors {
+		return false
+	}
+	if !now.Before(f.until) {
+		f.failovers++
+		slog.Warn("Failing over to the secondary API key", "status", status, "consecutive_errors", f.errors, "cooldown_seconds", cfg.CooldownSeconds)
+	}
+	f.errors = 0
+	f.until = now.Add(time.Duration(cfg.CooldownSeconds) * time.Second)
+	return true
+}
+
+// UsedSecondary counts a request sent with the secondary key
+func (f *keyFailover) UsedSecondary() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secondaryRequests++
+}
+
+// WritePrometheus writes the failover metrics in the Prometheus text format
+func (f *keyFailover) WritePrometheus(w io.Writer, configured bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !configured && f.failovers == 0 {
+		return nil
+	}
+	active := 0
+	if time.Now().Before(f.until) {
+		active = 1
+	}
+	_, err := fmt.Fprintf(w, `# HELP creddy_anthropic_failover_active Whether requests are failing over to the secondary API key.
+# TYPE creddy_anthropic_failover_active gauge
+creddy_anthropic_failover_active %d
+# HELP creddy_anthropic_failovers_total Times sustained 429 or 529 responses made requests fail over to the secondary API key.
+# TYPE creddy_anthropic_failovers_total counter
+creddy_anthropic_failovers_total %d
+# HELP creddy_anthropic_secondary_key_requests_total Requests sent with the secondary API key.
+# TYPE creddy_anthropic_secondary_key_requests_total counter
+creddy_anthropic_secondary_key_requests_total %d
+`, active, f.failovers, f.secondaryRequests)
+	return err
+}
+
+// failoverConfig returns the failover settings, or nil if no secondary
+// key is configured
+func (p *AnthropicPlugin) failoverConfig() *FailoverConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.config == nil {
+		return nil
+	}
+	return p.config.Failover
+}
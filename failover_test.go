@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfigure_Failover(t *testing.T) {
+	plugin := newTestPlugin(t)
+	for _, tt := range []struct{ failover, wantErr string }{
+		{`{}`, "failover: api_key is required"},
+		{`{"api_key": "sk-ant-test"}`, "must differ"},
+		{`{"api_key": "sk-ant-secondary", "after_errors": -1}`, "must not be negative"},
+	} {
+		err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19595, "failover": `+tt.failover+`}`)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("failover %s: Configure() = %v, want an error containing %q", tt.failover, err, tt.wantErr)
+		}
+	}
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19595, "failover": {"api_key": "sk-ant-secondary"}}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if f := plugin.failoverConfig(); f.AfterErrors != 3 || f.CooldownSeconds != 60 {
+		t.Errorf("failover defaults = %+v, want after_errors 3 and cooldown_seconds 60", f)
+	}
+}
+
+func TestProxy_Failover(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19595, "audit_log_path": "` + auditPath + `", "admin_token": "admin-secret",
+		"failover": {"api_key": "sk-ant-secondary", "after_errors": 2},
+		"workspaces": [{"name": "prod", "api_key": "sk-ant-prod"}]}`
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("x-api-key"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("x-api-key") != "sk-ant-secondary" {
+			w.WriteHeader(statusOverloaded)
+			w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+			return
+		}
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	token := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	body := `{"model":"claude-haiku-4-5","max_tokens":50}`
+
+	status := func() int {
+		t.Helper()
+		resp := proxyRequest(t, srv, token.Value, body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// The first 529 is passed on; the second fails over, retrying on the
+	// secondary key, which later requests use directly
+	for i, want := range []int{statusOverloaded, http.StatusOK, http.StatusOK} {
+		if got := status(); got != want {
+			t.Errorf("request %d: status %d, want %d", i+1, got, want)
+		}
+	}
+	mu.Lock()
+	if got := strings.Join(keys, ","); got != "sk-ant-test,sk-ant-test,sk-ant-secondary,sk-ant-secondary" {
+		t.Errorf("upstream keys = %s", got)
+	}
+	keys = nil
+	mu.Unlock()
+
+	var upstreamKeys []string
+	for _, ev := range readAuditLog(t, auditPath) {
+		if ev.Event == AuditRequest {
+			upstreamKeys = append(upstreamKeys, ev.UpstreamKey)
+		}
+	}
+	if got := strings.Join(upstreamKeys, ","); got != "current,secondary,secondary" {
+		t.Errorf("audited upstream_key = %s", got)
+	}
+
+	var metrics bytes.Buffer
+	if err := plugin.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"creddy_anthropic_failover_active 1\n", "creddy_anthropic_failovers_total 1\n", "creddy_anthropic_secondary_key_requests_total 2\n"} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, metrics.String())
+		}
+	}
+
+	// Workspaces keep their own key
+	prod := issueToken(t, plugin, "agent-1", "anthropic:prod", 10*time.Minute)
+	resp := proxyRequest(t, srv, prod.Value, body)
+	resp.Body.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if resp.StatusCode != statusOverloaded || len(keys) != 1 || keys[0] != "sk-ant-prod" {
+		t.Errorf("workspace request: status %d, upstream keys %v", resp.StatusCode, keys)
+	}
+}
+
+func TestKeyFailover_Cooldown(t *testing.T) {
+	var f keyFailover
+	cfg := &FailoverConfig{AfterErrors: 2, CooldownSeconds: 60}
+	now := time.Now()
+	if f.Observe(cfg, http.StatusTooManyRequests, now) || f.Observe(cfg, http.StatusOK, now) || f.Observe(cfg, http.StatusTooManyRequests, now) {
+		t.Fatal("failed over before after_errors consecutive errors")
+	}
+	if !f.Observe(cfg, statusOverloaded, now) || !f.Active(now.Add(59*time.Second)) {
+		t.Fatal("did not fail over after after_errors consecutive errors")
+	}
+	if f.Active(now.Add(61 * time.Second)) {
+		t.Error("still failing over after the cooldown")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FallbackConfig is an ordered chain of upstreams serving Messages
+// requests while the ones before them are failing
+type FallbackConfig struct {
+	Chain           []*FallbackProvider `json:"chain"`            // Upstreams in order of preference
+	AfterErrors     int                 `json:"after_errors"`     // Consecutive 5xx responses or failed requests before an upstream is skipped (default 3)
+	CooldownSeconds int                 `json:"cooldown_seconds"` // How long an upstream is skipped before it is tried again (default 60)
+}
+
+// FallbackProvider is an upstream in the fallback chain
+type FallbackProvider struct {
+	Upstream      string            `json:"upstream"`        // anthropic, vertex, or the base URL of an Anthropic-compatible API
+	APIKey        string            `json:"api_key"`         // Key for a base URL (default: the token's workspace key)
+	APIKeyFile    string            `json:"api_key_file"`    // File holding the key, instead of api_key
+	APIKeyEnv     string            `json:"api_key_env"`     // Environment variable holding the key, instead of api_key
+	APIKeyKeyring string            `json:"api_key_keyring"` // OS keyring entry ("service/account") holding the key, instead of api_key
+	ModelIDs      map[string]string `json:"model_ids"`       // The upstream's names for models, by the name requested
+
+	// route sends requests to a base URL
+	route *UpstreamRoute
+}
+
+// setupFallback checks the fallback chain, applying defaults and reading
+// the keys of base URL upstreams
+func (cfg *AnthropicConfig) setupFallback(ctx context.Context) error {
+	f := cfg.Fallback
+	if f == nil {
+		return nil
+	}
+	if len(f.Chain) < 2 {
+		return errors.New("fallback: chain needs at least two upstreams")
+	}
+	seen := make(map[string]bool)
+	for i, provider := range f.Chain {
+		if provider == nil {
+			return fmt.Errorf("fallback: chain[%d]: must be an object", i)
+		}
+		var err error
+		provider.Upstream, provider.APIKey, err = cfg.setupUpstream(ctx, provider.Upstream, provider.APIKey, provider.APIKeyFile, provider.APIKeyEnv, provider.APIKeyKeyring)
+		if err != nil {
+			return fmt.Errorf("fallback: chain[%d]: %w", i, err)
+		}
+		if seen[provider.Upstream] {
+			return fmt.Errorf("fallback: chain[%d]: duplicate upstream %q", i, provider.Upstream)
+		}
+		seen[provider.Upstream] = true
+		if provider.Upstream != upstreamAnthropic && provider.Upstream != upstreamVertex {
+			provider.route = &UpstreamRoute{Upstream: provider.Upstream, APIKey: provider.APIKey}
+		}
+	}
+	if f.AfterErrors < 0 || f.CooldownSeconds < 0 {
+		return errors.New("fallback: after_errors and cooldown_seconds must not be negative")
+	}
+	if f.AfterErrors == 0 {
+		f.AfterErrors = 3
+	}
+	if f.CooldownSeconds == 0 {
+		f.CooldownSeconds = 60
+	}
+	return nil
+}
+
+// upstreamTarget is where a Messages request is sent: Anthropic if vertex
+// and route are nil, Vertex AI, or a base URL
+type upstreamTarget struct {
+	vertex *VertexConfig
+	route  *UpstreamRoute
+	// modelIDs renames the request's model for a fallback upstream
+	modelIDs map[string]string
+	// chain is the target's position in the fallback chain, or -1
+	chain int
+}
+
+// name identifies the target's upstream as routes and the fallback chain
+// do
+func (t upstreamTarget) name() string {
+	switch {
+	case t.vertex != nil:
+		return upstreamVertex
+	case t.route != nil:
+		return t.route.Upstream
+	}
+	return upstreamAnthropic
+}
+
+// backend is the target for logs and audit records, "" for Anthropic
+func (t upstreamTarget) backend() string {
+	if t.vertex == nil && t.route == nil {
+		return ""
+	}
+	return t.name()
+}
+
+// prepare returns the body of a Messages request for the target, and its
+// URL if the target is Vertex AI
+func (t upstreamTarget) prepare(body []byte) (string, []byte, error) {
+	if len(t.modelIDs) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return "", nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		var model string
+		json.Unmarshal(fields["model"], &model)
+		if id, ok := t.modelIDs[model]; ok {
+			fields["model"], _ = json.Marshal(id)
+			var err error
+			if body, err = json.Marshal(fields); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	if t.vertex != nil {
+		return t.vertex.route(body)
+	}
+	return "", body, nil
+}
+
+// fallbackTarget returns the upstream at position i of the fallback chain
+func (cfg *AnthropicConfig) fallbackTarget(i int) upstreamTarget {
+	provider := cfg.Fallback.Chain[i]
+	t := upstreamTarget{route: provider.route, modelIDs: provider.ModelIDs, chain: i}
+	if provider.Upstream == upstreamVertex {
+		t.vertex = cfg.Vertex
+	}
+	return t
+}
+
+// withFallback places a routed target in the fallback chain, moving it
+// past upstreams that are being skipped. Targets outside the chain are
+// returned as they are.
+func (p *AnthropicPlugin) withFallback(cfg *AnthropicConfig, t upstreamTarget, now time.Time) upstreamTarget {
+	t.chain = -1
+	if cfg.Fallback == nil {
+		return t
+	}
+	for i, provider := range cfg.Fallback.Chain {
+		if provider.Upstream != t.name() {
+			continue
+		}
+		t.chain = i
+		if p.fallback.Healthy(provider.Upstream, now) {
+			return t
+		}
+		if next, ok := p.nextFallback(cfg, i, now); ok {
+			p.fallback.FellBack()
+			return next
+		}
+		return t
+	}
+	return t
+}
+
+// nextFallback returns the first upstream after position i of the
+// fallback chain that is not being skipped
+func (p *AnthropicPlugin) nextFallback(cfg *AnthropicConfig, i int, now time.Time) (upstreamTarget, bool) {
+	for j := i + 1; j < len(cfg.Fallback.Chain); j++ {
+		if p.fallback.Healthy(cfg.Fallback.Chain[j].Upstream, now) {
+			return cfg.fallbackTarget(j), true
+		}
+	}
+	return upstreamTarget{}, false
+}
+
+// ObserveFallback records how t answered a request. It returns the
+// upstream to send the request to instead if t has now failed after_errors
+// times in a row and a later upstream in the chain is not being skipped.
+func (p *AnthropicPlugin) ObserveFallback(t upstreamTarget, failed bool) (upstreamTarget, bool) {
+	p.mu.RLock()
+	cfg := p.config
+	p.mu.RUnlock()
+	if cfg == nil || cfg.Fallback == nil || t.chain < 0 || t.chain >= len(cfg.Fallback.Chain) {
+		return upstreamTarget{}, false
+	}
+	now := time.Now()
+	if !p.fallback.Observe(cfg.Fallback, t.name(), failed, now) {
+		return upstreamTarget{}, false
+	}
+	return p.nextFallback(cfg, t.chain, now)
+}
+
+// fallbackFailed reports whether a response means its upstream is failing
+func fallbackFailed(status int) bool {
+	return status >= http.StatusInternalServerError
+}
+
+// fallbackHealth follows the failures of the upstreams in the fallback
+// chain, deciding which are skipped
+type fallbackHealth struct {
+	mu sync.Mutex
+	// errors counts consecutive failures by upstream
+	errors map[string]int
+	// until is when skipped upstreams are tried again
+	until map[string]time.Time
+	// fallbacks is counted for /metrics
+	fallbacks int64
+}
+
+// Healthy reports whether upstream is not being skipped at now
+func (h *fallbackHealth) Healthy(upstream string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !now.Before(h.until[upstream])
+}
+
+// Observe records whether a request to upstream failed. It reports
+// whether upstream is skipped for cfg's cooldown, once after_errors
+// consecutive requests failed.
+func (h *fallbackHealth) Observe(cfg *FallbackConfig, upstream string, failed bool, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.errors == nil {
+		h.errors, h.until = make(map[string]int), make(map[string]time.Time)
+	}
+	if !failed {
+		delete(h.errors, upstream)
+		return false
+	}
+	h.errors[upstream]++
+	if h.errors[upstream] < cfg.AfterErrors {
+		return false
+	}
+	if !now.Before(h.until[upstream]) {
+		slog.Warn("Upstream is failing, falling back", "upstream", upstream, "consecutive_errors", h.errors[upstream], "cooldown_seconds", cfg.CooldownSeconds)
+	}
+	delete(h.errors, upstream)
+	h.until[upstream] = now.Add(time.Duration(cfg.CooldownSeconds) * time.Second)
+	return true
+}
+
+// FellBack counts a request sent to a later upstream in the chain
+func (h *fallbackHealth) FellBack() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fallbacks++
+}
+
+// WritePrometheus writes the health of cfg's upstreams in the Prometheus
+// text format
+func (h *fallbackHealth) WritePrometheus(w io.Writer, cfg *FallbackConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	upstreams := make([]string, len(cfg.Chain))
+	for i, provider := range cfg.Chain {
+		upstreams[i] = provider.Upstream
+	}
+	sort.Strings(upstreams)
+	var b strings.Builder
+	b.WriteString("# HELP creddy_anthropic_upstream_healthy Whether the fallback chain sends requests to the upstream.\n# TYPE creddy_anthropic_upstream_healthy gauge\n")
+	now := time.Now()
+	for _, upstream := range upstreams {
+		healthy := 1
+		if now.Before(h.until[upstream]) {
+			healthy = 0
+		}
+		fmt.Fprintf(&b, "creddy_anthropic_upstream_healthy{upstream=%q} %d\n", upstream, healthy)
+	}
+	fmt.Fprintf(&b, "# HELP creddy_anthropic_fallback_requests_total Requests sent to a later upstream in the fallback chain after the one before failed.\n# TYPE creddy_anthropic_fallback_requests_total counter\ncreddy_anthropic_fallback_requests_total %d\n", h.fallbacks)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fallbackConfig returns the fallback chain settings, or nil if none are
+// configured
+func (p *AnthropicPlugin) fallbackConfig() *FallbackConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.config == nil {
+		return nil
+	}
+	return p.config.Fallback
+}
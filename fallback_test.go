@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfigure_Fallback(t *testing.T) {
+	plugin := newTestPlugin(t)
+	for _, tt := range []struct{ fallback, wantErr string }{
+		{`{"chain": [{"upstream": "anthropic"}]}`, "at least two upstreams"},
+		{`{"chain": [{"upstream": "anthropic"}, {"upstream": "vertex"}]}`, "chain[1]: upstream vertex requires vertex settings"},
+		{`{"chain": [{"upstream": "anthropic"}, {"upstream": "https://gateway.internal/"}, {"upstream": "https://gateway.internal"}]}`, "duplicate upstream"},
+		{`{"chain": [{"upstream": "anthropic", "api_key": "sk-other"}, {"upstream": "https://gateway.internal"}]}`, "only used with a base URL"},
+		{`{"chain": [{"upstream": "anthropic"}, {"upstream": "https://gateway.internal"}], "after_errors": -1}`, "must not be negative"},
+	} {
+		err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19598, "fallback": `+tt.fallback+`}`)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("fallback %s: Configure() = %v, want an error containing %q", tt.fallback, err, tt.wantErr)
+		}
+	}
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19598, "fallback": {"chain": [{"upstream": "anthropic"}, {"upstream": "https://gateway.internal"}]}}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if f := plugin.fallbackConfig(); f.AfterErrors != 3 || f.CooldownSeconds != 60 {
+		t.Errorf("fallback defaults = %+v, want after_errors 3 and cooldown_seconds 60", f)
+	}
+}
+
+func TestProxy_Fallback(t *testing.T) {
+	type gatewayRequest struct{ key, model string }
+	var mu sync.Mutex
+	var anthropicRequests int
+	var gatewayRequests []gatewayRequest
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		mu.Lock()
+		gatewayRequests = append(gatewayRequests, gatewayRequest{r.Header.Get("x-api-key"), body.Model})
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-sonnet-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer gateway.Close()
+
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	config, _ := json.Marshal(map[string]any{
+		"api_key":        "sk-ant-test",
+		"proxy_port":     19598,
+		"audit_log_path": auditPath,
+		"fallback": map[string]any{
+			"chain": []map[string]any{
+				{"upstream": "anthropic"},
+				{"upstream": gateway.URL, "api_key": "sk-gateway", "model_ids": map[string]string{"claude-sonnet-4-5": "anthropic.claude-sonnet-4-5"}},
+			},
+			"after_errors": 2,
+		},
+	})
+	plugin, srv, _ := newTestProxyWithUpstream(t, string(config), func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		anthropicRequests++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusOverloaded)
+		w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+	})
+	token := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	// The first 529 is passed on; the second falls back, sending the
+	// request again to the gateway, which later requests go to directly
+	for i, want := range []int{statusOverloaded, http.StatusOK, http.StatusOK} {
+		resp := proxyRequest(t, srv, token.Value, `{"model":"claude-sonnet-4-5","max_tokens":50}`)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	mu.Lock()
+	if anthropicRequests != 2 || len(gatewayRequests) != 2 {
+		t.Errorf("anthropic requests %d, gateway requests %d, want 2 and 2", anthropicRequests, len(gatewayRequests))
+	}
+	for _, req := range gatewayRequests {
+		if req != (gatewayRequest{"sk-gateway", "anthropic.claude-sonnet-4-5"}) {
+			t.Errorf("gateway request = %+v, want the gateway's key and model ID", req)
+		}
+	}
+	mu.Unlock()
+
+	var backends []string
+	for _, ev := range readAuditLog(t, auditPath) {
+		if ev.Event == AuditRequest {
+			backends = append(backends, ev.Backend)
+		}
+	}
+	if got := strings.Join(backends, ","); got != ","+gateway.URL+","+gateway.URL {
+		t.Errorf("audited backends = %q", got)
+	}
+
+	var metrics bytes.Buffer
+	if err := plugin.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`creddy_anthropic_upstream_healthy{upstream="anthropic"} 0`, `creddy_anthropic_upstream_healthy{upstream="` + gateway.URL + `"} 1`, "creddy_anthropic_fallback_requests_total 2\n"} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestFallbackHealth_Cooldown(t *testing.T) {
+	var h fallbackHealth
+	cfg := &FallbackConfig{AfterErrors: 2, CooldownSeconds: 60}
+	now := time.Now()
+	if h.Observe(cfg, "anthropic", true, now) || h.Observe(cfg, "anthropic", false, now) || h.Observe(cfg, "anthropic", true, now) {
+		t.Fatal("skipped an upstream before after_errors consecutive failures")
+	}
+	if h.Observe(cfg, "vertex", true, now) {
+		t.Fatal("failures of one upstream counted for another")
+	}
+	if !h.Observe(cfg, "anthropic", true, now) || h.Healthy("anthropic", now.Add(59*time.Second)) {
+		t.Fatal("did not skip an upstream after after_errors consecutive failures")
+	}
+	if !h.Healthy("anthropic", now.Add(61*time.Second)) || !h.Healthy("vertex", now) {
+		t.Error("upstream still skipped after the cooldown")
+	}
+}
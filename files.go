@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// filesPath is the Files API; files are addressed below it as
+// /v1/files/<id>[/content]
+const filesPath = "/v1/files"
+
+// referencesFiles reports whether requests to urlPath may refer to
+// uploaded files by ID, e.g. as document or image sources
+func referencesFiles(urlPath string) bool {
+	return urlPath == "/v1/messages" || urlPath == countTokensPath || urlPath == batchesPath
+}
+
+// fileReferences returns the IDs in "file_id" fields at any depth of a
+// JSON request body
+func fileReferences(body []byte) []string {
+	if !bytes.Contains(body, []byte(`"file_id"`)) {
+		return nil
+	}
+	var doc any
+	if json.Unmarshal(body, &doc) != nil {
+		return nil
+	}
+	var ids []string
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for key, child := range v {
+				if id, ok := child.(string); ok && key == "file_id" {
+					ids = append(ids, id)
+				}
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(doc)
+	return ids
+}
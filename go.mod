@@ -2,9 +2,18 @@ module github.com/getcreddy/creddy-anthropic
 
 go 1.24.0
 
-require github.com/getcreddy/creddy-plugin-sdk v0.0.0-20260223035836-0cafb6469018
+require (
+	github.com/alicebob/miniredis/v2 v2.35.0
+	github.com/getcreddy/creddy-plugin-sdk v0.0.0-20260223035836-0cafb6469018
+	github.com/redis/go-redis/v9 v9.7.3
+	go.etcd.io/bbolt v1.4.3
+	google.golang.org/grpc v1.79.1
+	google.golang.org/protobuf v1.36.11
+)
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/fatih/color v1.13.0 // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/hashicorp/go-hclog v1.6.3 // indirect
@@ -13,10 +22,9 @@ require (
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/oklog/run v1.1.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	golang.org/x/net v0.48.0 // indirect
 	golang.org/x/sys v0.39.0 // indirect
 	golang.org/x/text v0.32.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251202230838-ff82c1b0f217 // indirect
-	google.golang.org/grpc v1.79.1 // indirect
-	google.golang.org/protobuf v1.36.11 // indirect
 )
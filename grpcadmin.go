@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/getcreddy/creddy-anthropic/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcAdmin serves the admin API over gRPC on admin_grpc_listen, with the
+// same operations and auditing as the HTTP admin endpoints
+type grpcAdmin struct {
+	adminpb.UnimplementedAdminServer
+	plugin *AnthropicPlugin
+}
+
+// newGRPCAdminServer returns a gRPC server for p's admin API
+func newGRPCAdminServer(p *AnthropicPlugin) *grpc.Server {
+	admin := &grpcAdmin{plugin: p}
+	srv := grpc.NewServer(
+		grpc.Creds(adminCredentials{plugin: p}),
+		grpc.UnaryInterceptor(admin.authenticate),
+	)
+	adminpb.RegisterAdminServer(srv, admin)
+	return srv
+}
+
+// stopGRPC stops srv once its calls in flight finish, or cuts them off
+// when ctx is done
+func stopGRPC(ctx context.Context, srv *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		return ctx.Err()
+	}
+}
+
+// adminCredentials secures gRPC admin connections with TLS as currently
+// configured, like tlsListener, so reloading the configuration renews
+// certificates without rebinding
+type adminCredentials struct {
+	plugin *AnthropicPlugin
+}
+
+func (c adminCredentials) current() credentials.TransportCredentials {
+	if cfg := c.plugin.AdminTLSConfig(); cfg != nil {
+		return credentials.NewTLS(cfg)
+	}
+	return insecure.NewCredentials()
+}
+
+func (c adminCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.current().ServerHandshake(conn)
+}
+
+func (c adminCredentials) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("admin credentials are server-side only")
+}
+
+func (c adminCredentials) Info() credentials.ProtocolInfo {
+	return c.current().Info()
+}
+
+func (c adminCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (c adminCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+// authenticate admits calls carrying the admin token, as x-api-key or
+// Bearer authorization metadata, or made with a verified client certificate
+func (s *grpcAdmin) authenticate(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			return handler(ctx, req)
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		token = v[0]
+	} else if v := md.Get("authorization"); len(v) > 0 {
+		token, _ = strings.CutPrefix(v[0], "Bearer ")
+	}
+	if !s.plugin.IsAdminToken(token) {
+		return nil, status.Error(codes.Unauthenticated, "admin token required")
+	}
+	return handler(ctx, req)
+}
+
+// grpcClientIP returns the address a gRPC call came from, for auditing
+func grpcClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return ""
+}
+
+// timestamp converts t, leaving zero times unset
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func (s *grpcAdmin) ListTokens(_ context.Context, req *adminpb.ListTokensRequest) (*adminpb.ListTokensResponse, error) {
+	filter := TokenFilter{AgentID: req.AgentId, Scope: req.Scope}
+	if req.ExpiringWithin != nil {
+		within := req.ExpiringWithin.AsDuration()
+		if within <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "expiring_within must be positive")
+		}
+		filter.ExpiresBefore = time.Now().Add(within)
+	}
+	resp := &adminpb.ListTokensResponse{}
+	for _, info := range s.plugin.ListTokens(filter) {
+		token := &adminpb.Token{
+			Id:           info.ID,
+			AgentId:      info.AgentID,
+			AgentName:    info.AgentName,
+			Scope:        info.Scope,
+			ClientIp:     info.ClientIP,
+			CreatedAt:    timestamp(info.CreatedAt),
+			ExpiresAt:    timestamp(info.ExpiresAt),
+			LastUsedAt:   timestamp(info.LastUsedAt),
+			RequestCount: info.RequestCount,
+			MaxUses:      info.MaxUses,
+			SpentUsd:     info.SpentUSD,
+		}
+		if scope, err := s.plugin.ResolveScope(info.Scope); err == nil {
+			token.BudgetUsd = scope.BudgetUSD
+		}
+		resp.Tokens = append(resp.Tokens, token)
+	}
+	return resp, nil
+}
+
+func (s *grpcAdmin) IssueToken(ctx context.Context, req *adminpb.IssueTokenRequest) (*adminpb.IssueTokenResponse, error) {
+	if req.AgentId == "" || req.Scope == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id and scope are required")
+	}
+	ttl := req.Ttl.AsDuration()
+	if ttl < minTokenTTL || ttl > maxTokenTTL {
+		return nil, status.Errorf(codes.InvalidArgument, "ttl must be between %s and %s", minTokenTTL, maxTokenTTL)
+	}
+	cred, err := s.plugin.issueAdminToken(ctx, issueRequest{
+		AgentID:   req.AgentId,
+		AgentName: req.AgentName,
+		Scope:     req.Scope,
+		MaxUses:   req.MaxUses,
+	}, ttl)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &adminpb.IssueTokenResponse{
+		Token:          cred.Value,
+		Id:             cred.ExternalID,
+		AgentId:        req.AgentId,
+		Scope:          cred.Metadata["scope"],
+		RequestedScope: cred.Metadata["requested_scope"],
+		ExpiresAt:      timestamppb.New(cred.ExpiresAt),
+	}, nil
+}
+
+func (s *grpcAdmin) RevokeToken(_ context.Context, req *adminpb.RevokeTokenRequest) (*adminpb.RevokeResponse, error) {
+	if req.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is required")
+	}
+	return s.revoke(revokeRequest{Token: req.Token})
+}
+
+func (s *grpcAdmin) RevokeAgentTokens(_ context.Context, req *adminpb.RevokeAgentTokensRequest) (*adminpb.RevokeResponse, error) {
+	if req.AgentId == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	return s.revoke(revokeRequest{AgentID: req.AgentId})
+}
+
+func (s *grpcAdmin) revoke(req revokeRequest) (*adminpb.RevokeResponse, error) {
+	revoked, err := s.plugin.adminRevoke(req)
+	if errors.Is(err, ErrBulkRevokeUnsupported) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		slog.Error("Token revocation failed", "error", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	return &adminpb.RevokeResponse{Revoked: int32(revoked)}, nil
+}
+
+func (s *grpcAdmin) GetUsage(_ context.Context, req *adminpb.GetUsageRequest) (*adminpb.GetUsageResponse, error) {
+	var start, end time.Time
+	if req.Start != nil {
+		start = req.Start.AsTime()
+	}
+	if req.End != nil {
+		end = req.End.AsTime()
+	}
+	var bucket time.Duration
+	switch req.Bucket {
+	case adminpb.Bucket_BUCKET_UNSPECIFIED:
+	case adminpb.Bucket_BUCKET_HOUR:
+		bucket = time.Hour
+	case adminpb.Bucket_BUCKET_DAY:
+		bucket = 24 * time.Hour
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown bucket %v", req.Bucket)
+	}
+
+	var total SpendTotals
+	resp := &adminpb.GetUsageResponse{}
+	for _, row := range s.plugin.SpendRows(start, end, bucket) {
+		total.Requests += row.Requests
+		total.InputTokens += row.InputTokens
+		total.OutputTokens += row.OutputTokens
+		total.CacheCreationInputTokens += row.CacheCreationInputTokens
+		total.CacheReadInputTokens += row.CacheReadInputTokens
+		total.CostUSD += row.CostUSD
+		resp.Rows = append(resp.Rows, &adminpb.SpendRow{
+			Time:    timestamp(row.Time),
+			AgentId: row.AgentID,
+			Model:   row.Model,
+			Totals:  spendTotalsProto(row.SpendTotals),
+		})
+	}
+	resp.Total = spendTotalsProto(total)
+	return resp, nil
+}
+
+func spendTotalsProto(t SpendTotals) *adminpb.SpendTotals {
+	return &adminpb.SpendTotals{
+		Requests:                 t.Requests,
+		InputTokens:              t.InputTokens,
+		OutputTokens:             t.OutputTokens,
+		CacheCreationInputTokens: t.CacheCreationInputTokens,
+		CacheReadInputTokens:     t.CacheReadInputTokens,
+		CostUsd:                  t.CostUSD,
+	}
+}
+
+func (s *grpcAdmin) GetAgentPolicy(_ context.Context, req *adminpb.GetAgentPolicyRequest) (*adminpb.AgentPolicy, error) {
+	if req.AgentId == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	policy := s.plugin.AgentPolicy(req.AgentId)
+	if policy == nil {
+		return nil, status.Errorf(codes.NotFound, "agent %s has no policy override", req.AgentId)
+	}
+	return agentPolicyProto(policy), nil
+}
+
+// SetAgentPolicy replaces an agent's policy override, as PUT
+// /admin/agents/{agent_id}/policy does; an empty policy removes it
+func (s *grpcAdmin) SetAgentPolicy(ctx context.Context, req *adminpb.SetAgentPolicyRequest) (*adminpb.AgentPolicy, error) {
+	if req.AgentId == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	var policy AgentPolicy
+	if pb := req.Policy; pb != nil {
+		if pb.RequestsPerMinute != nil {
+			rpm := int(*pb.RequestsPerMinute)
+			policy.RequestsPerMinute = &rpm
+		}
+		if pb.BudgetUsd != nil {
+			budget := *pb.BudgetUsd
+			if budget < 0 || math.IsInf(budget, 0) || math.IsNaN(budget) {
+				return nil, status.Error(codes.InvalidArgument, "budget_usd must be a non-negative number of dollars")
+			}
+			policy.BudgetUSD = (*usdAmount)(&budget)
+		}
+		policy.Models = pb.Models
+	}
+	if err := policy.validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	policy.UpdatedAt = time.Now().UTC()
+	stored := &policy
+	if policy.empty() {
+		stored = nil
+	}
+	if err := s.setAgentPolicy(ctx, req.AgentId, stored); err != nil {
+		return nil, err
+	}
+	return agentPolicyProto(&policy), nil
+}
+
+func (s *grpcAdmin) DeleteAgentPolicy(ctx context.Context, req *adminpb.DeleteAgentPolicyRequest) (*adminpb.DeleteAgentPolicyResponse, error) {
+	if req.AgentId == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	if err := s.setAgentPolicy(ctx, req.AgentId, nil); err != nil {
+		return nil, err
+	}
+	return &adminpb.DeleteAgentPolicyResponse{}, nil
+}
+
+// setAgentPolicy stores and audits an admin's change to an agent's policy
+func (s *grpcAdmin) setAgentPolicy(ctx context.Context, agentID string, policy *AgentPolicy) error {
+	if err := s.plugin.SetAgentPolicy(agentID, policy); err != nil {
+		slog.Error("Failed to store agent policy", "agent", agentID, "error", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+	s.plugin.auditLog(AuditEvent{
+		Event:    AuditAgentPolicy,
+		AgentID:  agentID,
+		Caller:   "admin",
+		ClientIP: grpcClientIP(ctx),
+	})
+	return nil
+}
+
+func agentPolicyProto(policy *AgentPolicy) *adminpb.AgentPolicy {
+	pb := &adminpb.AgentPolicy{
+		Models:    policy.Models,
+		UpdatedAt: timestamp(policy.UpdatedAt),
+	}
+	if policy.RequestsPerMinute != nil {
+		rpm := int32(min(*policy.RequestsPerMinute, math.MaxInt32))
+		pb.RequestsPerMinute = &rpm
+	}
+	if policy.BudgetUSD != nil {
+		budget := float64(*policy.BudgetUSD)
+		pb.BudgetUsd = &budget
+	}
+	return pb
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getcreddy/creddy-anthropic/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestGRPCAdmin(t *testing.T) {
+	plugin := newTestPlugin(t)
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19592, "listen_addr": "127.0.0.1", "admin_token": "admin-secret",
+		"admin_grpc_listen": "127.0.0.1:19593"}`
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	t.Cleanup(func() { plugin.Shutdown(context.Background()) })
+
+	conn, err := grpc.NewClient("127.0.0.1:19593", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := adminpb.NewAdminClient(conn)
+
+	ctx := context.Background()
+	if _, err := client.ListTokens(ctx, &adminpb.ListTokensRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("ListTokens() without the admin token: %v, want Unauthenticated", err)
+	}
+	bad := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer wrong")
+	if _, err := client.ListTokens(bad, &adminpb.ListTokensRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("ListTokens() with a wrong admin token: %v, want Unauthenticated", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", "admin-secret")
+
+	if _, err := client.IssueToken(ctx, &adminpb.IssueTokenRequest{AgentId: "agent-1", Scope: "anthropic", Ttl: durationpb.New(time.Second)}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("IssueToken() with a 1s TTL: %v, want InvalidArgument", err)
+	}
+	issued, err := client.IssueToken(ctx, &adminpb.IssueTokenRequest{AgentId: "agent-1", Scope: "anthropic", Ttl: durationpb.New(10 * time.Minute), MaxUses: 5})
+	if err != nil {
+		t.Fatalf("IssueToken() error: %v", err)
+	}
+	if _, ok := plugin.ValidateToken(issued.Token); !ok || issued.Scope != "anthropic" || issued.ExpiresAt.AsTime().Before(time.Now().Add(9*time.Minute)) {
+		t.Errorf("IssueToken() = %+v", issued)
+	}
+
+	listed, err := client.ListTokens(ctx, &adminpb.ListTokensRequest{AgentId: "agent-1"})
+	if err != nil {
+		t.Fatalf("ListTokens() error: %v", err)
+	}
+	if len(listed.Tokens) != 1 || listed.Tokens[0].Id != issued.Id || listed.Tokens[0].MaxUses != 5 || listed.Tokens[0].AgentName != "agent-1" {
+		t.Errorf("ListTokens() = %+v", listed.Tokens)
+	}
+
+	rpm := int32(30)
+	set, err := client.SetAgentPolicy(ctx, &adminpb.SetAgentPolicyRequest{AgentId: "agent-1", Policy: &adminpb.AgentPolicy{RequestsPerMinute: &rpm, Models: []string{"claude-haiku-*"}}})
+	if err != nil {
+		t.Fatalf("SetAgentPolicy() error: %v", err)
+	}
+	if set.UpdatedAt == nil || plugin.AgentRequestsPerMinute("agent-1") != 30 {
+		t.Errorf("SetAgentPolicy() = %+v, requests per minute %d", set, plugin.AgentRequestsPerMinute("agent-1"))
+	}
+	got, err := client.GetAgentPolicy(ctx, &adminpb.GetAgentPolicyRequest{AgentId: "agent-1"})
+	if err != nil || got.GetRequestsPerMinute() != 30 || len(got.Models) != 1 || got.BudgetUsd != nil {
+		t.Errorf("GetAgentPolicy() = %+v, %v", got, err)
+	}
+	if _, err := client.SetAgentPolicy(ctx, &adminpb.SetAgentPolicyRequest{AgentId: "agent-1", Policy: &adminpb.AgentPolicy{Models: []string{"["}}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SetAgentPolicy() with a bad model pattern: %v, want InvalidArgument", err)
+	}
+	if _, err := client.DeleteAgentPolicy(ctx, &adminpb.DeleteAgentPolicyRequest{AgentId: "agent-1"}); err != nil {
+		t.Fatalf("DeleteAgentPolicy() error: %v", err)
+	}
+	if _, err := client.GetAgentPolicy(ctx, &adminpb.GetAgentPolicyRequest{AgentId: "agent-1"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetAgentPolicy() after DeleteAgentPolicy(): %v, want NotFound", err)
+	}
+
+	usage, err := client.GetUsage(ctx, &adminpb.GetUsageRequest{Bucket: adminpb.Bucket_BUCKET_HOUR})
+	if err != nil || usage.Total == nil || len(usage.Rows) != 0 {
+		t.Errorf("GetUsage() = %+v, %v", usage, err)
+	}
+
+	leaked, err := client.IssueToken(ctx, &adminpb.IssueTokenRequest{AgentId: "agent-2", Scope: "anthropic", Ttl: durationpb.New(10 * time.Minute)})
+	if err != nil {
+		t.Fatalf("IssueToken() error: %v", err)
+	}
+	if _, err := client.RevokeToken(context.Background(), &adminpb.RevokeTokenRequest{Token: leaked.Token}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("RevokeToken() without the admin token: %v, want Unauthenticated", err)
+	}
+	if _, ok := plugin.ValidateToken(leaked.Token); !ok {
+		t.Fatal("unauthenticated RevokeToken() revoked the token")
+	}
+	if _, err := client.RevokeToken(ctx, &adminpb.RevokeTokenRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("RevokeToken() without a token: %v, want InvalidArgument", err)
+	}
+	if revoked, err := client.RevokeToken(ctx, &adminpb.RevokeTokenRequest{Token: "crd_unknown"}); err != nil || revoked.Revoked != 0 {
+		t.Errorf("RevokeToken() of an unknown token = %+v, %v; want 0 revoked", revoked, err)
+	}
+	if revoked, err := client.RevokeToken(ctx, &adminpb.RevokeTokenRequest{Token: leaked.Token}); err != nil || revoked.Revoked != 1 {
+		t.Fatalf("RevokeToken() = %+v, %v", revoked, err)
+	}
+	if _, ok := plugin.ValidateToken(leaked.Token); ok {
+		t.Error("token still valid after RevokeToken()")
+	}
+
+	revoked, err := client.RevokeAgentTokens(ctx, &adminpb.RevokeAgentTokensRequest{AgentId: "agent-1"})
+	if err != nil || revoked.Revoked != 1 {
+		t.Fatalf("RevokeAgentTokens() = %+v, %v", revoked, err)
+	}
+	if _, ok := plugin.ValidateToken(issued.Token); ok {
+		t.Error("token still valid after RevokeAgentTokens()")
+	}
+}
+
+func TestGRPCAdmin_UnixSocketMTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "server", ca, caKey)
+	writeTestCert(t, dir, "client", ca, caKey)
+	socket := filepath.Join(dir, "admin-grpc.sock")
+
+	plugin := newTestPlugin(t)
+	config, _ := json.Marshal(map[string]any{
+		"api_key":              "sk-ant-test",
+		"proxy_port":           19594,
+		"listen_addr":          "127.0.0.1",
+		"admin_grpc_listen":    "unix:" + socket,
+		"admin_tls_cert_file":  filepath.Join(dir, "server.pem"),
+		"admin_tls_key_file":   filepath.Join(dir, "server-key.pem"),
+		"admin_client_ca_file": filepath.Join(dir, "ca.pem"),
+	})
+	if err := plugin.Configure(context.Background(), string(config)); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	t.Cleanup(func() { plugin.Shutdown(context.Background()) })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(certs ...tls.Certificate) adminpb.AdminClient {
+		creds := credentials.NewTLS(&tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certs})
+		conn, err := grpc.NewClient("unix:"+socket, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return adminpb.NewAdminClient(conn)
+	}
+
+	if _, err := dial(clientCert).ListTokens(context.Background(), &adminpb.ListTokensRequest{}); err != nil {
+		t.Errorf("ListTokens() with a client certificate: %v", err)
+	}
+	if _, err := dial().ListTokens(context.Background(), &adminpb.ListTokensRequest{}); err == nil {
+		t.Error("ListTokens() without a client certificate should fail the handshake")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders are the client request headers sent on to Anthropic.
+// Others, among them X-Forwarded-*, Via, and anthropic-* headers but
+// these, are dropped so clients cannot pass claims the proxy has not
+// made through it. Accept-Encoding is dropped too: responses are parsed
+// for usage, quotas, and stream limits, so the transport negotiates
+// compression itself and hands them on decompressed.
+var forwardedHeaders = map[string]bool{
+	"Accept":            true,
+	"Anthropic-Beta":    true,
+	"Anthropic-Version": true,
+	"Content-Type":      true,
+	"User-Agent":        true,
+}
+
+// stainlessHeaderPrefix starts the headers the Anthropic SDKs describe
+// themselves and their retries with
+const stainlessHeaderPrefix = "X-Stainless-"
+
+// unforwardableHeaders carry the client's credential or the proxy's own
+// claims, or belong to the client's connection rather than the request,
+// so forward_headers cannot name them. Nor can it name Accept-Encoding,
+// which would keep responses compressed past the proxy's accounting.
+var unforwardableHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Authorization":     true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Forwarded":         true,
+	"Host":              true,
+	"Te":                true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Via":               true,
+	"X-Api-Key":         true,
+}
+
+// setupForwardHeaders checks forward_headers, canonicalizing the names and
+// dropping those forwarded anyway, which would otherwise be sent twice
+func (cfg *AnthropicConfig) setupForwardHeaders() error {
+	names := cfg.ForwardHeaders[:0]
+	seen := make(map[string]bool)
+	for _, name := range cfg.ForwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if unforwardableHeaders[name] || strings.HasPrefix(name, "X-Forwarded-") {
+			return fmt.Errorf("forward_headers: %s cannot be forwarded", name)
+		}
+		if seen[name] || forwardedHeaders[name] || strings.HasPrefix(name, stainlessHeaderPrefix) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	cfg.ForwardHeaders = names
+	return nil
+}
+
+// copyUpstreamHeaders copies the headers of the client request r that are
+// forwarded, by default or as extra names, to h, and adds a Forwarded
+// header naming the client, at clientIP, and the protocol it used
+func copyUpstreamHeaders(h http.Header, r *http.Request, extra []string, clientIP string) {
+	for k, vv := range r.Header {
+		k = http.CanonicalHeaderKey(k)
+		if !forwardedHeaders[k] && !strings.HasPrefix(k, stainlessHeaderPrefix) {
+			continue
+		}
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+	for _, k := range extra {
+		for _, v := range r.Header.Values(k) {
+			h.Add(k, v)
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	h.Set("Forwarded", fmt.Sprintf("for=%s;proto=%s", forwardedNode(clientIP), proto))
+}
+
+// forwardedNode formats a client address as a Forwarded header node
+// (RFC 7239), in which IPv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	addr := net.ParseIP(ip)
+	switch {
+	case addr == nil:
+		return "unknown"
+	case addr.To4() == nil:
+		return `"[` + addr.String() + `]"`
+	default:
+		return addr.String()
+	}
+}
+
+// ForwardHeaders returns the client request headers forwarded upstream
+// besides the default ones
+func (p *AnthropicPlugin) ForwardHeaders() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.config == nil {
+		return nil
+	}
+	return p.config.ForwardHeaders
+}
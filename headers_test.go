@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_ForwardedHeaders(t *testing.T) {
+	var got http.Header
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19604, "trusted_proxies": ["127.0.0.1"], "forward_headers": ["x-trace-id", "content-type", "X-Stainless-Retry-Count", "X-TRACE-ID"]}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Clone()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+		})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(`{"model":"claude-haiku-4-5","max_tokens":10}`))
+	for k, v := range map[string]string{
+		"x-api-key":                    cred.Value,
+		"Content-Type":                 "application/json",
+		"anthropic-beta":               "prompt-caching-2024-07-31",
+		"X-Stainless-Retry-Count":      "1",
+		"X-Trace-Id":                   "trace-1",
+		"X-Forwarded-For":              "2001:db8::7",
+		"X-Forwarded-Host":             "api.anthropic.com",
+		"Via":                          "1.1 attacker",
+		"Forwarded":                    "for=10.0.0.1",
+		"Anthropic-Organization-Id":    "org-other",
+		"X-Internal-Smuggled-Override": "1",
+	} {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+
+	for k, want := range map[string]string{
+		"Content-Type":            "application/json",
+		"Anthropic-Beta":          "prompt-caching-2024-07-31",
+		"X-Stainless-Retry-Count": "1",
+		"X-Trace-Id":              "trace-1",
+		"X-Api-Key":               "sk-ant-test",
+		// The client address comes from the trusted proxy's X-Forwarded-For
+		"Forwarded": `for="[2001:db8::7]";proto=http`,
+	} {
+		if got.Get(k) != want {
+			t.Errorf("upstream %s = %q, want %q", k, got.Get(k), want)
+		}
+	}
+	// Naming a header forwarded anyway does not send it twice
+	for _, k := range []string{"Content-Type", "X-Stainless-Retry-Count", "X-Trace-Id"} {
+		if n := len(got.Values(k)); n != 1 {
+			t.Errorf("upstream %s sent %d times, want once", k, n)
+		}
+	}
+	for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Host", "Via", "Anthropic-Organization-Id", "X-Internal-Smuggled-Override"} {
+		if v := got.Get(k); v != "" {
+			t.Errorf("upstream %s = %q, want it stripped", k, v)
+		}
+	}
+}
+
+func TestConfigure_ForwardHeaders(t *testing.T) {
+	for _, name := range []string{"authorization", "X-Api-Key", "x-forwarded-for", "via", "accept-encoding", "connection", "Transfer-Encoding", "content-length", "te", "upgrade"} {
+		err := newTestPlugin(t).Configure(context.Background(), `{"api_key": "sk-ant-test", "forward_headers": ["`+name+`"]}`)
+		if err == nil || !strings.Contains(err.Error(), "cannot be forwarded") {
+			t.Errorf("forward_headers %s: Configure() = %v, want an error", name, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamCheckInterval is how long an upstream reachability check is
+// reused, so frequent health checks do not each call Anthropic
+const upstreamCheckInterval = 30 * time.Second
+
+// upstreamCheckTimeout bounds a single reachability check
+const upstreamCheckTimeout = 5 * time.Second
+
+// healthcheckTimeout is the healthcheck command's default timeout
+const healthcheckTimeout = 5 * time.Second
+
+// storePinger is implemented by token stores that depend on an external
+// service, so readiness can check it is reachable
+type storePinger interface {
+	Ping(ctx context.Context) error
+}
+
+// upstreamHealth is the result of the last upstream reachability check
+type upstreamHealth struct {
+	Reachable bool      `json:"reachable"`
+	Status    int       `json:"status,omitempty"` // HTTP status of the check
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// storeHealth describes the token store
+type storeHealth struct {
+	Backend string `json:"backend"`
+	Tokens  int    `json:"tokens"` // unexpired tokens in the store
+	Error   string `json:"error,omitempty"`
+}
+
+// healthResponse is returned by GET /health
+type healthResponse struct {
+	Status            string         `json:"status"` // ok or degraded
+	Version           string         `json:"version"`
+	Build             versionInfo    `json:"build"`
+	UptimeSeconds     int64          `json:"uptime_seconds"`
+	Upstream          upstreamHealth `json:"upstream"`
+	TokenStore        storeHealth    `json:"token_store"`
+	ConfigFingerprint string         `json:"config_fingerprint,omitempty"`
+}
+
+// upstreamProbe checks that Anthropic is reachable with a HEAD request,
+// caching the result for upstreamCheckInterval. Any HTTP response counts
+// as reachable: the check sends no API key.
+type upstreamProbe struct {
+	mu   sync.Mutex
+	last upstreamHealth
+}
+
+func newUpstreamProbe() *upstreamProbe {
+	return &upstreamProbe{}
+}
+
+// Check returns the cached result, checking baseURL again with client, as
+// proxied requests would reach it, if it is stale
+func (u *upstreamProbe) Check(ctx context.Context, client *http.Client, baseURL string) upstreamHealth {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.last.CheckedAt.IsZero() && time.Since(u.last.CheckedAt) < upstreamCheckInterval {
+		return u.last
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+
+	started := time.Now()
+	h := upstreamHealth{CheckedAt: started.UTC()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, baseURL+"/v1/models", nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = client.Do(req); err == nil {
+			resp.Body.Close()
+			h.Reachable, h.Status = true, resp.StatusCode
+		}
+	}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	h.LatencyMS = time.Since(started).Milliseconds()
+	u.last = h
+	return h
+}
+
+// handleHealth reports upstream reachability, the token store, uptime, and
+// a fingerprint of the configuration, with 503 if anything is unhealthy
+func (ps *ProxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{
+		Status:            "ok",
+		Version:           buildVersion().Version,
+		Build:             buildVersion(),
+		UptimeSeconds:     int64(time.Since(ps.plugin.started).Seconds()),
+		Upstream:          ps.probe.Check(r.Context(), ps.plugin.UpstreamClient(), ps.upstreamURL),
+		TokenStore:        ps.plugin.StoreHealth(r.Context()),
+		ConfigFingerprint: ps.plugin.ConfigFingerprint(),
+	}
+	status := http.StatusOK
+	if !resp.Upstream.Reachable || resp.TokenStore.Error != "" {
+		resp.Status, status = "degraded", http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// handleLivez reports that the process is serving requests. It checks
+// nothing else, so a restart is only triggered for a hung process.
+func (ps *ProxyServer) handleLivez(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the proxy can serve requests: the plugin is
+// configured and its token store is reachable. Upstream outages do not
+// make the proxy unready, since every replica would be affected alike.
+func (ps *ProxyServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if ps.plugin.GetAPIKey() == "" {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unready", "reason": "plugin not configured"})
+		return
+	}
+	if err := ps.plugin.PingStore(r.Context()); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unready", "reason": "token store: " + err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// runHealthcheck runs `creddy-anthropic healthcheck`, which checks that a
+// local proxy is ready (or live), failing otherwise, for container probes
+// in images without curl
+func runHealthcheck(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	defaultURL := "http://127.0.0.1:" + envOr("PROXY_PORT", "8401")
+	target := flags.String("url", envOr("CREDDY_ANTHROPIC_URL", defaultURL), "base URL of the proxy (env CREDDY_ANTHROPIC_URL; default: PROXY_PORT on localhost)")
+	live := flags.Bool("live", false, "check /livez, that the process is serving, instead of /readyz")
+	timeout := flags.Duration("timeout", healthcheckTimeout, "how long to wait for the proxy")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(*target, "/") + "/readyz"
+	if *live {
+		endpoint = strings.TrimSuffix(*target, "/") + "/livez"
+	}
+	resp, err := (&http.Client{Timeout: *timeout}).Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	if resp.StatusCode != http.StatusOK {
+		if body.Reason != "" {
+			return fmt.Errorf("%s: %s: %s", endpoint, body.Status, body.Reason)
+		}
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	fmt.Fprintln(out, body.Status)
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func getJSON(t *testing.T, url string, v any) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: invalid JSON: %v", url, err)
+	}
+	return resp.StatusCode
+}
+
+func TestHealth(t *testing.T) {
+	var checks int
+	plugin, srv, ps := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19543}`, func(w http.ResponseWriter, r *http.Request) {
+		checks++
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	var health healthResponse
+	for range 2 {
+		if status := getJSON(t, srv.URL+"/health", &health); status != http.StatusOK {
+			t.Fatalf("status = %d, want 200", status)
+		}
+	}
+	if health.Status != "ok" || !health.Upstream.Reachable || health.Upstream.Status != http.StatusUnauthorized ||
+		health.TokenStore.Backend != "memory" || health.TokenStore.Tokens != 1 || health.ConfigFingerprint == "" ||
+		health.Build.Version != health.Version || health.Build.GoVersion == "" {
+		t.Errorf("health = %+v", health)
+	}
+	if checks != 1 {
+		t.Errorf("upstream checked %d times, want 1 (cached)", checks)
+	}
+
+	// An unreachable upstream degrades health once the cache expires
+	ps.upstreamURL = "http://127.0.0.1:1"
+	ps.probe = newUpstreamProbe()
+	if status := getJSON(t, srv.URL+"/health", &health); status != http.StatusServiceUnavailable || health.Status != "degraded" || health.Upstream.Error == "" {
+		t.Errorf("status = %d, health = %+v", status, health)
+	}
+}
+
+func TestConfigFingerprint(t *testing.T) {
+	// Each plugin is shut down to free the port for the next
+	a, b := newTestPlugin(t), newTestPlugin(t)
+	a.Configure(t.Context(), `{"api_key": "sk-ant-test", "proxy_port": 19544, "max_tokens_per_agent": 3}`)
+	a.Shutdown(t.Context())
+	b.Configure(t.Context(), `{"max_tokens_per_agent": 3, "proxy_port": 19544, "api_key": "sk-ant-test"}`)
+	b.Shutdown(t.Context())
+	if a.ConfigFingerprint() == "" || a.ConfigFingerprint() != b.ConfigFingerprint() {
+		t.Errorf("fingerprints %q and %q should match", a.ConfigFingerprint(), b.ConfigFingerprint())
+	}
+	c := newTestPlugin(t)
+	c.Configure(t.Context(), `{"api_key": "sk-ant-test", "proxy_port": 19544, "max_tokens_per_agent": 4}`)
+	c.Shutdown(t.Context())
+	if a.ConfigFingerprint() == c.ConfigFingerprint() {
+		t.Error("fingerprints should differ for different configs")
+	}
+
+	// The fingerprint is served unauthenticated, so it reveals nothing of
+	// the secrets
+	d := newTestPlugin(t)
+	d.Configure(t.Context(), `{"api_key": "sk-ant-other", "proxy_port": 19544, "max_tokens_per_agent": 3}`)
+	if a.ConfigFingerprint() != d.ConfigFingerprint() {
+		t.Error("fingerprints should not depend on api_key")
+	}
+}
+
+func TestLivezReadyz(t *testing.T) {
+	// Before Configure the proxy is live but not ready
+	srv := httptest.NewServer(NewProxyServer(newTestPlugin(t)).routes())
+	defer srv.Close()
+	var body map[string]string
+	if status := getJSON(t, srv.URL+"/livez", &body); status != http.StatusOK {
+		t.Errorf("livez status = %d, want 200", status)
+	}
+	if status := getJSON(t, srv.URL+"/readyz", &body); status != http.StatusServiceUnavailable {
+		t.Errorf("readyz status = %d, want 503", status)
+	}
+
+	mr := miniredis.RunT(t)
+	_, srv2 := newTestProxy(t, fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19545, "token_store": "redis", "redis_url": "redis://%s"}`, mr.Addr()))
+	if status := getJSON(t, srv2.URL+"/readyz", &body); status != http.StatusOK {
+		t.Errorf("readyz status = %d, want 200: %v", status, body)
+	}
+	// Losing the token store makes the proxy unready
+	mr.Close()
+	if status := getJSON(t, srv2.URL+"/readyz", &body); status != http.StatusServiceUnavailable || body["reason"] == "" {
+		t.Errorf("readyz status = %d, body = %v, want 503", status, body)
+	}
+}
+
+func TestHealthcheckCommand(t *testing.T) {
+	unconfigured := httptest.NewServer(NewProxyServer(newTestPlugin(t)).routes())
+	defer unconfigured.Close()
+	_, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19579}`)
+
+	var out strings.Builder
+	if err := runHealthcheck([]string{"-url", srv.URL}, &out); err != nil || out.String() != "ready\n" {
+		t.Errorf("healthcheck of a ready proxy = %q, %v", out.String(), err)
+	}
+	err := runHealthcheck([]string{"-url", unconfigured.URL}, &out)
+	if err == nil || !strings.Contains(err.Error(), "plugin not configured") {
+		t.Errorf("healthcheck of an unconfigured proxy = %v, want the readiness reason", err)
+	}
+	out.Reset()
+	if err := runHealthcheck([]string{"-url", unconfigured.URL, "-live"}, &out); err != nil || out.String() != "ok\n" {
+		t.Errorf("healthcheck -live of an unconfigured proxy = %q, %v", out.String(), err)
+	}
+	if err := runHealthcheck([]string{"-url", "http://127.0.0.1:1", "-timeout", "1s"}, &out); err == nil {
+		t.Error("healthcheck with nothing listening should fail")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// maxInspectedBody bounds request bodies buffered for scope enforcement;
+// it matches the Messages API's own request size limit
+const maxInspectedBody = 32 << 20
+
+// messageParams are the request body fields scope constraints inspect
+type messageParams struct {
+	Model     string `json:"model"`
+	MaxTokens int64  `json:"max_tokens"`
+	Stream    bool   `json:"stream"`
+	Tools     []struct {
+		Name           string   `json:"name"`
+		Type           string   `json:"type"`
+		AllowedDomains []string `json:"allowed_domains"`
+	} `json:"tools"`
+	ToolChoice json.RawMessage `json:"tool_choice"`
+}
+
+// inspectedBody is a Messages request, or a Message Batches request whose
+// items each carry their own params
+type inspectedBody struct {
+	messageParams
+	Requests []struct {
+		Params messageParams `json:"params"`
+	} `json:"requests"`
+}
+
+// policyError is a request that is well-formed but not permitted by the
+// token's scope
+type policyError struct {
+	msg string
+}
+
+func (e *policyError) Error() string { return e.msg }
+
+// enforceOptions selects how violations that can be repaired are handled
+type enforceOptions struct {
+	ClampMaxTokens bool // rewrite max_tokens over the cap to the cap
+	StripTools     bool // drop disallowed tools instead of rejecting
+}
+
+// enforceRequestBody enforces scope's body constraints on a request to
+// urlPath and returns the body to forward, rewritten if opts allow
+// repairing a violation. It returns a *policyError for requests the scope
+// forbids and a plain error for bodies that cannot be parsed.
+func enforceRequestBody(scope *Scope, urlPath string, body []byte, opts enforceOptions) ([]byte, error) {
+	if len(body) == 0 {
+		return body, nil
+	}
+	var req inspectedBody
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+
+	batch := urlPath == "/v1/messages/batches"
+	params := []messageParams{req.messageParams}
+	if batch {
+		params = params[:0]
+		for _, item := range req.Requests {
+			params = append(params, item.Params)
+		}
+	}
+
+	rewrite := false
+	for _, p := range params {
+		if !scope.AllowsModel(p.Model) {
+			return nil, &policyError{fmt.Sprintf("model %q is not permitted by this token's scope", p.Model)}
+		}
+		if scope.NoStream && p.Stream {
+			return nil, &policyError{`streaming is not permitted for this token; send "stream": false`}
+		}
+		if scope.MaxTokens > 0 && p.MaxTokens > scope.MaxTokens {
+			if !opts.ClampMaxTokens {
+				return nil, &policyError{fmt.Sprintf("max_tokens %d exceeds this token's cap of %d", p.MaxTokens, scope.MaxTokens)}
+			}
+			rewrite = true
+		}
+		if scope.NoTools && (len(p.Tools) > 0 || (len(p.ToolChoice) > 0 && string(p.ToolChoice) != "null")) {
+			if !opts.StripTools {
+				return nil, &policyError{"tool use is not permitted for this token"}
+			}
+			rewrite = true
+		}
+		for _, tool := range p.Tools {
+			if !scope.AllowsTool(tool.Name) {
+				if !opts.StripTools {
+					return nil, &policyError{fmt.Sprintf("tool %q is not permitted by this token's scope", tool.Name)}
+				}
+				rewrite = true
+				continue
+			}
+			server, ok := serverToolName(tool.Type)
+			if !ok {
+				continue
+			}
+			if !scope.AllowsServerTool(server) {
+				if !opts.StripTools {
+					return nil, &policyError{fmt.Sprintf("server tool %q is not permitted by this token's scope", server)}
+				}
+				rewrite = true
+				continue
+			}
+			if webTools[server] && len(scope.WebDomainAllowlists) > 0 {
+				// Web tools without allowed_domains are limited to the scope's
+				if len(tool.AllowedDomains) == 0 && len(scope.webDomains()) == 0 {
+					return nil, &policyError{fmt.Sprintf("server tool %q is not permitted: no domain is allowed by both this token's scope and its policy", server)}
+				} else if len(tool.AllowedDomains) == 0 {
+					rewrite = true
+				}
+				for _, domain := range tool.AllowedDomains {
+					if !scope.AllowsWebDomain(domain) {
+						return nil, &policyError{fmt.Sprintf("%s domain %q is not permitted by this token's scope", server, domain)}
+					}
+				}
+			}
+		}
+	}
+	if !rewrite {
+		return body, nil
+	}
+	return rewriteParams(body, batch, func(params map[string]any) {
+		clampMaxTokens(params, scope.MaxTokens)
+		stripTools(params, scope)
+		restrictWebDomains(params, scope)
+	})
+}
+
+// rewriteParams decodes body, applies fn to its params (each item's params
+// for a batch), and re-encodes it, leaving all other fields as they were
+func rewriteParams(body []byte, batch bool, fn func(params map[string]any)) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // keep numbers exactly as sent
+	var req map[string]any
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+
+	if batch {
+		items, _ := req["requests"].([]any)
+		for _, item := range items {
+			if m, ok := item.(map[string]any); ok {
+				if params, ok := m["params"].(map[string]any); ok {
+					fn(params)
+				}
+			}
+		}
+	} else {
+		fn(req)
+	}
+	return json.Marshal(req)
+}
+
+// clampMaxTokens lowers params' max_tokens to limit if it is above it
+func clampMaxTokens(params map[string]any, limit int64) {
+	if limit <= 0 {
+		return
+	}
+	n, ok := params["max_tokens"].(json.Number)
+	if v, err := n.Int64(); ok && err == nil && v > limit {
+		params["max_tokens"] = limit
+	}
+}
+
+// stripTools removes tool definitions scope does not allow. If none are
+// left, tools and tool_choice are removed altogether; a tool_choice naming
+// a removed tool is dropped so the request stays valid.
+func stripTools(params map[string]any, scope *Scope) {
+	tools, _ := params["tools"].([]any)
+	kept := make([]any, 0, len(tools))
+	allowed := make(map[string]bool)
+	if !scope.NoTools {
+		for _, tool := range tools {
+			m, _ := tool.(map[string]any)
+			name, _ := m["name"].(string)
+			toolType, _ := m["type"].(string)
+			if server, ok := serverToolName(toolType); ok && !scope.AllowsServerTool(server) {
+				continue
+			}
+			if scope.AllowsTool(name) {
+				kept = append(kept, tool)
+				allowed[name] = true
+			}
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(params, "tools")
+		delete(params, "tool_choice")
+		return
+	}
+	params["tools"] = kept
+	if choice, ok := params["tool_choice"].(map[string]any); ok {
+		if name, ok := choice["name"].(string); ok && !allowed[name] {
+			delete(params, "tool_choice")
+		}
+	}
+}
@@ -87,7 +87,7 @@ func makeProxyRequest(port int, token, body string) *http.Request {
 }
 
 func TestIntegration_PluginInfo(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	info, err := plugin.Info(context.Background())
 	if err != nil {
 		t.Fatalf("Info() error: %v", err)
@@ -137,7 +137,7 @@ func TestIntegration_Configure(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			plugin := NewPlugin()
+			plugin := newTestPlugin(t)
 			err := plugin.Configure(context.Background(), tt.config)
 
 			if tt.wantErr {
@@ -157,7 +157,7 @@ func TestIntegration_Configure(t *testing.T) {
 }
 
 func TestIntegration_MatchScope(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 
 	tests := []struct {
 		scope string
@@ -188,7 +188,7 @@ func TestIntegration_GetCredential(t *testing.T) {
 	apiKey := getAPIKey(t)
 	port := getProxyPort()
 
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, port))
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -238,7 +238,7 @@ func TestIntegration_FullProxyLifecycle(t *testing.T) {
 	apiKey := getAPIKey(t)
 	port := getProxyPort() + 1 // Use different port to avoid conflicts
 
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, port))
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -320,7 +320,7 @@ func TestIntegration_InvalidTokenRejected(t *testing.T) {
 	apiKey := getAPIKey(t)
 	port := getProxyPort() + 2
 
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, port))
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -361,7 +361,7 @@ func TestIntegration_ConcurrentTokens(t *testing.T) {
 	apiKey := getAPIKey(t)
 	port := getProxyPort() + 3
 
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, port))
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -437,7 +437,7 @@ func TestIntegration_TokenExpiry(t *testing.T) {
 	apiKey := getAPIKey(t)
 	port := getProxyPort() + 4
 
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, port))
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -494,7 +494,7 @@ func TestIntegration_SSEStreaming(t *testing.T) {
 	apiKey := getAPIKey(t)
 	port := getProxyPort() + 5
 
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, port))
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -577,7 +577,7 @@ func TestIntegration_SSEStreaming(t *testing.T) {
 }
 
 func TestIntegration_RevokeIdempotent(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	apiKey := getAPIKey(t)
 
 	err := plugin.Configure(context.Background(), fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, getProxyPort()+6))
@@ -618,7 +618,7 @@ func TestIntegration_ProxyForwardsHeaders(t *testing.T) {
 	apiKey := getAPIKey(t)
 	port := getProxyPort() + 7
 
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, port))
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// logLevel is the minimum level logged; Configure updates it in place so
+// loggers derived from the default keep following it
+var logLevel = new(slog.LevelVar)
+
+// logHandlers maps log_format config values to slog handler constructors
+var logHandlers = map[string]func(w io.Writer, opts *slog.HandlerOptions) slog.Handler{
+	"text": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, opts) },
+	"json": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, opts) },
+}
+
+// parseLogLevel parses a log_level config value
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log_level %q (supported: debug, info, warn, error)", s)
+	}
+	return level, nil
+}
+
+// setupLogging makes the default logger write format-style records to w
+// at level and above
+func setupLogging(w io.Writer, format string, level slog.Level) {
+	logLevel.Set(level)
+	newHandler := logHandlers[strings.ToLower(format)]
+	if newHandler == nil {
+		newHandler = logHandlers["text"]
+	}
+	slog.SetDefault(slog.New(newHandler(w, &slog.HandlerOptions{Level: logLevel})))
+}
+
+// loggingSettings are the logging settings GET and PUT /admin/logging show
+// and change
+type loggingSettings struct {
+	Level                string `json:"level"`
+	CaptureSamplePercent *int   `json:"capture_sample_percent,omitempty"` // Only while capture_dir is set
+}
+
+// handleLogging shows the log level and debug capture sampling in effect
+// and, for PUT, changes them until the configuration is next reloaded, so
+// debugging can be turned up during an incident without a restart
+func (ps *ProxyServer) handleLogging(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	capture := ps.plugin.DebugCapture()
+	if r.Method == http.MethodPut {
+		var req struct {
+			Level                string `json:"level"`
+			CaptureSamplePercent *int   `json:"capture_sample_percent"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON body")
+			return
+		}
+		level := logLevel.Level()
+		if req.Level != "" {
+			var err error
+			if level, err = parseLogLevel(req.Level); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+		}
+		attrs := []any{"level", strings.ToLower(level.String())}
+		if percent := req.CaptureSamplePercent; percent != nil {
+			if capture == nil {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", "capture_sample_percent requires capture_dir to be configured")
+				return
+			}
+			if *percent < 1 || *percent > 100 {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", "capture_sample_percent must be between 1 and 100")
+				return
+			}
+			capture.percent.Store(int32(*percent))
+			attrs = append(attrs, "capture_sample_percent", *percent)
+		}
+		logLevel.Set(level)
+		slog.Warn("Logging settings changed until the next reload", attrs...)
+	}
+
+	settings := loggingSettings{Level: strings.ToLower(logLevel.Level().String())}
+	if capture != nil {
+		percent := int(capture.percent.Load())
+		settings.CaptureSamplePercent = &percent
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// newRequestID returns a random ID identifying a proxied request in logs
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+// requestIDPattern matches the x-request-id values clients may supply;
+// others are replaced, since IDs end up in logs and capture file names
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// requestID returns the client's x-request-id if it is well-formed, so
+// callers can correlate their own logs, or else a new ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("x-request-id"); requestIDPattern.MatchString(id) {
+		return id
+	}
+	return newRequestID()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_LogsRequestFields(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19537}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":10,"output_tokens":5}}`))
+	})
+	var buf bytes.Buffer
+	setupLogging(&buf, "json", slog.LevelInfo)
+	t.Cleanup(func() { setupLogging(os.Stderr, "text", slog.LevelInfo) })
+
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	resp := proxyRequest(t, srv, cred.Value, `{}`)
+	resp.Body.Close()
+
+	var line map[string]any
+	for _, raw := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var rec map[string]any
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", raw, err)
+		}
+		if rec["msg"] == "Proxied request" {
+			line = rec
+		}
+	}
+	if line == nil {
+		t.Fatalf("no request log line in %q", buf.String())
+	}
+	for key, want := range map[string]any{"agent": "agent-1", "model": "claude-haiku-4-5", "status": float64(200), "path": "/v1/messages"} {
+		if line[key] != want {
+			t.Errorf("%s = %v, want %v", key, line[key], want)
+		}
+	}
+	if id, _ := line["request_id"].(string); id == "" {
+		t.Error("request_id missing")
+	}
+	if _, ok := line["duration_ms"].(float64); !ok {
+		t.Error("duration_ms missing")
+	}
+}
+
+func TestConfigure_LogSettings(t *testing.T) {
+	t.Cleanup(func() { setupLogging(os.Stderr, "text", slog.LevelInfo) })
+	for config, wantErr := range map[string]bool{
+		`{"api_key": "sk-ant-test", "log_level": "debug", "log_format": "json"}`: false,
+		`{"api_key": "sk-ant-test", "log_level": "loud"}`:                        true,
+		`{"api_key": "sk-ant-test", "log_format": "xml"}`:                        true,
+	} {
+		if err := newTestPlugin(t).Configure(context.Background(), config); (err != nil) != wantErr {
+			t.Errorf("Configure(%s) error = %v, want error %v", config, err, wantErr)
+		}
+	}
+}
+
+func TestLoggingEndpoint(t *testing.T) {
+	t.Cleanup(func() { setupLogging(os.Stderr, "text", slog.LevelInfo) })
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19588, "admin_token": "admin-secret", "capture_dir": %q, "capture_sample_percent": 10}`, t.TempDir())
+	plugin, srv := newTestProxy(t, config)
+	call := func(method, token, body string) (int, loggingSettings) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+"/admin/logging", strings.NewReader(body))
+		req.Header.Set("x-api-key", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var settings loggingSettings
+		json.NewDecoder(resp.Body).Decode(&settings)
+		return resp.StatusCode, settings
+	}
+
+	if status, got := call(http.MethodGet, "admin-secret", ""); status != 200 || got.Level != "info" || got.CaptureSamplePercent == nil || *got.CaptureSamplePercent != 10 {
+		t.Errorf("GET = %d, %+v", status, got)
+	}
+	if status, _ := call(http.MethodPut, "wrong", `{"level": "debug"}`); status != http.StatusUnauthorized {
+		t.Errorf("PUT without the admin token: status %d, want 401", status)
+	}
+	for _, body := range []string{`{"level": "loud"}`, `{"capture_sample_percent": 0}`, `{"level": "debug", "capture_sample_percent": 101}`} {
+		if status, _ := call(http.MethodPut, "admin-secret", body); status != http.StatusBadRequest {
+			t.Errorf("PUT %s: status %d, want 400", body, status)
+		}
+	}
+	if logLevel.Level() != slog.LevelInfo {
+		t.Errorf("rejected PUTs changed the level to %v", logLevel.Level())
+	}
+
+	status, got := call(http.MethodPut, "admin-secret", `{"level": "debug", "capture_sample_percent": 100}`)
+	if status != 200 || got.Level != "debug" || *got.CaptureSamplePercent != 100 {
+		t.Errorf("PUT = %d, %+v", status, got)
+	}
+	if logLevel.Level() != slog.LevelDebug || !plugin.DebugCapture().Sample() {
+		t.Errorf("after PUT: level %v, capture sampling every request %v", logLevel.Level(), plugin.DebugCapture().Sample())
+	}
+
+	// Reloading the configuration restores its settings
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if _, got := call(http.MethodGet, "admin-secret", ""); got.Level != "info" || *got.CaptureSamplePercent != 10 {
+		t.Errorf("GET after reload = %+v", got)
+	}
+}
+
+func TestProxy_RequestIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var forwarded []string
+	plugin, srv, _ := newTestProxyWithUpstream(t, fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19542, "audit_log_path": %q}`, path),
+		func(w http.ResponseWriter, r *http.Request) {
+			forwarded = append(forwarded, r.Header.Get("x-request-id"))
+			w.Header().Set("request-id", "req_upstream_1")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	send := func(incoming string) string {
+		req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(`{}`))
+		req.Header.Set("x-api-key", cred.Value)
+		if incoming != "" {
+			req.Header.Set("x-request-id", incoming)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if ids := resp.Header.Values("x-request-id"); len(ids) != 1 {
+			t.Fatalf("x-request-id = %q, want one value", ids)
+		}
+		return resp.Header.Get("x-request-id")
+	}
+
+	// A client's ID is honoured end to end
+	if id := send("agent-trace-42"); id != "agent-trace-42" {
+		t.Errorf("x-request-id = %q, want agent-trace-42", id)
+	}
+	// Malformed IDs are replaced
+	if id := send("bad id/../x"); !strings.HasPrefix(id, "req_") {
+		t.Errorf("x-request-id = %q, want a generated ID", id)
+	}
+	generated := send("")
+
+	if len(forwarded) != 3 || forwarded[0] != "agent-trace-42" || forwarded[2] != generated {
+		t.Errorf("forwarded x-request-id = %q", forwarded)
+	}
+	events := readAuditLog(t, path)
+	if ev := events[1]; ev.RequestID != "agent-trace-42" || ev.UpstreamRequestID != "req_upstream_1" {
+		t.Errorf("request event = %+v", ev)
+	}
+}
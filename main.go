@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	sdk "github.com/getcreddy/creddy-plugin-sdk"
 )
@@ -16,27 +21,84 @@ func main() {
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "info":
-			fmt.Printf("Name:              %s\n", PluginName)
-			fmt.Printf("Version:           %s\n", PluginVersion)
-			fmt.Printf("Description:       Anthropic API access via plugin proxy\n")
-			fmt.Printf("Min Creddy Version: 0.4.0\n")
+			if err := runInfo(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "info: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "version", "-version", "--version":
+			if len(os.Args) > 2 && os.Args[2] == "-json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(buildVersion())
+				return
+			}
+			fmt.Print(buildVersion())
 			return
 
 		case "scopes":
-			fmt.Println("Pattern: anthropic")
-			fmt.Println("  Description: Full access to the Anthropic API")
-			fmt.Println("  Examples:")
-			fmt.Println("    - anthropic")
-			fmt.Println()
-			fmt.Println("Pattern: anthropic:claude")
-			fmt.Println("  Description: Access to Claude models")
-			fmt.Println("  Examples:")
-			fmt.Println("    - anthropic:claude")
+			if err := runScopes(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "scopes: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "models":
+			if err := runModels(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "models: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "config":
+			if err := runConfigCommand(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "config: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "encrypt-config", "decrypt-config":
+			if err := runConfigCrypt(os.Args[1], os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+
+		case "tokens":
+			if err := runTokensCommand(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "tokens: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "audit":
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			err := runAuditCommand(ctx, os.Args[2:], os.Stdout)
+			stop()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "audit: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "healthcheck":
+			if err := runHealthcheck(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "healthcheck: %v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "bench":
+			if err := runBench(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+				os.Exit(1)
+			}
 			return
 
 		case "proxy":
 			// Run standalone proxy mode (for testing or standalone deployment)
-			runProxyMode()
+			runProxyMode(os.Args[2:])
 			return
 
 		case "help", "-h", "--help":
@@ -46,53 +108,187 @@ func main() {
 	}
 
 	// Default: run as Creddy plugin
-	sdk.Serve(NewPlugin())
+	plugin := NewPlugin()
+
+	// Save state on termination, whether it arrives as a signal or as the
+	// host shutting the plugin server down
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		shutdown(plugin)
+		os.Exit(0)
+	}()
+
+	sdk.Serve(plugin)
+	shutdown(plugin)
 }
 
-func runProxyMode() {
-	// Get config from environment
-	apiKey := os.Getenv("ANTHROPIC_API_KEY")
-	if apiKey == "" {
-		log.Fatal("ANTHROPIC_API_KEY environment variable required")
-	}
+var shutdownOnce sync.Once
 
+// shutdown shuts the plugin down (once) within a bounded time, logging
+// failures
+func shutdown(plugin *AnthropicPlugin) {
+	shutdownOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := plugin.Shutdown(ctx); err != nil {
+			slog.Error("Shutdown failed", "error", err)
+		}
+	})
+}
+
+func runProxyMode(args []string) {
+	// Get config from a file, or from the environment overridden by flags
 	port := 8401
 	if p := os.Getenv("PROXY_PORT"); p != "" {
 		fmt.Sscanf(p, "%d", &port)
 	}
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "plugin configuration file, reloaded on change or SIGHUP (env CONFIG_FILE)")
+	flags.IntVar(&port, "port", port, "port for the proxy (env PROXY_PORT)")
+	listenAddr := flags.String("listen-addr", os.Getenv("LISTEN_ADDR"), "IP address, hostname, or interface the proxy binds (env LISTEN_ADDR; default: all interfaces)")
+	printToken := flags.Bool("print-token", false, "issue a token once the proxy is up and print it, with ANTHROPIC_BASE_URL, to standard output")
+	tokenAgent := flags.String("token-agent", "local", "agent ID of the -print-token token")
+	tokenScope := flags.String("token-scope", "anthropic", "scope of the -print-token token")
+	tokenTTL := flags.Duration("token-ttl", maxTokenTTL, "lifetime of the -print-token token")
+	flags.Parse(args)
+
+	// The file sets proxy_port and listen_addr, so flags for them would
+	// be ignored
+	if *configPath != "" {
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name == "port" || f.Name == "listen-addr" {
+				slog.Error("-"+f.Name+" cannot be used with -config; set proxy_port and listen_addr in the configuration file", "path", *configPath)
+				os.Exit(2)
+			}
+		})
+	}
 
-	// Create and configure plugin
+	// Create and configure plugin, which starts the proxy
 	plugin := NewPlugin()
-	configJSON := fmt.Sprintf(`{"api_key": "%s", "proxy_port": %d}`, apiKey, port)
-	if err := plugin.Configure(context.Background(), configJSON); err != nil {
-		log.Fatalf("Failed to configure: %v", err)
+	var reloader *configReloader
+	if *configPath != "" {
+		reloader = newConfigReloader(plugin, *configPath)
+		if err := reloader.Reload(context.Background(), true); err != nil {
+			slog.Error("Failed to configure", "path", *configPath, "error", err)
+			os.Exit(1)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go reloader.Watch(ctx, configWatchInterval)
+	} else {
+		apiKey := os.Getenv("ANTHROPIC_API_KEY")
+		if apiKey == "" {
+			slog.Error("ANTHROPIC_API_KEY environment variable or -config required")
+			os.Exit(1)
+		}
+		configJSON, _ := json.Marshal(map[string]any{"api_key": apiKey, "proxy_port": port, "listen_addr": *listenAddr})
+		if err := plugin.Configure(context.Background(), string(configJSON)); err != nil {
+			slog.Error("Failed to configure", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	// Start proxy
-	proxy := NewProxyServer(plugin)
+	if *printToken {
+		if err := printBootstrapToken(context.Background(), plugin, os.Stdout, *tokenAgent, *tokenScope, *tokenTTL); err != nil {
+			slog.Error("Failed to issue a token", "error", err)
+			shutdown(plugin)
+			os.Exit(1)
+		}
+	}
 
-	// Handle shutdown
+	// Run until told to stop, reloading the configuration file on SIGHUP
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	if reloader != nil {
+		signal.Notify(sigCh, syscall.SIGHUP)
+	}
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := reloader.Reload(context.Background(), true); err != nil {
+			slog.Error("Configuration reload failed; keeping the previous configuration", "path", *configPath, "error", err)
+		}
+	}
+	slog.Info("Shutting down")
+	shutdown(plugin)
+}
 
-	go func() {
-		<-sigCh
-		log.Println("Shutting down...")
-		proxy.Stop(context.Background())
-	}()
+func runConfigCrypt(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	keyEnv := flags.String("key-env", "", "environment variable holding the passphrase")
+	keyKeyring := flags.String("key-keyring", "", "OS keyring entry (service/account) holding the passphrase")
+	flags.Parse(args)
+
+	in := io.Reader(os.Stdin)
+	if path := flags.Arg(0); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
 
-	if err := proxy.Start(port); err != nil {
-		log.Fatalf("Proxy server error: %v", err)
+	if command == "decrypt-config" {
+		plain, err := decryptConfig(context.Background(), string(data))
+		if err != nil {
+			return err
+		}
+		fmt.Println(plain)
+		return nil
+	}
+	passphrase, err := configPassphrase(context.Background(), *keyEnv, *keyKeyring)
+	if err != nil {
+		return err
+	}
+	out, err := encryptConfig(data, passphrase, *keyEnv, *keyKeyring)
+	if err != nil {
+		return err
 	}
+	fmt.Println(string(out))
+	return nil
 }
 
 func printHelp() {
 	fmt.Println("creddy-anthropic - Anthropic plugin for Creddy")
 	fmt.Println()
 	fmt.Println("Commands:")
-	fmt.Println("  info     Show plugin information")
-	fmt.Println("  scopes   List supported scopes")
+	fmt.Println("  info     Show plugin information [-json]")
+	fmt.Println("  version  Show version, commit, build date, and plugin SDK version [-json]")
+	fmt.Println("  scopes   List supported scopes [-config config.json] [-json]")
+	fmt.Println("  models   List the models the API key reaches and the scopes permitting each")
+	fmt.Println("           [-config config.json] [-workspace NAME] [-json]")
 	fmt.Println("  proxy    Run standalone proxy server (for testing)")
+	fmt.Println("           [-port 8401] [-listen-addr 127.0.0.1] [-config config.json]")
+	fmt.Println("           [-print-token [-token-agent local] [-token-scope anthropic] [-token-ttl 1h]]")
+	fmt.Println("  audit tail [-file PATH | -url URL -admin-token TOKEN] [-follow] [-n 10]")
+	fmt.Println("           [-agent ID] [-model GLOB] [-status CODE] [-json]")
+	fmt.Println("           Print recent audit events, and new ones with -follow")
+	fmt.Println("  healthcheck [-url URL] [-live] [-timeout 5s]")
+	fmt.Println("           Check a local proxy's /readyz (or /livez), exiting 1 if it fails")
+	fmt.Println("  bench    Load-test the proxy and report throughput, latency, and allocations")
+	fmt.Println("           -mock-upstream [-port 8401] | -url URL [-token TOKEN]")
+	fmt.Println("           [-concurrency 50] [-duration 10s] [-requests N] [-stream] [-json]")
+	fmt.Println("  config validate [-file] config.json")
+	fmt.Println("           Check a plugin configuration before deploying it")
+	fmt.Println("  encrypt-config [-key-env VAR | -key-keyring service/account] [file]")
+	fmt.Println("           Encrypt a plugin configuration for storage")
+	fmt.Println("  decrypt-config [file]")
+	fmt.Println("           Decrypt an encrypted configuration for editing")
+	fmt.Println("  tokens list [-url URL] [-admin-token TOKEN] [-agent ID] [-scope SCOPE] [-expiring-within 15m] [-json]")
+	fmt.Println("           List a running proxy's active tokens")
+	fmt.Println("  tokens issue -agent ID [-scope SCOPE] [-ttl 30m] [-max-uses N] [-url URL] [-admin-token TOKEN]")
+	fmt.Println("           [-base-url URL] [-json]")
+	fmt.Println("           Issue a token from a running proxy without Creddy")
+	fmt.Println("  tokens revoke <token or ID> | -agent ID | -all [-url URL] [-admin-token TOKEN]")
+	fmt.Println("           Revoke tokens on a running proxy and its peers")
 	fmt.Println("  help     Show this help")
 	fmt.Println()
 	fmt.Println("This plugin runs as a Creddy plugin process and provides its own proxy.")
@@ -101,7 +297,8 @@ func printHelp() {
 	fmt.Println("  1. Add backend to Creddy:")
 	fmt.Println("     creddy backend add anthropic --config '{")
 	fmt.Println("       \"api_key\": \"sk-ant-...\",")
-	fmt.Println("       \"proxy_port\": 8401")
+	fmt.Println("       \"proxy_port\": 8401,")
+	fmt.Println("       \"listen_addr\": \"127.0.0.1\"")
 	fmt.Println("     }'")
 	fmt.Println()
 	fmt.Println("  2. Agent gets a token:")
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// infoOutput is `info -json`
+type infoOutput struct {
+	Name             string              `json:"name"`
+	Version          string              `json:"version"`
+	Description      string              `json:"description"`
+	MinCreddyVersion string              `json:"min_creddy_version"`
+	Build            versionInfo         `json:"build"`
+	MinTTLSeconds    int64               `json:"min_ttl_seconds"`
+	MaxTTLSeconds    int64               `json:"max_ttl_seconds"`
+	Config           []configFieldOutput `json:"config"`
+}
+
+// configFieldOutput describes a configuration field in `info -json`
+type configFieldOutput struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	Default     string `json:"default,omitempty"`
+}
+
+// scopesOutput is `scopes -json`
+type scopesOutput struct {
+	Scopes      []scopeOutput           `json:"scopes"`
+	Constraints []scopeConstraintDoc    `json:"constraints"`
+	Policies    map[string]*ScopePolicy `json:"policies,omitempty"` // from -config
+}
+
+// scopeOutput describes a scope pattern in `scopes -json`
+type scopeOutput struct {
+	Pattern     string   `json:"pattern"`
+	Description string   `json:"description"`
+	Examples    []string `json:"examples"`
+	Endpoints   []string `json:"endpoints,omitempty"` // API paths the scope may call ("*" suffix); none means all outside the Admin API
+	Explicit    bool     `json:"explicit,omitempty"`  // only issued when allowed_scopes lists it
+	Source      string   `json:"source"`              // builtin, policy, or workspace
+}
+
+// runInfo runs `creddy-anthropic info`
+func runInfo(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("info", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print plugin metadata, TTL limits, and configuration fields as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	plugin := NewPlugin()
+	info, _ := plugin.Info(ctx)
+	if !*asJSON {
+		fmt.Fprintf(out, "Name:              %s\n", info.Name)
+		fmt.Fprintf(out, "Version:           %s\n", info.Version)
+		fmt.Fprintf(out, "Description:       Anthropic API access via plugin proxy\n")
+		fmt.Fprintf(out, "Min Creddy Version: %s\n", info.MinCreddyVersion)
+		return nil
+	}
+
+	constraints, _ := plugin.Constraints(ctx)
+	schema, _ := plugin.ConfigSchema(ctx)
+	result := infoOutput{
+		Name:             info.Name,
+		Version:          info.Version,
+		Description:      info.Description,
+		MinCreddyVersion: info.MinCreddyVersion,
+		Build:            buildVersion(),
+		MinTTLSeconds:    int64(constraints.MinTTL.Seconds()),
+		MaxTTLSeconds:    int64(constraints.MaxTTL.Seconds()),
+		Config:           make([]configFieldOutput, len(schema)),
+	}
+	for i, f := range schema {
+		result.Config[i] = configFieldOutput{Name: f.Name, Type: f.Type, Description: f.Description, Required: f.Required, Default: f.Default}
+	}
+	return writeIndentedJSON(out, result)
+}
+
+// runScopes runs `creddy-anthropic scopes`, listing the built-in scopes
+// and, with -config, the named scopes a configuration adds
+func runScopes(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("scopes", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print scopes, constraints, and policies as JSON")
+	configPath := flags.String("config", "", "plugin configuration file whose policies and workspaces to include")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	result := scopesOutput{Constraints: scopeConstraintDocs}
+	for i, spec := range scopeSpecs() {
+		def := scopeDefs[i]
+		result.Scopes = append(result.Scopes, scopeOutput{
+			Pattern:     spec.Pattern,
+			Description: spec.Description,
+			Examples:    spec.Examples,
+			Endpoints:   def.Paths,
+			Explicit:    def.Explicit,
+			Source:      "builtin",
+		})
+	}
+	if *configPath != "" {
+		cfg, err := readConfigFile(context.Background(), *configPath)
+		if err != nil {
+			return err
+		}
+		result.Policies = cfg.Policies
+		for _, spec := range policyScopeSpecs(cfg.Policies) {
+			result.Scopes = append(result.Scopes, scopeOutput{
+				Pattern:     spec.Pattern,
+				Description: spec.Description,
+				Examples:    spec.Examples,
+				Endpoints:   cfg.Policies[spec.Pattern].Endpoints,
+				Source:      "policy",
+			})
+		}
+		for _, spec := range workspaceScopeSpecs(cfg.Workspaces) {
+			result.Scopes = append(result.Scopes, scopeOutput{
+				Pattern:     spec.Pattern,
+				Description: spec.Description,
+				Examples:    spec.Examples,
+				Source:      "workspace",
+			})
+		}
+	}
+	if *asJSON {
+		return writeIndentedJSON(out, result)
+	}
+
+	for i, s := range result.Scopes {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "Pattern: %s\n", s.Pattern)
+		fmt.Fprintf(out, "  Description: %s\n", s.Description)
+		fmt.Fprintln(out, "  Examples:")
+		for _, ex := range s.Examples {
+			fmt.Fprintf(out, "    - %s\n", ex)
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads a plugin configuration, decrypting it if needed,
+// and checks its policies and workspaces without reading API keys or
+// starting a proxy
+func readConfigFile(ctx context.Context, path string) (*AnthropicConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configJSON, err := decryptConfig(ctx, string(data))
+	if err != nil {
+		return nil, err
+	}
+	var cfg AnthropicConfig
+	if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := validatePolicies(cfg.Policies); err != nil {
+		return nil, err
+	}
+	for i, ws := range cfg.Workspaces {
+		if ws == nil || !policyNamePattern.MatchString(ws.Name) {
+			return nil, fmt.Errorf("workspaces[%d]: invalid name", i)
+		}
+	}
+	return &cfg, nil
+}
+
+// writeIndentedJSON writes v as indented JSON
+func writeIndentedJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
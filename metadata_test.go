@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScopeConstraintDocs(t *testing.T) {
+	documented := map[string]bool{}
+	for _, doc := range scopeConstraintDocs {
+		documented[doc.Key] = true
+		scope := "anthropic:" + doc.Key + ":" + doc.Example
+		if doc.Repeatable {
+			scope += ":" + doc.Key + ":" + doc.Example
+		}
+		if _, err := ParseScope(scope); err != nil {
+			t.Errorf("example for %s: %v", doc.Key, err)
+		}
+	}
+	for key := range scopeConstraints {
+		if !documented[key] {
+			t.Errorf("constraint %q is not in scopeConstraintDocs", key)
+		}
+	}
+	if len(documented) != len(scopeConstraints) {
+		t.Errorf("%d constraints documented, %d exist", len(documented), len(scopeConstraints))
+	}
+}
+
+func TestInfoJSON(t *testing.T) {
+	var out strings.Builder
+	if err := runInfo([]string{"-json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var info infoOutput
+	if err := json.Unmarshal([]byte(out.String()), &info); err != nil {
+		t.Fatalf("info -json output is not JSON: %v\n%s", err, out.String())
+	}
+	if info.Name != PluginName || info.Version == "" || info.Build.GoVersion == "" || info.MinTTLSeconds != 60 || info.MaxTTLSeconds != 3600 {
+		t.Errorf("info = %+v", info)
+	}
+	var found bool
+	for _, f := range info.Config {
+		found = found || (f.Name == "proxy_port" && f.Type == "int" && f.Default == "8401")
+	}
+	if !found {
+		t.Errorf("info config fields lack proxy_port: %+v", info.Config)
+	}
+}
+
+func TestScopesJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"api_key_env": "UNSET_FOR_TEST",
+		"policies": {"anthropic:ci": {"description": "CI jobs", "endpoints": ["/v1/messages"], "models": ["claude-haiku-*"]},
+			"anthropic:messages": {"max_tokens": 1024}},
+		"workspaces": [{"name": "prod", "api_key_env": "UNSET_FOR_TEST"}]}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := runScopes([]string{"-json", "-config", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var scopes scopesOutput
+	if err := json.Unmarshal([]byte(out.String()), &scopes); err != nil {
+		t.Fatalf("scopes -json output is not JSON: %v\n%s", err, out.String())
+	}
+	sources := map[string]string{}
+	for _, s := range scopes.Scopes {
+		sources[s.Pattern] = s.Source
+		if s.Pattern == "anthropic:messages" && len(s.Endpoints) == 0 {
+			t.Errorf("anthropic:messages lists no endpoints")
+		}
+	}
+	if sources["anthropic"] != "builtin" || sources["anthropic:ci"] != "policy" || sources["anthropic:prod"] != "workspace" {
+		t.Errorf("scope sources = %v", sources)
+	}
+	if len(scopes.Constraints) != len(scopeConstraints) {
+		t.Errorf("%d constraints, want %d", len(scopes.Constraints), len(scopeConstraints))
+	}
+	if pol := scopes.Policies["anthropic:messages"]; pol == nil || pol.MaxTokens != 1024 {
+		t.Errorf("policies = %+v", scopes.Policies)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"policies": {"openai:x": {}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := runScopes([]string{"-config", path}, &out); err == nil {
+		t.Error("scopes with an invalid config should fail")
+	}
+}
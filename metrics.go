@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ttftBuckets are the upper bounds, in seconds, of the time-to-first-token
+// histogram buckets
+var ttftBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60}
+
+// histogram counts observations per bucket; buckets are made cumulative
+// when written
+type histogram struct {
+	counts []uint64 // per bucket in ttftBuckets, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if i, _ := slices.BinarySearch(ttftBuckets, v); i < len(ttftBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// tokenTypes label the token counters, in the order they are written
+var tokenTypes = []string{"input", "output", "cache_read", "cache_creation"}
+
+// proxyMetrics collects per-model latency and token metrics for the
+// /metrics endpoint
+type proxyMetrics struct {
+	mu   sync.Mutex
+	ttft map[string]*histogram
+	// tokens counts tokens per model, indexed like tokenTypes
+	tokens map[string]*[4]int64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{ttft: make(map[string]*histogram), tokens: make(map[string]*[4]int64)}
+}
+
+// ObserveTTFT records the time to first token of a streamed response
+func (m *proxyMetrics) ObserveTTFT(model string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.ttft[model]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(ttftBuckets))}
+		m.ttft[model] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// AddUsage counts the tokens a response used by type, so the share of
+// input read from the prompt cache can be followed
+func (m *proxyMetrics) AddUsage(model string, usage Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts, ok := m.tokens[model]
+	if !ok {
+		counts = new([4]int64)
+		m.tokens[model] = counts
+	}
+	counts[0] += usage.InputTokens
+	counts[1] += usage.OutputTokens
+	counts[2] += usage.CacheReadInputTokens
+	counts[3] += usage.CacheCreationInputTokens
+}
+
+// labelEscaper escapes Prometheus label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (m *proxyMetrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	const name = "creddy_anthropic_time_to_first_token_seconds"
+	fmt.Fprintf(bw, "# HELP %s Time from sending a streaming request upstream to its first content_block_delta.\n", name)
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", name)
+	for _, model := range slices.Sorted(maps.Keys(m.ttft)) {
+		h, label := m.ttft[model], labelEscaper.Replace(model)
+		var cumulative uint64
+		for i, le := range ttftBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(bw, "%s_bucket{model=\"%s\",le=\"%s\"} %d\n", name, label, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "%s_bucket{model=\"%s\",le=\"+Inf\"} %d\n", name, label, h.count)
+		fmt.Fprintf(bw, "%s_sum{model=\"%s\"} %s\n", name, label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_count{model=\"%s\"} %d\n", name, label, h.count)
+	}
+
+	const tokens = "creddy_anthropic_tokens_total"
+	fmt.Fprintf(bw, "# HELP %s Tokens used by proxied requests, by type: input excludes cache_read and cache_creation.\n", tokens)
+	fmt.Fprintf(bw, "# TYPE %s counter\n", tokens)
+	for _, model := range slices.Sorted(maps.Keys(m.tokens)) {
+		label := labelEscaper.Replace(model)
+		for i, typ := range tokenTypes {
+			fmt.Fprintf(bw, "%s{model=\"%s\",type=\"%s\"} %d\n", tokens, label, typ, m.tokens[model][i])
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_TimeToFirstToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19540, "admin_token": "admin-secret", "audit_log_path": %q}`, path)
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\n"+`data: {"type":"message_start","message":{"model":"claude-haiku-4-5","usage":{"input_tokens":10}}}`+"\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, "event: content_block_delta\n"+`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"hi"}}`+"\n\n")
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5","stream":true}`)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	events := readAuditLog(t, path)
+	if ev := events[len(events)-1]; ev.Event != AuditRequest || ev.TTFTMS < 50 || ev.TTFTMS > ev.LatencyMS {
+		t.Errorf("request event ttft_ms = %d, latency_ms = %d", ev.TTFTMS, ev.LatencyMS)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`creddy_anthropic_time_to_first_token_seconds_bucket{model="claude-haiku-4-5",le="+Inf"} 1`,
+		`creddy_anthropic_time_to_first_token_seconds_count{model="claude-haiku-4-5"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetrics_RequiresAdmin(t *testing.T) {
+	_, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19541, "admin_token": "admin-secret"}`)
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestHistogram_Buckets(t *testing.T) {
+	m := newProxyMetrics()
+	m.ObserveTTFT("m", 250*time.Millisecond) // on a bucket bound
+	m.ObserveTTFT("m", 2*time.Minute)        // above every bound
+
+	var sb strings.Builder
+	m.WritePrometheus(&sb)
+	for _, want := range []string{`le="0.1"} 0`, `le="0.25"} 1`, `le="60"} 1`, `le="+Inf"} 2`, `_sum{model="m"} 120.25`} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, sb.String())
+		}
+	}
+}
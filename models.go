@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// modelsTimeout bounds listing models from Anthropic
+const modelsTimeout = 30 * time.Second
+
+// anthropicModel is a model as listed by GET /v1/models
+type anthropicModel struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"display_name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// modelsOutput is `models -json`
+type modelsOutput struct {
+	Models []modelOutput `json:"models"`
+	// Unmatched describes model patterns in the configuration that match
+	// none of the models, which are usually typos or retired models
+	Unmatched []string `json:"unmatched,omitempty"`
+}
+
+// modelOutput is a model and the scopes whose tokens may use it
+type modelOutput struct {
+	anthropicModel
+	Scopes []string `json:"scopes"`
+}
+
+// runModels runs `creddy-anthropic models`, listing the models the API key
+// can reach and which scopes permit them
+func runModels(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("models", flag.ContinueOnError)
+	configPath := flags.String("config", "", "plugin configuration file whose API key, policies, and allowed scopes to use (default: ANTHROPIC_API_KEY, built-in scopes)")
+	workspace := flags.String("workspace", "", "list with this configured workspace's API key and scopes")
+	asJSON := flags.Bool("json", false, "print the models and their scopes as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), modelsTimeout)
+	defer cancel()
+	var configJSON string
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return err
+		}
+		configJSON = string(data)
+	} else {
+		apiKey := os.Getenv("ANTHROPIC_API_KEY")
+		if apiKey == "" {
+			return errors.New("ANTHROPIC_API_KEY environment variable or -config required")
+		}
+		data, _ := json.Marshal(map[string]string{"api_key": apiKey})
+		configJSON = string(data)
+	}
+	cfg, err := parseConfig(ctx, configJSON)
+	if err != nil {
+		return err
+	}
+	// The configuration is only read, so no proxy is started
+	plugin := &AnthropicPlugin{config: cfg, upstreamURL: AnthropicBaseURL}
+	result, err := listScopedModels(ctx, plugin, *workspace)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return writeIndentedJSON(out, result)
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tNAME\tSCOPES")
+	for _, m := range result.Models {
+		scopes := strings.Join(m.Scopes, ", ")
+		if scopes == "" {
+			scopes = "(none)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", m.ID, m.DisplayName, scopes)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(result.Unmatched) > 0 {
+		fmt.Fprintln(out)
+		for _, problem := range result.Unmatched {
+			fmt.Fprintf(out, "warning: %s\n", problem)
+		}
+	}
+	return nil
+}
+
+// listScopedModels lists the models reachable with the API key of the
+// workspace ("" for api_key), each with the scopes that may be issued for
+// the workspace and permit Messages API requests for it
+func listScopedModels(ctx context.Context, p *AnthropicPlugin, workspace string) (*modelsOutput, error) {
+	p.mu.RLock()
+	cfg := p.config
+	p.mu.RUnlock()
+	key, policies := cfg.APIKey, cfg.Policies
+	if workspace != "" {
+		ws := cfg.workspaces[workspace]
+		if ws == nil {
+			return nil, fmt.Errorf("unknown workspace %q", workspace)
+		}
+		key, policies = ws.APIKey, ws.policies
+	}
+	models, err := listModels(ctx, p.UpstreamClient(), p.upstreamURL, key, cfg.AnthropicVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every scope that may be requested, resolved to the scope actually
+	// issued under allowed_scopes and scope_narrowing
+	var patterns []string
+	for _, def := range scopeDefs {
+		patterns = append(patterns, def.Pattern)
+	}
+	for _, spec := range policyScopeSpecs(policies) {
+		patterns = append(patterns, spec.Pattern)
+	}
+	type issuable struct {
+		pattern string
+		scope   *Scope
+	}
+	var scopes []issuable
+	for _, pattern := range patterns {
+		_, s, err := p.effectiveScope(cfg, withWorkspace(pattern, workspace))
+		if err == nil && s.AllowsPath("/v1/messages") {
+			scopes = append(scopes, issuable{withWorkspace(pattern, workspace), s})
+		}
+	}
+
+	result := &modelsOutput{Models: make([]modelOutput, len(models))}
+	for i, m := range models {
+		result.Models[i] = modelOutput{anthropicModel: m, Scopes: []string{}}
+		for _, s := range scopes {
+			if s.scope.AllowsModel(m.ID) {
+				result.Models[i].Scopes = append(result.Models[i].Scopes, s.pattern)
+			}
+		}
+	}
+
+	matchesAny := func(pattern string) bool {
+		return slices.ContainsFunc(models, func(m anthropicModel) bool {
+			ok, _ := path.Match(pattern, m.ID)
+			return ok
+		})
+	}
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if pol := policies[name]; pol != nil {
+			for _, pattern := range pol.Models {
+				if !matchesAny(pattern) {
+					result.Unmatched = append(result.Unmatched, fmt.Sprintf("policies[%q]: models pattern %q matches no available model", name, pattern))
+				}
+			}
+		}
+	}
+	names = names[:0]
+	for name := range cfg.ScopeNarrowing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		target, err := parseScope(cfg.ScopeNarrowing[name], policies)
+		if err != nil {
+			continue
+		}
+		for _, pattern := range target.Models {
+			if !matchesAny(pattern) {
+				result.Unmatched = append(result.Unmatched, fmt.Sprintf("scope_narrowing[%q]: model %q matches no available model", name, pattern))
+			}
+		}
+	}
+	return result, nil
+}
+
+// listModels lists every model key can use, following pagination
+func listModels(ctx context.Context, client *http.Client, baseURL, key, version string) ([]anthropicModel, error) {
+	var models []anthropicModel
+	q := url.Values{"limit": {"1000"}}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+modelsPath+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		setUpstreamAuth(req.Header, key)
+		req.Header.Set("anthropic-version", version)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("listing models: could not reach Anthropic: %w", err)
+		}
+		var page struct {
+			Data    []anthropicModel `json:"data"`
+			HasMore bool             `json:"has_more"`
+			LastID  string           `json:"last_id"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("listing models: Anthropic returned %s (%s)", resp.Status, upstreamErrorMessage(resp))
+		} else if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			err = fmt.Errorf("listing models: invalid response: %w", err)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, page.Data...)
+		if !page.HasMore || page.LastID == "" {
+			return models, nil
+		}
+		q.Set("after_id", page.LastID)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestListScopedModels(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" || r.Header.Get("x-api-key") != "sk-ant-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`)
+			return
+		}
+		// Two pages
+		if r.URL.Query().Get("after_id") == "" {
+			fmt.Fprint(w, `{"data":[{"id":"claude-haiku-4-5","display_name":"Claude Haiku 4.5"}],"has_more":true,"last_id":"claude-haiku-4-5"}`)
+			return
+		}
+		fmt.Fprint(w, `{"data":[{"id":"claude-sonnet-4-5","display_name":"Claude Sonnet 4.5"}],"has_more":false,"last_id":"claude-sonnet-4-5"}`)
+	}))
+	defer up.Close()
+
+	cfg, err := parseConfig(context.Background(), `{
+		"api_key": "sk-ant-test",
+		"policies": {
+			"anthropic:messages": {"models": ["claude-haiku-*"]},
+			"anthropic:ci": {"models": ["claude-sonet-*"]}
+		},
+		"allowed_scopes": ["anthropic:messages", "anthropic:ci", "anthropic:claude"],
+		"scope_narrowing": {"anthropic": "anthropic:messages"},
+		"workspaces": [{"name": "prod", "api_key": "sk-ant-other"}]
+	}`)
+	if err != nil {
+		t.Fatalf("parseConfig() error: %v", err)
+	}
+	plugin := &AnthropicPlugin{config: cfg, upstreamURL: up.URL}
+
+	result, err := listScopedModels(context.Background(), plugin, "")
+	if err != nil {
+		t.Fatalf("listScopedModels() error: %v", err)
+	}
+	scopes := map[string][]string{}
+	for _, m := range result.Models {
+		scopes[m.ID] = m.Scopes
+	}
+	want := map[string][]string{
+		"claude-haiku-4-5":  {"anthropic", "anthropic:claude", "anthropic:messages"},
+		"claude-sonnet-4-5": {"anthropic:claude"},
+	}
+	if !reflect.DeepEqual(scopes, want) {
+		t.Errorf("scopes = %v, want %v", scopes, want)
+	}
+	if len(result.Unmatched) != 1 || result.Unmatched[0] != `policies["anthropic:ci"]: models pattern "claude-sonet-*" matches no available model` {
+		t.Errorf("unmatched = %q", result.Unmatched)
+	}
+
+	if _, err := listScopedModels(context.Background(), plugin, "prod"); err == nil {
+		t.Error("listScopedModels() with a rejected workspace key should fail")
+	}
+	if _, err := listScopedModels(context.Background(), plugin, "staging"); err == nil {
+		t.Error("listScopedModels() with an unknown workspace should fail")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// parseProxyTLS checks the proxy port's TLS settings, loading the
+// certificates they name
+func parseProxyTLS(cfg *AnthropicConfig) error {
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	if cfg.TLSCertFile == "" {
+		if cfg.ClientCAFile != "" || len(cfg.ClientCertAgents) > 0 {
+			return errors.New("client_ca_file and client_cert_agents require tls_cert_file and tls_key_file")
+		}
+		return nil
+	}
+	if len(cfg.ClientCertAgents) > 0 && cfg.ClientCAFile == "" {
+		return errors.New("client_cert_agents requires client_ca_file")
+	}
+	for identity, patterns := range cfg.ClientCertAgents {
+		if identity == "" {
+			return errors.New("client_cert_agents: certificate identity must not be empty")
+		}
+		if len(patterns) == 0 {
+			return fmt.Errorf("client_cert_agents[%q]: at least one agent pattern is required", identity)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("client_cert_agents[%q]: invalid pattern %q", identity, pattern)
+			}
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return fmt.Errorf("tls_cert_file: %w", err)
+	}
+	cfg.proxyTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("client_ca_file: %w", err)
+		}
+		cfg.proxyTLS.ClientCAs = pool
+		// Certificates are required of API requests rather than in the
+		// handshake, so health checks reach the port without one
+		cfg.proxyTLS.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// loadCertPool reads the PEM certificates in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// certIdentities returns the names a client certificate identifies its
+// holder by: the subject common name and the DNS, email, and URI subject
+// alternative names
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	return ids
+}
+
+// ProxyTLSConfig returns the TLS configuration of the proxy port, or nil
+// to serve it without TLS
+func (p *AnthropicPlugin) ProxyTLSConfig() *tls.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.config == nil {
+		return nil
+	}
+	return p.config.proxyTLS
+}
+
+// RequiresClientCert reports whether requests on the proxy port must
+// present a client certificate client_ca_file verified
+func (p *AnthropicPlugin) RequiresClientCert() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config != nil && p.config.ClientCAFile != ""
+}
+
+// CheckClientCert checks that a request with a token of agentID came with
+// a client certificate client_ca_file verified, if one is required, and
+// that client_cert_agents maps one of its identities to the agent
+func (p *AnthropicPlugin) CheckClientCert(state *tls.ConnectionState, agentID string) error {
+	p.mu.RLock()
+	cfg := p.config
+	p.mu.RUnlock()
+	if cfg == nil || cfg.ClientCAFile == "" {
+		return nil
+	}
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return errors.New("a client certificate is required")
+	}
+	if len(cfg.ClientCertAgents) == 0 {
+		return nil
+	}
+	for _, id := range certIdentities(state.VerifiedChains[0][0]) {
+		if matchAny(cfg.ClientCertAgents[id], agentID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate is not mapped to agent %q", agentID)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "server", ca, caKey)
+	writeTestCert(t, dir, "ci-runner", ca, caKey)
+	writeTestCert(t, dir, "laptop", ca, caKey)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	plugin := newTestPlugin(t)
+	plugin.upstreamURL = upstream.URL
+	config, _ := json.Marshal(map[string]any{
+		"api_key":            "sk-ant-test",
+		"proxy_port":         19601,
+		"listen_addr":        "127.0.0.1",
+		"tls_cert_file":      filepath.Join(dir, "server.pem"),
+		"tls_key_file":       filepath.Join(dir, "server-key.pem"),
+		"client_ca_file":     filepath.Join(dir, "ca.pem"),
+		"client_cert_agents": map[string][]string{"ci-runner": {"ci-*"}},
+		"admin_token":        "admin-secret",
+	})
+	if err := plugin.Configure(context.Background(), string(config)); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	token := issueToken(t, plugin, "ci-1", "anthropic", 10*time.Minute)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	send := func(method, path, cert, key string) int {
+		t.Helper()
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != "" {
+			pair, err := tls.LoadX509KeyPair(filepath.Join(dir, cert+".pem"), filepath.Join(dir, cert+"-key.pem"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		req, _ := http.NewRequest(method, "https://localhost:19601"+path, strings.NewReader(`{"model":"claude-haiku-4-5","max_tokens":10}`))
+		req.Header.Set("x-api-key", key)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s with certificate %q: %v", method, path, cert, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tt := range []struct {
+		method, path, cert, key string
+		want                    int
+	}{
+		{"POST", "/v1/messages", "ci-runner", token.Value, http.StatusOK},
+		// The token alone is not enough
+		{"POST", "/v1/messages", "", token.Value, http.StatusUnauthorized},
+		// A certificate is only accepted for the agents it is mapped to
+		{"POST", "/v1/messages", "laptop", token.Value, http.StatusUnauthorized},
+		{"POST", "/v1/tokens/introspect", "laptop", token.Value, http.StatusUnauthorized},
+		// Nor is the admin token
+		{"GET", "/v1/tokens", "", "admin-secret", http.StatusUnauthorized},
+		{"GET", "/metrics", "", "admin-secret", http.StatusUnauthorized},
+		{"GET", "/v1/tokens", "laptop", "admin-secret", http.StatusOK},
+		// Health checks need no certificate
+		{"GET", "/health", "", "", http.StatusOK},
+		{"GET", "/livez", "", "", http.StatusOK},
+	} {
+		if got := send(tt.method, tt.path, tt.cert, tt.key); got != tt.want {
+			t.Errorf("%s %s with certificate %q: status %d, want %d", tt.method, tt.path, tt.cert, got, tt.want)
+		}
+	}
+}
+
+func TestConfigure_InvalidProxyTLS(t *testing.T) {
+	for _, extra := range []string{
+		`"tls_cert_file": "cert.pem"`,
+		`"client_ca_file": "ca.pem"`,
+		`"tls_cert_file": "cert.pem", "tls_key_file": "key.pem"`,
+		`"tls_cert_file": "cert.pem", "tls_key_file": "key.pem", "client_cert_agents": {"ci": ["ci-*"]}`,
+		`"tls_cert_file": "cert.pem", "tls_key_file": "key.pem", "client_ca_file": "ca.pem", "client_cert_agents": {"ci": ["ci-["]}`,
+	} {
+		plugin := newTestPlugin(t)
+		config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19601, %s}`, extra)
+		if err := plugin.Configure(context.Background(), config); err == nil {
+			t.Errorf("Configure() with %s should fail", extra)
+		}
+	}
+}
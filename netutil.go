@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// stringList is a config value accepted either as a JSON array or as a
+// comma-separated string, so list fields work from both raw JSON config
+// and generated CLI flags.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a list or comma-separated string")
+	}
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// parseCIDRs parses a list of CIDRs or bare IP addresses
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip falls in any of nets
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientFilter admits the client addresses in allow, or any if it is
+// empty, except those in deny
+type clientFilter struct {
+	allow, deny []*net.IPNet
+}
+
+// parseClientFilter parses an allow and a deny list, named for errors
+func parseClientFilter(allowName string, allow []string, denyName string, deny []string) (clientFilter, error) {
+	var f clientFilter
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return f, fmt.Errorf("%s: %w", allowName, err)
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return f, fmt.Errorf("%s: %w", denyName, err)
+	}
+	return f, nil
+}
+
+// allows reports whether f admits the client address ip. An address
+// that does not parse is only admitted when there are no lists.
+func (f clientFilter) allows(ip string) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil || containsIP(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, addr)
+}
+
+// clientIP returns the address of the client that sent r. When the direct
+// peer is a trusted proxy (e.g. Creddy), X-Forwarded-For is walked from the
+// right and the first untrusted hop is returned.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !containsIP(trusted, peer) {
+		return host
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			continue
+		}
+		if !containsIP(trusted, ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
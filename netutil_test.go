@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStringList_Unmarshal(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{`["a", "b"]`, []string{"a", "b"}},
+		{`"a, b,,c "`, []string{"a", "b", "c"}},
+		{`""`, nil},
+	}
+
+	for _, tt := range tests {
+		var got stringList
+		if err := json.Unmarshal([]byte(tt.input), &got); err != nil {
+			t.Fatalf("Unmarshal(%s) error: %v", tt.input, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("Unmarshal(%s) = %v, want %v", tt.input, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Unmarshal(%s) = %v, want %v", tt.input, got, tt.want)
+			}
+		}
+	}
+
+	var bad stringList
+	if err := json.Unmarshal([]byte(`42`), &bad); err == nil {
+		t.Error("expected error for non-string value")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("parseCIDRs() error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5555", "", "203.0.113.7"},
+		{"untrusted peer ignores XFF", "203.0.113.7:5555", "198.51.100.1", "203.0.113.7"},
+		{"trusted peer uses XFF", "127.0.0.1:5555", "198.51.100.1", "198.51.100.1"},
+		{"skips trusted hops", "127.0.0.1:5555", "198.51.100.1, 10.1.2.3", "198.51.100.1"},
+		{"spoofed leftmost ignored", "127.0.0.1:5555", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"trusted peer without XFF", "127.0.0.1:5555", "", "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs_Invalid(t *testing.T) {
+	if _, err := parseCIDRs([]string{"not-an-ip"}); err == nil {
+		t.Error("expected error for invalid address")
+	}
+}
+
+func TestClientFilter(t *testing.T) {
+	f, err := parseClientFilter("allow_cidrs", []string{"10.0.0.0/8", "2001:db8::/32"}, "deny_cidrs", []string{"10.66.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"2001:db8::1": true,
+		"10.66.1.1":   false,
+		"192.0.2.1":   false,
+		"not-an-ip":   false,
+	} {
+		if got := f.allows(ip); got != want {
+			t.Errorf("allows(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if !(clientFilter{}).allows("not-an-ip") {
+		t.Error("a filter without lists should admit every client")
+	}
+	if _, err := parseClientFilter("allow_cidrs", nil, "deny_cidrs", []string{"10.0.0.0/33"}); err == nil || !strings.HasPrefix(err.Error(), "deny_cidrs:") {
+		t.Errorf("parseClientFilter() = %v, want a deny_cidrs error", err)
+	}
+}
+
+func TestProxy_ClientAllowlists(t *testing.T) {
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19602, "admin_token": "admin-secret", "trusted_proxies": ["127.0.0.1"],
+		"allow_cidrs": ["10.0.0.0/8"], "deny_cidrs": ["10.66.0.0/16"], "issue_allow_cidrs": ["192.0.2.10"]}`
+	_, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	send := func(path, client string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(`{"agent_id": "agent-1", "scope": "anthropic", "ttl_seconds": 600}`))
+		req.Header.Set("x-api-key", "admin-secret")
+		req.Header.Set("X-Forwarded-For", client)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, tt := range []struct {
+		path, client string
+		want         int
+	}{
+		// Refused before the token is checked
+		{"/v1/messages", "10.66.0.5", http.StatusForbidden},
+		{"/v1/messages", "192.0.2.10", http.StatusForbidden},
+		{"/v1/messages", "10.1.2.3", http.StatusUnauthorized},
+		// Issuance has its own lists
+		{"/v1/tokens/issue", "10.1.2.3", http.StatusForbidden},
+		{"/v1/tokens/issue", "192.0.2.10", http.StatusOK},
+	} {
+		if got := send(tt.path, tt.client); got != tt.want {
+			t.Errorf("POST %s from %s: status %d, want %d", tt.path, tt.client, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// oauthTokenPrefix starts Anthropic OAuth access tokens, which are sent
+	// as bearer tokens rather than in x-api-key
+	oauthTokenPrefix = "sk-ant-oat"
+	// oauthBeta is the anthropic-beta flag the API requires with OAuth
+	// access tokens
+	oauthBeta = "oauth-2025-04-20"
+	// oauthRefreshMargin is how long before it expires an access token is
+	// refreshed
+	oauthRefreshMargin = 5 * time.Minute
+	// oauthCredentialsKey holds the tokens in Claude Code's credentials
+	// file
+	oauthCredentialsKey = "claudeAiOauth"
+	// oauthRetryDelay is how long after a failed refresh of an expiring
+	// token it is tried again
+	oauthRetryDelay = 30 * time.Second
+)
+
+// OAuthConfig authenticates to Anthropic with a Claude subscription's
+// OAuth tokens instead of an API key, refreshing the access token as it
+// expires
+type OAuthConfig struct {
+	CredentialsFile string `json:"credentials_file"` // File holding the tokens, as Claude Code's ~/.claude/.credentials.json; refreshed tokens are written back
+	TokenURL        string `json:"token_url"`        // OAuth token endpoint (default: Anthropic's)
+	ClientID        string `json:"client_id"`        // OAuth client the tokens were issued to (default: Claude Code's)
+
+	refreshToken string
+	expires      time.Time
+}
+
+// oauthCredentials are the tokens in a credentials file
+type oauthCredentials struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresAt    int64  `json:"expiresAt"` // Unix milliseconds
+}
+
+// setupOAuth reads the OAuth tokens, making the access token api_key
+func (cfg *AnthropicConfig) setupOAuth() error {
+	o := cfg.OAuth
+	if cfg.APIKey != "" || cfg.APIKeyFile != "" || cfg.APIKeyEnv != "" || cfg.APIKeyKeyring != "" {
+		return errors.New("oauth: api_key cannot be set as well")
+	}
+	if o.CredentialsFile == "" {
+		return errors.New("oauth: credentials_file is required")
+	}
+	if o.TokenURL == "" {
+		o.TokenURL = "https://console.anthropic.com/v1/oauth/token"
+	} else if err := checkSinkURL(o.TokenURL); err != nil {
+		return fmt.Errorf("oauth: token_url: %w", err)
+	}
+	if o.ClientID == "" {
+		o.ClientID = "9d1c250a-e61b-44d9-88ed-5944d1962f5e"
+	}
+	creds, err := readOAuthCredentials(o.CredentialsFile)
+	if err != nil {
+		return fmt.Errorf("oauth: credentials_file: %w", err)
+	}
+	cfg.APIKey, o.refreshToken = creds.AccessToken, creds.RefreshToken
+	if creds.ExpiresAt > 0 {
+		o.expires = time.UnixMilli(creds.ExpiresAt)
+	}
+	return nil
+}
+
+func readOAuthCredentials(file string) (*oauthCredentials, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var creds oauthCredentials
+	if err := json.Unmarshal(doc[oauthCredentialsKey], &creds); err != nil || creds.AccessToken == "" || creds.RefreshToken == "" {
+		return nil, fmt.Errorf("%s has no %s access and refresh tokens", file, oauthCredentialsKey)
+	}
+	return &creds, nil
+}
+
+// writeOAuthCredentials stores refreshed tokens in file, keeping the
+// file's other fields
+func writeOAuthCredentials(file string, creds oauthCredentials) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var doc, entry map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	json.Unmarshal(doc[oauthCredentialsKey], &entry)
+	if entry == nil {
+		entry = make(map[string]json.RawMessage)
+	}
+	entry["accessToken"], _ = json.Marshal(creds.AccessToken)
+	entry["refreshToken"], _ = json.Marshal(creds.RefreshToken)
+	entry["expiresAt"], _ = json.Marshal(creds.ExpiresAt)
+	doc[oauthCredentialsKey], _ = json.Marshal(entry)
+	return writeFileAtomic(file, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	})
+}
+
+// oauthDue reports whether cfg's OAuth access token should be refreshed
+func oauthDue(cfg *AnthropicConfig, rejected string) bool {
+	if cfg == nil || cfg.OAuth == nil {
+		return false
+	}
+	if rejected != "" {
+		return rejected == cfg.APIKey
+	}
+	return !cfg.OAuth.expires.IsZero() && time.Until(cfg.OAuth.expires) <= oauthRefreshMargin
+}
+
+// setUpstreamAuth authenticates an Anthropic request with key: an OAuth
+// access token as a bearer token, anything else as an API key
+func setUpstreamAuth(h http.Header, key string) {
+	if !strings.HasPrefix(key, oauthTokenPrefix) {
+		h.Del("Authorization")
+		h.Set("x-api-key", key)
+		return
+	}
+	h.Del("x-api-key")
+	h.Set("Authorization", "Bearer "+key)
+	for _, v := range h.Values("anthropic-beta") {
+		for _, flag := range strings.Split(v, ",") {
+			if strings.TrimSpace(flag) == oauthBeta {
+				return
+			}
+		}
+	}
+	h.Add("anthropic-beta", oauthBeta)
+}
+
+// RefreshOAuth refreshes the OAuth access token if it expires within
+// oauthRefreshMargin, or if it is rejected, the token Anthropic refused.
+// A token refreshed in the meantime is not refreshed again. It is a no-op
+// without oauth settings.
+func (p *AnthropicPlugin) RefreshOAuth(ctx context.Context, rejected string) error {
+	p.mu.RLock()
+	due := oauthDue(p.config, rejected)
+	p.mu.RUnlock()
+	if !due {
+		return nil
+	}
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	p.mu.RLock()
+	cfg := p.config
+	p.mu.RUnlock()
+	if !oauthDue(cfg, rejected) || (rejected == "" && time.Now().Before(p.oauthRetry)) {
+		return nil
+	}
+	if err := p.refreshOAuth(ctx, cfg); err != nil {
+		p.oauthRetry = time.Now().Add(oauthRetryDelay)
+		return err
+	}
+	return nil
+}
+
+// refreshOAuth exchanges cfg's refresh token for a new access token and
+// applies it. Called with p.configMu held.
+func (p *AnthropicPlugin) refreshOAuth(ctx context.Context, cfg *AnthropicConfig) error {
+	o := cfg.OAuth
+
+	body, _ := json.Marshal(map[string]string{"grant_type": "refresh_token", "refresh_token": o.refreshToken, "client_id": o.ClientID})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.TokenURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.UpstreamClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("refresh oauth token: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("refresh oauth token: status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil || token.AccessToken == "" {
+		return errors.New("refresh oauth token: no access_token in response")
+	}
+
+	refreshed := *o
+	if token.RefreshToken != "" {
+		refreshed.refreshToken = token.RefreshToken
+	}
+	refreshed.expires = time.Time{}
+	if token.ExpiresIn > 0 {
+		refreshed.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	creds := oauthCredentials{AccessToken: token.AccessToken, RefreshToken: refreshed.refreshToken}
+	if !refreshed.expires.IsZero() {
+		creds.ExpiresAt = refreshed.expires.UnixMilli()
+	}
+	// The refresh token may have been rotated, so the file must be kept
+	// current for the tokens to survive a restart
+	if err := writeOAuthCredentials(o.CredentialsFile, creds); err != nil {
+		slog.Error("Failed to save refreshed OAuth tokens", "path", o.CredentialsFile, "error", err)
+	}
+
+	updated := *cfg
+	updated.APIKey, updated.OAuth = token.AccessToken, &refreshed
+	updated.fingerprint = configFingerprint(&updated)
+	p.mu.Lock()
+	p.config = &updated
+	p.mu.Unlock()
+	slog.Info("Refreshed OAuth access token", "expires", refreshed.expires)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeOAuthCredentialsFile writes a Claude Code credentials file with an
+// access token expiring at expires
+func writeOAuthCredentialsFile(t *testing.T, access, refresh string, expires time.Time) string {
+	t.Helper()
+	data, _ := json.Marshal(map[string]any{oauthCredentialsKey: map[string]any{
+		"accessToken": access, "refreshToken": refresh, "expiresAt": expires.UnixMilli(), "subscriptionType": "max",
+	}})
+	file := filepath.Join(t.TempDir(), ".credentials.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfigure_OAuth(t *testing.T) {
+	plugin := newTestPlugin(t)
+	file := writeOAuthCredentialsFile(t, "sk-ant-oat01-initial", "sk-ant-ort01-initial", time.Now().Add(time.Hour))
+	empty := filepath.Join(t.TempDir(), "empty.json")
+	os.WriteFile(empty, []byte(`{}`), 0o600)
+	for _, tt := range []struct{ config, wantErr string }{
+		{`"api_key": "sk-ant-test", "oauth": {"credentials_file": "` + file + `"}`, "api_key cannot be set as well"},
+		{`"oauth": {}`, "credentials_file is required"},
+		{`"oauth": {"credentials_file": "` + empty + `"}`, "no claudeAiOauth access and refresh tokens"},
+		{`"oauth": {"credentials_file": "` + file + `", "token_url": "http://auth.example.com/token"}`, "must use https"},
+	} {
+		err := plugin.Configure(context.Background(), `{"proxy_port": 19599, `+tt.config+`}`)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Configure() = %v, want an error containing %q", tt.config, err, tt.wantErr)
+		}
+	}
+	if err := plugin.Configure(context.Background(), `{"proxy_port": 19599, "oauth": {"credentials_file": "`+file+`"}}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if key := plugin.GetAPIKey(); key != "sk-ant-oat01-initial" {
+		t.Errorf("GetAPIKey() = %q, want the credentials file's access token", key)
+	}
+}
+
+func TestProxy_OAuth(t *testing.T) {
+	var mu sync.Mutex
+	issued, refresh := 0, "sk-ant-ort01-initial"
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		if req["grant_type"] != "refresh_token" || req["refresh_token"] != refresh || req["client_id"] == "" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		// Refresh tokens are rotated on every use
+		issued++
+		refresh = fmt.Sprintf("sk-ant-ort01-%d", issued)
+		json.NewEncoder(w).Encode(map[string]any{"access_token": fmt.Sprintf("sk-ant-oat01-%d", issued), "refresh_token": refresh, "expires_in": 3600})
+	}))
+	defer tokens.Close()
+
+	rejected := map[string]bool{}
+	var auths []string
+	file := writeOAuthCredentialsFile(t, "sk-ant-oat01-initial", "sk-ant-ort01-initial", time.Now().Add(time.Minute))
+	config := `{"proxy_port": 19599, "oauth": {"credentials_file": "` + file + `", "token_url": "` + tokens.URL + `"}}`
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		auth := r.Header.Get("Authorization")
+		auths = append(auths, auth)
+		if r.Header.Get("x-api-key") != "" || !strings.Contains(r.Header.Get("anthropic-beta"), oauthBeta) || rejected[auth] {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid token"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	token := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	send := func() {
+		t.Helper()
+		resp := proxyRequest(t, srv, token.Value, `{"model":"claude-haiku-4-5","max_tokens":50}`)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200", resp.StatusCode)
+		}
+	}
+
+	// The access token expires within the refresh margin, so it is
+	// refreshed before the request
+	send()
+	// A revoked access token is refreshed when Anthropic rejects it
+	mu.Lock()
+	rejected["Bearer sk-ant-oat01-1"] = true
+	mu.Unlock()
+	send()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(auths, ","); got != "Bearer sk-ant-oat01-1,Bearer sk-ant-oat01-1,Bearer sk-ant-oat01-2" {
+		t.Errorf("upstream Authorization headers = %s", got)
+	}
+	creds, err := readOAuthCredentials(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessToken != "sk-ant-oat01-2" || creds.RefreshToken != "sk-ant-ort01-2" || time.Until(time.UnixMilli(creds.ExpiresAt)) < 59*time.Minute {
+		t.Errorf("saved credentials = %+v, want the refreshed tokens", creds)
+	}
+	data, _ := os.ReadFile(file)
+	if !strings.Contains(string(data), `"subscriptionType": "max"`) {
+		t.Errorf("credentials file lost its other fields:\n%s", data)
+	}
+}
+
+func TestSetUpstreamAuth(t *testing.T) {
+	h := http.Header{"Anthropic-Beta": {"prompt-caching-2024-07-31"}}
+	setUpstreamAuth(h, "sk-ant-oat01-abc")
+	if h.Get("Authorization") != "Bearer sk-ant-oat01-abc" || h.Get("x-api-key") != "" || len(h.Values("anthropic-beta")) != 2 {
+		t.Errorf("OAuth token headers = %v", h)
+	}
+	setUpstreamAuth(h, "sk-ant-oat01-def")
+	if len(h.Values("anthropic-beta")) != 2 {
+		t.Errorf("anthropic-beta repeated: %v", h.Values("anthropic-beta"))
+	}
+	setUpstreamAuth(h, "sk-ant-api03-abc")
+	if h.Get("x-api-key") != "sk-ant-api03-abc" || h.Get("Authorization") != "" {
+		t.Errorf("API key headers = %v", h)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resourceOwner records which agent created an upstream resource
+type resourceOwner struct {
+	AgentID string    `json:"agent_id"`
+	Created time.Time `json:"created"`
+}
+
+// resourceOwners tracks the agent that created each upstream resource of
+// one kind (message batches, files), so agents can only see and act on
+// their own: every resource belongs to the shared API key upstream. If
+// path is set, owners are saved there on every change.
+type resourceOwners struct {
+	kind   string // for log and error messages
+	mu     sync.Mutex
+	owners map[string]resourceOwner
+	path   string
+}
+
+func newResourceOwners(kind string) *resourceOwners {
+	return &resourceOwners{kind: kind, owners: make(map[string]resourceOwner)}
+}
+
+// Record notes that agentID created resource id
+func (b *resourceOwners) Record(id, agentID string, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.owners[id] = resourceOwner{AgentID: agentID, Created: now}
+	return b.save()
+}
+
+// Forget removes resource id, once it has been deleted upstream
+func (b *resourceOwners) Forget(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.owners, id)
+	return b.save()
+}
+
+// Owns reports whether agentID created resource id
+func (b *resourceOwners) Owns(id, agentID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	owner, ok := b.owners[id]
+	return ok && owner.AgentID == agentID
+}
+
+// Prune forgets resources created before cutoff
+func (b *resourceOwners) Prune(cutoff time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pruned := false
+	for id, owner := range b.owners {
+		if owner.Created.Before(cutoff) {
+			delete(b.owners, id)
+			pruned = true
+		}
+	}
+	if pruned {
+		if err := b.save(); err != nil {
+			slog.Error("Failed to save resource owners", "kind", b.kind, "error", err)
+		}
+	}
+}
+
+// save writes the owners to b.path, if set; b.mu must be held
+func (b *resourceOwners) save() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(b.owners)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Path returns the file owners are saved to, or "" if not persisted
+func (b *resourceOwners) Path() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.path
+}
+
+// Load replaces the owners with those saved at path and saves future
+// changes there; an empty path stops saving. A missing file is not an
+// error.
+func (b *resourceOwners) Load(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.path = path
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read %s owners: %w", b.kind, err)
+	}
+	owners := make(map[string]resourceOwner)
+	if err := json.Unmarshal(data, &owners); err != nil {
+		return fmt.Errorf("read %s owners: %w", b.kind, err)
+	}
+	b.owners = owners
+	return nil
+}
+
+// resourceID returns the resource ID in a path below collection, e.g.
+// /v1/files/<id>/content, or "" for the collection itself
+func resourceID(urlPath, collection string) string {
+	rest, ok := strings.CutPrefix(urlPath, collection+"/")
+	if !ok {
+		return ""
+	}
+	id, _, _ := strings.Cut(rest, "/")
+	return id
+}
+
+// rewriteOwnedResponse buffers a successful create or list response to
+// agentID's request for a resource collection, recording the created
+// resource's owner or filtering the list to the agent's own resources,
+// and replaces resp's body with the result
+func rewriteOwnedResponse(owners *resourceOwners, method string, resp *http.Response, agentID string) error {
+	body, err := readResponse(resp, maxListResponse)
+	if err != nil {
+		return err
+	}
+
+	switch method {
+	case http.MethodPost:
+		var created struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(body, &created); err != nil || created.ID == "" {
+			return fmt.Errorf("%s response has no id", owners.kind)
+		}
+		if err := owners.Record(created.ID, agentID, time.Now()); err != nil {
+			slog.Error("Failed to save resource owners", "kind", owners.kind, "error", err)
+		}
+	case http.MethodGet:
+		if body, err = filterList(body, func(id string) bool { return owners.Owns(id, agentID) }); err != nil {
+			return fmt.Errorf("filter %s list: %w", owners.kind, err)
+		}
+	}
+	setResponseBody(resp, body)
+	return nil
+}
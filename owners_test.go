@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_BatchOwnership(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batches.json")
+	var created int
+	plugin, srv, _ := newTestProxyWithUpstream(t, fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19546, "batch_owners_path": %q}`, path),
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == "POST" && r.URL.Path == batchesPath:
+				created++
+				fmt.Fprintf(w, `{"id":"msgbatch_%d","type":"message_batch","processing_status":"in_progress"}`, created)
+			case r.Method == "GET" && r.URL.Path == batchesPath:
+				w.Write([]byte(`{"data":[{"id":"msgbatch_2"},{"id":"msgbatch_1"},{"id":"msgbatch_unknown"}],"has_more":false,"first_id":"msgbatch_2","last_id":"msgbatch_unknown"}`))
+			default:
+				fmt.Fprintf(w, `{"path":%q}`, r.URL.Path)
+			}
+		})
+	agent1 := issueToken(t, plugin, "agent-1", "anthropic:batches", 10*time.Minute)
+	agent2 := issueToken(t, plugin, "agent-2", "anthropic:batches", 10*time.Minute)
+
+	do := func(token, method, urlPath string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+urlPath, strings.NewReader(`{"requests":[]}`))
+		req.Header.Set("x-api-key", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	do(agent1.Value, "POST", batchesPath)
+	do(agent2.Value, "POST", batchesPath)
+
+	for _, tc := range []struct {
+		token, method, path string
+		want                int
+	}{
+		{agent1.Value, "GET", batchesPath + "/msgbatch_1", 200},
+		{agent1.Value, "GET", batchesPath + "/msgbatch_1/results", 200},
+		{agent1.Value, "POST", batchesPath + "/msgbatch_1/cancel", 200},
+		{agent2.Value, "GET", batchesPath + "/msgbatch_1", 404},
+		{agent2.Value, "GET", batchesPath + "/msgbatch_1/results", 404},
+		{agent2.Value, "POST", batchesPath + "/msgbatch_1/cancel", 404},
+		{agent2.Value, "DELETE", batchesPath + "/msgbatch_1", 404},
+		{agent1.Value, "GET", batchesPath + "/msgbatch_unknown", 404},
+	} {
+		if status, body := do(tc.token, tc.method, tc.path); status != tc.want {
+			t.Errorf("%s %s = %d, want %d: %s", tc.method, tc.path, status, tc.want, body)
+		}
+	}
+
+	// Listing shows each agent only its own batches
+	_, body := do(agent2.Value, "GET", batchesPath)
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+		HasMore *bool `json:"has_more"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatalf("invalid list response %q: %v", body, err)
+	}
+	if len(list.Data) != 1 || list.Data[0].ID != "msgbatch_2" || list.HasMore == nil {
+		t.Errorf("agent-2 list = %s", body)
+	}
+
+	// Ownership survives a restart
+	owners := newResourceOwners("batch")
+	if err := owners.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !owners.Owns("msgbatch_1", "agent-1") || owners.Owns("msgbatch_1", "agent-2") {
+		t.Error("restored owners should match the recorded ones")
+	}
+}
+
+func TestResourceOwners_Prune(t *testing.T) {
+	owners := newResourceOwners("batch")
+	now := time.Now()
+	owners.Record("old", "agent-1", now.Add(-31*24*time.Hour))
+	owners.Record("new", "agent-1", now)
+	owners.Prune(now.Add(-batchOwnerRetention))
+	if owners.Owns("old", "agent-1") || !owners.Owns("new", "agent-1") {
+		t.Error("Prune should forget only batches past retention")
+	}
+}
+
+func TestProxy_FileOwnership(t *testing.T) {
+	var uploaded int
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19549}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST" && r.URL.Path == filesPath:
+			uploaded++
+			fmt.Fprintf(w, `{"id":"file_%d","type":"file","filename":"notes.txt"}`, uploaded)
+		case r.Method == "GET" && r.URL.Path == filesPath:
+			w.Write([]byte(`{"data":[{"id":"file_2"},{"id":"file_1"}],"has_more":false}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+	// A model constraint must not make the proxy parse multipart uploads
+	agent1 := issueToken(t, plugin, "agent-1", "anthropic:model:claude-*", 10*time.Minute)
+	agent2 := issueToken(t, plugin, "agent-2", "anthropic", 10*time.Minute)
+
+	do := func(token, method, urlPath, contentType, body string) int {
+		req, _ := http.NewRequest(method, srv.URL+urlPath, strings.NewReader(body))
+		req.Header.Set("x-api-key", token)
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	upload := "--x\r\nContent-Disposition: form-data; name=\"file\"; filename=\"notes.txt\"\r\n\r\nhello\r\n--x--\r\n"
+	if status := do(agent1.Value, "POST", filesPath, "multipart/form-data; boundary=x", upload); status != http.StatusOK {
+		t.Fatalf("upload: status = %d, want 200", status)
+	}
+	do(agent2.Value, "POST", filesPath, "multipart/form-data; boundary=x", upload)
+
+	message := `{"model":"claude-haiku-4-5","max_tokens":10,"messages":[{"role":"user","content":[{"type":"document","source":{"type":"file","file_id":"file_1"}}]}]}`
+	for _, tc := range []struct {
+		name                string
+		token, method, path string
+		body                string
+		want                int
+	}{
+		{"owner reads metadata", agent1.Value, "GET", filesPath + "/file_1", "", 200},
+		{"owner downloads", agent1.Value, "GET", filesPath + "/file_1/content", "", 200},
+		{"other agent reads metadata", agent2.Value, "GET", filesPath + "/file_1", "", 404},
+		{"other agent downloads", agent2.Value, "GET", filesPath + "/file_1/content", "", 404},
+		{"other agent deletes", agent2.Value, "DELETE", filesPath + "/file_1", "", 404},
+		{"owner refers to file", agent1.Value, "POST", "/v1/messages", message, 200},
+		{"other agent refers to file", agent2.Value, "POST", "/v1/messages", message, 404},
+		{"owner deletes", agent1.Value, "DELETE", filesPath + "/file_1", "", 200},
+		{"deleted file is forgotten", agent1.Value, "GET", filesPath + "/file_1", "", 404},
+	} {
+		if status := do(tc.token, tc.method, tc.path, "application/json", tc.body); status != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, status, tc.want)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+filesPath, nil)
+	req.Header.Set("x-api-key", agent2.Value)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "file_2") || strings.Contains(string(body), "file_1") {
+		t.Errorf("agent-2 file list = %s", body)
+	}
+}
+
+func TestFileReferences(t *testing.T) {
+	body := `{"messages":[{"content":[{"type":"image","source":{"type":"file","file_id":"file_a"}},{"type":"text","text":"file_id"}]}],
+		"requests":[{"params":{"messages":[{"content":[{"source":{"file_id":"file_b"}}]}]}}]}`
+	got := fileReferences([]byte(body))
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"file_a", "file_b"}) {
+		t.Errorf("fileReferences() = %v", got)
+	}
+	if got := fileReferences([]byte(`{"messages":[]}`)); got != nil {
+		t.Errorf("fileReferences() = %v, want none", got)
+	}
+}
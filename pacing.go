@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pacingThreshold is the fraction of the upstream request limit below
+// which requests are spaced out until the limit resets
+const pacingThreshold = 0.1
+
+// upstreamLimitPrefixes are the anthropic-ratelimit-* header families
+// reported by the API; each has -limit, -remaining, and -reset headers
+var upstreamLimitPrefixes = []string{
+	"anthropic-ratelimit-requests-",
+	"anthropic-ratelimit-tokens-",
+	"anthropic-ratelimit-input-tokens-",
+	"anthropic-ratelimit-output-tokens-",
+}
+
+// upstreamPacer delays outgoing requests based on the organization's rate
+// limit state reported in upstream response headers, so agents sharing
+// the key don't all run into upstream 429s. It is shared by all tokens of
+// a plugin instance.
+type upstreamPacer struct {
+	mu sync.Mutex
+	// blockedUntil holds all requests until a limit that ran out resets
+	blockedUntil time.Time
+	// interval spaces requests apart until intervalUntil while few
+	// requests remain; next is the earliest slot not yet reserved
+	interval      time.Duration
+	intervalUntil time.Time
+	next          time.Time
+}
+
+func newUpstreamPacer() *upstreamPacer {
+	return &upstreamPacer{}
+}
+
+// Reserve returns how long a request made at now must wait before going
+// upstream. If that exceeds maxWait, no slot is reserved and it returns
+// false.
+func (p *upstreamPacer) Reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := now
+	if p.blockedUntil.After(start) {
+		start = p.blockedUntil
+	}
+	paced := p.interval > 0 && p.intervalUntil.After(start)
+	if paced && p.next.After(start) {
+		start = p.next
+	}
+	wait := start.Sub(now)
+	if wait > maxWait {
+		return wait, false
+	}
+	if paced {
+		p.next = start.Add(p.interval)
+	}
+	return wait, true
+}
+
+// Observe updates the pacing state from an upstream response received at
+// now
+func (p *upstreamPacer) Observe(h http.Header, status int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, prefix := range upstreamLimitPrefixes {
+		limit, err1 := strconv.ParseInt(h.Get(prefix+"limit"), 10, 64)
+		remaining, err2 := strconv.ParseInt(h.Get(prefix+"remaining"), 10, 64)
+		reset, err3 := time.Parse(time.RFC3339, h.Get(prefix+"reset"))
+		if err1 != nil || err2 != nil || err3 != nil || limit <= 0 || !reset.After(now) {
+			continue
+		}
+		if remaining <= 0 && reset.After(p.blockedUntil) {
+			p.blockedUntil = reset
+		}
+		if prefix != "anthropic-ratelimit-requests-" {
+			continue
+		}
+		if remaining > 0 && float64(remaining) < float64(limit)*pacingThreshold {
+			p.interval = reset.Sub(now) / time.Duration(remaining)
+			p.intervalUntil = reset
+		} else {
+			p.interval = 0
+		}
+	}
+
+	if status == http.StatusTooManyRequests {
+		if secs, err := strconv.Atoi(h.Get("Retry-After")); err == nil && secs > 0 {
+			if until := now.Add(time.Duration(secs) * time.Second); until.After(p.blockedUntil) {
+				p.blockedUntil = until
+			}
+		}
+	}
+}
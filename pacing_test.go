@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func limitHeaders(limit, remaining string, reset time.Time) http.Header {
+	h := http.Header{}
+	h.Set("anthropic-ratelimit-requests-limit", limit)
+	h.Set("anthropic-ratelimit-requests-remaining", remaining)
+	h.Set("anthropic-ratelimit-requests-reset", reset.Format(time.RFC3339))
+	return h
+}
+
+func TestUpstreamPacer(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	p := newUpstreamPacer()
+
+	// Plenty left: no delay
+	p.Observe(limitHeaders("100", "50", now.Add(time.Minute)), http.StatusOK, now)
+	if wait, ok := p.Reserve(now, time.Minute); !ok || wait != 0 {
+		t.Errorf("Reserve() = %v, %v; want no wait", wait, ok)
+	}
+
+	// Under 10% left: the 5 remaining requests are spread over the minute
+	p.Observe(limitHeaders("100", "5", now.Add(time.Minute)), http.StatusOK, now)
+	for i, want := range []time.Duration{0, 12 * time.Second, 24 * time.Second} {
+		if wait, ok := p.Reserve(now, time.Minute); !ok || wait != want {
+			t.Errorf("Reserve() #%d = %v, %v; want %v", i+1, wait, ok, want)
+		}
+	}
+
+	// Exhausted: requests are held until the reset, or refused if that is
+	// too far away
+	p = newUpstreamPacer()
+	p.Observe(limitHeaders("100", "0", now.Add(40*time.Second)), http.StatusOK, now)
+	if wait, ok := p.Reserve(now, time.Minute); !ok || wait != 40*time.Second {
+		t.Errorf("Reserve() = %v, %v; want 40s", wait, ok)
+	}
+	if _, ok := p.Reserve(now, 30*time.Second); ok {
+		t.Error("Reserve() should refuse waits over the maximum")
+	}
+}
+
+func TestUpstreamPacer_RetryAfter(t *testing.T) {
+	now := time.Now()
+	p := newUpstreamPacer()
+	p.Observe(http.Header{"Retry-After": {"20"}}, http.StatusTooManyRequests, now)
+	if wait, ok := p.Reserve(now, time.Minute); !ok || wait != 20*time.Second {
+		t.Errorf("Reserve() = %v, %v; want 20s", wait, ok)
+	}
+}
+
+func TestProxy_AdaptivePacing(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19536,
+		"adaptive_pacing": true, "pacing_max_wait_seconds": 5}`, func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range limitHeaders("50", "0", time.Now().Add(time.Hour)) {
+			w.Header()[k] = v
+		}
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+}
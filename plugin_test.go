@@ -3,7 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -12,8 +17,17 @@ import (
 	sdk "github.com/getcreddy/creddy-plugin-sdk"
 )
 
+// newTestPlugin returns a plugin that is shut down when the test ends,
+// releasing its proxy port
+func newTestPlugin(t *testing.T) *AnthropicPlugin {
+	t.Helper()
+	p := NewPlugin()
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+	return p
+}
+
 func TestPluginInfo(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	info, err := plugin.Info(context.Background())
 	if err != nil {
 		t.Fatalf("Info() error: %v", err)
@@ -28,10 +42,13 @@ func TestPluginInfo(t *testing.T) {
 	if info.Description == "" {
 		t.Error("expected non-empty description")
 	}
+	if details := buildVersion().details(); details != "" && !strings.Contains(info.Description, details) {
+		t.Errorf("description %q lacks build metadata %q", info.Description, details)
+	}
 }
 
 func TestConfigSchema(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	schema, err := plugin.ConfigSchema(context.Background())
 	if err != nil {
 		t.Fatalf("ConfigSchema() error: %v", err)
@@ -41,26 +58,32 @@ func TestConfigSchema(t *testing.T) {
 		t.Fatal("expected non-empty schema")
 	}
 
-	// Should have api_key field
-	hasAPIKey := false
+	// Should have api_key field, and the alternatives to it
+	hasAPIKey, sources := false, 0
 	for _, field := range schema {
-		if field.Name == "api_key" {
+		switch field.Name {
+		case "api_key":
 			hasAPIKey = true
-			if !field.Required {
-				t.Error("api_key should be required")
+			if field.Required {
+				t.Error("api_key should not be required when it can come from a file, env, or keyring")
 			}
 			if field.Type != "secret" {
 				t.Errorf("api_key should be type 'secret', got %q", field.Type)
 			}
+		case "api_key_file", "api_key_env", "api_key_keyring":
+			sources++
 		}
 	}
 	if !hasAPIKey {
 		t.Error("expected api_key field in schema")
 	}
+	if sources != 3 {
+		t.Errorf("expected api_key_file, api_key_env, and api_key_keyring in schema, got %d of them", sources)
+	}
 }
 
 func TestConfigure_MissingAPIKey(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{}`)
 	if err == nil {
 		t.Fatal("expected error for missing api_key")
@@ -71,7 +94,7 @@ func TestConfigure_MissingAPIKey(t *testing.T) {
 }
 
 func TestConfigure_EmptyAPIKey(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{"api_key": ""}`)
 	if err == nil {
 		t.Fatal("expected error for empty api_key")
@@ -79,7 +102,7 @@ func TestConfigure_EmptyAPIKey(t *testing.T) {
 }
 
 func TestConfigure_InvalidJSON(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{invalid}`)
 	if err == nil {
 		t.Fatal("expected error for invalid JSON")
@@ -87,7 +110,7 @@ func TestConfigure_InvalidJSON(t *testing.T) {
 }
 
 func TestConfigure_DefaultProxyPort(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test"}`)
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -99,7 +122,7 @@ func TestConfigure_DefaultProxyPort(t *testing.T) {
 }
 
 func TestConfigure_CustomProxyPort(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 9999}`)
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -110,8 +133,72 @@ func TestConfigure_CustomProxyPort(t *testing.T) {
 	}
 }
 
+func TestConfigure_Reconfigure(t *testing.T) {
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-old", "proxy_port": 19564}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic",
+		TTL:   10 * time.Minute,
+		Agent: sdk.Agent{ID: "test", Name: "test"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+	live := func(port int) bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/livez", port))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+
+	// Same port: the key changes in place and the listener stays
+	proxy := plugin.proxy
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-new", "proxy_port": 19564}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if plugin.proxy != proxy || !live(19564) || plugin.GetAPIKey() != "sk-ant-new" {
+		t.Errorf("same-port reconfiguration: proxy replaced %v, live %v, key %q", plugin.proxy != proxy, live(19564), plugin.GetAPIKey())
+	}
+	if _, ok := plugin.ValidateToken(cred.Value); !ok {
+		t.Error("token issued before reconfiguration is no longer valid")
+	}
+
+	// A port in use fails without changing anything
+	busy, err := net.Listen("tcp", ":19566")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-other", "proxy_port": 19566}`); err == nil {
+		t.Error("Configure() should fail when proxy_port is in use")
+	}
+	if plugin.GetAPIKey() != "sk-ant-new" || plugin.GetProxyPort() != 19564 || !live(19564) {
+		t.Errorf("failed reconfiguration was applied: key %q, port %d", plugin.GetAPIKey(), plugin.GetProxyPort())
+	}
+
+	// A new port is served before the old one closes
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-new", "proxy_port": 19565}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if !live(19565) {
+		t.Error("new port is not served")
+	}
+	for deadline := time.Now().Add(2 * time.Second); live(19564); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("old port is still served")
+		}
+	}
+	if _, ok := plugin.ValidateToken(cred.Value); !ok {
+		t.Error("token issued before the port change is no longer valid")
+	}
+}
+
 func TestMatchScope(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 
 	tests := []struct {
 		scope string
@@ -142,7 +229,7 @@ func TestMatchScope(t *testing.T) {
 }
 
 func TestScopes(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	scopes, err := plugin.Scopes(context.Background())
 	if err != nil {
 		t.Fatalf("Scopes() error: %v", err)
@@ -165,7 +252,7 @@ func TestScopes(t *testing.T) {
 }
 
 func TestConstraints(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	constraints, err := plugin.Constraints(context.Background())
 	if err != nil {
 		t.Fatalf("Constraints() error: %v", err)
@@ -180,7 +267,7 @@ func TestConstraints(t *testing.T) {
 }
 
 func TestValidate_NotConfigured(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Validate(context.Background())
 	if err == nil {
 		t.Fatal("expected error when not configured")
@@ -188,20 +275,51 @@ func TestValidate_NotConfigured(t *testing.T) {
 }
 
 func TestValidate_Configured(t *testing.T) {
-	plugin := NewPlugin()
-	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test"}`)
-	if err != nil {
-		t.Fatalf("Configure() error: %v", err)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" || r.Header.Get("anthropic-version") == "" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		switch r.Header.Get("x-api-key") {
+		case "sk-ant-test":
+			w.Write([]byte(`{"data":[{"id":"claude-haiku-4-5","type":"model"}],"has_more":true}`))
+		case "sk-ant-limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"type":"error","error":{"type":"rate_limit_error","message":"Too many requests"}}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	plugin := newTestPlugin(t)
+	plugin.upstreamURL = upstream.URL
+	for _, tt := range []struct {
+		key     string
+		wantErr string
+	}{
+		{key: "sk-ant-test"},
+		{key: "sk-ant-limited"},
+		{key: "sk-ant-revoked", wantErr: "api_key was rejected by Anthropic; it is invalid, expired, or revoked (authentication_error: invalid x-api-key)"},
+	} {
+		if err := plugin.Configure(context.Background(), `{"api_key": "`+tt.key+`"}`); err != nil {
+			t.Fatalf("Configure() error: %v", err)
+		}
+		err := plugin.Validate(context.Background())
+		if got := fmt.Sprint(err); (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && got != tt.wantErr) {
+			t.Errorf("%s: Validate() = %v, want %q", tt.key, err, tt.wantErr)
+		}
 	}
 
-	err = plugin.Validate(context.Background())
-	if err != nil {
-		t.Fatalf("Validate() error: %v", err)
+	upstream.Close()
+	if err := plugin.Validate(context.Background()); err == nil || !strings.Contains(err.Error(), "could not reach Anthropic") {
+		t.Errorf("Validate() with Anthropic unreachable = %v", err)
 	}
 }
 
 func TestGetCredential_NotConfigured(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	_, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
 		Scope: "anthropic",
 		TTL:   10 * time.Minute,
@@ -212,7 +330,7 @@ func TestGetCredential_NotConfigured(t *testing.T) {
 }
 
 func TestGetCredential_TokenFormat(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19401}`)
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -237,10 +355,13 @@ func TestGetCredential_TokenFormat(t *testing.T) {
 		t.Errorf("token too short: %d chars", len(cred.Value))
 	}
 
-	// ExternalID should be set (same as Value for this plugin)
+	// ExternalID should be set (the token hash, never the plaintext)
 	if cred.ExternalID == "" {
 		t.Error("expected ExternalID to be set")
 	}
+	if cred.ExternalID == cred.Value {
+		t.Error("expected ExternalID to differ from the plaintext token")
+	}
 
 	// ExpiresAt should be set
 	if cred.ExpiresAt.IsZero() {
@@ -252,7 +373,7 @@ func TestGetCredential_TokenFormat(t *testing.T) {
 }
 
 func TestGetCredential_TTLRespected(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19402}`)
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -405,8 +526,342 @@ func TestTokenStore_Concurrent(t *testing.T) {
 	}
 }
 
+func TestBoltTokenStore_Persistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+
+	store, err := NewBoltTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltTokenStore() error: %v", err)
+	}
+	store.Add("crd_keep", &TokenInfo{
+		AgentID:   "agent1",
+		AgentName: "Test Agent",
+		Scope:     "anthropic",
+		ExpiresAt: time.Now().Add(10 * time.Minute),
+		CreatedAt: time.Now(),
+	})
+	store.Add("crd_revoked", &TokenInfo{ExpiresAt: time.Now().Add(10 * time.Minute)})
+	store.Add("crd_expired", &TokenInfo{ExpiresAt: time.Now().Add(-1 * time.Minute)})
+	store.Remove("crd_revoked")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	// Reopen, simulating a plugin restart
+	store, err = NewBoltTokenStore(path)
+	if err != nil {
+		t.Fatalf("reopen error: %v", err)
+	}
+	defer store.Close()
+
+	got, ok := store.Get("crd_keep")
+	if !ok {
+		t.Fatal("expected token to survive restart")
+	}
+	if got.AgentName != "Test Agent" || got.Scope != "anthropic" {
+		t.Errorf("metadata not preserved: %+v", got)
+	}
+	if _, ok := store.Get("crd_revoked"); ok {
+		t.Error("expected revoked token to stay revoked")
+	}
+	if _, ok := store.Get("crd_expired"); ok {
+		t.Error("expected expired token to not be found")
+	}
+}
+
+func TestTokenStore_List(t *testing.T) {
+	stores := map[string]TokenStore{
+		"memory": NewTokenStore(),
+	}
+	bolt, err := NewBoltTokenStore(filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatalf("NewBoltTokenStore() error: %v", err)
+	}
+	defer bolt.Close()
+	stores["bolt"] = bolt
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			store.Add("crd_a", &TokenInfo{AgentID: "a", ExpiresAt: time.Now().Add(10 * time.Minute)})
+			store.Add("crd_b", &TokenInfo{AgentID: "b", ExpiresAt: time.Now().Add(10 * time.Minute)})
+			store.Add("crd_old", &TokenInfo{AgentID: "old", ExpiresAt: time.Now().Add(-1 * time.Minute)})
+
+			if got := len(store.List(TokenFilter{})); got != 2 {
+				t.Errorf("expected 2 active tokens, got %d", got)
+			}
+			if removed := store.Cleanup(); removed != 1 {
+				t.Errorf("expected 1 removed, got %d", removed)
+			}
+		})
+	}
+}
+
+func TestListTokens(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19406}`)
+	if err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	requests := []struct{ agent, scope string }{
+		{"agent-a", "anthropic"},
+		{"agent-b", "anthropic:claude"},
+		{"agent-a", "anthropic:claude"},
+	}
+	for _, r := range requests {
+		_, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+			Scope: r.scope,
+			TTL:   10 * time.Minute,
+			Agent: sdk.Agent{ID: r.agent, Name: r.agent},
+		})
+		if err != nil {
+			t.Fatalf("GetCredential() error: %v", err)
+		}
+	}
+
+	all := plugin.ListTokens(TokenFilter{})
+	if len(all) != 3 {
+		t.Fatalf("expected 3 tokens, got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].CreatedAt.Before(all[i-1].CreatedAt) {
+			t.Error("expected tokens ordered by creation time")
+		}
+	}
+
+	if got := plugin.ListTokens(TokenFilter{AgentID: "agent-a"}); len(got) != 2 {
+		t.Errorf("expected 2 tokens for agent-a, got %d", len(got))
+	}
+	if got := plugin.ListTokens(TokenFilter{AgentID: "agent-a", Scope: "anthropic:claude"}); len(got) != 1 {
+		t.Errorf("expected 1 token for agent-a/anthropic:claude, got %d", len(got))
+	}
+}
+
+func TestRenewCredential(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19407}`)
+	if err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic",
+		TTL:   5 * time.Minute,
+		Agent: sdk.Agent{ID: "test", Name: "test"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+
+	info, err := plugin.RenewCredential(context.Background(), cred.ExternalID, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("RenewCredential() error: %v", err)
+	}
+	if d := time.Until(info.ExpiresAt); d < 29*time.Minute || d > 30*time.Minute {
+		t.Errorf("expected expiry ~30m out, got %v", d)
+	}
+
+	// Requests beyond MaxTTL are clamped
+	info, err = plugin.RenewCredential(context.Background(), cred.ExternalID, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("RenewCredential() error: %v", err)
+	}
+	if d := time.Until(info.ExpiresAt); d > maxTokenTTL {
+		t.Errorf("expected renewal clamped to %v, got %v", maxTokenTTL, d)
+	}
+
+	// The same token value keeps working
+	got, ok := plugin.ValidateToken(cred.Value)
+	if !ok || !got.ExpiresAt.Equal(info.ExpiresAt) {
+		t.Error("expected renewed expiry to apply to the existing token")
+	}
+
+	plugin.RevokeCredential(context.Background(), cred.ExternalID)
+	if _, err := plugin.RenewCredential(context.Background(), cred.ExternalID, time.Minute); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound for revoked token, got %v", err)
+	}
+}
+
+func TestGetCredential_MaxTokensPerAgent(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19408, "max_tokens_per_agent": 2}`)
+	if err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	request := func(agent string) (*sdk.Credential, error) {
+		return plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+			Scope: "anthropic",
+			TTL:   10 * time.Minute,
+			Agent: sdk.Agent{ID: agent, Name: agent},
+		})
+	}
+
+	first, err := request("greedy")
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+	if _, err := request("greedy"); err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+	if _, err := request("greedy"); err == nil || !strings.Contains(err.Error(), "max_tokens_per_agent") {
+		t.Fatalf("expected max_tokens_per_agent error, got %v", err)
+	}
+
+	// Other agents are unaffected
+	if _, err := request("other"); err != nil {
+		t.Fatalf("GetCredential() for other agent error: %v", err)
+	}
+
+	// Revoking frees a slot
+	plugin.RevokeCredential(context.Background(), first.ExternalID)
+	if _, err := request("greedy"); err != nil {
+		t.Fatalf("expected issuance after revoke, got %v", err)
+	}
+}
+
+func TestGetCredential_StoresOnlyHash(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19409}`)
+	if err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic",
+		TTL:   10 * time.Minute,
+		Agent: sdk.Agent{ID: "test", Name: "test"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+
+	store := plugin.tokenStore().(*MemoryTokenStore)
+	for key, info := range store.tokens {
+		if strings.Contains(key, cred.Value) || strings.HasPrefix(key, "crd_") {
+			t.Errorf("store key contains plaintext token: %s", key)
+		}
+		if key != info.ID {
+			t.Errorf("store key %s does not match info ID %s", key, info.ID)
+		}
+	}
+	if _, ok := store.tokens[hashToken(cred.Value)]; !ok {
+		t.Error("expected token to be stored under its hash")
+	}
+
+	// Revocation works with either the ExternalID or the plaintext token
+	plugin.RevokeCredential(context.Background(), cred.Value)
+	if _, ok := plugin.ValidateToken(cred.Value); ok {
+		t.Error("expected token revoked by plaintext value to be invalid")
+	}
+}
+
+func TestGetCredential_CustomTokenFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		prefix   string
+		valueLen int
+	}{
+		{"defaults", `{}`, "crd_", 48},
+		{"hex 32 bytes", `{"token_prefix": "crda_", "token_bytes": 32}`, "crda_", 64},
+		{"base64url", `{"token_prefix": "crda_", "token_encoding": "base64url"}`, "crda_", 32},
+		{"base32", `{"token_encoding": "base32", "token_bytes": 20}`, "crd_", 32},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var extra map[string]any
+			json.Unmarshal([]byte(tt.config), &extra)
+			extra["api_key"] = "sk-ant-test"
+			extra["proxy_port"] = 19420 + i
+			config, _ := json.Marshal(extra)
+
+			plugin := newTestPlugin(t)
+			if err := plugin.Configure(context.Background(), string(config)); err != nil {
+				t.Fatalf("Configure() error: %v", err)
+			}
+			cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+				Scope: "anthropic",
+				TTL:   10 * time.Minute,
+				Agent: sdk.Agent{ID: "test", Name: "test"},
+			})
+			if err != nil {
+				t.Fatalf("GetCredential() error: %v", err)
+			}
+
+			if !strings.HasPrefix(cred.Value, tt.prefix) {
+				t.Errorf("expected prefix %q, got %q", tt.prefix, cred.Value)
+			}
+			if got := len(strings.TrimPrefix(cred.Value, tt.prefix)); got != tt.valueLen {
+				t.Errorf("expected %d encoded chars, got %d (%s)", tt.valueLen, got, cred.Value)
+			}
+			if _, ok := plugin.ValidateToken(cred.Value); !ok {
+				t.Error("expected token to validate")
+			}
+			plugin.RevokeCredential(context.Background(), cred.Value)
+			if _, ok := plugin.ValidateToken(cred.Value); ok {
+				t.Error("expected revocation by plaintext value to work with a custom prefix")
+			}
+		})
+	}
+}
+
+func TestConfigure_InvalidTokenFormat(t *testing.T) {
+	configs := []string{
+		`{"api_key": "sk-ant-test", "token_prefix": "crd"}`,
+		`{"api_key": "sk-ant-test", "token_prefix": "_x_"}`,
+		`{"api_key": "sk-ant-test", "token_bytes": 8}`,
+		`{"api_key": "sk-ant-test", "token_encoding": "rot13"}`,
+	}
+	for _, config := range configs {
+		if err := newTestPlugin(t).Configure(context.Background(), config); err == nil {
+			t.Errorf("expected error for config %s", config)
+		}
+	}
+}
+
+func TestConfigure_UnknownTokenStore(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "token_store": "floppy"}`)
+	if err == nil {
+		t.Fatal("expected error for unknown token_store")
+	}
+	if !strings.Contains(err.Error(), "token_store") {
+		t.Errorf("expected error about token_store, got: %v", err)
+	}
+}
+
+func TestConfigure_TokenStorePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19405, "token_store_path": %q}`, path)
+
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic",
+		TTL:   10 * time.Minute,
+		Agent: sdk.Agent{ID: "test", Name: "test"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+	plugin.Shutdown(context.Background())
+
+	restarted := newTestPlugin(t)
+	if err := restarted.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	defer restarted.tokenStore().Close()
+	if _, ok := restarted.ValidateToken(cred.Value); !ok {
+		t.Error("expected token issued before restart to remain valid")
+	}
+}
+
 func TestRevokeCredential_Idempotent(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19403}`)
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -440,7 +895,7 @@ func TestRevokeCredential_Idempotent(t *testing.T) {
 }
 
 func TestGetAPIKey(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 
 	// Before configure
 	if plugin.GetAPIKey() != "" {
@@ -458,7 +913,7 @@ func TestGetAPIKey(t *testing.T) {
 }
 
 func TestValidateToken(t *testing.T) {
-	plugin := NewPlugin()
+	plugin := newTestPlugin(t)
 	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19404}`)
 	if err != nil {
 		t.Fatalf("Configure() error: %v", err)
@@ -513,3 +968,57 @@ func TestConfig_JSON(t *testing.T) {
 		t.Errorf("ProxyPort mismatch")
 	}
 }
+
+func TestShutdown_WaitsForRequestsInFlight(t *testing.T) {
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	plugin := newTestPlugin(t)
+	plugin.upstreamURL = upstream.URL
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19605, "listen_addr": "127.0.0.1", "audit_log_path": %q}`, path)
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:19605/v1/messages", strings.NewReader(`{"model":"claude-haiku-4-5","max_tokens":10}`))
+		req.Header.Set("x-api-key", cred.Value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := plugin.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown() took %v, want it to return once the request finished", elapsed)
+	}
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("request in flight: status %d, want 200", got)
+	}
+	var proxied bool
+	for _, ev := range readAuditLog(t, path) {
+		proxied = proxied || ev.AgentID == "agent-1" && ev.Status == http.StatusOK
+	}
+	if !proxied {
+		t.Error("the request in flight was not audited before the audit log closed")
+	}
+}
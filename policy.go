@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// ScopePolicy holds operator-configured restrictions for a scope. Keyed by
+// a built-in capability (e.g. "anthropic:messages") it tightens every token
+// of that scope, on top of any constraints in the scope string itself;
+// where both set a limit, the stricter one wins. Keyed by a new name (e.g.
+// "anthropic:ci") it defines a named scope template that agents can
+// request like a built-in one.
+type ScopePolicy struct {
+	Description string `json:"description"` // Shown by Scopes() for named scopes
+
+	Endpoints []string `json:"endpoints"` // API path patterns ("*" suffix); others are forbidden
+	Models    []string `json:"models"`    // Model glob patterns; others are forbidden
+
+	MaxTokens int64 `json:"max_tokens"` // Cap on request max_tokens (0 = no cap)
+	Stream    *bool `json:"stream"`     // false forbids streaming requests
+
+	MaxStreamSeconds int   `json:"max_stream_seconds"` // Streams running longer are ended with an error event (0 = no limit)
+	MaxStreamTokens  int64 `json:"max_stream_tokens"`  // Streams producing more output tokens are ended with an error event (0 = no limit)
+
+	Tools        *bool    `json:"tools"`         // false forbids tools and tool_choice
+	AllowedTools []string `json:"allowed_tools"` // Tool name glob patterns; other tools are forbidden
+
+	ServerTools        *bool    `json:"server_tools"`         // false forbids server tools such as web_search
+	AllowedServerTools []string `json:"allowed_server_tools"` // Server tool name glob patterns, e.g. web_search; others are forbidden
+	WebDomains         []string `json:"web_domains"`          // Domains web_search and web_fetch may reach, with their subdomains
+
+	RequestsPerMinute int `json:"requests_per_minute"` // Per-token rate limit (0 = unlimited)
+
+	Transcripts bool `json:"transcripts"` // Record streamed responses, reassembled, in the audit log
+}
+
+// policyNamePattern matches the capability part of named scopes
+var policyNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// validatePolicies checks that policies are keyed by built-in capabilities
+// or valid new scope names, and hold sane limits
+func validatePolicies(policies map[string]*ScopePolicy) error {
+	for pattern, policy := range policies {
+		if _, ok := lookupScope(pattern); !ok {
+			name, ok := strings.CutPrefix(pattern, "anthropic:")
+			if _, isKey := scopeConstraints[name]; !ok || isKey || !policyNamePattern.MatchString(name) {
+				return fmt.Errorf("policies: invalid scope name %q: must be a built-in scope or anthropic:<name> with lowercase letters, digits, _ and -", pattern)
+			}
+		}
+		if policy == nil {
+			continue
+		}
+		if policy.MaxTokens < 0 {
+			return fmt.Errorf("policies[%q]: max_tokens must not be negative", pattern)
+		}
+		if policy.MaxStreamSeconds < 0 || policy.MaxStreamTokens < 0 {
+			return fmt.Errorf("policies[%q]: max_stream_seconds and max_stream_tokens must not be negative", pattern)
+		}
+		if policy.RequestsPerMinute < 0 {
+			return fmt.Errorf("policies[%q]: requests_per_minute must not be negative", pattern)
+		}
+		for _, endpoint := range policy.Endpoints {
+			if !strings.HasPrefix(endpoint, "/") {
+				return fmt.Errorf("policies[%q]: endpoint %q must start with /", pattern, endpoint)
+			}
+		}
+		for _, list := range [][]string{policy.Models, policy.AllowedTools, policy.AllowedServerTools} {
+			for _, p := range list {
+				if _, err := path.Match(p, ""); err != nil {
+					return fmt.Errorf("policies[%q]: invalid pattern %q", pattern, p)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateScopeNarrowing checks that allowed_scopes and scope_narrowing
+// name known scopes, and that every narrowing yields an allowed scope
+func validateScopeNarrowing(cfg *AnthropicConfig) error {
+	known := func(pattern string) bool {
+		_, builtin := lookupScope(pattern)
+		return builtin || cfg.Policies[pattern] != nil
+	}
+	for _, pattern := range cfg.AllowedScopes {
+		if !known(pattern) {
+			return fmt.Errorf("allowed_scopes: unknown scope %q", pattern)
+		}
+	}
+	for from, to := range cfg.ScopeNarrowing {
+		if !known(from) {
+			return fmt.Errorf("scope_narrowing: unknown scope %q", from)
+		}
+		target, err := parseScope(to, cfg.Policies)
+		if err != nil {
+			return fmt.Errorf("scope_narrowing[%q]: %w", from, err)
+		}
+		if len(cfg.AllowedScopes) > 0 && !slices.Contains(cfg.AllowedScopes, target.def.Pattern) {
+			return fmt.Errorf("scope_narrowing[%q]: %q is not in allowed_scopes", from, to)
+		}
+	}
+	return nil
+}
+
+// scopeDef describes the named scope pattern defined by the policy
+func (pol *ScopePolicy) scopeDef(pattern string) scopeDef {
+	desc := pol.Description
+	if desc == "" {
+		desc = "Policy-defined scope"
+	}
+	return scopeDef{Pattern: pattern, Description: desc, Paths: pol.Endpoints}
+}
+
+// apply tightens s with the policy's limits
+func (pol *ScopePolicy) apply(s *Scope) {
+	if pol == nil {
+		return
+	}
+	if len(pol.Endpoints) > 0 {
+		s.PolicyEndpoints = pol.Endpoints
+	}
+	if len(pol.Models) > 0 {
+		s.PolicyModels = pol.Models
+	}
+	if pol.MaxTokens > 0 && (s.MaxTokens == 0 || pol.MaxTokens < s.MaxTokens) {
+		s.MaxTokens = pol.MaxTokens
+	}
+	if pol.Stream != nil && !*pol.Stream {
+		s.NoStream = true
+	}
+	if n := pol.MaxStreamSeconds; n > 0 && (s.MaxStreamSeconds == 0 || n < s.MaxStreamSeconds) {
+		s.MaxStreamSeconds = n
+	}
+	if n := pol.MaxStreamTokens; n > 0 && (s.MaxStreamTokens == 0 || n < s.MaxStreamTokens) {
+		s.MaxStreamTokens = n
+	}
+	if pol.Tools != nil && !*pol.Tools {
+		s.NoTools = true
+	}
+	if len(pol.AllowedTools) > 0 {
+		s.ToolAllowlists = append(s.ToolAllowlists, pol.AllowedTools)
+	}
+	if pol.ServerTools != nil && !*pol.ServerTools {
+		s.NoServerTools = true
+	}
+	if len(pol.AllowedServerTools) > 0 {
+		s.ServerToolAllowlists = append(s.ServerToolAllowlists, pol.AllowedServerTools)
+	}
+	if len(pol.WebDomains) > 0 {
+		s.WebDomainAllowlists = append(s.WebDomainAllowlists, pol.WebDomains)
+	}
+	if rpm := pol.RequestsPerMinute; rpm > 0 && (s.RequestsPerMinute == 0 || rpm < s.RequestsPerMinute) {
+		s.RequestsPerMinute = rpm
+	}
+	if pol.Transcripts {
+		s.RecordTranscripts = true
+	}
+}
+
+// policyScopeSpecs describes the named scopes defined by policies, sorted
+// by pattern
+func policyScopeSpecs(policies map[string]*ScopePolicy) []sdk.ScopeSpec {
+	var specs []sdk.ScopeSpec
+	for pattern, pol := range policies {
+		if _, builtin := lookupScope(pattern); builtin || pol == nil {
+			continue
+		}
+		specs = append(specs, sdk.ScopeSpec{
+			Pattern:     pattern,
+			Description: pol.scopeDef(pattern).Description,
+			Examples:    []string{pattern},
+		})
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Pattern < specs[j].Pattern })
+	return specs
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestPolicy_MaxTokensReject(t *testing.T) {
+	var forwarded atomic.Int32
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19522,
+		"policies": {"anthropic": {"max_tokens": 1000}}}`, func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{"model": "claude-sonnet-4-5", "max_tokens": 100000}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", resp.StatusCode)
+	}
+
+	resp = proxyRequest(t, srv, cred.Value, `{"model": "claude-sonnet-4-5", "max_tokens": 1000}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if n := forwarded.Load(); n != 1 {
+		t.Errorf("upstream received %d requests, want 1", n)
+	}
+}
+
+func TestPolicy_MaxTokensClamp(t *testing.T) {
+	received := make(chan map[string]any, 2)
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19523,
+		"policies": {"anthropic:batches": {"max_tokens": 2000}}, "max_tokens_action": "clamp"}`, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		received <- body
+		w.Write([]byte(`{"id": "msgbatch_1", "type": "message_batch"}`))
+	})
+
+	// The scope's own cap is stricter than the policy's and wins
+	cred := issueToken(t, plugin, "agent-1", "anthropic:batches:max_tokens:500", 10*time.Minute)
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/messages/batches", strings.NewReader(`{"requests": [
+		{"custom_id": "a", "params": {"model": "claude-sonnet-4-5", "max_tokens": 8000, "temperature": 0.25}},
+		{"custom_id": "b", "params": {"model": "claude-sonnet-4-5", "max_tokens": 100}}
+	]}`))
+	req.Header.Set("x-api-key", cred.Value)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	body := <-received
+	items := body["requests"].([]any)
+	first := items[0].(map[string]any)["params"].(map[string]any)
+	second := items[1].(map[string]any)["params"].(map[string]any)
+	if first["max_tokens"] != 500.0 {
+		t.Errorf("first max_tokens = %v, want 500", first["max_tokens"])
+	}
+	if first["temperature"] != 0.25 {
+		t.Errorf("temperature = %v, want it preserved", first["temperature"])
+	}
+	if second["max_tokens"] != 100.0 {
+		t.Errorf("second max_tokens = %v, want 100 (under the cap)", second["max_tokens"])
+	}
+}
+
+func TestConfigure_PolicyValidation(t *testing.T) {
+	tests := []string{
+		`{"api_key": "sk-ant-test", "policies": {"openai": {"max_tokens": 10}}}`,
+		`{"api_key": "sk-ant-test", "policies": {"anthropic": {"max_tokens": -1}}}`,
+		`{"api_key": "sk-ant-test", "max_tokens_action": "truncate"}`,
+		`{"api_key": "sk-ant-test", "tools_action": "ignore"}`,
+		`{"api_key": "sk-ant-test", "policies": {"anthropic:Bad Name": {}}}`,
+		`{"api_key": "sk-ant-test", "policies": {"anthropic:model": {}}}`,
+		`{"api_key": "sk-ant-test", "policies": {"anthropic:ci": {"endpoints": ["v1/messages"]}}}`,
+		`{"api_key": "sk-ant-test", "policies": {"anthropic:ci": {"requests_per_minute": -1}}}`,
+		`{"api_key": "sk-ant-test", "policies": {"anthropic": {"allowed_tools": ["["]}}}`,
+	}
+	for _, config := range tests {
+		if err := newTestPlugin(t).Configure(context.Background(), config); err == nil {
+			t.Errorf("Configure(%s) should fail", config)
+		}
+	}
+}
+
+func TestStreamForbidden(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19524,
+		"policies": {"anthropic:messages": {"stream": false}}}`, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		scope string
+		body  string
+		want  int
+	}{
+		{"anthropic:stream:false", `{"model": "claude-sonnet-4-5", "stream": true}`, http.StatusForbidden},
+		{"anthropic:stream:false", `{"model": "claude-sonnet-4-5", "stream": false}`, http.StatusOK},
+		{"anthropic:messages", `{"model": "claude-sonnet-4-5", "stream": true}`, http.StatusForbidden},
+		{"anthropic", `{"model": "claude-sonnet-4-5", "stream": true}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		cred := issueToken(t, plugin, "agent-1", tt.scope, 10*time.Minute)
+		resp := proxyRequest(t, srv, cred.Value, tt.body)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("scope %s, body %s: status = %d, want %d", tt.scope, tt.body, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusForbidden && !strings.Contains(string(body), "streaming is not permitted") {
+			t.Errorf("error body = %s, want a streaming error", body)
+		}
+	}
+}
+
+func TestToolRestrictions(t *testing.T) {
+	const tools = `"tools": [{"name": "get_weather", "input_schema": {}}, {"name": "run_shell", "input_schema": {}}]`
+	tests := []struct {
+		scope string
+		body  string
+		want  int
+	}{
+		{"anthropic:tools:false", `{"model": "m"}`, http.StatusOK},
+		{"anthropic:tools:false", `{"model": "m", ` + tools + `}`, http.StatusForbidden},
+		{"anthropic:tools:false", `{"model": "m", "tool_choice": {"type": "auto"}}`, http.StatusForbidden},
+		{"anthropic:tool:get_*", `{"model": "m", ` + tools + `}`, http.StatusForbidden},
+		{"anthropic:tool:get_*:tool:run_shell", `{"model": "m", ` + tools + `}`, http.StatusOK},
+	}
+
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19525}`, func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		cred := issueToken(t, plugin, "agent-1", tt.scope, 10*time.Minute)
+		resp := proxyRequest(t, srv, cred.Value, tt.body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("scope %s, body %s: status = %d, want %d", tt.scope, tt.body, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestServerToolRestrictions(t *testing.T) {
+	const search = `"tools": [{"type": "web_search_20250305", "name": "web_search"%s}]`
+	const exec = `"tools": [{"type": "code_execution_20250522", "name": "code_execution"}]`
+	tests := []struct {
+		scope string
+		body  string
+		want  int
+	}{
+		{"anthropic", `{"model": "m", ` + exec + `}`, http.StatusOK},
+		{"anthropic:server_tools:false", `{"model": "m", ` + exec + `}`, http.StatusForbidden},
+		{"anthropic:server_tools:false", `{"model": "m", "tools": [{"name": "get_weather", "input_schema": {}}]}`, http.StatusOK},
+		{"anthropic:server_tool:web_search", `{"model": "m", ` + exec + `}`, http.StatusForbidden},
+		{"anthropic:server_tool:web_search", `{"model": "m", ` + fmt.Sprintf(search, "") + `}`, http.StatusOK},
+		{"anthropic:web_domain:example.com", `{"model": "m", ` + fmt.Sprintf(search, `, "allowed_domains": ["docs.example.com"]`) + `}`, http.StatusOK},
+		{"anthropic:web_domain:example.com", `{"model": "m", ` + fmt.Sprintf(search, `, "allowed_domains": ["example.org"]`) + `}`, http.StatusForbidden},
+		// The domain list must be in both the scope and the ci policy
+		{"anthropic:ci:web_domain:example.org", `{"model": "m", ` + fmt.Sprintf(search, "") + `}`, http.StatusForbidden},
+	}
+
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19552,
+		"policies": {"anthropic:ci": {"web_domains": ["example.com"]}}}`, func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		cred := issueToken(t, plugin, "agent-1", tt.scope, 10*time.Minute)
+		resp := proxyRequest(t, srv, cred.Value, tt.body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("scope %s, body %s: status = %d, want %d", tt.scope, tt.body, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestServerToolRestrictions_WebDomains(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19553, "tools_action": "strip",
+		"policies": {"anthropic": {"web_domains": ["example.com", "example.org"]}}}`, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic:server_tool:web_*:web_domain:example.com:web_domain:example.net", 10*time.Minute)
+	resp := proxyRequest(t, srv, cred.Value, `{"model": "m", "tools": [
+		{"type": "web_search_20250305", "name": "web_search", "blocked_domains": ["evil.example.com"]},
+		{"type": "bash_20250124", "name": "bash"}]}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	// bash is stripped, and search is limited to the domains both allow
+	body := <-received
+	tools, _ := body["tools"].([]any)
+	if len(tools) != 1 {
+		t.Fatalf("tools = %v, want only web_search", body["tools"])
+	}
+	tool := tools[0].(map[string]any)
+	if fmt.Sprint(tool["allowed_domains"]) != "[example.com]" || tool["blocked_domains"] != nil {
+		t.Errorf("web_search = %v, want allowed_domains [example.com] only", tool)
+	}
+}
+
+func TestToolRestrictions_Strip(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19526,
+		"policies": {"anthropic": {"allowed_tools": ["get_*"]}}, "tools_action": "strip"}`, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		received <- body
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{"model": "m",
+		"tools": [{"name": "get_weather", "input_schema": {}}, {"name": "run_shell", "input_schema": {}}],
+		"tool_choice": {"type": "tool", "name": "run_shell"}}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	body := <-received
+	tools, _ := body["tools"].([]any)
+	if len(tools) != 1 || tools[0].(map[string]any)["name"] != "get_weather" {
+		t.Errorf("tools = %v, want only get_weather", body["tools"])
+	}
+	if _, ok := body["tool_choice"]; ok {
+		t.Error("tool_choice naming a stripped tool should be removed")
+	}
+}
+
+func TestPolicy_NamedScopeTemplate(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19529,
+		"policies": {"anthropic:ci": {
+			"description": "CI jobs: Haiku on the Messages API",
+			"endpoints": ["/v1/messages"],
+			"models": ["claude-haiku-*"],
+			"max_tokens": 1024
+		}}}`, func(w http.ResponseWriter, r *http.Request) {})
+
+	scopes, _ := plugin.Scopes(context.Background())
+	found := false
+	for _, s := range scopes {
+		if s.Pattern == "anthropic:ci" {
+			found = s.Description == "CI jobs: Haiku on the Messages API"
+		}
+	}
+	if !found {
+		t.Error("Scopes() should include the policy-defined anthropic:ci scope")
+	}
+	if ok, _ := plugin.MatchScope(context.Background(), "anthropic:ci:max_tokens:512"); !ok {
+		t.Error("MatchScope() should accept the named scope with constraints")
+	}
+
+	cred := issueToken(t, plugin, "agent-1", "anthropic:ci", 10*time.Minute)
+	tests := []struct {
+		path string
+		body string
+		want int
+	}{
+		{"/v1/messages", `{"model": "claude-haiku-4-5", "max_tokens": 1024}`, http.StatusOK},
+		{"/v1/messages", `{"model": "claude-opus-4-1", "max_tokens": 1024}`, http.StatusForbidden},
+		{"/v1/messages", `{"model": "claude-haiku-4-5", "max_tokens": 4096}`, http.StatusForbidden},
+		{"/v1/messages/batches", `{"requests": []}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", srv.URL+tt.path, strings.NewReader(tt.body))
+		req.Header.Set("x-api-key", cred.Value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.path, tt.body, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestPolicy_RequestsPerMinute(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19530,
+		"policies": {"anthropic": {"requests_per_minute": 2}}}`, func(w http.ResponseWriter, r *http.Request) {})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	other := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("429 response should carry Retry-After")
+		}
+	}
+
+	// The limit is per token
+	resp := proxyRequest(t, srv, other.Value, `{}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("other token: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAgentRateLimit(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19531,
+		"agent_requests_per_minute": 2, "agent_rate_limits": {"agent-vip": 0}}`, func(w http.ResponseWriter, r *http.Request) {})
+
+	// The limit is shared by all of an agent's tokens
+	first := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	second := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	for i, cred := range []*sdk.Credential{first, second, second} {
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+
+	// Other agents have their own allowance, and overrides replace it
+	other := issueToken(t, plugin, "agent-2", "anthropic", 10*time.Minute)
+	vip := issueToken(t, plugin, "agent-vip", "anthropic", 10*time.Minute)
+	for _, cred := range []*sdk.Credential{other, vip, vip, vip} {
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19535, "agent_requests_per_minute": 10}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("anthropic-ratelimit-requests-remaining", "99")
+		})
+	cred := issueToken(t, plugin, "agent-1", "anthropic:rpm:5", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{}`)
+	resp.Body.Close()
+	for header, want := range map[string]string{
+		"anthropic-ratelimit-requests-remaining":      "99",
+		"x-creddy-ratelimit-requests-limit":           "5",
+		"x-creddy-ratelimit-requests-remaining":       "4",
+		"x-creddy-ratelimit-agent-requests-limit":     "10",
+		"x-creddy-ratelimit-agent-requests-remaining": "9",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, resp.Header.Get("x-creddy-ratelimit-requests-reset")); err != nil {
+		t.Errorf("x-creddy-ratelimit-requests-reset: %v", err)
+	}
+}
+
+func TestGetCredential_AdminScopeExplicit(t *testing.T) {
+	issue := func(config string) error {
+		plugin := NewPlugin()
+		if err := plugin.Configure(context.Background(), config); err != nil {
+			t.Fatalf("Configure() error: %v", err)
+		}
+		defer plugin.Shutdown(context.Background())
+		_, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+			Scope: "anthropic:admin",
+			TTL:   10 * time.Minute,
+			Agent: sdk.Agent{ID: "agent-1"},
+		})
+		return err
+	}
+
+	// The default of all scopes does not include the Admin API
+	if err := issue(`{"api_key": "sk-ant-test"}`); err == nil {
+		t.Error("anthropic:admin issued without being listed in allowed_scopes")
+	}
+	if err := issue(`{"api_key": "sk-ant-admin", "allowed_scopes": ["anthropic", "anthropic:admin"]}`); err != nil {
+		t.Errorf("GetCredential() error: %v", err)
+	}
+}
+
+func TestGetCredential_ScopeNarrowing(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test",
+		"allowed_scopes": "anthropic:messages,anthropic:batches",
+		"scope_narrowing": {"anthropic": "anthropic:messages:model:claude-haiku-*"}}`)
+	if err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	issue := func(scope string) (*sdk.Credential, error) {
+		return plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+			Scope: scope,
+			TTL:   10 * time.Minute,
+			Agent: sdk.Agent{ID: "agent-1"},
+		})
+	}
+
+	// Allowed scopes are granted as requested
+	cred, err := issue("anthropic:batches")
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+	if cred.Metadata["scope"] != "anthropic:batches" || cred.Metadata["requested_scope"] != "" {
+		t.Errorf("metadata = %v", cred.Metadata)
+	}
+
+	// Broad scopes are narrowed, keeping the request's own constraints
+	cred, err = issue("anthropic:max_tokens:512")
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+	want := "anthropic:messages:model:claude-haiku-*:max_tokens:512"
+	if cred.Metadata["scope"] != want || cred.Metadata["requested_scope"] != "anthropic:max_tokens:512" {
+		t.Errorf("metadata = %v, want scope %q", cred.Metadata, want)
+	}
+	if info, _ := plugin.ValidateToken(cred.Value); info.Scope != want {
+		t.Errorf("stored scope = %q, want %q", info.Scope, want)
+	}
+
+	// Disallowed scopes without a narrowing are refused
+	if _, err := issue("anthropic:claude"); err == nil {
+		t.Error("GetCredential() should refuse a disallowed scope with no narrowing")
+	}
+}
+
+func TestConfigure_ScopeNarrowingValidation(t *testing.T) {
+	tests := []string{
+		`{"api_key": "sk-ant-test", "allowed_scopes": ["anthropic:nope"]}`,
+		`{"api_key": "sk-ant-test", "scope_narrowing": {"anthropic": "anthropic:nope"}}`,
+		`{"api_key": "sk-ant-test", "allowed_scopes": ["anthropic:messages"], "scope_narrowing": {"anthropic": "anthropic:batches"}}`,
+	}
+	for _, config := range tests {
+		if err := newTestPlugin(t).Configure(context.Background(), config); err == nil {
+			t.Errorf("Configure(%s) should fail", config)
+		}
+	}
+}
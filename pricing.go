@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// modelPrice is the list price of a model family in USD per million tokens
+type modelPrice struct {
+	prefix string
+	input  float64
+	output float64
+}
+
+// modelPrices is matched by model ID prefix, first match wins, so more
+// specific prefixes come first. Cache writes cost 1.25x and cache reads
+// 0.1x the input price.
+var modelPrices = []modelPrice{
+	{"claude-opus-4-5", 5, 25},
+	{"claude-opus-4", 15, 75},
+	{"claude-3-opus", 15, 75},
+	{"claude-sonnet-4", 3, 15},
+	{"claude-3-7-sonnet", 3, 15},
+	{"claude-3-5-sonnet", 3, 15},
+	{"claude-haiku-4-5", 1, 5},
+	{"claude-3-5-haiku", 0.80, 4},
+	{"claude-3-haiku", 0.25, 1.25},
+}
+
+// unknownModelPrice is charged for models missing from modelPrices; it is
+// the most expensive tier so budgets err on the safe side
+var unknownModelPrice = modelPrice{input: 15, output: 75}
+
+// ModelPrice is a pricing override from config, in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// pricingTable prices model usage: prices are matched by model ID prefix
+// in order, and unknown applies to models matching none of them
+type pricingTable struct {
+	prices  []modelPrice
+	unknown modelPrice
+}
+
+// defaultPricing is the built-in list price table
+var defaultPricing = pricingTable{prices: modelPrices, unknown: unknownModelPrice}
+
+// newPricingTable returns the built-in table with overrides, keyed by
+// model ID prefix, taking precedence. The key "*" replaces the price of
+// unknown models.
+func newPricingTable(overrides map[string]ModelPrice) (pricingTable, error) {
+	t := pricingTable{unknown: unknownModelPrice}
+	for prefix, p := range overrides {
+		if prefix == "" {
+			return pricingTable{}, errors.New("pricing: empty model prefix")
+		}
+		for _, v := range []float64{p.Input, p.Output} {
+			if v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+				return pricingTable{}, fmt.Errorf("pricing[%q]: prices must be non-negative", prefix)
+			}
+		}
+		if prefix == "*" {
+			t.unknown = modelPrice{input: p.Input, output: p.Output}
+			continue
+		}
+		t.prices = append(t.prices, modelPrice{prefix, p.Input, p.Output})
+	}
+	// Longer prefixes are more specific, so they are tried first
+	sort.Slice(t.prices, func(i, j int) bool {
+		a, b := t.prices[i].prefix, t.prices[j].prefix
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	t.prices = append(t.prices, modelPrices...)
+	return t, nil
+}
+
+// priceFor returns the price of model
+func (t pricingTable) priceFor(model string) modelPrice {
+	for _, p := range t.prices {
+		if strings.HasPrefix(model, p.prefix) {
+			return p
+		}
+	}
+	return t.unknown
+}
+
+// estimateCost returns the estimated USD cost of usage on model
+func (t pricingTable) estimateCost(model string, u Usage) float64 {
+	p := t.priceFor(model)
+	perToken := func(perMTok float64) float64 { return perMTok / 1e6 }
+	return float64(u.InputTokens)*perToken(p.input) +
+		float64(u.CacheCreationInputTokens)*perToken(p.input*1.25) +
+		float64(u.CacheReadInputTokens)*perToken(p.input*0.1) +
+		float64(u.OutputTokens)*perToken(p.output)
+}
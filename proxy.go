@@ -1,75 +1,768 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	AnthropicBaseURL = "https://api.anthropic.com"
+
+	// defaultAnthropicVersion is sent for requests without an
+	// anthropic-version unless anthropic_version is configured
+	defaultAnthropicVersion = "2023-06-01"
 )
 
+// errUpstreamTimeout ends upstream requests that exceed the configured
+// upstream timeout
+var errUpstreamTimeout = errors.New("upstream request timed out")
+
 // ProxyServer handles proxying requests to Anthropic
 type ProxyServer struct {
-	plugin *AnthropicPlugin
-	server *http.Server
+	plugin      *AnthropicPlugin
+	mu          sync.Mutex // guards server and listener, which Stop reads
+	server      *http.Server
+	listener    net.Listener
+	upstreamURL string
+	probe       *upstreamProbe
+	// adminAPI serves the admin API alone, on admin_listen
+	adminAPI bool
 }
 
 // NewProxyServer creates a new proxy server
 func NewProxyServer(plugin *AnthropicPlugin) *ProxyServer {
 	return &ProxyServer{
-		plugin: plugin,
+		plugin:      plugin,
+		upstreamURL: plugin.upstreamURL,
+		probe:       newUpstreamProbe(),
 	}
 }
 
-// Start starts the proxy server
-func (ps *ProxyServer) Start(port int) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", ps.handleProxy)
+// listenAddress returns the address to bind for listen_addr and port.
+// listenAddr may be an IP address, a hostname, or the name of a network
+// interface, which binds the interface's first address; "" binds all
+// interfaces.
+func listenAddress(listenAddr string, port int) (string, error) {
+	host := strings.TrimSuffix(strings.TrimPrefix(listenAddr, "["), "]")
+	if host != "" && net.ParseIP(host) == nil {
+		if iface, err := net.InterfaceByName(host); err == nil {
+			addrs, err := iface.Addrs()
+			if err != nil || len(addrs) == 0 {
+				return "", fmt.Errorf("listen_addr: interface %s has no addresses", host)
+			}
+			ip, _, _ := net.ParseCIDR(addrs[0].String())
+			host = ip.String()
+		} else if strings.ContainsAny(host, ":/ ") {
+			return "", fmt.Errorf("listen_addr must be an IP address, hostname, or interface name without a port, got %q", listenAddr)
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
 
-	ps.server = &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      mux,
-		ReadTimeout:  5 * time.Minute,
-		WriteTimeout: 5 * time.Minute,
+// Start starts the proxy server on addr
+func (ps *ProxyServer) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
+	return ps.listen(ln).Serve(ln)
+}
 
-	log.Printf("Anthropic proxy listening on :%d", port)
-	return ps.server.ListenAndServe()
+// listen sets the proxy up to serve on ln, returning the server to run
+// on it; from then on Stop closes ln, whether or not the server has
+// started. The server's timeouts are read now; later changes apply when
+// the proxy next starts.
+func (ps *ProxyServer) listen(ln net.Listener) *http.Server {
+	timeouts := ps.plugin.Timeouts()
+	handler, name := ps.routes(), "Anthropic proxy"
+	if ps.adminAPI {
+		handler, name = ps.adminRoutes(), "Admin API"
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       timeouts.Read,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+		MaxHeaderBytes:    ps.plugin.Limits().MaxHeaderBytes,
+	}
+	ps.mu.Lock()
+	ps.server, ps.listener = server, ln
+	ps.mu.Unlock()
+
+	slog.Info(name+" listening", "addr", ln.Addr().String())
+	return server
 }
 
-// Stop gracefully stops the proxy server
+// Stop gracefully stops the proxy server, closing connections still open
+// when ctx is done
 func (ps *ProxyServer) Stop(ctx context.Context) error {
-	if ps.server != nil {
-		return ps.server.Shutdown(ctx)
+	ps.mu.Lock()
+	server, ln := ps.server, ps.listener
+	ps.mu.Unlock()
+	if server == nil {
+		return nil
 	}
-	return nil
+	err := server.Shutdown(ctx)
+	if err != nil {
+		server.Close()
+	}
+	// The server may not have taken ln over yet
+	ln.Close()
+	return err
 }
 
-// handleProxy handles all proxy requests
-func (ps *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
-	// Extract token from x-api-key header (standard for Anthropic SDK)
+// routes builds the proxy's HTTP handler
+func (ps *ProxyServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	ps.handleAdminAPI(mux, ps.unlessAdminListener)
+	ps.handleCommon(mux)
+	mux.HandleFunc("/", ps.handleProxy)
+	return ps.allowClients(ps.requireClientCert(mux))
+}
+
+// adminRoutes builds the handler of the admin listener, which serves the
+// admin API and nothing is proxied
+func (ps *ProxyServer) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+	ps.handleAdminAPI(mux, func(h http.HandlerFunc) http.HandlerFunc { return h })
+	ps.handleCommon(mux)
+	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found_error", "not an admin API endpoint")
+	})
+	return ps.allowClients(mux)
+}
+
+// requireClientCert refuses requests on the proxy port without a
+// verified client certificate while client_ca_file is set, whatever
+// credential they carry, except health checks. Token holders' certificates
+// are further checked against client_cert_agents.
+func (ps *ProxyServer) requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health", "/livez", "/readyz":
+		default:
+			if ps.plugin.RequiresClientCert() && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+				writeError(w, http.StatusUnauthorized, "authentication_error", "a client certificate is required")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowClients refuses requests from addresses the allow and deny lists
+// exclude, before any token is looked at. Token issuance has lists of its
+// own; on the admin listener they are the only ones, and connections over
+// a Unix socket have no address to check.
+func (ps *ProxyServer) allowClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issue := r.Method == http.MethodPost && r.URL.Path == "/v1/tokens/issue"
+		ip := clientIP(r, ps.plugin.TrustedProxies())
+		local := ps.adminAPI && net.ParseIP(ip) == nil
+		if (issue || !ps.adminAPI) && !local && !ps.plugin.AllowsClient(ip, issue) {
+			slog.Debug("Refused request from a client address not allowed", "client_ip", ip, "path", r.URL.Path)
+			writeError(w, http.StatusForbidden, "permission_error", "requests from this address are not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminAPI registers the admin-only endpoints, each wrapped by wrap.
+// Those under /admin are also served at the /v1 paths they first had.
+func (ps *ProxyServer) handleAdminAPI(mux *http.ServeMux, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("GET /admin/tokens", wrap(ps.handleListTokens))
+	mux.HandleFunc("GET /v1/tokens", wrap(ps.handleListTokens))
+	mux.HandleFunc("POST /v1/tokens/issue", wrap(ps.handleIssue))
+	mux.HandleFunc("POST /v1/tokens/revoke", wrap(ps.handleRevoke))
+	mux.HandleFunc("DELETE /admin/tokens/{id}", wrap(ps.handleDeleteToken))
+	mux.HandleFunc("DELETE /v1/tokens/{id}", wrap(ps.handleDeleteToken))
+	mux.HandleFunc("DELETE /admin/agents/{agent_id}/tokens", wrap(ps.handleDeleteAgentTokens))
+	mux.HandleFunc("DELETE /v1/agents/{agent_id}/tokens", wrap(ps.handleDeleteAgentTokens))
+	mux.HandleFunc("GET /admin/agents/{agent_id}/policy", wrap(ps.handleAgentPolicy))
+	mux.HandleFunc("PUT /admin/agents/{agent_id}/policy", wrap(ps.handleAgentPolicy))
+	mux.HandleFunc("DELETE /admin/agents/{agent_id}/policy", wrap(ps.handleAgentPolicy))
+	mux.HandleFunc("GET /v1/agents/{agent_id}/policy", wrap(ps.handleAgentPolicy))
+	mux.HandleFunc("PUT /v1/agents/{agent_id}/policy", wrap(ps.handleAgentPolicy))
+	mux.HandleFunc("DELETE /v1/agents/{agent_id}/policy", wrap(ps.handleAgentPolicy))
+	mux.HandleFunc("GET /v1/audit/events", wrap(ps.handleAuditEvents))
+	mux.HandleFunc("GET /admin/usage", wrap(ps.handleUsage))
+	mux.HandleFunc("GET /v1/usage", wrap(ps.handleUsage))
+	mux.HandleFunc("GET /v1/config", wrap(ps.handleConfig))
+	mux.HandleFunc("POST /admin/rotate-key", wrap(ps.handleRotateAPIKey))
+	mux.HandleFunc("POST /v1/api-key/rotate", wrap(ps.handleRotateAPIKey))
+	mux.HandleFunc("GET /admin/logging", wrap(ps.handleLogging))
+	mux.HandleFunc("PUT /admin/logging", wrap(ps.handleLogging))
+	mux.HandleFunc("GET /v1/logging", wrap(ps.handleLogging))
+	mux.HandleFunc("PUT /v1/logging", wrap(ps.handleLogging))
+	mux.HandleFunc("GET /metrics", wrap(ps.handleMetrics))
+	mux.HandleFunc("GET /dashboard/", wrap(ps.handleDashboard))
+}
+
+// handleCommon registers the endpoints served on both the proxy port and
+// the admin listener: token holders' own endpoints, revocation notices
+// from peers, and health checks
+func (ps *ProxyServer) handleCommon(mux *http.ServeMux) {
+	mux.HandleFunc("POST /v1/tokens/introspect", ps.handleIntrospect)
+	mux.HandleFunc("POST /v1/tokens/renew", ps.handleRenew)
+	mux.HandleFunc("POST /v1/tokens/revocations", ps.handleRevocationNotice)
+	mux.HandleFunc("GET /health", ps.handleHealth)
+	mux.HandleFunc("GET /livez", ps.handleLivez)
+	mux.HandleFunc("GET /readyz", ps.handleReadyz)
+}
+
+// unlessAdminListener serves an admin endpoint on the proxy port only
+// while no admin listener is configured
+func (ps *ProxyServer) unlessAdminListener(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ps.plugin.AdminListenerEnabled() {
+			writeError(w, http.StatusNotFound, "not_found_error", "the admin API is served on admin_listen")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// isAdmin reports whether r is authenticated as an admin, by the admin
+// token or, on the admin listener, by a client certificate that
+// admin_client_ca_file verified
+func (ps *ProxyServer) isAdmin(r *http.Request) bool {
+	if ps.adminAPI && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	return ps.plugin.IsAdminToken(requestToken(r))
+}
+
+// requestToken extracts the caller's credential from the x-api-key header
+// (standard for Anthropic SDK) or a Bearer Authorization header
+func requestToken(r *http.Request) string {
 	token := r.Header.Get("x-api-key")
 	if token == "" {
-		// Also check Authorization header
 		auth := r.Header.Get("Authorization")
 		if strings.HasPrefix(auth, "Bearer ") {
 			token = strings.TrimPrefix(auth, "Bearer ")
 		}
 	}
+	return token
+}
+
+// writeJSON writes v as a JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an Anthropic-style error response
+func writeError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]string{"type": errType, "message": message},
+	})
+}
+
+// tokenRequest is the body accepted by the /v1/tokens endpoints
+type tokenRequest struct {
+	Token      string `json:"token"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"` // renew only
+}
+
+// introspectResponse describes a token's state. Only Active is set for
+// unknown, expired, or revoked tokens.
+type introspectResponse struct {
+	Active       bool       `json:"active"`
+	ID           string     `json:"id,omitempty"`
+	AgentID      string     `json:"agent_id,omitempty"`
+	AgentName    string     `json:"agent_name,omitempty"`
+	Scope        string     `json:"scope,omitempty"`
+	ClientIP     string     `json:"client_ip,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	RemainingTTL int64      `json:"remaining_ttl_seconds,omitempty"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	RequestCount int64      `json:"request_count,omitempty"`
+	MaxUses      int64      `json:"max_uses,omitempty"`
+	UsesLeft     *int64     `json:"uses_left,omitempty"`
+	BytesIn      int64      `json:"bytes_in,omitempty"`
+	BytesOut     int64      `json:"bytes_out,omitempty"`
+	SpentUSD     float64    `json:"spent_usd,omitempty"`
+	BudgetUSD    float64    `json:"budget_usd,omitempty"`
+	BudgetLeft   *float64   `json:"budget_left_usd,omitempty"`
+}
+
+// newIntrospectResponse describes an active token; scope is its resolved
+// scope, or nil if it cannot be resolved
+func newIntrospectResponse(info *TokenInfo, scope *Scope) introspectResponse {
+	createdAt, expiresAt := info.CreatedAt, info.ExpiresAt
+	resp := introspectResponse{
+		Active:       true,
+		ID:           info.ID,
+		AgentID:      info.AgentID,
+		AgentName:    info.AgentName,
+		Scope:        info.Scope,
+		ClientIP:     info.ClientIP,
+		CreatedAt:    &createdAt,
+		ExpiresAt:    &expiresAt,
+		RemainingTTL: int64(time.Until(expiresAt).Seconds()),
+		RequestCount: info.RequestCount,
+		BytesIn:      info.BytesIn,
+		BytesOut:     info.BytesOut,
+	}
+	if info.MaxUses > 0 {
+		left := max(info.MaxUses-info.RequestCount, 0)
+		resp.MaxUses = info.MaxUses
+		resp.UsesLeft = &left
+	}
+	if !info.LastUsedAt.IsZero() {
+		lastUsed := info.LastUsedAt
+		resp.LastUsedAt = &lastUsed
+	}
+	resp.SpentUSD = info.SpentUSD
+	if scope != nil && scope.BudgetUSD > 0 {
+		left := max(scope.BudgetUSD-info.SpentUSD, 0)
+		resp.BudgetUSD = scope.BudgetUSD
+		resp.BudgetLeft = &left
+	}
+	return resp
+}
+
+// readTokenRequest authenticates the caller of a /v1/tokens endpoint and
+// decodes its body. Holders may only act on their own token (the body
+// token may then be omitted); acting on any other token requires the
+// admin token. It writes an error response and returns false on failure.
+func (ps *ProxyServer) readTokenRequest(w http.ResponseWriter, r *http.Request) (tokenRequest, bool) {
+	var req tokenRequest
+	caller, admin := requestToken(r), ps.isAdmin(r)
+	if caller == "" && !admin {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "missing api key")
+		return req, false
+	}
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON body")
+		return req, false
+	}
+	if req.Token == "" {
+		req.Token = caller
+	}
+
+	if !admin {
+		info, ok := ps.plugin.ValidateToken(caller)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "authentication_error", "invalid or expired token")
+			return req, false
+		}
+		if err := ps.plugin.CheckClientCert(r.TLS, info.AgentID); err != nil {
+			writeError(w, http.StatusUnauthorized, "authentication_error", err.Error())
+			return req, false
+		}
+		if req.Token != caller {
+			writeError(w, http.StatusForbidden, "permission_error", "acting on other tokens requires the admin token")
+			return req, false
+		}
+	}
+	return req, true
+}
+
+// resolveScope resolves info's scope, or returns nil if it is invalid
+func (ps *ProxyServer) resolveScope(info *TokenInfo) *Scope {
+	scope, err := ps.plugin.ResolveScope(info.Scope)
+	if err != nil {
+		return nil
+	}
+	return scope
+}
+
+// handleIntrospect reports a token's scope, agent, and remaining TTL
+func (ps *ProxyServer) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	req, ok := ps.readTokenRequest(w, r)
+	if !ok {
+		return
+	}
+
+	info, ok := ps.plugin.ValidateToken(req.Token)
+	if !ok {
+		writeJSON(w, http.StatusOK, introspectResponse{Active: false})
+		return
+	}
+	writeJSON(w, http.StatusOK, newIntrospectResponse(info, ps.resolveScope(info)))
+}
+
+// handleRenew extends an unexpired token's TTL without changing its value,
+// so long-running sessions keep working without swapping keys
+func (ps *ProxyServer) handleRenew(w http.ResponseWriter, r *http.Request) {
+	req, ok := ps.readTokenRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.TTLSeconds < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "ttl_seconds must be positive")
+		return
+	}
+
+	info, err := ps.plugin.RenewCredential(r.Context(), req.Token, time.Duration(req.TTLSeconds)*time.Second)
+	if errors.Is(err, ErrTokenNotFound) {
+		writeError(w, http.StatusNotFound, "not_found_error", "token not found or expired")
+		return
+	}
+	if errors.Is(err, ErrRenewalUnsupported) {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Token renewal failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "api_error", "internal error")
+		return
+	}
+
+	caller := "holder"
+	if ps.isAdmin(r) {
+		caller = "admin"
+	}
+	ev := auditEventFor(AuditRenew, caller, info)
+	ev.TTLSeconds = int64(time.Until(info.ExpiresAt).Round(time.Second).Seconds())
+	ev.ClientIP = clientIP(r, ps.plugin.TrustedProxies())
+	ps.plugin.auditLog(ev)
+
+	writeJSON(w, http.StatusOK, newIntrospectResponse(info, ps.resolveScope(info)))
+}
+
+// tokenListResponse is returned by GET /admin/tokens
+type tokenListResponse struct {
+	Tokens []introspectResponse `json:"tokens"`
+}
+
+// handleListTokens lists active tokens, oldest first, to admins. The
+// optional agent_id, scope, and expiring_within query parameters filter
+// the list.
+func (ps *ProxyServer) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	q := r.URL.Query()
+	filter := TokenFilter{AgentID: q.Get("agent_id"), Scope: q.Get("scope")}
+	if v := q.Get("expiring_within"); v != "" {
+		within, err := parseSeconds(v)
+		if err != nil || within <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "expiring_within must be a duration like 15m or a number of seconds")
+			return
+		}
+		filter.ExpiresBefore = time.Now().Add(within)
+	}
+	resp := tokenListResponse{Tokens: []introspectResponse{}}
+	for _, info := range ps.plugin.ListTokens(filter) {
+		resp.Tokens = append(resp.Tokens, newIntrospectResponse(info, ps.resolveScope(info)))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// issueRequest is the body of POST /v1/tokens/issue
+type issueRequest struct {
+	AgentID    string `json:"agent_id"`
+	AgentName  string `json:"agent_name,omitempty"` // default: agent_id
+	Scope      string `json:"scope"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+	MaxUses    int64  `json:"max_uses,omitempty"`
+}
+
+// issueResponse describes a token issued by POST /v1/tokens/issue
+type issueResponse struct {
+	Token          string    `json:"token"`
+	ID             string    `json:"id"`
+	AgentID        string    `json:"agent_id"`
+	Scope          string    `json:"scope"`
+	RequestedScope string    `json:"requested_scope,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// handleIssue issues a token to admins directly, without Creddy, for
+// development and incident response. Issuance is audited with caller
+// "admin" and follows the same scope rules as through Creddy.
+func (ps *ProxyServer) handleIssue(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	var req issueRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.AgentID == "" || req.Scope == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "expected {\"agent_id\": \"...\", \"scope\": \"...\", \"ttl_seconds\": n}")
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl < minTokenTTL || ttl > maxTokenTTL {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("ttl_seconds must be between %d and %d", int(minTokenTTL.Seconds()), int(maxTokenTTL.Seconds())))
+		return
+	}
+	cred, err := ps.plugin.issueAdminToken(r.Context(), req, ttl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, issueResponse{
+		Token:          cred.Value,
+		ID:             cred.ExternalID,
+		AgentID:        req.AgentID,
+		Scope:          cred.Metadata["scope"],
+		RequestedScope: cred.Metadata["requested_scope"],
+		ExpiresAt:      cred.ExpiresAt,
+	})
+}
+
+// revokeRequest is the body of POST /v1/tokens/revoke: exactly one of a
+// token (or token ID), an agent's tokens, or all tokens
+type revokeRequest struct {
+	Token   string `json:"token,omitempty"`
+	AgentID string `json:"agent_id,omitempty"`
+	All     bool   `json:"all,omitempty"`
+}
+
+// handleRevoke revokes tokens for admins, on this instance and through
+// revocation broadcast on its peers
+func (ps *ProxyServer) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	var req revokeRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req)
+	selectors := 0
+	for _, set := range []bool{req.Token != "", req.AgentID != "", req.All} {
+		if set {
+			selectors++
+		}
+	}
+	if err != nil || selectors != 1 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "expected one of {\"token\": \"...\"}, {\"agent_id\": \"...\"}, or {\"all\": true}")
+		return
+	}
+	ps.revoke(w, req)
+}
+
+// handleDeleteToken revokes the token, or token ID, in the path for admins
+func (ps *ProxyServer) handleDeleteToken(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	ps.revoke(w, revokeRequest{Token: r.PathValue("id")})
+}
+
+// handleDeleteAgentTokens revokes every token of the agent in the path for
+// admins
+func (ps *ProxyServer) handleDeleteAgentTokens(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	ps.revoke(w, revokeRequest{AgentID: r.PathValue("agent_id")})
+}
+
+// withAPIKey returns a copy of req to send again with key; body is its
+// buffered body, or nil if it has none
+func withAPIKey(ctx context.Context, req *http.Request, key string, body []byte) *http.Request {
+	retry := req.Clone(ctx)
+	setUpstreamAuth(retry.Header, key)
+	retry.Body, retry.ContentLength = http.NoBody, 0
+	if body != nil {
+		retry.Body, retry.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+	}
+	return retry
+}
+
+// retarget returns a copy of req, made for the client's request r, that
+// sends body, r's Messages body as the client sent it, to the upstream t
+// instead, and the body as prepared for t
+func (ps *ProxyServer) retarget(ctx context.Context, r, req *http.Request, scope *Scope, t upstreamTarget, body []byte) (*http.Request, []byte, error) {
+	vertexURL, body, err := t.prepare(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := ps.plugin.WorkspaceAPIKey(scope.Workspace)
+	target := ps.upstreamURL + r.URL.Path
+	if t.route != nil {
+		target = t.route.Upstream + r.URL.Path
+		if t.route.APIKey != "" {
+			key = t.route.APIKey
+		}
+	}
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	retry := withAPIKey(ctx, req, key, body)
+	if t.vertex != nil {
+		token, err := t.vertex.AccessToken(ctx, ps.plugin.UpstreamClient())
+		if err != nil {
+			return nil, nil, fmt.Errorf("vertex ai: %w", err)
+		}
+		retry.Header.Del("x-api-key")
+		retry.Header.Set("Authorization", "Bearer "+token)
+		target = vertexURL
+	}
+	if retry.URL, err = url.Parse(target); err != nil {
+		return nil, nil, err
+	}
+	retry.Host = retry.URL.Host
+	return retry, body, nil
+}
+
+// revoke carries out an admin's revocation request, responding with the
+// number of active tokens revoked
+func (ps *ProxyServer) revoke(w http.ResponseWriter, req revokeRequest) {
+	revoked, err := ps.plugin.adminRevoke(req)
+	if errors.Is(err, ErrBulkRevokeUnsupported) {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	} else if err != nil {
+		slog.Error("Token revocation failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "api_error", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"revoked": revoked})
+}
+
+// handleRevocationNotice applies a revocation broadcast by a peer instance
+func (ps *ProxyServer) handleRevocationNotice(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+
+	var notice revocationNotice
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&notice); err != nil || notice.ID == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "expected {\"id\": \"...\"}")
+		return
+	}
+
+	if err := ps.plugin.ApplyRevocation(notice.ID); err != nil {
+		slog.Error("Failed to apply revocation notice", "error", err)
+		writeError(w, http.StatusInternalServerError, "api_error", "internal error")
+		return
+	}
+	ps.plugin.auditLog(AuditEvent{
+		Event:    AuditRevoke,
+		TokenID:  notice.ID,
+		Caller:   "peer",
+		ClientIP: clientIP(r, ps.plugin.TrustedProxies()),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUsage reports estimated spend per agent, scope, and model to
+// admins. The optional start and end query parameters (RFC 3339 or
+// YYYY-MM-DD) bound the range; format=csv returns one row per agent and
+// model instead of JSON.
+func (ps *ProxyServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+
+	q := r.URL.Query()
+	var bounds [2]time.Time
+	for i, name := range []string{"start", "end"} {
+		t, err := parseUsageTime(q.Get(name))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("invalid %s: use RFC 3339 or YYYY-MM-DD", name))
+			return
+		}
+		bounds[i] = t
+	}
+	start, end := bounds[0], bounds[1]
+	var bucket time.Duration
+	switch q.Get("bucket") {
+	case "":
+	case "hour":
+		bucket = time.Hour
+	case "day":
+		bucket = 24 * time.Hour
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "bucket must be hour or day")
+		return
+	}
+
+	switch format := q.Get("format"); {
+	case (format == "" || format == "json") && bucket == 0:
+		writeJSON(w, http.StatusOK, ps.plugin.SpendReport(start, end))
+	case format == "" || format == "json":
+		series := SpendSeries{Bucket: q.Get("bucket"), Series: ps.plugin.SpendRows(start, end, bucket)}
+		if !start.IsZero() {
+			series.Start = &start
+		}
+		if !end.IsZero() {
+			series.End = &end
+		}
+		writeJSON(w, http.StatusOK, series)
+	case format == "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		if err := writeSpendCSV(w, ps.plugin.SpendRows(start, end, bucket), bucket > 0); err != nil {
+			slog.Error("Failed to write usage CSV", "error", err)
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "format must be json or csv")
+	}
+}
 
+// handleMetrics serves latency metrics in the Prometheus text format to
+// admins
+func (ps *ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !ps.isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "admin token required")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := ps.plugin.WriteMetrics(w); err != nil {
+		slog.Error("Failed to write metrics", "error", err)
+	}
+}
+
+// parseSeconds parses a duration given as a number of seconds or in Go
+// syntax, such as 90 or 1m30s
+func parseSeconds(s string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseUsageTime parses a /admin/usage range bound; empty is the zero time
+func parseUsageTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// handleProxy handles all proxy requests
+func (ps *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	id := requestID(r)
+	w.Header().Set("x-request-id", id)
+	token := requestToken(r)
 	if token == "" {
 		http.Error(w, `{"error": {"type": "authentication_error", "message": "missing api key"}}`, http.StatusUnauthorized)
 		return
 	}
 
-	// Validate the crd_xxx token
-	if !strings.HasPrefix(token, "crd_") {
+	// Validate the crd_xxx token (or JWT, with token_format "jwt")
+	if !ps.plugin.LooksLikeToken(token) {
 		http.Error(w, `{"error": {"type": "authentication_error", "message": "invalid token format"}}`, http.StatusUnauthorized)
 		return
 	}
@@ -80,63 +773,418 @@ func (ps *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the real API key
-	apiKey := ps.plugin.GetAPIKey()
-	if apiKey == "" {
-		http.Error(w, `{"error": {"type": "api_error", "message": "plugin not configured"}}`, http.StatusInternalServerError)
+	// Requests with a valid token are logged and audited when they
+	// complete, whether proxied or refused
+	rec := &requestRecord{ID: id, Started: started}
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer func() { ps.finishRequest(r, tokenInfo, rec, sw.status) }()
+
+	if !ps.plugin.CheckTokenIP(token, tokenInfo, clientIP(r, ps.plugin.TrustedProxies())) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "token is bound to a different client address")
+		return
+	}
+	// With client_ca_file, a token is only half of the credential
+	if err := ps.plugin.CheckClientCert(r.TLS, tokenInfo.AgentID); err != nil {
+		writeError(w, http.StatusUnauthorized, "authentication_error", err.Error())
+		return
+	}
+
+	scope, err := ps.plugin.ResolveScope(tokenInfo.Scope)
+	if err != nil {
+		writeError(w, http.StatusForbidden, "permission_error", err.Error())
+		return
+	}
+	if policy := ps.plugin.AgentPolicy(tokenInfo.AgentID); policy != nil {
+		scope.AgentModels = policy.Models
+	}
+	if !scope.AllowsPath(r.URL.Path) {
+		writeError(w, http.StatusForbidden, "permission_error", fmt.Sprintf("scope %q does not permit %s", tokenInfo.Scope, r.URL.Path))
+		return
+	}
+	// Models the scope does not allow are hidden, as if they did not exist
+	if id, ok := strings.CutPrefix(r.URL.Path, modelsPath+"/"); ok && !scope.AllowsModel(id) {
+		writeError(w, http.StatusNotFound, "not_found_error", fmt.Sprintf("model: %s", id))
+		return
+	}
+	// Agents may only see and act on the message batches and files they
+	// created; others' are reported as missing so their IDs are not leaked
+	var ownedID string
+	owners, collection := ps.plugin.ownedCollection(r.URL.Path)
+	if owners != nil {
+		ownedID = resourceID(r.URL.Path, collection)
+	}
+	if ownedID != "" && !owners.Owns(ownedID, tokenInfo.AgentID) {
+		writeError(w, http.StatusNotFound, "not_found_error", fmt.Sprintf("%s %s not found", owners.kind, ownedID))
+		return
+	}
+
+	// Bodies larger than max_request_body_mb, or max_messages_body_mb for
+	// the Messages API's requests, are refused before they are read if
+	// their length is known, and otherwise once they grow past it, rather
+	// than forwarded for Anthropic to refuse
+	limits := ps.plugin.Limits()
+	maxBody := limits.MaxRequestBody
+	if referencesFiles(r.URL.Path) {
+		maxBody = min(maxBody, limits.MaxMessagesBody)
+	}
+	if r.ContentLength > maxBody {
+		writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("request body exceeds %d bytes", maxBody))
+		return
+	}
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+
+	// Buffer the body when the scope constrains its contents, or to check
+	// the files a message refers to, add organization system prompts, mark
+	// the prompt for caching, and route messages by model. File uploads
+	// are multipart, not JSON.
+	inspect := scope.inspectsBody() && r.URL.Path != filesPath
+	routed := r.Method == http.MethodPost && r.URL.Path == "/v1/messages" && ps.plugin.routesMessages()
+	var reqBody []byte // the buffered body, kept to resume dropped streams
+	if (inspect || referencesFiles(r.URL.Path) || routed) && r.Body != nil {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxInspectedBody+1))
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("request body exceeds %d bytes", maxBody))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "failed to read request body")
+			return
+		}
+		if len(data) > maxInspectedBody {
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("request body exceeds %d bytes", maxInspectedBody))
+			return
+		}
+		if inspect {
+			var perr *policyError
+			data, err = enforceRequestBody(scope, r.URL.Path, data, ps.plugin.EnforceOptions())
+			if errors.As(err, &perr) {
+				writeError(w, http.StatusForbidden, "permission_error", perr.Error())
+				return
+			} else if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+		}
+		// Organization prompts go first, so they are inside any cached prefix
+		if texts := ps.plugin.SystemPrompts(tokenInfo.AgentID, scope); len(texts) > 0 && r.Method == http.MethodPost &&
+			(r.URL.Path == "/v1/messages" || r.URL.Path == countTokensPath || r.URL.Path == batchesPath) {
+			if data, err = prependSystemPrompts(data, r.URL.Path == batchesPath, texts); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+		}
+		// Anthropic tells agents apart by metadata.user_id, which agents
+		// may not choose themselves
+		if userID := ps.plugin.MetadataUserID(tokenInfo, scope); userID != "" && r.Method == http.MethodPost &&
+			(r.URL.Path == "/v1/messages" || r.URL.Path == batchesPath) {
+			if data, err = setMetadataUserID(data, r.URL.Path == batchesPath, userID); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+		}
+		if minTokens := ps.plugin.PromptCacheMinTokens(); minTokens > 0 && r.Method == http.MethodPost &&
+			(r.URL.Path == "/v1/messages" || r.URL.Path == batchesPath) {
+			if data, err = injectCacheControl(data, r.URL.Path == batchesPath, minTokens); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+		}
+		for _, id := range fileReferences(data) {
+			if !ps.plugin.OwnsFile(id, tokenInfo.AgentID) {
+				writeError(w, http.StatusNotFound, "not_found_error", fmt.Sprintf("file %s not found", id))
+				return
+			}
+		}
+		reqBody = data
+		r.Body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	// Messages go to the upstream their model or scope is routed to, or
+	// past it in the fallback chain while it is failing; those for
+	// Vertex AI are rewritten for it
+	target := upstreamTarget{chain: -1}
+	messageBody := reqBody // as the client sent it, to fall back with
+	var vertexURL string
+	if routed && reqBody != nil {
+		model, err := requestModel(reqBody)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		target = ps.plugin.upstreamFor(scope, model)
+		if vertexURL, reqBody, err = target.prepare(reqBody); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+		rec.Backend = target.backend()
+	}
+	vertex, route := target.vertex, target.route
+	// Pacing, key rotation, and failover follow Anthropic's keys and
+	// limits, which other upstreams do not share
+	external := rec.Backend != ""
+
+	if rpm := scope.RequestsPerMinute; rpm > 0 {
+		limit := ps.plugin.AllowRequest("token:"+tokenInfo.ID, rpm)
+		setRateLimitHeaders(w.Header(), "x-creddy-ratelimit-requests-", limit)
+		if !limit.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limit.RetryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate_limit_error", fmt.Sprintf("token is limited to %d requests per minute", rpm))
+			return
+		}
+	}
+	// Agents are limited across all their tokens, so minting more tokens
+	// does not raise their rate
+	if rpm := ps.plugin.AgentRequestsPerMinute(tokenInfo.AgentID); rpm > 0 {
+		limit := ps.plugin.AllowRequest("agent:"+tokenInfo.AgentID, rpm)
+		setRateLimitHeaders(w.Header(), "x-creddy-ratelimit-agent-requests-", limit)
+		if !limit.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limit.RetryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate_limit_error", fmt.Sprintf("agent is limited to %d requests per minute", rpm))
+			return
+		}
+	}
+
+	// Token counting is free, so agents over budget can still use it
+	free := r.URL.Path == countTokensPath
+	if !free && scope.BudgetUSD > 0 && tokenInfo.SpentUSD >= scope.BudgetUSD {
+		writeError(w, http.StatusPaymentRequired, "budget_exceeded_error",
+			fmt.Sprintf("token budget of $%.2f is exhausted (spent $%.4f)", scope.BudgetUSD, tokenInfo.SpentUSD))
+		return
+	}
+
+	if limit, spent, resets := ps.plugin.AgentBudget(tokenInfo.AgentID); !free && limit > 0 && spent >= limit {
+		writeError(w, http.StatusPaymentRequired, "budget_exceeded_error",
+			fmt.Sprintf("agent budget of $%.2f is exhausted (spent $%.4f); it resets at %s", limit, spent, resets.Format(time.RFC3339)))
 		return
 	}
 
+	// Requests for the default workspace use the secondary key while
+	// failing over
+	failover := ps.plugin.failoverConfig()
+	if scope.Workspace != "" || external {
+		failover = nil
+	}
+	secondary := failover != nil && ps.plugin.failover.Active(time.Now())
+
+	// Hold the request if the organization's upstream limit is nearly used
+	// up; that is the primary key's limit, so not while failing over or
+	// for other upstreams
+	if !secondary && !external {
+		if wait, ok := ps.plugin.PaceUpstream(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate_limit_error", "upstream rate limit is exhausted; retry later")
+			return
+		} else if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	if limit, resets := ps.plugin.AdmitAgentRequest(tokenInfo.AgentID); limit != "" {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(resets).Seconds()))))
+		writeError(w, http.StatusTooManyRequests, "rate_limit_error",
+			fmt.Sprintf("agent quota of %s is exhausted; it resets at %s", limit, resets.Format(time.RFC3339)))
+		return
+	}
+
+	if !ps.plugin.ConsumeTokenUse(token, tokenInfo) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "token has no uses left")
+		return
+	}
+
+	// Get the real API key, or an access token for Vertex AI
+	var apiKey, accessToken string
+	if vertex != nil {
+		var err error
+		if accessToken, err = vertex.AccessToken(r.Context(), ps.plugin.UpstreamClient()); err != nil {
+			rec.Err = fmt.Errorf("vertex ai: %w", err)
+			writeError(w, http.StatusBadGateway, "api_error", "failed to authenticate with Vertex AI")
+			return
+		}
+	} else if route != nil && route.APIKey != "" {
+		apiKey = route.APIKey
+	} else {
+		if scope.Workspace == "" && !secondary {
+			if err := ps.plugin.RefreshOAuth(r.Context(), ""); err != nil {
+				slog.Warn("Failed to refresh OAuth access token", "request_id", rec.ID, "error", err)
+			}
+		}
+		apiKey = ps.plugin.WorkspaceAPIKey(scope.Workspace)
+		if secondary {
+			apiKey = failover.APIKey
+			rec.UpstreamKey = "secondary"
+			ps.plugin.failover.UsedSecondary()
+		} else if failover != nil {
+			rec.UpstreamKey = "current"
+		}
+		if apiKey == "" {
+			http.Error(w, `{"error": {"type": "api_error", "message": "plugin not configured"}}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Build upstream request
-	upstreamURL := AnthropicBaseURL + r.URL.Path
+	upstreamURL := ps.upstreamURL + r.URL.Path
+	if route != nil {
+		upstreamURL = route.Upstream + r.URL.Path
+	}
 	if r.URL.RawQuery != "" {
 		upstreamURL += "?" + r.URL.RawQuery
 	}
+	if vertex != nil {
+		upstreamURL = vertexURL
+	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	// The upstream timeout covers whole responses, but only the start of
+	// streams, which may run as long as the model keeps generating
+	ctx, cancelCause := context.WithCancelCause(r.Context())
+	cancel := func() { cancelCause(context.Canceled) }
 	defer cancel()
+	upstreamTimer := time.AfterFunc(ps.plugin.Timeouts().Upstream, func() { cancelCause(errUpstreamTimeout) })
+	defer upstreamTimer.Stop()
 
-	upstreamReq, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, r.Body)
+	// Sampled requests are captured with their responses for debugging
+	if capture := ps.plugin.DebugCapture(); capture.Sample() {
+		rec.Capture = &requestCapture{capture: capture}
+		r.Body = io.NopCloser(io.TeeReader(r.Body, &rec.Capture.Request))
+	}
+
+	body := &countingReader{r: r.Body}
+	upstreamReq, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, body)
 	if err != nil {
-		log.Printf("Failed to create upstream request: %v", err)
+		rec.Err = fmt.Errorf("create upstream request: %w", err)
 		http.Error(w, `{"error": {"type": "api_error", "message": "internal error"}}`, http.StatusInternalServerError)
 		return
 	}
 
-	// Copy headers (except auth headers)
-	for k, vv := range r.Header {
-		k = http.CanonicalHeaderKey(k)
-		if k == "X-Api-Key" || k == "Authorization" || k == "Host" {
-			continue
-		}
-		for _, v := range vv {
-			upstreamReq.Header.Add(k, v)
-		}
-	}
+	// Only the headers Anthropic uses are copied, never the token, and the
+	// proxy says who the client is itself
+	copyUpstreamHeaders(upstreamReq.Header, r, ps.plugin.ForwardHeaders(), clientIP(r, ps.plugin.TrustedProxies()))
 
 	// Set the real API key
-	upstreamReq.Header.Set("x-api-key", apiKey)
+	if vertex != nil {
+		upstreamReq.Header.Set("Authorization", "Bearer "+accessToken)
+	} else {
+		setUpstreamAuth(upstreamReq.Header, apiKey)
+	}
+	upstreamReq.Header.Set("x-request-id", rec.ID)
+
+	filterModels := r.URL.Path == modelsPath && r.Method == http.MethodGet && scope.restrictsModels()
 
-	// Ensure anthropic-version is set
-	if upstreamReq.Header.Get("anthropic-version") == "" {
-		upstreamReq.Header.Set("anthropic-version", "2023-06-01")
+	// Ensure anthropic-version is set, or that it is the pinned one
+	version, pinned := ps.plugin.AnthropicVersion()
+	if got := upstreamReq.Header.Get("anthropic-version"); got == "" || (pinned && got != version) {
+		if got != "" {
+			slog.Debug("replacing client anthropic-version with the pinned one", "request_id", rec.ID, "client_version", got, "version", version)
+		}
+		upstreamReq.Header.Set("anthropic-version", version)
 	}
 
 	// Make the request
-	client := &http.Client{
-		Timeout: 5 * time.Minute,
-	}
+	client := ps.plugin.UpstreamClient()
 
+	sent := time.Now()
 	resp, err := client.Do(upstreamReq)
-	if err != nil {
-		log.Printf("Upstream request failed: %v", err)
+	replayable := reqBody != nil || r.ContentLength == 0
+	// While a key is being rotated out, requests the new key is refused
+	// for are retried with the old one, if their body can be sent again
+	if previous := ps.plugin.PreviousAPIKey(); previous != "" && scope.Workspace == "" && !secondary && !external {
+		rec.UpstreamKey = "current"
+		if err == nil && resp.StatusCode == http.StatusUnauthorized && replayable {
+			resp.Body.Close()
+			upstreamReq = withAPIKey(ctx, upstreamReq, previous, reqBody)
+			rec.UpstreamKey = "previous"
+			resp, err = client.Do(upstreamReq)
+		}
+	}
+	// A rejected OAuth access token is refreshed, and the request sent
+	// again with the new one
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && replayable && scope.Workspace == "" && !secondary && !external {
+		if rerr := ps.plugin.RefreshOAuth(ctx, apiKey); rerr != nil {
+			slog.Warn("Failed to refresh OAuth access token", "request_id", rec.ID, "error", rerr)
+		} else if key := ps.plugin.WorkspaceAPIKey(""); key != apiKey {
+			resp.Body.Close()
+			upstreamReq = withAPIKey(ctx, upstreamReq, key, reqBody)
+			resp, err = client.Do(upstreamReq)
+		}
+	}
+	// Sustained rate limiting or overload of the primary key fails over to
+	// the secondary key, starting with this request if it can be sent again
+	if failover != nil && !secondary && err == nil && ps.plugin.failover.Observe(failover, resp.StatusCode, time.Now()) && replayable {
+		resp.Body.Close()
+		upstreamReq = withAPIKey(ctx, upstreamReq, failover.APIKey, reqBody)
+		rec.UpstreamKey = "secondary"
+		ps.plugin.failover.UsedSecondary()
+		resp, err = client.Do(upstreamReq)
+	}
+	// Upstreams in the fallback chain that keep failing are skipped for
+	// the next one, starting with this request
+	if target.chain >= 0 && r.Context().Err() == nil {
+		failed := err != nil || fallbackFailed(resp.StatusCode)
+		if next, ok := ps.plugin.ObserveFallback(target, failed); ok && ctx.Err() == nil {
+			retry, prepared, rerr := ps.retarget(ctx, r, upstreamReq, scope, next, messageBody)
+			if rerr != nil {
+				slog.Warn("Failed to fall back to the next upstream", "request_id", rec.ID, "upstream", next.name(), "error", rerr)
+			} else {
+				if err == nil {
+					resp.Body.Close()
+				}
+				upstreamReq, target, reqBody = retry, next, prepared
+				rec.Backend, rec.UpstreamKey = target.backend(), ""
+				ps.plugin.fallback.FellBack()
+				resp, err = client.Do(upstreamReq)
+			}
+		}
+	}
+	if err != nil && r.Context().Err() != nil {
+		rec.Disconnected = true
+		return
+	} else if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("request body exceeds %d bytes", maxBody))
+		return
+	} else if err != nil && context.Cause(ctx) == errUpstreamTimeout {
+		rec.Err = errUpstreamTimeout
+		writeError(w, http.StatusGatewayTimeout, "timeout_error", "upstream request timed out")
+		return
+	} else if err != nil {
+		rec.Err = fmt.Errorf("upstream request: %w", err)
 		http.Error(w, `{"error": {"type": "api_error", "message": "upstream request failed"}}`, http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
+	if rec.UpstreamKey != "secondary" && rec.Backend == "" {
+		ps.plugin.ObserveUpstream(resp.Header, resp.StatusCode)
+	}
+	rec.Forwarded = true
+	rec.UpstreamID = resp.Header.Get("request-id")
 
-	// Log the request (minimal)
-	log.Printf("[%s] %s %s → %d", tokenInfo.AgentName, r.Method, r.URL.Path, resp.StatusCode)
+	if owners != nil && resp.StatusCode/100 == 2 {
+		if r.URL.Path == collection {
+			if err := rewriteOwnedResponse(owners, r.Method, resp, tokenInfo.AgentID); err != nil {
+				rec.Err = fmt.Errorf("%s response: %w", owners.kind, err)
+				writeError(w, http.StatusBadGateway, "api_error", fmt.Sprintf("invalid %s response from upstream", owners.kind))
+				return
+			}
+		} else if r.Method == http.MethodDelete && r.URL.Path == collection+"/"+ownedID {
+			if err := owners.Forget(ownedID); err != nil {
+				slog.Error("Failed to save resource owners", "kind", owners.kind, "error", err)
+			}
+		}
+	}
+	// Model discovery lists only the models the scope allows
+	if filterModels && resp.StatusCode/100 == 2 {
+		if err := filterModelList(resp, scope); err != nil {
+			rec.Err = fmt.Errorf("model list: %w", err)
+			writeError(w, http.StatusBadGateway, "api_error", "invalid model list from upstream")
+			return
+		}
+	}
 
 	// Copy response headers
 	for k, vv := range resp.Header {
@@ -144,30 +1192,536 @@ func (ps *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add(k, v)
 		}
 	}
+	w.Header().Set("x-request-id", rec.ID)
 
 	w.WriteHeader(resp.StatusCode)
 
-	// Check if streaming (SSE)
-	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
-		// Stream with flushing
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			io.Copy(w, resp.Body)
-			return
+	sse := strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream")
+	if sse {
+		upstreamTimer.Stop()
+		if n := scope.MaxStreamSeconds; n > 0 {
+			limit := &streamLimitError{fmt.Sprintf("stream exceeded this token's limit of %d seconds", n)}
+			defer time.AfterFunc(time.Duration(n)*time.Second, func() { cancelCause(limit) }).Stop()
+		}
+		// Long generations must not be cut off by the server's write
+		// timeout; copyResponse bounds each write instead
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			slog.Warn("Failed to clear write deadline", "request_id", rec.ID, "error", err)
+		}
+	}
+
+	// Meter spend from the usage reported in the response
+	usage := newUsageRecorder(sse)
+	var tap io.Writer = usage
+	if rec.Capture != nil {
+		rec.Capture.ResponseHeader = resp.Header
+		tap = io.MultiWriter(usage, &rec.Capture.Response)
+	}
+	tracker := &streamTracker{}
+	opts := streamOptions{
+		Hooks:        []sseHook{usage.ObserveEvent},
+		Sent:         []sseHook{tracker.ObserveEvent},
+		KeepAlive:    ps.plugin.StreamKeepAlive(),
+		WriteTimeout: ps.plugin.Timeouts().StreamWrite,
+	}
+	if sse && scope.MaxStreamTokens > 0 {
+		opts.Check = (&streamTokenLimiter{limit: scope.MaxStreamTokens}).Check
+	}
+	var transcript *transcriptRecorder
+	if sse && scope.RecordTranscripts {
+		transcript = &transcriptRecorder{}
+		opts.Sent = append(opts.Sent, transcript.ObserveEvent)
+	}
+	written, err := copyResponse(w, resp, tap, opts)
+	if sse && err == nil && ctx.Err() == nil && !tracker.complete {
+		// The connection to Anthropic broke mid-stream
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/messages" {
+			reqBody = nil
+		}
+		var n int64
+		n, err = ps.resumeStream(ctx, w, client, upstreamReq, reqBody, tap, opts, tracker, usage, rec)
+		written += n
+	}
+	var limit *streamLimitError
+	if errors.As(err, &limit) || errors.As(context.Cause(ctx), &limit) {
+		// Runaway generations are stopped upstream and reported to the
+		// agent in the stream itself
+		cancel()
+		rec.StreamLimit = limit.msg
+		if err := writeStreamError(w, "stream_limit_error", limit.msg); err != nil {
+			rec.Disconnected = true
+		}
+	} else if err != nil || r.Context().Err() != nil {
+		// The agent has gone: abort the upstream request so Anthropic stops
+		// generating tokens nobody will read
+		rec.Disconnected = true
+		cancel()
+	}
+
+	rec.Model, rec.Usage = usage.Result()
+	rec.StopReason = usage.StopReason()
+	rec.ToolCalls = usage.ToolCalls()
+	if transcript != nil {
+		rec.Transcript = transcript.Transcript()
+	}
+	if first := usage.FirstTokenAt(); !first.IsZero() {
+		rec.TTFT = first.Sub(sent)
+		ps.plugin.RecordTTFT(rec.Model, rec.TTFT)
+	}
+	if rec.Model != "" {
+		rec.CostUSD = ps.plugin.RecordSpend(tokenInfo, scope, rec.Model, rec.Usage)
+		ps.plugin.RecordUsageMetrics(rec.Model, rec.Usage)
+	}
+	ps.plugin.RecordTokenUse(token, body.n, written, rec.CostUSD)
+}
+
+// resumeStream finishes a stream that upstream dropped before completing
+// it. Text responses to Messages requests (body is the request, nil if it
+// was not buffered) are retried with the text already sent prefilled, and
+// the new stream is forwarded as the rest of the old one. Anything else is
+// ended with an overloaded_error event, so the client retries instead of
+// taking a truncated response for a complete one. It returns what
+// copyResponse returned for the new stream.
+func (ps *ProxyServer) resumeStream(ctx context.Context, w http.ResponseWriter, client *http.Client, req *http.Request, body []byte, tap io.Writer, opts streamOptions, tracker *streamTracker, usage *usageRecorder, rec *requestRecord) (int64, error) {
+	var written int64
+	if tracker.stopped {
+		// Only the final event was lost
+		return int64(len(messageStopEvent)), writeSSE(w, messageStopEvent)
+	}
+	for range maxStreamResumes {
+		if body == nil || !tracker.resumable() {
+			break
+		}
+		retryBody, err := resumeBody(body, tracker.text.String())
+		if err != nil {
+			break
+		}
+		retry := req.Clone(ctx)
+		retry.Body = io.NopCloser(bytes.NewReader(retryBody))
+		retry.ContentLength = int64(len(retryBody))
+		resp, err := client.Do(retry)
+		if err != nil {
+			break
+		}
+		if rec.Backend == "" {
+			ps.plugin.ObserveUpstream(resp.Header, resp.StatusCode)
+		}
+		if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+			resp.Body.Close()
+			break
+		}
+		rec.StreamResumes++
+		usage.Resume()
+		opts.Transform = newResumeRewriter(tracker).Transform
+		n, err := copyResponse(w, resp, tap, opts)
+		resp.Body.Close()
+		written += n
+		if err != nil || ctx.Err() != nil || tracker.complete {
+			return written, err
+		}
+	}
+	if ctx.Err() != nil {
+		return written, nil
+	}
+	rec.Err = errStreamDropped
+	return written, writeStreamError(w, "overloaded_error", "upstream stream ended unexpectedly; retry the request")
+}
+
+// requestRecord collects what is known about a proxied request for its log
+// line and audit record
+type requestRecord struct {
+	// ID is the client's x-request-id or a generated one; UpstreamID is
+	// Anthropic's request-id for the forwarded request
+	ID         string
+	UpstreamID string
+	Started    time.Time
+	Model      string // from the response; "" if none was reported
+	Usage      Usage
+	CostUSD    float64
+	StopReason string        // from the response, e.g. end_turn
+	TTFT       time.Duration // time to first token; 0 unless streamed
+	Err        error         // why the request could not be proxied, if it failed
+	// Forwarded is set once upstream has responded
+	Forwarded bool
+	// Disconnected is set if the client went away before the response
+	// was complete
+	Disconnected bool
+	// StreamLimit says which scope limit ended the stream, if one did
+	StreamLimit string
+	// StreamResumes counts the retries of a stream upstream dropped
+	StreamResumes int
+	// UpstreamKey says which API key was used while a previous key is
+	// being rotated out or a failover key is configured: current,
+	// previous, or secondary
+	UpstreamKey string
+	// Backend is "vertex" or the route's base URL for requests sent
+	// somewhere other than Anthropic
+	Backend string
+	// ToolCalls are the tools the model called in the response
+	ToolCalls []*ToolCall
+	// Capture holds the bodies of a request sampled for debug capture
+	Capture *requestCapture
+	// Transcript is the reassembled stream, if the scope records them
+	Transcript *streamTranscript
+}
+
+// finishRequest logs and audits a request made with info that completed
+// with status
+func (ps *ProxyServer) finishRequest(r *http.Request, info *TokenInfo, rec *requestRecord, status int) {
+	latency := time.Since(rec.Started)
+	level, msg := slog.LevelInfo, "Proxied request"
+	switch {
+	case rec.Err != nil:
+		level, msg = slog.LevelError, "Proxy request failed"
+	case !rec.Forwarded:
+		msg = "Refused request"
+	}
+	attrs := []any{
+		"request_id", rec.ID, "agent", info.AgentID, "method", r.Method, "path", r.URL.Path,
+		"model", rec.Model, "status", status, "duration_ms", latency.Milliseconds(),
+		"input_tokens", rec.Usage.InputTokens, "output_tokens", rec.Usage.OutputTokens, "cost_usd", rec.CostUSD,
+	}
+	if rec.UpstreamID != "" {
+		attrs = append(attrs, "upstream_request_id", rec.UpstreamID)
+	}
+	if rec.UpstreamKey != "" {
+		attrs = append(attrs, "upstream_key", rec.UpstreamKey)
+	}
+	if rec.Backend != "" {
+		attrs = append(attrs, "backend", rec.Backend)
+	}
+	if rec.StopReason != "" {
+		attrs = append(attrs, "stop_reason", rec.StopReason)
+	}
+	if rec.Disconnected {
+		attrs = append(attrs, "client_disconnected", true)
+	}
+	if len(rec.ToolCalls) > 0 {
+		attrs = append(attrs, "tool_calls", len(rec.ToolCalls))
+	}
+	if rec.StreamLimit != "" {
+		attrs = append(attrs, "stream_limit", rec.StreamLimit)
+	}
+	if rec.StreamResumes > 0 {
+		attrs = append(attrs, "stream_resumes", rec.StreamResumes)
+	}
+	if rec.TTFT > 0 {
+		attrs = append(attrs, "ttft_ms", rec.TTFT.Milliseconds())
+	}
+	if rec.Err != nil {
+		attrs = append(attrs, "error", rec.Err)
+	}
+	slog.Log(r.Context(), level, msg, attrs...)
+
+	ps.plugin.auditLog(AuditEvent{
+		Event:                    AuditRequest,
+		TokenID:                  info.ID,
+		AgentID:                  info.AgentID,
+		AgentName:                info.AgentName,
+		Scope:                    info.Scope,
+		Caller:                   "holder",
+		ClientIP:                 clientIP(r, ps.plugin.TrustedProxies()),
+		RequestID:                rec.ID,
+		UpstreamRequestID:        rec.UpstreamID,
+		UpstreamKey:              rec.UpstreamKey,
+		Backend:                  rec.Backend,
+		Method:                   r.Method,
+		Path:                     r.URL.Path,
+		Model:                    rec.Model,
+		Status:                   status,
+		StopReason:               rec.StopReason,
+		ClientDisconnected:       rec.Disconnected,
+		StreamLimit:              rec.StreamLimit,
+		StreamResumes:            rec.StreamResumes,
+		ToolCalls:                rec.ToolCalls,
+		InputTokens:              rec.Usage.InputTokens,
+		OutputTokens:             rec.Usage.OutputTokens,
+		CacheCreationInputTokens: rec.Usage.CacheCreationInputTokens,
+		CacheReadInputTokens:     rec.Usage.CacheReadInputTokens,
+		CostUSD:                  rec.CostUSD,
+		LatencyMS:                latency.Milliseconds(),
+		TTFTMS:                   rec.TTFT.Milliseconds(),
+		Transcript:               rec.Transcript,
+	})
+
+	if c := rec.Capture; c != nil && rec.Forwarded {
+		err := c.capture.Save(&capturedExchange{
+			RequestID:  rec.ID,
+			Time:       rec.Started.UTC(),
+			TokenID:    info.ID,
+			AgentID:    info.AgentID,
+			Scope:      info.Scope,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     status,
+			DurationMS: latency.Milliseconds(),
+			Request:    c.capture.message(r.Header, &c.Request),
+			Response:   c.capture.message(c.ResponseHeader, &c.Response),
+		})
+		if err != nil {
+			slog.Error("Failed to save debug capture", "request_id", rec.ID, "error", err)
+		}
+	}
+}
+
+// statusWriter records the status code written through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through for streamed responses
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// setRateLimitHeaders reports the proxy's own rate limit state in the
+// style of Anthropic's anthropic-ratelimit-* headers, which are passed
+// through from upstream unchanged
+func setRateLimitHeaders(h http.Header, prefix string, limit rateLimit) {
+	h.Set(prefix+"limit", strconv.Itoa(limit.Limit))
+	h.Set(prefix+"remaining", strconv.Itoa(limit.Remaining))
+	h.Set(prefix+"reset", time.Now().Add(limit.Reset).UTC().Format(time.RFC3339))
+}
+
+// copyResponse copies the upstream body to the client, returning the bytes
+// written and any error writing them, such as the client disconnecting,
+// or from opts.Check.
+// Event streams are forwarded an event at a time, flushing after each so
+// events reach the client whole and without delay (see streamOptions).
+// Copying stops as soon as either fails.
+func copyResponse(w http.ResponseWriter, resp *http.Response, tap io.Writer, opts streamOptions) (int64, error) {
+	var src io.Reader = resp.Body
+	if tap != nil {
+		src = io.TeeReader(resp.Body, tap)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return copyToClient(w, src)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	rc := http.NewResponseController(w)
+	var written int64
+	write := func(p []byte) error {
+		if opts.WriteTimeout > 0 {
+			// Errors only mean the writer has no deadlines, as in tests
+			_ = rc.SetWriteDeadline(time.Now().Add(opts.WriteTimeout))
+		}
+		n, err := w.Write(p)
+		written += int64(n)
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+	forward := func(ev *sseEvent) error {
+		if opts.Check != nil {
+			if err := opts.Check(ev); err != nil {
+				return err
+			}
+		}
+		for _, hook := range opts.Hooks {
+			hook(ev)
+		}
+		if opts.Transform != nil {
+			if ev = opts.Transform(ev); ev == nil {
+				return nil
+			}
 		}
+		for _, hook := range opts.Sent {
+			hook(ev)
+		}
+		return write(ev.Raw)
+	}
 
-		buf := make([]byte, 4096)
+	events := newSSEReader(src)
+	defer events.release()
+	if opts.KeepAlive <= 0 {
 		for {
-			n, err := resp.Body.Read(buf)
-			if n > 0 {
-				w.Write(buf[:n])
-				flusher.Flush()
+			ev, err := events.Next()
+			if ev != nil {
+				if werr := forward(ev); werr != nil {
+					return written, werr
+				}
 			}
 			if err != nil {
-				break
+				return written, nil
 			}
 		}
-	} else {
-		io.Copy(w, resp.Body)
 	}
+
+	// Read in the background so keepalives can be sent while upstream is
+	// silent. Keepalives only go between events, never inside one. The
+	// reader waits for each event to be taken before reading the next, so
+	// a slow client holds back the upstream read rather than buffering.
+	type result struct {
+		ev  *sseEvent
+		err error
+	}
+	results, stop, done := make(chan result), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			ev, err := events.Next()
+			select {
+			case results <- result{ev, err}:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// Closing the body ends a pending read, so tap is no longer written
+	// once this returns
+	defer func() {
+		close(stop)
+		resp.Body.Close()
+		<-done
+	}()
+
+	timer := time.NewTimer(opts.KeepAlive)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-results:
+			if r.ev != nil {
+				if err := forward(r.ev); err != nil {
+					return written, err
+				}
+			}
+			if r.err != nil {
+				return written, nil
+			}
+		case <-timer.C:
+			if err := write(keepAliveComment); err != nil {
+				return written, err
+			}
+		}
+		timer.Reset(opts.KeepAlive)
+	}
+}
+
+// copyToClient copies src to w like io.Copy, but reports only errors
+// writing to w; read errors end the copy as the end of the body would
+func copyToClient(w io.Writer, src io.Reader) (int64, error) {
+	var written int64
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	buf := *bufp
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err != nil {
+			return written, nil
+		}
+	}
+}
+
+// maxListResponse bounds the list responses buffered to filter them
+const maxListResponse = 8 << 20
+
+// readResponse reads and closes resp's body, failing if it is over limit
+// bytes
+func readResponse(resp *http.Response, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errors.New("response too large")
+	}
+	return body, nil
+}
+
+// setResponseBody replaces resp's body, updating its length
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// filterModelList filters a model list response to the models scope allows
+func filterModelList(resp *http.Response, scope *Scope) error {
+	body, err := readResponse(resp, maxListResponse)
+	if err != nil {
+		return err
+	}
+	if body, err = filterList(body, scope.AllowsModel); err != nil {
+		return err
+	}
+	setResponseBody(resp, body)
+	return nil
+}
+
+// filterList removes the items keep rejects from the data array of an
+// Anthropic list response, keeping the other fields as they were
+func filterList(body []byte, keep func(id string) bool) ([]byte, error) {
+	var list map[string]json.RawMessage
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(list["data"], &items); err != nil {
+		return nil, err
+	}
+	kept := make([]json.RawMessage, 0, len(items))
+	for _, raw := range items {
+		var item struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &item) == nil && keep(item.ID) {
+			kept = append(kept, raw)
+		}
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	list["data"] = data
+	return json.Marshal(list)
+}
+
+// countingReader counts bytes read through it
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
 }
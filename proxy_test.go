@@ -0,0 +1,670 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// newTestProxy returns a configured plugin and an httptest server running
+// its proxy routes. The plugin's own listener uses an unused port.
+func newTestProxy(t *testing.T, config string) (*AnthropicPlugin, *httptest.Server) {
+	t.Helper()
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, nil)
+	return plugin, srv
+}
+
+// newTestProxyWithUpstream is like newTestProxy but forwards proxied
+// requests to upstream instead of api.anthropic.com
+func newTestProxyWithUpstream(t *testing.T, config string, upstream http.HandlerFunc) (*AnthropicPlugin, *httptest.Server, *ProxyServer) {
+	t.Helper()
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	ps := NewProxyServer(plugin)
+	if upstream != nil {
+		up := httptest.NewServer(upstream)
+		t.Cleanup(up.Close)
+		ps.upstreamURL = up.URL
+	}
+	srv := httptest.NewServer(ps.routes())
+	t.Cleanup(srv.Close)
+	return plugin, srv, ps
+}
+
+// proxyRequest sends a POST /v1/messages request through the proxy
+func proxyRequest(t *testing.T, srv *httptest.Server, token, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(body))
+	req.Header.Set("x-api-key", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	return resp
+}
+
+// issueToken issues a credential through GetCredential
+func issueToken(t *testing.T, plugin *AnthropicPlugin, agentID, scope string, ttl time.Duration) *sdk.Credential {
+	t.Helper()
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: scope,
+		TTL:   ttl,
+		Agent: sdk.Agent{ID: agentID, Name: agentID},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+	return cred
+}
+
+func introspect(t *testing.T, srv *httptest.Server, caller, token string) (*http.Response, introspectResponse) {
+	t.Helper()
+	body := `{}`
+	if token != "" {
+		body = `{"token": "` + token + `"}`
+	}
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/tokens/introspect", strings.NewReader(body))
+	req.Header.Set("x-api-key", caller)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("introspect request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var out introspectResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp, out
+}
+
+func TestIntrospect_Holder(t *testing.T) {
+	plugin, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19501}`)
+	cred := issueToken(t, plugin, "agent-1", "anthropic:claude", 10*time.Minute)
+
+	resp, out := introspect(t, srv, cred.Value, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if !out.Active || out.AgentID != "agent-1" || out.Scope != "anthropic:claude" {
+		t.Errorf("unexpected introspection: %+v", out)
+	}
+	if out.RemainingTTL <= 0 || out.RemainingTTL > 600 {
+		t.Errorf("unexpected remaining TTL: %d", out.RemainingTTL)
+	}
+}
+
+func TestIntrospect_OtherTokenRequiresAdmin(t *testing.T) {
+	plugin, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19502, "admin_token": "admin-secret"}`)
+	a := issueToken(t, plugin, "agent-a", "anthropic", 10*time.Minute)
+	b := issueToken(t, plugin, "agent-b", "anthropic", 10*time.Minute)
+
+	resp, _ := introspect(t, srv, a.Value, b.Value)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for cross-token introspection, got %d", resp.StatusCode)
+	}
+
+	resp, out := introspect(t, srv, "admin-secret", b.Value)
+	if resp.StatusCode != http.StatusOK || !out.Active || out.AgentID != "agent-b" {
+		t.Errorf("expected admin to introspect agent-b token, got %d %+v", resp.StatusCode, out)
+	}
+
+	plugin.RevokeCredential(context.Background(), b.ExternalID)
+	_, out = introspect(t, srv, "admin-secret", b.Value)
+	if out.Active {
+		t.Error("expected revoked token to be inactive")
+	}
+}
+
+func TestIntrospect_InvalidCaller(t *testing.T) {
+	_, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19503}`)
+
+	resp, _ := introspect(t, srv, "crd_bogus", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestRenewEndpoint(t *testing.T) {
+	plugin, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19504}`)
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 2*time.Minute)
+
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/tokens/renew", strings.NewReader(`{"ttl_seconds": 1200}`))
+	req.Header.Set("x-api-key", cred.Value)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("renew request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var out introspectResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	if out.RemainingTTL < 1190 || out.RemainingTTL > 1200 {
+		t.Errorf("expected ~1200s remaining after renewal, got %d", out.RemainingTTL)
+	}
+}
+
+func TestProxy_RecordsTokenUsage(t *testing.T) {
+	var gotKey string
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-real", "proxy_port": 19505}`, func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("x-api-key")
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"content": []}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	body := `{"model": "claude-3-haiku-20240307", "max_tokens": 10}`
+	for i := 0; i < 2; i++ {
+		resp := proxyRequest(t, srv, cred.Value, body)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if gotKey != "sk-ant-real" {
+		t.Errorf("expected upstream to receive the real key, got %q", gotKey)
+	}
+
+	info, ok := plugin.ValidateToken(cred.Value)
+	if !ok {
+		t.Fatal("expected token to be valid")
+	}
+	if info.RequestCount != 2 {
+		t.Errorf("expected 2 requests, got %d", info.RequestCount)
+	}
+	if info.BytesIn != int64(2*len(body)) {
+		t.Errorf("expected %d bytes in, got %d", 2*len(body), info.BytesIn)
+	}
+	if info.BytesOut != int64(2*len(`{"content": []}`)) {
+		t.Errorf("unexpected bytes out: %d", info.BytesOut)
+	}
+	if info.LastUsedAt.IsZero() {
+		t.Error("expected LastUsedAt to be set")
+	}
+}
+
+func TestProxy_BindIP(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t,
+		`{"api_key": "sk-ant-test", "proxy_port": 19506, "bind_ip": true, "trusted_proxies": "127.0.0.1,::1"}`,
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	send := func(from string) int {
+		req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(`{}`))
+		req.Header.Set("x-api-key", cred.Value)
+		req.Header.Set("X-Forwarded-For", from)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := send("198.51.100.1"); code != http.StatusOK {
+		t.Fatalf("first use should bind and succeed, got %d", code)
+	}
+	if code := send("198.51.100.2"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 from a different address, got %d", code)
+	}
+	if code := send("198.51.100.1"); code != http.StatusOK {
+		t.Errorf("expected bound address to keep working, got %d", code)
+	}
+}
+
+func TestGetCredential_BindIPAtIssuance(t *testing.T) {
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19507, "bind_ip": true}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope:      "anthropic",
+		TTL:        10 * time.Minute,
+		Agent:      sdk.Agent{ID: "agent-1", Name: "agent-1"},
+		Parameters: map[string]string{"client_ip": "192.0.2.10"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+
+	info, _ := plugin.ValidateToken(cred.Value)
+	if info.ClientIP != "192.0.2.10" {
+		t.Fatalf("expected token bound at issuance, got %q", info.ClientIP)
+	}
+	if plugin.CheckTokenIP(cred.Value, info, "192.0.2.11") {
+		t.Error("expected other address to be rejected")
+	}
+	if !plugin.CheckTokenIP(cred.Value, info, "192.0.2.10") {
+		t.Error("expected issuance address to be accepted")
+	}
+}
+
+func TestProxy_MaxUses(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19508}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			upstreamCalls.Add(1)
+			w.Write([]byte(`{}`))
+		})
+
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope:      "anthropic",
+		TTL:        10 * time.Minute,
+		Agent:      sdk.Agent{ID: "ci-job", Name: "ci-job"},
+		Parameters: map[string]string{"max_uses": "2"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusUnauthorized} {
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: expected %d, got %d", i+1, want, resp.StatusCode)
+		}
+	}
+	if n := upstreamCalls.Load(); n != 2 {
+		t.Errorf("expected exactly 2 upstream calls, got %d", n)
+	}
+
+	_, out := introspect(t, srv, cred.Value, "")
+	if out.UsesLeft == nil || *out.UsesLeft != 0 || out.RequestCount != 2 {
+		t.Errorf("unexpected introspection after exhaustion: %+v", out)
+	}
+}
+
+func TestGetCredential_InvalidMaxUses(t *testing.T) {
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19509}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	_, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope:      "anthropic",
+		TTL:        10 * time.Minute,
+		Parameters: map[string]string{"max_uses": "zero"},
+	})
+	if err == nil {
+		t.Fatal("expected error for invalid max_uses")
+	}
+}
+
+func TestProxy_ClientDisconnectCancelsUpstream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19555, "audit_log_path": %q}`, path)
+	cancelled := make(chan struct{})
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// Stream until the proxy goes away
+		for {
+			io.WriteString(w, "event: ping\ndata: {\"type\":\"ping\"}\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5","stream":true}`)
+	resp.Body.Read(make([]byte, 1))
+	resp.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled after the client disconnected")
+	}
+	// The request is audited once the handler returns
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if events := readAuditLog(t, path); events[len(events)-1].Event == AuditRequest {
+			if !events[len(events)-1].ClientDisconnected {
+				t.Errorf("request event = %+v, want client_disconnected", events[len(events)-1])
+			}
+			return
+		}
+	}
+	t.Error("request was not audited")
+}
+
+func TestProxy_SlowStreamingClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19561, "audit_log_path": %q, "stream_write_timeout_seconds": 1}`, path)
+	var sent atomic.Int64
+	cancelled := make(chan struct{})
+	event := fmt.Sprintf("event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":%q}}\n\n", strings.Repeat("x", 64<<10))
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		defer close(cancelled)
+		// Stream far more than socket buffers hold; writes block once the
+		// proxy stops reading
+		for range 1024 {
+			if _, err := io.WriteString(w, event); err != nil {
+				return
+			}
+			sent.Add(int64(len(event)))
+			w.(http.Flusher).Flush()
+		}
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	// The client reads the headers and then nothing more
+	resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5","stream":true}`)
+	defer resp.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("upstream request was not cancelled while the client was not reading")
+	}
+	if n := sent.Load(); n >= 1024*int64(len(event)) {
+		t.Errorf("upstream sent the whole %d byte stream to a client that read none of it", n)
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if events := readAuditLog(t, path); events[len(events)-1].Event == AuditRequest {
+			if !events[len(events)-1].ClientDisconnected {
+				t.Errorf("request event = %+v, want client_disconnected", events[len(events)-1])
+			}
+			return
+		}
+	}
+	t.Error("request was not audited")
+}
+
+func TestProxy_APIKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-new", "previous_api_key": "sk-ant-old", "proxy_port": 19567, "audit_log_path": %q}`, path)
+	var accepted atomic.Value
+	accepted.Store("sk-ant-old")
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("x-api-key") != accepted.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`))
+			return
+		}
+		if string(body) != `{"model":"claude-haiku-4-5"}` {
+			http.Error(w, "body not replayed: "+string(body), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	send := func() (int, string) {
+		resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5"}`)
+		resp.Body.Close()
+		events := readAuditLog(t, path)
+		return resp.StatusCode, events[len(events)-1].UpstreamKey
+	}
+
+	// The new key is not active upstream yet, so the old one serves
+	if status, key := send(); status != http.StatusOK || key != "previous" {
+		t.Errorf("new key refused: status %d, upstream_key %q; want 200 from the previous key", status, key)
+	}
+	accepted.Store("sk-ant-new")
+	if status, key := send(); status != http.StatusOK || key != "current" {
+		t.Errorf("new key accepted: status %d, upstream_key %q; want 200 from the current key", status, key)
+	}
+
+	// After the grace period, the old key is no longer tried
+	accepted.Store("sk-ant-old")
+	plugin.mu.Lock()
+	plugin.config.previousKeySince = time.Now().Add(-2 * time.Hour)
+	plugin.mu.Unlock()
+	if status, key := send(); status != http.StatusUnauthorized || key != "" {
+		t.Errorf("grace period over: status %d, upstream_key %q; want 401", status, key)
+	}
+}
+
+func TestProxy_Timeouts(t *testing.T) {
+	plugin, _, ps := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19556, "write_timeout_seconds": 2, "upstream_timeout_seconds": 1}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+				time.Sleep(1500 * time.Millisecond)
+				return
+			}
+			// A stream that outlasts both the upstream and write timeouts
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := range 4 {
+				fmt.Fprintf(w, "event: ping\ndata: %d\n\n", i)
+				w.(http.Flusher).Flush()
+				time.Sleep(700 * time.Millisecond)
+			}
+			fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+		})
+	srv := httptest.NewUnstartedServer(ps.routes())
+	timeouts := plugin.Timeouts()
+	srv.Config.WriteTimeout = timeouts.Write
+	srv.Start()
+	t.Cleanup(srv.Close)
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("slow response: status = %d, want 504", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(`{"model":"claude-haiku-4-5","stream":true}`))
+	req.Header.Set("x-api-key", cred.Value)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || strings.Count(string(body), "event: ping") != 4 {
+		t.Errorf("stream = %q, %v; want all 4 events", body, err)
+	}
+}
+
+func TestProxy_AnthropicVersion(t *testing.T) {
+	var got atomic.Value
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19569, "anthropic_version": "2024-01-01"}`, func(w http.ResponseWriter, r *http.Request) {
+		got.Store(r.Header.Get("anthropic-version"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	send := func(version string) string {
+		req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(`{"model":"claude-haiku-4-5"}`))
+		req.Header.Set("x-api-key", cred.Value)
+		if version != "" {
+			req.Header.Set("anthropic-version", version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return got.Load().(string)
+	}
+
+	if v := send(""); v != "2024-01-01" {
+		t.Errorf("default anthropic-version = %q, want the configured one", v)
+	}
+	if v := send("2023-06-01"); v != "2023-06-01" {
+		t.Errorf("client anthropic-version = %q, want it passed through", v)
+	}
+
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19569, "anthropic_version": "2024-01-01", "pin_anthropic_version": true}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if v := send("2023-06-01"); v != "2024-01-01" {
+		t.Errorf("pinned anthropic-version = %q, want the configured one", v)
+	}
+
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19569, "anthropic_version": "latest"}`); err == nil {
+		t.Error("Configure() should reject an anthropic_version that is not a date")
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"", ":8401"},
+		{"127.0.0.1", "127.0.0.1:8401"},
+		{"::1", "[::1]:8401"},
+		{"[::1]", "[::1]:8401"},
+		{"localhost", "localhost:8401"},
+	} {
+		if got, err := listenAddress(tt.in, 8401); err != nil || got != tt.want {
+			t.Errorf("listenAddress(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := listenAddress("127.0.0.1:9000", 8401); err == nil {
+		t.Error("listenAddress() should reject an address with a port")
+	}
+	if loopback, err := net.InterfaceByName("lo"); err == nil {
+		addrs, _ := loopback.Addrs()
+		if got, err := listenAddress("lo", 8401); err != nil || len(addrs) == 0 || !strings.HasSuffix(got, ":8401") || got == ":8401" {
+			t.Errorf("listenAddress(lo) = %q, %v; want an address of lo", got, err)
+		}
+	}
+}
+
+func TestConfigure_ListenAddr(t *testing.T) {
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19570, "listen_addr": "127.0.0.1"}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	plugin.proxy.mu.Lock()
+	addr := plugin.proxy.listener.Addr().String()
+	plugin.proxy.mu.Unlock()
+	if addr != "127.0.0.1:19570" {
+		t.Errorf("proxy bound %s, want 127.0.0.1:19570", addr)
+	}
+
+	// Changing only the address rebinds; all of 127/8 is loopback on Linux
+	if runtime.GOOS != "linux" {
+		return
+	}
+	proxy := plugin.proxy
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19570, "listen_addr": "127.0.0.2"}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if plugin.proxy == proxy {
+		t.Error("changing listen_addr kept the old listener")
+	}
+}
+
+func TestProxy_RequestSizeLimits(t *testing.T) {
+	var forwarded atomic.Int32
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19571, "max_header_bytes": 1024, "max_request_body_mb": 1}`, func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			return
+		}
+		forwarded.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	big := `{"model":"claude-haiku-4-5","pad":"` + strings.Repeat("x", 1<<20) + `"}`
+
+	for _, tt := range []struct {
+		name, path string
+		body       io.Reader
+	}{
+		{"known length", "/v1/messages", strings.NewReader(big)},
+		{"chunked, buffered", "/v1/messages", io.MultiReader(strings.NewReader(big))},
+		{"chunked, streamed upstream", "/v1/complete", io.MultiReader(strings.NewReader(big))},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+tt.path, tt.body)
+		req.Header.Set("x-api-key", cred.Value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(data), "request_too_large") {
+			t.Errorf("%s: status %d %s, want 413 request_too_large", tt.name, resp.StatusCode, data)
+		}
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("%d oversized requests reached upstream", n)
+	}
+	resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("small request: status %d", resp.StatusCode)
+	}
+
+	// The header limit applies to the plugin's own listener
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:19571/livez", nil)
+	req.Header.Set("X-Padding", strings.Repeat("x", 8<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized headers: status %d, want 431", resp.StatusCode)
+	}
+}
+
+func TestProxy_MessagesBodyLimit(t *testing.T) {
+	var forwarded atomic.Int32
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19603, "max_messages_body_mb": 1, "read_header_timeout_seconds": 1}`, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		forwarded.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	big := `{"model":"claude-haiku-4-5","pad":"` + strings.Repeat("x", 3<<19) + `"}`
+
+	// Messages API requests have the API's own, lower limit; others only
+	// max_request_body_mb
+	for path, want := range map[string]int{"/v1/messages": http.StatusRequestEntityTooLarge, countTokensPath: http.StatusRequestEntityTooLarge, "/v1/complete": http.StatusOK} {
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(big))
+		req.Header.Set("x-api-key", cred.Value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("POST %s of 1.5 MiB: status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+	if n := forwarded.Load(); n != 1 {
+		t.Errorf("%d requests reached upstream, want 1", n)
+	}
+
+	// A client that sends its headers too slowly is disconnected
+	conn, err := net.Dial("tcp", "127.0.0.1:19603")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /livez HTTP/1.1\r\nHost: localhost\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("slow headers: read = %v, want the connection closed", err)
+	}
+
+	if err := newTestPlugin(t).Configure(context.Background(), `{"api_key": "sk-ant-test", "max_messages_body_mb": 33}`); err == nil {
+		t.Error("Configure() with max_messages_body_mb over the Messages API's limit succeeded, want error")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// usdAmount is a dollar amount in config, given as a number or a string
+// such as "10.00"
+type usdAmount float64
+
+func (a *usdAmount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return fmt.Errorf("invalid amount %s: must be a non-negative number of dollars", data)
+	}
+	*a = usdAmount(v)
+	return nil
+}
+
+// quotaWindows maps window names to functions returning the start of the
+// window containing t. Windows follow UTC calendar days and months.
+var quotaWindows = map[string]func(t time.Time) time.Time{
+	"day": func(t time.Time) time.Time {
+		y, m, d := t.UTC().Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	},
+	"month": func(t time.Time) time.Time {
+		y, m, _ := t.UTC().Date()
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	},
+}
+
+// windowEnd returns the end of the window starting at start
+func windowEnd(window string, start time.Time) time.Time {
+	if window == "month" {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// AgentQuota limits an agent's requests, tokens, and estimated spend per
+// UTC day and month. Zero fields are unlimited.
+type AgentQuota struct {
+	RequestsPerDay   int64     `json:"requests_per_day"`
+	RequestsPerMonth int64     `json:"requests_per_month"`
+	TokensPerDay     int64     `json:"tokens_per_day"`
+	TokensPerMonth   int64     `json:"tokens_per_month"`
+	USDPerDay        usdAmount `json:"usd_per_day"`
+	USDPerMonth      usdAmount `json:"usd_per_month"`
+}
+
+// validateQuotas checks the quotas config
+func validateQuotas(quotas map[string]*AgentQuota) error {
+	for agent, q := range quotas {
+		if q == nil {
+			return fmt.Errorf("quotas[%q]: must be an object", agent)
+		}
+		if q.RequestsPerDay < 0 || q.RequestsPerMonth < 0 || q.TokensPerDay < 0 || q.TokensPerMonth < 0 {
+			return fmt.Errorf("quotas[%q]: limits must not be negative", agent)
+		}
+	}
+	return nil
+}
+
+// quotaCounter is an agent's usage in the window starting at Start
+type quotaCounter struct {
+	Start    time.Time `json:"start"`
+	Requests int64     `json:"requests"`
+	Tokens   int64     `json:"tokens"`
+	USD      float64   `json:"usd"`
+}
+
+// exceeded returns a description of the first limit the counter has
+// reached, or "" if none
+func (c quotaCounter) exceeded(requests, tokens int64, usd usdAmount, window string) string {
+	switch {
+	case requests > 0 && c.Requests >= requests:
+		return fmt.Sprintf("%d requests per %s", requests, window)
+	case tokens > 0 && c.Tokens >= tokens:
+		return fmt.Sprintf("%d tokens per %s", tokens, window)
+	case usd > 0 && c.USD >= float64(usd):
+		return fmt.Sprintf("$%.2f per %s", float64(usd), window)
+	}
+	return ""
+}
+
+// quotaTracker counts each agent's usage in the current day and month.
+// Counters are kept in memory per plugin instance and can be saved to a
+// file so restarts keep partially used quotas.
+type quotaTracker struct {
+	mu sync.Mutex
+	// counters is keyed by agent ID and window name, e.g. "agent-x/day"
+	counters map[string]*quotaCounter
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{counters: make(map[string]*quotaCounter)}
+}
+
+// counter returns agentID's counter for the window containing now,
+// starting a new one if the stored one is from an earlier window.
+// The caller must hold q.mu.
+func (q *quotaTracker) counter(agentID, window string, now time.Time) *quotaCounter {
+	start := quotaWindows[window](now)
+	key := agentID + "/" + window
+	c := q.counters[key]
+	if c == nil || !c.Start.Equal(start) {
+		c = &quotaCounter{Start: start}
+		q.counters[key] = c
+	}
+	return c
+}
+
+// Add adds usage to agentID's day and month counters
+func (q *quotaTracker) Add(agentID string, now time.Time, requests, tokens int64, usd float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for window := range quotaWindows {
+		c := q.counter(agentID, window, now)
+		c.Requests += requests
+		c.Tokens += tokens
+		c.USD += usd
+	}
+}
+
+// Get returns agentID's usage in the window containing now
+func (q *quotaTracker) Get(agentID, window string, now time.Time) quotaCounter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.counter(agentID, window, now)
+}
+
+// Admit counts a request against agentID's quota. If the quota has a
+// limit already reached, the request is not counted and Admit returns a
+// description of the limit and when its window resets; otherwise it
+// returns "".
+func (q *quotaTracker) Admit(agentID string, quota *AgentQuota, now time.Time) (string, time.Time) {
+	if quota == nil {
+		quota = &AgentQuota{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, w := range []struct {
+		window   string
+		requests int64
+		tokens   int64
+		usd      usdAmount
+	}{
+		{"day", quota.RequestsPerDay, quota.TokensPerDay, quota.USDPerDay},
+		{"month", quota.RequestsPerMonth, quota.TokensPerMonth, quota.USDPerMonth},
+	} {
+		c := q.counter(agentID, w.window, now)
+		if limit := c.exceeded(w.requests, w.tokens, w.usd, w.window); limit != "" {
+			return limit, windowEnd(w.window, c.Start)
+		}
+	}
+	for window := range quotaWindows {
+		q.counter(agentID, window, now).Requests++
+	}
+	return "", time.Time{}
+}
+
+// Save writes the counters to path as JSON, replacing it atomically
+func (q *quotaTracker) Save(path string) error {
+	q.mu.Lock()
+	data, err := json.Marshal(q.counters)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Load replaces the counters with those saved at path. A missing file is
+// not an error: there is nothing to restore on first start.
+func (q *quotaTracker) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read quota state: %w", err)
+	}
+	counters := make(map[string]*quotaCounter)
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return fmt.Errorf("read quota state: %w", err)
+	}
+	q.mu.Lock()
+	q.counters = counters
+	q.mu.Unlock()
+	return nil
+}
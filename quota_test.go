@@ -0,0 +1,144 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaWindows(t *testing.T) {
+	now := time.Date(2026, 3, 31, 23, 30, 0, 0, time.UTC)
+	if got, want := quotaWindows["day"](now), time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("day window = %v, want %v", got, want)
+	}
+	month := quotaWindows["month"](now)
+	if got, want := windowEnd("month", month), time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("month window end = %v, want %v", got, want)
+	}
+}
+
+func TestQuotaTracker_Admit(t *testing.T) {
+	q := newQuotaTracker()
+	quota := &AgentQuota{RequestsPerDay: 2, TokensPerMonth: 1000}
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	for i, want := range []string{"", "", "2 requests per day"} {
+		if limit, _ := q.Admit("agent-1", quota, now); limit != want {
+			t.Errorf("request %d: limit = %q, want %q", i+1, limit, want)
+		}
+	}
+
+	// The day counter resets at midnight; the month counter carries on
+	tomorrow := now.Add(12 * time.Hour)
+	q.Add("agent-1", tomorrow, 0, 1000, 0)
+	limit, resets := q.Admit("agent-1", quota, tomorrow)
+	if limit != "1000 tokens per month" || !resets.Equal(time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Admit() = %q, %v; want the month token limit resetting May 1", limit, resets)
+	}
+	if c := q.Get("agent-1", "day", tomorrow); c.Requests != 0 || c.Tokens != 1000 {
+		t.Errorf("day counter = %+v, want 0 requests and 1000 tokens", c)
+	}
+}
+
+func TestQuotaTracker_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	now := time.Now()
+
+	q := newQuotaTracker()
+	q.Add("agent-1", now, 3, 500, 1.25)
+	if err := q.Save(path); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	restored := newQuotaTracker()
+	if err := restored.Load(path); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if c := restored.Get("agent-1", "month", now); c.Requests != 3 || c.Tokens != 500 || c.USD != 1.25 {
+		t.Errorf("restored counter = %+v", c)
+	}
+
+	if err := newQuotaTracker().Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("Load() of a missing file should succeed, got %v", err)
+	}
+}
+
+func TestProxy_AgentQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19534, "quota_state_path": "` + path + `",
+		"quotas": {"agent-1": {"requests_per_day": 2}}}`
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {})
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("429 response should carry Retry-After")
+		}
+	}
+	if err := plugin.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error: %v", err)
+	}
+
+	// A restarted instance keeps the used quota
+	plugin, srv, _ = newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	resp := proxyRequest(t, srv, cred.Value, `{}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("after restart: status = %d, want 429", resp.StatusCode)
+	}
+}
+
+func TestProxy_TokenQuotaWithCompressedResponses(t *testing.T) {
+	// Anthropic compresses responses for clients that accept it
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19606, "quotas": {"agent-1": {"tokens_per_day": 100}}}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			body := `{"model":"claude-haiku-4-5","usage":{"input_tokens":500,"output_tokens":500}}`
+			w.Header().Set("Content-Type", "application/json")
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Write([]byte(body))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(body))
+			gz.Close()
+		})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	// A client asking for compression is still counted
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(`{"model":"claude-haiku-4-5","max_tokens":10}`))
+		req.Header.Set("x-api-key", cred.Value)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestConfigure_QuotaValidation(t *testing.T) {
+	for _, config := range []string{
+		`{"api_key": "sk-ant-test", "quotas": {"agent-1": {"requests_per_day": -1}}}`,
+		`{"api_key": "sk-ant-test", "quotas": {"agent-1": {"usd_per_month": "lots"}}}`,
+		`{"api_key": "sk-ant-test", "quotas": {"agent-1": null}}`,
+	} {
+		if err := newTestPlugin(t).Configure(context.Background(), config); err == nil {
+			t.Errorf("Configure(%s) should fail", config)
+		}
+	}
+}
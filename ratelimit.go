@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter enforces per-key request rates with token buckets held in
+// memory. Limits are per plugin instance.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket holds up to one minute's worth of requests and refills
+// continuously
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+// rateLimit is the outcome of taking a request from a bucket
+type rateLimit struct {
+	Allowed   bool
+	Limit     int // requests per minute
+	Remaining int
+	// RetryAfter is how long until a request is available, when refused
+	RetryAfter time.Duration
+	// Reset is how long until the bucket has refilled completely
+	Reset time.Duration
+}
+
+// Allow takes one request from key's bucket under a limit of perMinute
+// requests per minute
+func (l *rateLimiter) Allow(key string, perMinute int) rateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	capacity := float64(perMinute)
+	rate := capacity / 60 // requests per second
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	res := rateLimit{Limit: perMinute}
+	if b.tokens < 1 {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	} else {
+		b.tokens--
+		res.Allowed = true
+		res.Remaining = int(b.tokens)
+	}
+	res.Reset = time.Duration((capacity - b.tokens) / rate * float64(time.Second))
+	return res
+}
+
+// Cleanup drops buckets idle for over a minute; they would have refilled
+// completely, so forgetting them changes nothing
+func (l *rateLimiter) Cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-time.Minute)
+	for key, b := range l.buckets {
+		if b.last.Before(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+}
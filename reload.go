@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// configWatchInterval is how often proxy mode checks its configuration
+// file for changes
+const configWatchInterval = 2 * time.Second
+
+// configReloader configures the plugin from a file, again whenever the
+// file changes or a reload is requested. Reconfiguring keeps issued tokens
+// and open connections, and a configuration that fails leaves the previous
+// one in effect.
+type configReloader struct {
+	plugin *AnthropicPlugin
+	path   string
+
+	mu   sync.Mutex
+	last []byte // contents last applied, or last rejected
+}
+
+func newConfigReloader(plugin *AnthropicPlugin, path string) *configReloader {
+	return &configReloader{plugin: plugin, path: path}
+}
+
+// Reload configures the plugin from the file if it has changed since the
+// last reload, or in any case if force is set
+func (r *configReloader) Reload(ctx context.Context, force bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	if !force && r.last != nil && bytes.Equal(data, r.last) {
+		return nil
+	}
+	// A rejected file is not retried until it changes again
+	r.last = data
+	if err := r.plugin.Configure(ctx, string(data)); err != nil {
+		return err
+	}
+	slog.Info("Configuration loaded", "path", r.path, "fingerprint", r.plugin.ConfigFingerprint())
+	return nil
+}
+
+// Watch reloads the configuration when the file changes, until ctx ends
+func (r *configReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(ctx, false); err != nil {
+				slog.Error("Configuration reload failed; keeping the previous configuration", "path", r.path, "error", err)
+			}
+		}
+	}
+}
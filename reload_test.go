@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestConfigReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"api_key": "sk-ant-one", "proxy_port": 19574}`)
+
+	plugin := newTestPlugin(t)
+	reloader := newConfigReloader(plugin, path)
+	if err := reloader.Reload(context.Background(), true); err != nil {
+		t.Fatalf("Reload() error: %v", err)
+	}
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic",
+		TTL:   10 * time.Minute,
+		Agent: sdk.Agent{ID: "test", Name: "test"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, 10*time.Millisecond)
+	waitFor := func(key string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for plugin.GetAPIKey() != key {
+			if time.Now().After(deadline) {
+				t.Fatalf("API key is %q, want %q after the file changed", plugin.GetAPIKey(), key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	write(`{"api_key": "sk-ant-two", "proxy_port": 19574}`)
+	waitFor("sk-ant-two")
+	if _, ok := plugin.ValidateToken(cred.Value); !ok {
+		t.Error("token issued before the reload is no longer valid")
+	}
+
+	// A broken file leaves the configuration as it was, until it is fixed
+	write(`{"api_key": "sk-ant-three", "proxy_port": -1}`)
+	if err := reloader.Reload(context.Background(), true); err == nil {
+		t.Error("Reload() should fail for an invalid configuration")
+	}
+	if plugin.GetAPIKey() != "sk-ant-two" {
+		t.Errorf("failed reload was applied: key %q", plugin.GetAPIKey())
+	}
+	write(`{"api_key": "sk-ant-three", "proxy_port": 19574}`)
+	waitFor("sk-ant-three")
+}
+
+func TestConfigReloader_KeepsRevocations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19575, "token_mode": "stateless", "token_signing_key": "replica-secret"}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	plugin := newTestPlugin(t)
+	reloader := newConfigReloader(plugin, path)
+	if err := reloader.Reload(context.Background(), true); err != nil {
+		t.Fatalf("Reload() error: %v", err)
+	}
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	if err := plugin.RevokeCredential(context.Background(), cred.ExternalID); err != nil {
+		t.Fatal(err)
+	}
+
+	// As on SIGHUP
+	if err := reloader.Reload(context.Background(), true); err != nil {
+		t.Fatalf("Reload() error: %v", err)
+	}
+	if _, ok := plugin.ValidateToken(cred.Value); ok {
+		t.Error("revoked stateless token accepted again after a reload")
+	}
+}
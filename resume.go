@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxStreamResumes is how many times a dropped stream is retried
+const maxStreamResumes = 1
+
+// errStreamDropped is recorded for streams that ended without being
+// completed or resumed
+var errStreamDropped = errors.New("upstream stream ended unexpectedly")
+
+// messageStopEvent completes a stream whose stop reason was received but
+// whose final event was not
+var messageStopEvent = []byte("event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+
+// streamTracker follows the events a client has been sent, to tell whether
+// a stream ended cleanly and, if not, what it would take to resume it
+type streamTracker struct {
+	complete bool // message_stop or an error event was sent
+	stopped  bool // the stop reason was sent
+	nonText  bool // a block other than text was sent
+	open     bool // the last block has not been stopped
+	blocks   int
+	text     strings.Builder
+}
+
+// ObserveEvent follows one sent event; it is an sseHook
+func (st *streamTracker) ObserveEvent(ev *sseEvent) {
+	var e transcriptEvent
+	if len(ev.Data) == 0 || json.Unmarshal(ev.Data, &e) != nil {
+		return
+	}
+	switch e.Type {
+	case "message_stop", "error":
+		st.complete = true
+	case "message_delta":
+		if e.Delta != nil && e.Delta.StopReason != "" {
+			st.stopped = true
+		}
+	case "content_block_start":
+		st.blocks = e.Index + 1
+		st.open = true
+		if e.ContentBlock == nil || e.ContentBlock.Type != "text" {
+			st.nonText = true
+		} else {
+			st.text.WriteString(e.ContentBlock.Text)
+		}
+	case "content_block_delta":
+		if e.Delta != nil {
+			st.text.WriteString(e.Delta.Text)
+		}
+	case "content_block_stop":
+		st.open = false
+	}
+}
+
+// resumable reports whether the stream can be continued by prefilling the
+// text sent so far; tool calls and thinking cannot be prefilled
+func (st *streamTracker) resumable() bool {
+	return !st.nonText
+}
+
+// resumeBody returns a Messages request that continues from the text
+// already sent, prefilled as the start of the assistant's turn. Anthropic
+// rejects prefills ending in whitespace, so it is trimmed; if the request
+// already ends in an assistant prefill, the text is added to it.
+func resumeBody(body []byte, prefill string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var req map[string]any
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	prefill = strings.TrimRight(prefill, " \t\r\n")
+	if prefill == "" {
+		return body, nil
+	}
+	messages, _ := req["messages"].([]any)
+	if n := len(messages); n > 0 {
+		last, _ := messages[n-1].(map[string]any)
+		if role, _ := last["role"].(string); role == "assistant" {
+			content, ok := last["content"].(string)
+			if !ok {
+				return nil, errors.New("request ends in an assistant turn that is not text")
+			}
+			last["content"] = content + prefill
+			return json.Marshal(req)
+		}
+	}
+	req["messages"] = append(messages, map[string]any{"role": "assistant", "content": prefill})
+	return json.Marshal(req)
+}
+
+// resumeRewriter makes the stream of a resumed request read as the rest of
+// the stream it continues: the second message_start is dropped, and block
+// indexes follow on from the blocks already sent. If the last block sent
+// was still open, the first resumed block continues it.
+type resumeRewriter struct {
+	base  int  // index of the first resumed block
+	merge bool // the first resumed block continues block base
+}
+
+func newResumeRewriter(st *streamTracker) *resumeRewriter {
+	if st.open {
+		return &resumeRewriter{base: st.blocks - 1, merge: true}
+	}
+	return &resumeRewriter{base: st.blocks}
+}
+
+// Transform rewrites one event of the resumed stream
+func (rw *resumeRewriter) Transform(ev *sseEvent) *sseEvent {
+	var e map[string]any
+	dec := json.NewDecoder(bytes.NewReader(ev.Data))
+	dec.UseNumber()
+	if len(ev.Data) == 0 || dec.Decode(&e) != nil {
+		return ev
+	}
+	typ, _ := e["type"].(string)
+	if typ == "message_start" {
+		return nil
+	}
+	n, ok := e["index"].(json.Number)
+	index, err := n.Int64()
+	if !ok || err != nil {
+		return ev
+	}
+	if typ == "content_block_start" && index == 0 && rw.merge {
+		return nil
+	}
+	e["index"] = int64(rw.base) + index
+	data, err := json.Marshal(e)
+	if err != nil {
+		return ev
+	}
+	var raw []byte
+	if ev.Event != "" {
+		raw = fmt.Appendf(raw, "event: %s\n", ev.Event)
+	}
+	raw = fmt.Appendf(raw, "data: %s\n\n", data)
+	return &sseEvent{Raw: raw, Event: ev.Event, Data: data}
+}
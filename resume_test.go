@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResumeBody(t *testing.T) {
+	tests := []struct {
+		name, body, prefill, want string
+	}{
+		{
+			name:    "appends assistant turn",
+			body:    `{"messages":[{"role":"user","content":"Hi"}]}`,
+			prefill: "Hello, wor",
+			want:    `{"messages":[{"content":"Hi","role":"user"},{"content":"Hello, wor","role":"assistant"}]}`,
+		},
+		{
+			name:    "extends existing prefill and trims whitespace",
+			body:    `{"messages":[{"role":"user","content":"Hi"},{"role":"assistant","content":"{"}]}`,
+			prefill: `"a": 1, ` + "\n",
+			want:    `{"messages":[{"content":"Hi","role":"user"},{"content":"{\"a\": 1,","role":"assistant"}]}`,
+		},
+		{
+			name:    "nothing sent",
+			body:    `{"messages":[{"role":"user","content":"Hi"}]}`,
+			prefill: " ",
+			want:    `{"messages":[{"role":"user","content":"Hi"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := resumeBody([]byte(tt.body), tt.prefill)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: resumeBody() = %s, %v; want %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := resumeBody([]byte(`{"messages":[{"role":"assistant","content":[{"type":"text","text":"x"}]}]}`), "y"); err == nil {
+		t.Error("resumeBody() should refuse to extend a block prefill")
+	}
+}
+
+func TestResumeRewriter(t *testing.T) {
+	var st streamTracker
+	for _, data := range []string{
+		`{"type":"message_start","message":{"id":"msg_1"}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"One. "}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":"Tw"}}`,
+	} {
+		st.ObserveEvent(&sseEvent{Data: []byte(data)})
+	}
+	if st.complete || !st.open || !st.resumable() || st.text.String() != "One. Tw" {
+		t.Fatalf("tracker = %+v", st)
+	}
+
+	rw := newResumeRewriter(&st)
+	for _, tt := range []struct{ in, want string }{
+		{`{"type":"message_start","message":{"id":"msg_2"}}`, ""},
+		{`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`, ""},
+		{`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"o."}}`,
+			`{"delta":{"text":"o.","type":"text_delta"},"index":1,"type":"content_block_delta"}`},
+		{`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+			`{"content_block":{"text":"","type":"text"},"index":2,"type":"content_block_start"}`},
+		{`{"type":"message_stop"}`, `{"type":"message_stop"}`},
+	} {
+		ev := &sseEvent{Event: "x", Data: []byte(tt.in)}
+		got := rw.Transform(ev)
+		switch {
+		case tt.want == "" && got != nil:
+			t.Errorf("Transform(%s) = %s, want dropped", tt.in, got.Data)
+		case tt.want != "" && (got == nil || string(got.Data) != tt.want):
+			t.Errorf("Transform(%s) = %+v, want %s", tt.in, got, tt.want)
+		case got != nil && got != ev && string(got.Raw) != "event: x\ndata: "+tt.want+"\n\n":
+			t.Errorf("Transform(%s) raw = %q", tt.in, got.Raw)
+		}
+	}
+}
+
+// readStreamText returns the text of a stream's text deltas and its events
+func readStreamText(t *testing.T, body io.Reader) (string, []string) {
+	t.Helper()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text strings.Builder
+	var types []string
+	for _, line := range strings.Split(string(data), "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var e transcriptEvent
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			t.Fatalf("invalid event %q: %v", payload, err)
+		}
+		types = append(types, e.Type)
+		if e.Delta != nil {
+			text.WriteString(e.Delta.Text)
+		}
+	}
+	return text.String(), types
+}
+
+func TestProxy_ResumeDroppedStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19559, "forward_headers": ["x-test"], "audit_log_path": %q}`, path)
+	var calls atomic.Int32
+	var prefill atomic.Value
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		send := func(data string) {
+			fmt.Fprintf(w, "event: x\ndata: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+		if strings.Contains(r.Header.Get("x-test"), "tool") {
+			send(`{"type":"message_start","message":{"id":"msg_1","model":"claude-haiku-4-5","usage":{"input_tokens":10}}}`)
+			send(`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"f","input":{}}}`)
+			panic(http.ErrAbortHandler)
+		}
+		if calls.Add(1) == 1 {
+			send(`{"type":"message_start","message":{"id":"msg_1","model":"claude-haiku-4-5","usage":{"input_tokens":10}}}`)
+			send(`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`)
+			send(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello, wor"}}`)
+			panic(http.ErrAbortHandler)
+		}
+		var req struct {
+			Messages []struct {
+				Role    string `json:"role"`
+				Content any    `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == "assistant" {
+			prefill.Store(req.Messages[n-1].Content)
+		}
+		send(`{"type":"message_start","message":{"id":"msg_2","model":"claude-haiku-4-5","usage":{"input_tokens":14}}}`)
+		send(`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`)
+		send(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"ld!"}}`)
+		send(`{"type":"content_block_stop","index":0}`)
+		send(`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`)
+		send(`{"type":"message_stop"}`)
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	body := `{"model":"claude-haiku-4-5","stream":true,"messages":[{"role":"user","content":"Hi"}]}`
+
+	resp := proxyRequest(t, srv, cred.Value, body)
+	text, types := readStreamText(t, resp.Body)
+	resp.Body.Close()
+	if text != "Hello, world!" {
+		t.Errorf("text = %q, want %q", text, "Hello, world!")
+	}
+	if want := "message_start content_block_start content_block_delta content_block_delta content_block_stop message_delta message_stop"; strings.Join(types, " ") != want {
+		t.Errorf("events = %v, want %s", types, want)
+	}
+	if got := prefill.Load(); got != "Hello, wor" {
+		t.Errorf("retry prefill = %v, want %q", got, "Hello, wor")
+	}
+	events := readAuditLog(t, path)
+	if ev := events[len(events)-1]; ev.StreamResumes != 1 || ev.InputTokens != 24 || ev.OutputTokens != 2 || ev.StopReason != "end_turn" {
+		t.Errorf("audit = %+v", ev)
+	}
+
+	// A tool call cannot be prefilled, so the client is told to retry
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(body))
+	req.Header.Set("x-api-key", cred.Value)
+	req.Header.Set("x-test", "tool")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasSuffix(string(data), "event: error\ndata: {\"error\":{\"message\":\"upstream stream ended unexpectedly; retry the request\",\"type\":\"overloaded_error\"},\"type\":\"error\"}\n\n") {
+		t.Errorf("dropped tool stream = %q, want an overloaded_error event", data)
+	}
+	events = readAuditLog(t, path)
+	if ev := events[len(events)-1]; ev.StreamResumes != 0 {
+		t.Errorf("audit = %+v", ev)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RevocationBroadcaster tells other plugin instances about revocations so
+// they drop a token immediately instead of honoring it until it expires
+type RevocationBroadcaster interface {
+	// Publish announces that the token with the given ID was revoked
+	Publish(id string) error
+
+	// Close stops the broadcaster and any subscription it holds
+	Close() error
+}
+
+// RedisBroadcaster publishes revocations on a Redis pub/sub channel and
+// applies revocations published by other instances
+type RedisBroadcaster struct {
+	client  *redis.Client
+	channel string
+	origin  string
+	sub     *redis.PubSub
+}
+
+// NewRedisBroadcaster connects to url and subscribes to channel, calling
+// onRevoke for every revocation published by another instance
+func NewRedisBroadcaster(url, channel string, onRevoke func(id string)) (*RedisBroadcaster, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse revocation redis url: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	sub := client.Subscribe(ctx, channel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		client.Close()
+		return nil, fmt.Errorf("subscribe to %s: %w", channel, err)
+	}
+
+	origin := make([]byte, 8)
+	rand.Read(origin)
+	b := &RedisBroadcaster{client: client, channel: channel, origin: hex.EncodeToString(origin), sub: sub}
+
+	go func() {
+		for msg := range sub.Channel() {
+			var notice revocationNotice
+			if err := json.Unmarshal([]byte(msg.Payload), &notice); err != nil || notice.ID == "" {
+				slog.Warn("Ignoring malformed revocation message", "channel", channel)
+				continue
+			}
+			if notice.Origin != b.origin {
+				onRevoke(notice.ID)
+			}
+		}
+	}()
+
+	return b, nil
+}
+
+func (b *RedisBroadcaster) Publish(id string) error {
+	payload, err := json.Marshal(revocationNotice{ID: id, Origin: b.origin})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+func (b *RedisBroadcaster) Close() error {
+	b.sub.Close()
+	return b.client.Close()
+}
+
+// revocationNotice is the body POSTed to peers' /v1/tokens/revocations
+// and the payload of Redis revocation messages
+type revocationNotice struct {
+	ID string `json:"id"`
+	// Origin identifies the publishing instance so it can skip its own
+	// Redis messages
+	Origin string `json:"origin,omitempty"`
+}
+
+// WebhookBroadcaster POSTs revocations to peer proxies, authenticated
+// with the shared admin token
+type WebhookBroadcaster struct {
+	peers      []string
+	adminToken string
+	client     *http.Client
+}
+
+// NewWebhookBroadcaster creates a broadcaster for the given peer base URLs
+func NewWebhookBroadcaster(peers []string, adminToken string) *WebhookBroadcaster {
+	return &WebhookBroadcaster{
+		peers:      peers,
+		adminToken: adminToken,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Publish notifies every peer, returning the last delivery error
+func (b *WebhookBroadcaster) Publish(id string) error {
+	body, err := json.Marshal(revocationNotice{ID: id})
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, peer := range b.peers {
+		req, err := http.NewRequest("POST", peer+"/v1/tokens/revocations", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+b.adminToken)
+
+		resp, err := b.client.Do(req)
+		if err != nil {
+			slog.Warn("Revocation broadcast failed", "peer", peer, "error", err)
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			lastErr = fmt.Errorf("peer %s returned %d", peer, resp.StatusCode)
+			slog.Warn("Revocation broadcast failed", "peer", peer, "error", lastErr)
+		}
+	}
+	return lastErr
+}
+
+func (b *WebhookBroadcaster) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRevocationBroadcast_Redis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	config := func(port int) string {
+		return fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": %d, "token_mode": "stateless",
+			"token_signing_key": "shared", "revocation_broadcast": "redis", "redis_url": "redis://%s"}`, port, mr.Addr())
+	}
+
+	a := newTestPlugin(t)
+	if err := a.Configure(context.Background(), config(19510)); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	b := newTestPlugin(t)
+	if err := b.Configure(context.Background(), config(19511)); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	cred := issueToken(t, a, "agent-1", "anthropic", 10*time.Minute)
+	if _, ok := b.ValidateToken(cred.Value); !ok {
+		t.Fatal("instance b should accept a token signed with the shared key")
+	}
+
+	if err := a.RevokeCredential(context.Background(), cred.ExternalID); err != nil {
+		t.Fatalf("RevokeCredential() error: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := b.ValidateToken(cred.Value); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("instance b still accepts the token after broadcast revocation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRevocationBroadcast_Webhook(t *testing.T) {
+	peer, peerSrv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19512, "token_mode": "stateless",
+		"token_signing_key": "shared", "admin_token": "admin-secret"}`)
+
+	origin := newTestPlugin(t)
+	err := origin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19513, "token_mode": "stateless",
+		"token_signing_key": "shared", "admin_token": "admin-secret",
+		"revocation_broadcast": "webhook", "revocation_peers": "`+peerSrv.URL+`"}`)
+	if err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	cred := issueToken(t, origin, "agent-1", "anthropic", 10*time.Minute)
+	if err := origin.RevokeCredential(context.Background(), cred.ExternalID); err != nil {
+		t.Fatalf("RevokeCredential() error: %v", err)
+	}
+	if _, ok := peer.ValidateToken(cred.Value); ok {
+		t.Error("peer should reject the token after webhook revocation")
+	}
+}
+
+func TestRevocationNotice_RequiresAdmin(t *testing.T) {
+	_, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19514, "admin_token": "admin-secret"}`)
+
+	for _, tt := range []struct {
+		caller string
+		want   int
+	}{
+		{"wrong", http.StatusUnauthorized},
+		{"admin-secret", http.StatusNoContent},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+"/v1/tokens/revocations", strings.NewReader(`{"id": "abc"}`))
+		req.Header.Set("x-api-key", tt.caller)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("revocation request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("caller %q: status = %d, want %d", tt.caller, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestConfigure_RevocationBroadcastValidation(t *testing.T) {
+	tests := []string{
+		`{"api_key": "sk-ant-test", "revocation_broadcast": "carrier-pigeon"}`,
+		`{"api_key": "sk-ant-test", "revocation_broadcast": "redis"}`,
+		`{"api_key": "sk-ant-test", "revocation_broadcast": "webhook", "admin_token": "x"}`,
+		`{"api_key": "sk-ant-test", "revocation_broadcast": "webhook", "revocation_peers": ["http://peer:8401"]}`,
+	}
+	for _, config := range tests {
+		if err := newTestPlugin(t).Configure(context.Background(), config); err == nil {
+			t.Errorf("Configure(%s) should fail", config)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// UpstreamRoute sends the Messages requests for some models to an
+// upstream other than the default
+type UpstreamRoute struct {
+	Models        []string `json:"models"`          // Model glob patterns the route serves
+	Upstream      string   `json:"upstream"`        // anthropic, vertex, or the base URL of an Anthropic-compatible API
+	APIKey        string   `json:"api_key"`         // Key for a base URL (default: the token's workspace key)
+	APIKeyFile    string   `json:"api_key_file"`    // File holding the key, instead of api_key
+	APIKeyEnv     string   `json:"api_key_env"`     // Environment variable holding the key, instead of api_key
+	APIKeyKeyring string   `json:"api_key_keyring"` // OS keyring entry ("service/account") holding the key, instead of api_key
+}
+
+// Upstreams a route can name besides a base URL
+const (
+	upstreamAnthropic = "anthropic"
+	upstreamVertex    = "vertex"
+)
+
+// setupRoutes checks the routing table and reads the keys of base URL
+// upstreams
+func (cfg *AnthropicConfig) setupRoutes(ctx context.Context) error {
+	for i, route := range cfg.Routes {
+		if route == nil {
+			return fmt.Errorf("routes[%d]: must be an object", i)
+		}
+		if len(route.Models) == 0 {
+			return fmt.Errorf("routes[%d]: models is required", i)
+		}
+		for _, pattern := range route.Models {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("routes[%d]: models: invalid pattern %q", i, pattern)
+			}
+		}
+		var err error
+		route.Upstream, route.APIKey, err = cfg.setupUpstream(ctx, route.Upstream, route.APIKey, route.APIKeyFile, route.APIKeyEnv, route.APIKeyKeyring)
+		if err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// setupUpstream checks an upstream a route or the fallback chain names,
+// returning it without a trailing slash and, for a base URL, the key read
+// from one of the key sources if any is set
+func (cfg *AnthropicConfig) setupUpstream(ctx context.Context, upstream, key, file, env, keyring string) (string, string, error) {
+	hasKey := key != "" || file != "" || env != "" || keyring != ""
+	switch upstream {
+	case "":
+		return "", "", errors.New("upstream is required")
+	case upstreamAnthropic, upstreamVertex:
+		if upstream == upstreamVertex && cfg.Vertex == nil {
+			return "", "", errors.New("upstream vertex requires vertex settings")
+		}
+		if hasKey {
+			return "", "", errors.New("api_key is only used with a base URL upstream")
+		}
+		return upstream, "", nil
+	}
+	if err := checkSinkURL(upstream); err != nil {
+		return "", "", fmt.Errorf("upstream must be anthropic, vertex, or a base URL: %w", err)
+	}
+	if hasKey {
+		var err error
+		if key, err = readAPIKey(ctx, key, file, env, keyring); err != nil {
+			return "", "", err
+		}
+	}
+	return strings.TrimSuffix(upstream, "/"), key, nil
+}
+
+// routesTo reports whether a route names upstream
+func (cfg *AnthropicConfig) routesTo(upstream string) bool {
+	for _, route := range cfg.Routes {
+		if route != nil && route.Upstream == upstream {
+			return true
+		}
+	}
+	return false
+}
+
+// requestModel returns the model a JSON request body names
+func requestModel(body []byte) (string, error) {
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", errors.New("invalid JSON body")
+	}
+	return req.Model, nil
+}
+
+// routesMessages reports whether Messages requests may be sent anywhere
+// but the default upstream, so their bodies must be read to decide
+func (p *AnthropicPlugin) routesMessages() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config != nil && (len(p.config.Routes) > 0 || p.config.Vertex != nil || p.config.Fallback != nil)
+}
+
+// upstreamFor returns where a Messages request of scope for model goes.
+// The first route matching the model wins; without one, the vertex
+// settings' scopes and models decide, and otherwise it goes to
+// Anthropic. An upstream in the fallback chain that is failing is passed
+// over for the next one.
+func (p *AnthropicPlugin) upstreamFor(scope *Scope, model string) upstreamTarget {
+	p.mu.RLock()
+	cfg := p.config
+	p.mu.RUnlock()
+	if cfg == nil || model == "" {
+		return upstreamTarget{chain: -1}
+	}
+	return p.withFallback(cfg, cfg.route(scope, model), time.Now())
+}
+
+// route returns the upstream the routes and vertex settings choose for a
+// Messages request of scope for model
+func (cfg *AnthropicConfig) route(scope *Scope, model string) upstreamTarget {
+	for _, route := range cfg.Routes {
+		if !matchAny(route.Models, model) {
+			continue
+		}
+		switch route.Upstream {
+		case upstreamAnthropic:
+			return upstreamTarget{}
+		case upstreamVertex:
+			return upstreamTarget{vertex: cfg.Vertex}
+		default:
+			return upstreamTarget{route: route}
+		}
+	}
+	if v := cfg.Vertex; v != nil && v.wants(scope, model) {
+		return upstreamTarget{vertex: v}
+	}
+	return upstreamTarget{}
+}
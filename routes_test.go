@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfigure_Routes(t *testing.T) {
+	plugin := newTestPlugin(t)
+	for _, tt := range []struct{ routes, wantErr string }{
+		{`[{"upstream": "anthropic"}]`, "routes[0]: models is required"},
+		{`[{"models": ["["], "upstream": "anthropic"}]`, "invalid pattern"},
+		{`[{"models": ["claude-*"]}]`, "upstream is required"},
+		{`[{"models": ["claude-*"], "upstream": "vertex"}]`, "requires vertex settings"},
+		{`[{"models": ["claude-*"], "upstream": "bedrock"}]`, "upstream must be anthropic, vertex, or a base URL"},
+		{`[{"models": ["claude-*"], "upstream": "http://gateway.internal"}]`, "must use https"},
+		{`[{"models": ["claude-*"], "upstream": "anthropic", "api_key": "sk-other"}]`, "only used with a base URL"},
+		{`[{"models": ["claude-*"], "upstream": "https://gateway.internal", "api_key": "sk-other", "api_key_env": "KEY"}]`, "only one of"},
+	} {
+		err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19597, "routes": `+tt.routes+`}`)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("routes %s: Configure() = %v, want an error containing %q", tt.routes, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProxy_Routes(t *testing.T) {
+	type upstreamRequest struct{ upstream, key, path string }
+	var mu sync.Mutex
+	var requests []upstreamRequest
+	record := func(upstream string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests = append(requests, upstreamRequest{upstream, r.Header.Get("x-api-key"), r.URL.Path})
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+		}
+	}
+	gateway := httptest.NewServer(record("gateway"))
+	defer gateway.Close()
+	staging := httptest.NewServer(record("staging"))
+	defer staging.Close()
+
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	config, _ := json.Marshal(map[string]any{
+		"api_key":        "sk-ant-test",
+		"proxy_port":     19597,
+		"audit_log_path": auditPath,
+		"routes": []map[string]any{
+			{"models": []string{"claude-opus-4-1"}, "upstream": "anthropic"},
+			{"models": []string{"claude-opus-*"}, "upstream": gateway.URL + "/", "api_key": "sk-gateway"},
+			{"models": []string{"claude-3-*"}, "upstream": staging.URL},
+		},
+	})
+	plugin, srv, _ := newTestProxyWithUpstream(t, string(config), record("anthropic"))
+	token := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	for _, model := range []string{"claude-opus-4-1", "claude-opus-4-5", "claude-3-haiku-20240307", "claude-haiku-4-5"} {
+		resp := proxyRequest(t, srv, token.Value, `{"model":"`+model+`","max_tokens":50}`)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", model, resp.StatusCode)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The first matching route wins; base URLs without a key of their own
+	// get the workspace's key
+	want := []upstreamRequest{
+		{"anthropic", "sk-ant-test", "/v1/messages"},
+		{"gateway", "sk-gateway", "/v1/messages"},
+		{"staging", "sk-ant-test", "/v1/messages"},
+		{"anthropic", "sk-ant-test", "/v1/messages"},
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("upstream requests = %+v, want %+v", requests, want)
+	}
+	for i := range want {
+		if requests[i] != want[i] {
+			t.Errorf("request %d went to %+v, want %+v", i+1, requests[i], want[i])
+		}
+	}
+
+	var backends []string
+	for _, ev := range readAuditLog(t, auditPath) {
+		if ev.Event == AuditRequest {
+			backends = append(backends, ev.Backend)
+		}
+	}
+	if got := strings.Join(backends, ","); got != ","+gateway.URL+","+staging.URL+"," {
+		t.Errorf("audited backends = %q", got)
+	}
+}
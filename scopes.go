@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// adminPath is the Anthropic Admin API, reachable only with a scope that
+// lists it explicitly
+const adminPath = "/v1/organizations"
+
+// modelsPath lists models; single models are at modelsPath/<id>
+const modelsPath = "/v1/models"
+
+// countTokensPath is the token counting endpoint. It is free to call, so
+// spend budgets do not apply to it.
+const countTokensPath = "/v1/messages/count_tokens"
+
+// scopeDef describes a scope capability and the API endpoints it grants
+type scopeDef struct {
+	Pattern     string
+	Description string
+	// Paths lists the API paths the scope may call; a trailing "*" matches
+	// any suffix. Nil allows every path outside the Admin API.
+	Paths []string
+	// Explicit scopes are only issued when allowed_scopes lists them, never
+	// by default
+	Explicit bool
+}
+
+// scopeDefs are the capabilities this plugin issues tokens for. Any of them
+// may be followed by constraints (see scopeConstraints).
+var scopeDefs = []scopeDef{
+	{
+		Pattern:     "anthropic",
+		Description: "Full access to the Anthropic API (excluding the Admin API)",
+	},
+	{
+		Pattern:     "anthropic:claude",
+		Description: "Access to Claude models (messages, token counting, completions, models)",
+		Paths:       []string{"/v1/messages", countTokensPath, "/v1/complete", modelsPath, modelsPath + "/*"},
+	},
+	{
+		Pattern:     "anthropic:messages",
+		Description: "Messages API only (/v1/messages and token counting)",
+		Paths:       []string{"/v1/messages", countTokensPath},
+	},
+	{
+		Pattern:     "anthropic:batches",
+		Description: "Message Batches API only (/v1/messages/batches)",
+		Paths:       []string{"/v1/messages/batches", "/v1/messages/batches/*"},
+	},
+	{
+		Pattern:     "anthropic:files",
+		Description: "Files API only (/v1/files); agents see only files they uploaded",
+		Paths:       []string{filesPath, filesPath + "/*"},
+	},
+	{
+		Pattern:     "anthropic:completion",
+		Description: "Legacy Text Completions API only (/v1/complete)",
+		Paths:       []string{"/v1/complete"},
+	},
+	{
+		Pattern:     "anthropic:readonly",
+		Description: "Token counting and model listing only; never incurs spend",
+		Paths:       []string{countTokensPath, modelsPath, modelsPath + "/*"},
+	},
+	{
+		Pattern:     "anthropic:admin",
+		Description: "Admin API only (/v1/organizations); api_key must be an admin key. Issued only if listed in allowed_scopes",
+		Paths:       []string{adminPath, adminPath + "/*"},
+		Explicit:    true,
+	},
+}
+
+// scopeConstraints maps constraint keys to functions applying a value to a
+// parsed scope. Constraints follow the capability as key:value pairs, e.g.
+// anthropic:messages:model:claude-3-*:max_tokens:1024.
+var scopeConstraints = map[string]func(s *Scope, value string) error{
+	// model restricts the request's model to a glob pattern; repeat the
+	// key to allow several
+	"model": func(s *Scope, value string) error {
+		if _, err := path.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid model pattern %q", value)
+		}
+		s.Models = append(s.Models, value)
+		return nil
+	},
+	// max_tokens caps the request's max_tokens
+	"max_tokens": func(s *Scope, value string) error {
+		if s.MaxTokens != 0 {
+			return errors.New("max_tokens given twice")
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid max_tokens %q: must be a positive integer", value)
+		}
+		s.MaxTokens = n
+		return nil
+	},
+	// stream:false forbids streaming requests
+	"stream": func(s *Scope, value string) error {
+		allowed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid stream %q: must be true or false", value)
+		}
+		s.NoStream = !allowed
+		return nil
+	},
+	// tools:false forbids tools and tool_choice
+	"tools": func(s *Scope, value string) error {
+		allowed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid tools %q: must be true or false", value)
+		}
+		s.NoTools = !allowed
+		return nil
+	},
+	// stream_seconds ends streams that run longer than n seconds
+	"stream_seconds": func(s *Scope, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid stream_seconds %q: must be a positive integer", value)
+		}
+		s.MaxStreamSeconds = n
+		return nil
+	},
+	// stream_tokens ends streams once they produce about n output tokens
+	"stream_tokens": func(s *Scope, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid stream_tokens %q: must be a positive integer", value)
+		}
+		s.MaxStreamTokens = n
+		return nil
+	},
+	// budget sets a spend ceiling for the token, e.g. budget:5usd
+	"budget": func(s *Scope, value string) error {
+		amount, ok := strings.CutSuffix(value, "usd")
+		usd, err := strconv.ParseFloat(amount, 64)
+		if !ok || err != nil || usd <= 0 || math.IsInf(usd, 0) {
+			return fmt.Errorf("invalid budget %q: must be a positive amount like 5usd", value)
+		}
+		s.BudgetUSD = usd
+		return nil
+	},
+	// rpm limits the token to n requests per minute
+	"rpm": func(s *Scope, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid rpm %q: must be a positive integer", value)
+		}
+		s.RequestsPerMinute = n
+		return nil
+	},
+	// tool allows a tool name (glob pattern); repeat the key to allow
+	// several. Tools not listed are forbidden.
+	"tool": func(s *Scope, value string) error {
+		if _, err := path.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid tool pattern %q", value)
+		}
+		if len(s.ToolAllowlists) == 0 {
+			s.ToolAllowlists = [][]string{nil}
+		}
+		s.ToolAllowlists[0] = append(s.ToolAllowlists[0], value)
+		return nil
+	},
+	// server_tools:false forbids server tools such as web_search
+	"server_tools": func(s *Scope, value string) error {
+		allowed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid server_tools %q: must be true or false", value)
+		}
+		s.NoServerTools = !allowed
+		return nil
+	},
+	// server_tool allows a server tool by name (glob pattern), e.g.
+	// web_search; repeat the key to allow several. Others are forbidden.
+	"server_tool": func(s *Scope, value string) error {
+		if _, err := path.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid server_tool pattern %q", value)
+		}
+		if len(s.ServerToolAllowlists) == 0 {
+			s.ServerToolAllowlists = [][]string{nil}
+		}
+		s.ServerToolAllowlists[0] = append(s.ServerToolAllowlists[0], value)
+		return nil
+	},
+	// web_domain limits web_search and web_fetch to a domain and its
+	// subdomains; repeat the key to allow several
+	"web_domain": func(s *Scope, value string) error {
+		if strings.ContainsAny(value, "/*") {
+			return fmt.Errorf("invalid web_domain %q: must be a domain name", value)
+		}
+		if len(s.WebDomainAllowlists) == 0 {
+			s.WebDomainAllowlists = [][]string{nil}
+		}
+		s.WebDomainAllowlists[0] = append(s.WebDomainAllowlists[0], value)
+		return nil
+	},
+}
+
+// scopeConstraintDoc describes a scope constraint for `scopes -json`
+type scopeConstraintDoc struct {
+	Key         string `json:"key"`
+	Example     string `json:"example"`    // a valid value
+	Repeatable  bool   `json:"repeatable"` // may be given more than once
+	Description string `json:"description"`
+}
+
+// scopeConstraintDocs describes each of scopeConstraints
+var scopeConstraintDocs = []scopeConstraintDoc{
+	{"model", "claude-3-*", true, "Allows only models matching the glob pattern"},
+	{"max_tokens", "1024", false, "Caps the request's max_tokens"},
+	{"stream", "false", false, "false forbids streaming requests"},
+	{"tools", "false", false, "false forbids tools and tool_choice"},
+	{"stream_seconds", "300", false, "Ends streams that run longer than this many seconds"},
+	{"stream_tokens", "8000", false, "Ends streams once they produce about this many output tokens"},
+	{"budget", "5usd", false, "Spend ceiling for the token"},
+	{"rpm", "60", false, "Limits the token to this many requests per minute"},
+	{"tool", "get_*", true, "Allows a tool name (glob pattern); tools not listed are forbidden"},
+	{"server_tools", "false", false, "false forbids server tools such as web_search"},
+	{"server_tool", "web_search", true, "Allows a server tool by name (glob pattern); others are forbidden"},
+	{"web_domain", "docs.python.org", true, "Limits web_search and web_fetch to the domain and its subdomains"},
+}
+
+// Scope is a parsed scope string of the form
+// anthropic[:capability][:key:value]*
+type Scope struct {
+	def scopeDef
+
+	// Workspace is the configured workspace whose API key the token's
+	// requests use, from an anthropic:<workspace> prefix ("" = api_key)
+	Workspace string
+
+	// Models lists glob patterns the request model must match; empty
+	// allows any model
+	Models []string
+	// PolicyModels and PolicyEndpoints are further allowlists from the
+	// configured policy; both the scope's and the policy's must match
+	PolicyModels    []string
+	PolicyEndpoints []string
+	// AgentModels is a further model allowlist from the agent's policy
+	// override (see AgentPolicy)
+	AgentModels []string
+	// RequestsPerMinute rate-limits each token (0 = unlimited)
+	RequestsPerMinute int
+	// MaxTokens caps max_tokens in request bodies (0 = no cap)
+	MaxTokens int64
+	// NoStream rejects requests with "stream": true
+	NoStream bool
+	// MaxStreamSeconds and MaxStreamTokens end streams that run longer or
+	// produce more output, with an error event (0 = no limit)
+	MaxStreamSeconds int
+	MaxStreamTokens  int64
+	// BudgetUSD is the estimated spend after which the token is refused
+	// (0 = unlimited)
+	BudgetUSD float64
+	// NoTools rejects requests carrying tools or tool_choice
+	NoTools bool
+	// ToolAllowlists holds glob patterns for tool names, from the scope
+	// and from policy; a tool must match a pattern in every list
+	ToolAllowlists [][]string
+	// NoServerTools rejects server tools (typed tools such as web_search)
+	NoServerTools bool
+	// ServerToolAllowlists holds glob patterns for server tool names, from
+	// the scope and from policy; a server tool must match every list
+	ServerToolAllowlists [][]string
+	// WebDomainAllowlists holds the domains web_search and web_fetch may
+	// reach, from the scope and from policy; a domain must be in every list
+	WebDomainAllowlists [][]string
+	// RecordTranscripts audits the reassembled content of streamed
+	// responses; only policy can set it
+	RecordTranscripts bool
+}
+
+// ParseScope parses and validates a scope string against the built-in
+// capabilities
+func ParseScope(scope string) (*Scope, error) {
+	return parseScope(scope, nil)
+}
+
+// parseScope parses a scope string, also accepting the named scopes
+// defined in policies (see ScopePolicy)
+func parseScope(scope string, policies map[string]*ScopePolicy) (*Scope, error) {
+	segs := strings.Split(scope, ":")
+	if segs[0] != "anthropic" {
+		return nil, fmt.Errorf("scope %q: must start with \"anthropic\"", scope)
+	}
+
+	base, rest := "anthropic", segs[1:]
+	if len(rest) > 0 {
+		if _, isKey := scopeConstraints[rest[0]]; !isKey {
+			base, rest = base+":"+rest[0], rest[1:]
+		}
+	}
+	def, ok := lookupScope(base)
+	if pol := policies[base]; !ok && pol != nil {
+		def, ok = pol.scopeDef(base), true
+	}
+	if !ok {
+		return nil, fmt.Errorf("scope %q: unknown capability %q", scope, strings.TrimPrefix(base, "anthropic:"))
+	}
+
+	s := &Scope{def: def}
+	if len(rest)%2 != 0 {
+		return nil, fmt.Errorf("scope %q: constraint %q has no value", scope, rest[len(rest)-1])
+	}
+	for i := 0; i < len(rest); i += 2 {
+		key, value := rest[i], rest[i+1]
+		apply, ok := scopeConstraints[key]
+		if !ok {
+			return nil, fmt.Errorf("scope %q: unknown constraint %q", scope, key)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("scope %q: constraint %q has no value", scope, key)
+		}
+		if err := apply(s, value); err != nil {
+			return nil, fmt.Errorf("scope %q: %w", scope, err)
+		}
+	}
+	return s, nil
+}
+
+// lookupScope returns the definition for a capability pattern, or false if
+// unknown
+func lookupScope(pattern string) (scopeDef, bool) {
+	for _, def := range scopeDefs {
+		if def.Pattern == pattern {
+			return def, true
+		}
+	}
+	return scopeDef{}, false
+}
+
+// AllowsPath reports whether the scope may call the API path.
+// Non-canonical paths (e.g. containing "..") are denied.
+func (s *Scope) AllowsPath(urlPath string) bool {
+	if urlPath == "" || path.Clean(urlPath) != urlPath {
+		return false
+	}
+	if len(s.PolicyEndpoints) > 0 && !matchPath(s.PolicyEndpoints, urlPath) {
+		return false
+	}
+	if s.def.Paths == nil {
+		return !matchPath([]string{adminPath, adminPath + "/*"}, urlPath)
+	}
+	return matchPath(s.def.Paths, urlPath)
+}
+
+// matchPath reports whether urlPath matches one of the path patterns; a
+// trailing "*" matches any suffix
+func matchPath(patterns []string, urlPath string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(urlPath, prefix) {
+				return true
+			}
+		} else if urlPath == p {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsModel reports whether the scope permits requests for model
+func (s *Scope) AllowsModel(model string) bool {
+	if len(s.PolicyModels) > 0 && !matchAny(s.PolicyModels, model) {
+		return false
+	}
+	if len(s.AgentModels) > 0 && !matchAny(s.AgentModels, model) {
+		return false
+	}
+	return len(s.Models) == 0 || matchAny(s.Models, model)
+}
+
+// restrictsModels reports whether the scope, its policy, or the agent's
+// policy override limits models
+func (s *Scope) restrictsModels() bool {
+	return len(s.Models) > 0 || len(s.PolicyModels) > 0 || len(s.AgentModels) > 0
+}
+
+// AllowsTool reports whether the scope permits a tool definition named name
+func (s *Scope) AllowsTool(name string) bool {
+	if s.NoTools {
+		return false
+	}
+	for _, list := range s.ToolAllowlists {
+		if !matchAny(list, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsServerTool reports whether the scope permits the server tool name,
+// as returned by serverToolName
+func (s *Scope) AllowsServerTool(name string) bool {
+	if s.NoTools || s.NoServerTools {
+		return false
+	}
+	for _, list := range s.ServerToolAllowlists {
+		if !matchAny(list, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsWebDomain reports whether web tools may be limited to domain
+func (s *Scope) AllowsWebDomain(domain string) bool {
+	for _, list := range s.WebDomainAllowlists {
+		if !domainAllowed(list, domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// webDomains returns the domains web tools are limited to when a request
+// does not limit them itself: those of the first allowlist that every
+// other list allows, or nil if the scope sets none
+func (s *Scope) webDomains() []string {
+	if len(s.WebDomainAllowlists) == 0 {
+		return nil
+	}
+	domains := []string{}
+	for _, d := range s.WebDomainAllowlists[0] {
+		if s.AllowsWebDomain(d) {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// matchAny reports whether name matches one of the glob patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectsBody reports whether enforcing the scope requires reading
+// request bodies
+func (s *Scope) inspectsBody() bool {
+	return s.restrictsModels() || s.MaxTokens > 0 || s.NoStream || s.NoTools || len(s.ToolAllowlists) > 0 ||
+		s.NoServerTools || len(s.ServerToolAllowlists) > 0 || len(s.WebDomainAllowlists) > 0
+}
+
+// scopeSpecs converts scopeDefs for the SDK
+func scopeSpecs() []sdk.ScopeSpec {
+	specs := make([]sdk.ScopeSpec, len(scopeDefs))
+	for i, def := range scopeDefs {
+		examples := []string{def.Pattern}
+		if def.Pattern == "anthropic" {
+			examples = append(examples, "anthropic:model:claude-sonnet-*:max_tokens:4096")
+		}
+		specs[i] = sdk.ScopeSpec{
+			Pattern:     def.Pattern,
+			Description: def.Description,
+			Examples:    examples,
+		}
+	}
+	return specs
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestScopeAllowsPath(t *testing.T) {
+	tests := []struct {
+		scope string
+		path  string
+		want  bool
+	}{
+		{"anthropic", "/v1/messages", true},
+		{"anthropic", "/v1/messages/batches/msgbatch_1", true},
+		{"anthropic", "/v1/organizations/api_keys", false},
+		{"anthropic", "/v1/organizations", false},
+		{"anthropic:messages", "/v1/organizations", false},
+		{"anthropic:messages", "/v1/messages", true},
+		{"anthropic:messages", "/v1/messages/count_tokens", true},
+		{"anthropic:messages", "/v1/messages/batches", false},
+		{"anthropic:messages", "/v1/models", false},
+		{"anthropic:batches", "/v1/messages/batches", true},
+		{"anthropic:batches", "/v1/messages/batches/msgbatch_1/results", true},
+		{"anthropic:batches", "/v1/messages", false},
+		{"anthropic:claude", "/v1/models/claude-sonnet-4-5", true},
+		{"anthropic:claude", "/v1/files", false},
+		{"anthropic:admin", "/v1/organizations/users", true},
+		{"anthropic:admin", "/v1/organizations", true},
+		{"anthropic:admin", "/v1/messages", false},
+		{"anthropic:messages", "/v1/messages/../organizations/users", false},
+		{"anthropic", "/v1//organizations/users", false},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseScope(tt.scope)
+		if err != nil {
+			t.Fatalf("ParseScope(%q) error: %v", tt.scope, err)
+		}
+		if got := s.AllowsPath(tt.path); got != tt.want {
+			t.Errorf("ParseScope(%q).AllowsPath(%q) = %v, want %v", tt.scope, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_EnforcesScopeEndpoints(t *testing.T) {
+	var forwarded atomic.Int32
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19519}`, func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.Write([]byte(`{"data": [], "has_more": false}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic:batches", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /v1/messages with batches scope: status = %d, want 403", resp.StatusCode)
+	}
+	if forwarded.Load() != 0 {
+		t.Error("forbidden request must not reach upstream")
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/messages/batches", nil)
+	req.Header.Set("x-api-key", cred.Value)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /v1/messages/batches: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestProxy_FiltersModels(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19548,
+		"policies": {"anthropic:claude": {"models": ["claude-*"]}}}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == modelsPath {
+			w.Write([]byte(`{"data":[{"type":"model","id":"claude-opus-4-1"},{"type":"model","id":"claude-haiku-4-5"},{"type":"model","id":"claude-3-haiku-20240307"}],"has_more":false,"first_id":"claude-opus-4-1","last_id":"claude-3-haiku-20240307"}`))
+			return
+		}
+		w.Write([]byte(`{"type":"model","id":"` + strings.TrimPrefix(r.URL.Path, modelsPath+"/") + `"}`))
+	})
+	get := func(scope, urlPath string) (int, string) {
+		cred := issueToken(t, plugin, "agent-1", scope, 10*time.Minute)
+		req, _ := http.NewRequest("GET", srv.URL+urlPath, nil)
+		req.Header.Set("x-api-key", cred.Value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	ids := func(body string) []string {
+		var list struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		json.Unmarshal([]byte(body), &list)
+		var ids []string
+		for _, m := range list.Data {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	// Unconstrained scopes see the full list
+	if _, body := get("anthropic", modelsPath); len(ids(body)) != 3 {
+		t.Errorf("anthropic: models = %v, want all 3", ids(body))
+	}
+	// Scope and policy patterns both filter the list
+	_, body := get("anthropic:claude:model:claude-*-4-*", modelsPath)
+	if got := ids(body); !slices.Equal(got, []string{"claude-opus-4-1", "claude-haiku-4-5"}) {
+		t.Errorf("filtered models = %v", got)
+	}
+	if !strings.Contains(body, `"has_more":false`) {
+		t.Errorf("list fields should be kept: %s", body)
+	}
+
+	if status, _ := get("anthropic:model:claude-haiku-*", modelsPath+"/claude-haiku-4-5"); status != http.StatusOK {
+		t.Errorf("allowed model: status = %d, want 200", status)
+	}
+	if status, _ := get("anthropic:model:claude-haiku-*", modelsPath+"/claude-opus-4-1"); status != http.StatusNotFound {
+		t.Errorf("disallowed model: status = %d, want 404", status)
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		scope     string
+		wantErr   bool
+		models    []string
+		maxTokens int64
+	}{
+		{scope: "anthropic"},
+		{scope: "anthropic:messages"},
+		{scope: "anthropic:model:claude-3-*:max_tokens:1024", models: []string{"claude-3-*"}, maxTokens: 1024},
+		{scope: "anthropic:batches:model:claude-haiku-*:model:claude-sonnet-*", models: []string{"claude-haiku-*", "claude-sonnet-*"}},
+		{scope: "anthropicx", wantErr: true},
+		{scope: "anthropic:", wantErr: true},
+		{scope: "anthropic:nope", wantErr: true},
+		{scope: "anthropic:model", wantErr: true},
+		{scope: "anthropic:messages:color:blue", wantErr: true},
+		{scope: "anthropic:max_tokens:0", wantErr: true},
+		{scope: "anthropic:stream:maybe", wantErr: true},
+		{scope: "anthropic:tools:sometimes", wantErr: true},
+		{scope: "anthropic:budget:5", wantErr: true},
+		{scope: "anthropic:rpm:0", wantErr: true},
+		{scope: "anthropic:messages:rpm:60"},
+		{scope: "anthropic:budget:-1usd", wantErr: true},
+		{scope: "anthropic:messages:budget:2.50usd"},
+		{scope: "anthropic:messages:tool:get_*:tool:search"},
+		{scope: "anthropic:messages:stream:false"},
+		{scope: "anthropic:messages:server_tools:false"},
+		{scope: "anthropic:messages:stream_seconds:120:stream_tokens:8000"},
+		{scope: "anthropic:stream_seconds:0", wantErr: true},
+		{scope: "anthropic:stream_tokens:lots", wantErr: true},
+		{scope: "anthropic:server_tool:web_search:web_domain:example.com"},
+		{scope: "anthropic:server_tools:never", wantErr: true},
+		{scope: "anthropic:web_domain:example.com/docs", wantErr: true},
+		{scope: "anthropic:max_tokens:10:max_tokens:20", wantErr: true},
+		{scope: "anthropic:model:[", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			s, err := ParseScope(tt.scope)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseScope(%q) should fail", tt.scope)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseScope(%q) error: %v", tt.scope, err)
+			}
+			if strings.Join(s.Models, ",") != strings.Join(tt.models, ",") || s.MaxTokens != tt.maxTokens {
+				t.Errorf("ParseScope(%q) = models %v, max_tokens %d", tt.scope, s.Models, s.MaxTokens)
+			}
+
+			matched, _ := newTestPlugin(t).MatchScope(context.Background(), tt.scope)
+			if !matched {
+				t.Errorf("MatchScope(%q) should accept a valid scope", tt.scope)
+			}
+		})
+	}
+}
+
+func TestProxy_EnforcesScopeConstraints(t *testing.T) {
+	var forwarded atomic.Int32
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19520}`, func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.WriteHeader(http.StatusOK)
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic:model:claude-3-*:max_tokens:1024", 10*time.Minute)
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"model": "claude-3-haiku-20240307", "max_tokens": 512}`, http.StatusOK},
+		{`{"model": "claude-opus-4-1", "max_tokens": 512}`, http.StatusForbidden},
+		{`{"model": "claude-3-haiku-20240307", "max_tokens": 4096}`, http.StatusForbidden},
+		{`not json`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp := proxyRequest(t, srv, cred.Value, tt.body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("body %s: status = %d, want %d", tt.body, resp.StatusCode, tt.want)
+		}
+	}
+	if n := forwarded.Load(); n != 1 {
+		t.Errorf("upstream received %d requests, want 1", n)
+	}
+}
+
+func TestGetCredential_RejectsInvalidScope(t *testing.T) {
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19521}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	_, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic:model",
+		TTL:   10 * time.Minute,
+		Agent: sdk.Agent{ID: "agent-1"},
+	})
+	if err == nil {
+		t.Error("GetCredential() should reject a malformed scope")
+	}
+}
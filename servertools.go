@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+)
+
+// serverToolName returns the name of a typed tool, e.g. web_search for
+// web_search_20250305, or false for custom tools. Typed tools are run by
+// Anthropic (web_search, web_fetch, code_execution) or implement computer
+// use (computer, bash, text_editor); they are priced separately and can
+// reach outside the request, so scopes gate them by name.
+func serverToolName(toolType string) (string, bool) {
+	if toolType == "" || toolType == "custom" {
+		return "", false
+	}
+	if i := strings.LastIndexByte(toolType, '_'); i > 0 && isDigits(toolType[i+1:]) {
+		return toolType[:i], true
+	}
+	return toolType, true
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// webTools are the server tools that accept allowed_domains
+var webTools = map[string]bool{"web_search": true, "web_fetch": true}
+
+// domainAllowed reports whether domain, optionally followed by a path, is
+// one of the allowed domains or a subdomain of one
+func domainAllowed(allowed []string, domain string) bool {
+	host, _, _ := strings.Cut(strings.ToLower(domain), "/")
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if host == a || strings.HasSuffix(host, "."+a) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictWebDomains sets allowed_domains on web tools that do not limit
+// their domains to the scope's, dropping any blocked_domains, which cannot
+// be combined with it
+func restrictWebDomains(params map[string]any, scope *Scope) {
+	domains := scope.webDomains()
+	if len(domains) == 0 {
+		return
+	}
+	tools, _ := params["tools"].([]any)
+	for _, tool := range tools {
+		m, _ := tool.(map[string]any)
+		toolType, _ := m["type"].(string)
+		name, _ := serverToolName(toolType)
+		if !webTools[name] {
+			continue
+		}
+		if list, _ := m["allowed_domains"].([]any); len(list) == 0 {
+			allowed := make([]any, len(domains))
+			for i, d := range domains {
+				allowed[i] = d
+			}
+			m["allowed_domains"] = allowed
+			delete(m, "blocked_domains")
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestServerToolName(t *testing.T) {
+	tests := []struct {
+		toolType string
+		want     string
+		server   bool
+	}{
+		{"", "", false},
+		{"custom", "", false},
+		{"web_search_20250305", "web_search", true},
+		{"code_execution_20250522", "code_execution", true},
+		{"computer_20250124", "computer", true},
+		{"text_editor", "text_editor", true},
+	}
+	for _, tt := range tests {
+		if got, ok := serverToolName(tt.toolType); got != tt.want || ok != tt.server {
+			t.Errorf("serverToolName(%q) = %q, %v, want %q, %v", tt.toolType, got, ok, tt.want, tt.server)
+		}
+	}
+}
+
+func TestDomainAllowed(t *testing.T) {
+	allowed := []string{"example.com", "Docs.Example.org"}
+	for domain, want := range map[string]bool{
+		"example.com":          true,
+		"api.example.com":      true,
+		"example.com/blog":     true,
+		"docs.example.org":     true,
+		"example.org":          false,
+		"notexample.com":       false,
+		"example.com.evil.net": false,
+	} {
+		if got := domainAllowed(allowed, domain); got != want {
+			t.Errorf("domainAllowed(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
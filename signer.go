@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signingKeyLabel domain-separates the derived HMAC key from the secret
+// it is derived from
+const signingKeyLabel = "creddy-anthropic/token-signing/v1"
+
+// jwtHeader is the fixed JOSE header of issued JWTs
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// tokenClaims is the payload carried by a signed token. Field names follow
+// the registered JWT claims so both encodings share one payload.
+type tokenClaims struct {
+	Issuer    string `json:"iss,omitempty"`
+	ID        string `json:"jti"`
+	AgentID   string `json:"sub"`
+	AgentName string `json:"name,omitempty"`
+	Scope     string `json:"scope"`
+	ClientIP  string `json:"ip,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenSigner issues and verifies self-contained tokens that encode agent,
+// scope, and expiry under an HMAC-SHA256 signature, so validation needs no
+// token store and every replica sharing the key agrees. Tokens are encoded
+// either as crd_<payload>.<sig> or as standard HS256 JWTs that downstream
+// gateways can verify independently. Early revocations are tracked in a
+// small in-memory list until the token would have expired anyway.
+type TokenSigner struct {
+	key    []byte
+	jwt    bool
+	prefix string
+
+	mu      sync.Mutex
+	revoked map[string]time.Time // token ID -> time the entry can be dropped
+}
+
+// deriveSigningKey derives the HMAC key from a configured secret
+func deriveSigningKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingKeyLabel))
+	return mac.Sum(nil)
+}
+
+// NewTokenSigner creates a signer for prefixed (crd_) tokens keyed by a
+// key derived from secret
+func NewTokenSigner(secret, prefix string) *TokenSigner {
+	return &TokenSigner{
+		key:     deriveSigningKey(secret),
+		prefix:  prefix,
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// NewJWTSigner creates a signer for HS256 JWTs. The secret is used as the
+// HMAC key verbatim so other systems can verify tokens with it.
+func NewJWTSigner(secret string) *TokenSigner {
+	return &TokenSigner{
+		key:     []byte(secret),
+		jwt:     true,
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// Issue returns a signed token for info and fills in info.ID
+func (s *TokenSigner) Issue(info *TokenInfo) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	info.ID = hex.EncodeToString(id)
+
+	claims := tokenClaims{
+		ID:        info.ID,
+		AgentID:   info.AgentID,
+		AgentName: info.AgentName,
+		Scope:     info.Scope,
+		ClientIP:  info.ClientIP,
+		IssuedAt:  info.CreatedAt.Unix(),
+		ExpiresAt: info.ExpiresAt.Unix(),
+	}
+	if s.jwt {
+		claims.Issuer = PluginName
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	if s.jwt {
+		signed := jwtHeader + "." + body
+		return signed + "." + s.sign(signed), nil
+	}
+	return s.prefix + body + "." + s.sign(body), nil
+}
+
+// Verify checks the token's signature, expiry, and revocation status
+func (s *TokenSigner) Verify(token string) (*TokenInfo, bool) {
+	var signed, body, sig string
+	if s.jwt {
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 || parts[0] != jwtHeader {
+			return nil, false
+		}
+		signed, body, sig = parts[0]+"."+parts[1], parts[1], parts[2]
+	} else {
+		rest, ok := strings.CutPrefix(token, s.prefix)
+		if !ok {
+			return nil, false
+		}
+		body, sig, ok = strings.Cut(rest, ".")
+		if !ok {
+			return nil, false
+		}
+		signed = body
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.sign(signed))) {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, false
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+
+	info := &TokenInfo{
+		ID:        claims.ID,
+		AgentID:   claims.AgentID,
+		AgentName: claims.AgentName,
+		Scope:     claims.Scope,
+		ClientIP:  claims.ClientIP,
+		CreatedAt: time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}
+	if time.Now().After(info.ExpiresAt) || s.isRevoked(info.ID) {
+		return nil, false
+	}
+	return info, true
+}
+
+// Revoke adds a token ID to the revocation list. Entries are kept for the
+// maximum token lifetime, after which the token has expired on its own.
+func (s *TokenSigner) Revoke(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[id] = time.Now().Add(maxTokenTTL)
+}
+
+// Cleanup drops revocation entries for tokens that have since expired
+func (s *TokenSigner) Cleanup() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for id, until := range s.revoked {
+		if now.After(until) {
+			delete(s.revoked, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// sameKey reports whether o issues and verifies the same tokens as s, so
+// the tokens s revoked are o's as well
+func (s *TokenSigner) sameKey(o *TokenSigner) bool {
+	return s != nil && o != nil && s.jwt == o.jwt && s.prefix == o.prefix && hmac.Equal(s.key, o.key)
+}
+
+func (s *TokenSigner) isRevoked(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.revoked[id]
+	return ok
+}
+
+func (s *TokenSigner) sign(data string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isJWT reports whether token has the shape of a JWT
+func isJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
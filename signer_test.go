@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestTokenSigner_IssueAndVerify(t *testing.T) {
+	st := NewTokenSigner("secret", "crd_")
+	info := &TokenInfo{
+		AgentID:   "agent1",
+		AgentName: "Agent One",
+		Scope:     "anthropic:claude",
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(10 * time.Minute),
+	}
+
+	token, err := st.Issue(info)
+	if err != nil {
+		t.Fatalf("Issue() error: %v", err)
+	}
+	if !strings.HasPrefix(token, "crd_") {
+		t.Errorf("expected crd_ prefix, got %s", token)
+	}
+
+	got, ok := st.Verify(token)
+	if !ok {
+		t.Fatal("expected token to verify")
+	}
+	if got.ID != info.ID || got.AgentID != "agent1" || got.Scope != "anthropic:claude" {
+		t.Errorf("claims mismatch: %+v", got)
+	}
+
+	// A different key rejects the token
+	if _, ok := NewTokenSigner("other", "crd_").Verify(token); ok {
+		t.Error("expected token signed with another key to be rejected")
+	}
+
+	// Tampering with the payload breaks the signature
+	c := byte('x')
+	if token[10] == c {
+		c = 'y'
+	}
+	tampered := token[:10] + string(c) + token[11:]
+	if _, ok := st.Verify(tampered); ok {
+		t.Error("expected tampered token to be rejected")
+	}
+
+	st.Revoke(info.ID)
+	if _, ok := st.Verify(token); ok {
+		t.Error("expected revoked token to be rejected")
+	}
+}
+
+func TestTokenSigner_Expired(t *testing.T) {
+	st := NewTokenSigner("secret", "crd_")
+	token, err := st.Issue(&TokenInfo{
+		CreatedAt: time.Now().Add(-2 * time.Minute),
+		ExpiresAt: time.Now().Add(-1 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("Issue() error: %v", err)
+	}
+	if _, ok := st.Verify(token); ok {
+		t.Error("expected expired token to be rejected")
+	}
+}
+
+func TestStatelessMode_SharedAcrossReplicas(t *testing.T) {
+	a, b := newTestPlugin(t), newTestPlugin(t)
+	for i, p := range []*AnthropicPlugin{a, b} {
+		// Replicas share a configuration, but on one host not a port
+		config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": %d, "token_mode": "stateless", "token_signing_key": "replica-secret"}`, 20410+i)
+		if err := p.Configure(context.Background(), config); err != nil {
+			t.Fatalf("Configure() error: %v", err)
+		}
+	}
+
+	cred, err := a.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic",
+		TTL:   10 * time.Minute,
+		Agent: sdk.Agent{ID: "agent1", Name: "agent1"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+
+	info, ok := b.ValidateToken(cred.Value)
+	if !ok {
+		t.Fatal("expected replica b to accept a token issued by replica a")
+	}
+	if info.AgentID != "agent1" {
+		t.Errorf("AgentID mismatch: %q", info.AgentID)
+	}
+	if len(a.ListTokens(TokenFilter{})) != 0 {
+		t.Error("expected stateless tokens to bypass the token store")
+	}
+
+	a.RevokeCredential(context.Background(), cred.ExternalID)
+	if _, ok := a.ValidateToken(cred.Value); ok {
+		t.Error("expected revoked token to be rejected")
+	}
+
+	if _, err := a.RenewCredential(context.Background(), cred.ExternalID, time.Minute); err != ErrRenewalUnsupported {
+		t.Errorf("expected ErrRenewalUnsupported, got %v", err)
+	}
+}
+
+func TestConfigure_StatelessRejectsPerAgentLimit(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "token_mode": "stateless", "token_signing_key": "replica-secret", "max_tokens_per_agent": 3}`)
+	if err == nil {
+		t.Fatal("expected error combining stateless mode with max_tokens_per_agent")
+	}
+}
+
+func TestConfigure_StatelessRequiresSigningKey(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "token_mode": "stateless"}`)
+	if err == nil || !strings.Contains(err.Error(), "token_signing_key is required") {
+		t.Errorf("Configure() = %v, want token_signing_key required", err)
+	}
+}
+
+func TestJWTFormat_VerifiableWithSecret(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19411, "token_format": "jwt", "token_signing_key": "gateway-secret"}`)
+	if err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	cred, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic:claude",
+		TTL:   10 * time.Minute,
+		Agent: sdk.Agent{ID: "agent1", Name: "agent1"},
+	})
+	if err != nil {
+		t.Fatalf("GetCredential() error: %v", err)
+	}
+
+	// Verify the way an independent gateway would: HS256 over header.payload
+	parts := strings.Split(cred.Value, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a three-part JWT, got %q", cred.Value)
+	}
+	mac := hmac.New(sha256.New, []byte("gateway-secret"))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) != parts[2] {
+		t.Fatal("JWT signature does not verify with token_signing_key")
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("decode claims: %v", err)
+	}
+	if claims["sub"] != "agent1" || claims["scope"] != "anthropic:claude" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+	if exp, _ := claims["exp"].(float64); int64(exp) != cred.ExpiresAt.Unix() {
+		t.Errorf("exp claim %v does not match ExpiresAt %v", claims["exp"], cred.ExpiresAt.Unix())
+	}
+
+	// The proxy still validates it (store mode: by hash)
+	if _, ok := plugin.ValidateToken(cred.Value); !ok {
+		t.Error("expected JWT to validate")
+	}
+	plugin.RevokeCredential(context.Background(), cred.ExternalID)
+	if _, ok := plugin.ValidateToken(cred.Value); ok {
+		t.Error("expected revoked JWT to be rejected")
+	}
+}
+
+func TestJWTFormat_AcceptedByProxy(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t,
+		`{"api_key": "sk-ant-test", "proxy_port": 19412, "token_mode": "stateless", "token_format": "jwt", "token_signing_key": "gateway-secret"}`,
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+	cred := issueToken(t, plugin, "agent1", "anthropic", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected JWT to be accepted in x-api-key, got %d", resp.StatusCode)
+	}
+}
+
+func TestConfigure_JWTRequiresSigningKey(t *testing.T) {
+	plugin := newTestPlugin(t)
+	err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "token_format": "jwt"}`)
+	if err == nil || !strings.Contains(err.Error(), "token_signing_key") {
+		t.Fatalf("expected token_signing_key error, got %v", err)
+	}
+}
+
+func TestStatelessMode_RevocationsSurviveReconfigure(t *testing.T) {
+	plugin := newTestPlugin(t)
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19412, "token_mode": "stateless", "token_signing_key": "replica-secret", "log_level": "%s"}`
+	if err := plugin.Configure(context.Background(), fmt.Sprintf(config, "info")); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	if err := plugin.RevokeCredential(context.Background(), cred.ExternalID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := plugin.Configure(context.Background(), fmt.Sprintf(config, "debug")); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if _, ok := plugin.ValidateToken(cred.Value); ok {
+		t.Error("revoked token accepted again after reconfiguring with the same signing key")
+	}
+}
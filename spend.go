@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// spendRetention is how long hourly spend records are kept for reporting
+const spendRetention = 31 * 24 * time.Hour
+
+// SpendTotals accumulates usage and estimated cost
+type SpendTotals struct {
+	Requests                 int64   `json:"requests"`
+	InputTokens              int64   `json:"input_tokens"`
+	OutputTokens             int64   `json:"output_tokens"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens"`
+	CostUSD                  float64 `json:"cost_usd"`
+}
+
+func (t *SpendTotals) add(u Usage, cost float64) {
+	t.Requests++
+	t.InputTokens += u.InputTokens
+	t.OutputTokens += u.OutputTokens
+	t.CacheCreationInputTokens += u.CacheCreationInputTokens
+	t.CacheReadInputTokens += u.CacheReadInputTokens
+	t.CostUSD += cost
+}
+
+func (t *SpendTotals) merge(o *SpendTotals) {
+	t.Requests += o.Requests
+	t.InputTokens += o.InputTokens
+	t.OutputTokens += o.OutputTokens
+	t.CacheCreationInputTokens += o.CacheCreationInputTokens
+	t.CacheReadInputTokens += o.CacheReadInputTokens
+	t.CostUSD += o.CostUSD
+}
+
+// SpendReport is spend over a time range broken down by agent ID, scope
+// capability, and model
+type SpendReport struct {
+	Start  *time.Time              `json:"start,omitempty"`
+	End    *time.Time              `json:"end,omitempty"`
+	Total  SpendTotals             `json:"total"`
+	Agents map[string]*SpendTotals `json:"agents"`
+	Scopes map[string]*SpendTotals `json:"scopes"`
+	Models map[string]*SpendTotals `json:"models"`
+}
+
+// SpendRow is spend by one agent on one model, in one time bucket of a
+// series
+type SpendRow struct {
+	Time    time.Time `json:"time,omitzero"` // start of the bucket
+	AgentID string    `json:"agent_id"`
+	Model   string    `json:"model"`
+	SpendTotals
+}
+
+// SpendSeries is spend over a time range per bucket, agent, and model
+type SpendSeries struct {
+	Start  *time.Time `json:"start,omitempty"`
+	End    *time.Time `json:"end,omitempty"`
+	Bucket string     `json:"bucket"` // hour or day
+	Series []SpendRow `json:"series"`
+}
+
+// spendKey identifies an hourly spend record
+type spendKey struct {
+	Hour    time.Time
+	AgentID string
+	Scope   string
+	Model   string
+}
+
+// spendTracker keeps spend in hourly records in memory, per plugin
+// instance
+type spendTracker struct {
+	mu      sync.Mutex
+	records map[spendKey]*SpendTotals
+}
+
+func newSpendTracker() *spendTracker {
+	return &spendTracker{records: make(map[spendKey]*SpendTotals)}
+}
+
+// Record adds a response's usage and cost at time now
+func (t *spendTracker) Record(now time.Time, agentID, scope, model string, u Usage, cost float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := spendKey{now.UTC().Truncate(time.Hour), agentID, scope, model}
+	totals := t.records[key]
+	if totals == nil {
+		totals = &SpendTotals{}
+		t.records[key] = totals
+	}
+	totals.add(u, cost)
+}
+
+// each calls fn for each record in the hours overlapping [start, end); a
+// zero start or end leaves that side unbounded. The caller must hold t.mu.
+func (t *spendTracker) each(start, end time.Time, fn func(key spendKey, totals *SpendTotals)) {
+	from := start.UTC().Truncate(time.Hour)
+	for key, totals := range t.records {
+		if (!start.IsZero() && key.Hour.Before(from)) || (!end.IsZero() && !key.Hour.Before(end)) {
+			continue
+		}
+		fn(key, totals)
+	}
+}
+
+// Report totals spend between start and end, to the hour
+func (t *spendTracker) Report(start, end time.Time) SpendReport {
+	report := SpendReport{
+		Agents: make(map[string]*SpendTotals),
+		Scopes: make(map[string]*SpendTotals),
+		Models: make(map[string]*SpendTotals),
+	}
+	if !start.IsZero() {
+		report.Start = &start
+	}
+	if !end.IsZero() {
+		report.End = &end
+	}
+	add := func(m map[string]*SpendTotals, key string, totals *SpendTotals) {
+		if m[key] == nil {
+			m[key] = &SpendTotals{}
+		}
+		m[key].merge(totals)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.each(start, end, func(key spendKey, totals *SpendTotals) {
+		report.Total.merge(totals)
+		add(report.Agents, key.AgentID, totals)
+		add(report.Scopes, key.Scope, totals)
+		add(report.Models, key.Model, totals)
+	})
+	return report
+}
+
+// Rows totals spend between start and end per agent and model, and per
+// UTC bucket (an hour or a day) unless bucket is 0, sorted by time, agent,
+// and model
+func (t *spendTracker) Rows(start, end time.Time, bucket time.Duration) []SpendRow {
+	type rowKey struct {
+		time           time.Time
+		agentID, model string
+	}
+	byKey := make(map[rowKey]*SpendTotals)
+
+	t.mu.Lock()
+	t.each(start, end, func(key spendKey, totals *SpendTotals) {
+		k := rowKey{agentID: key.AgentID, model: key.Model}
+		if bucket > 0 {
+			k.time = key.Hour.Truncate(bucket)
+		}
+		if byKey[k] == nil {
+			byKey[k] = &SpendTotals{}
+		}
+		byKey[k].merge(totals)
+	})
+	t.mu.Unlock()
+
+	rows := make([]SpendRow, 0, len(byKey))
+	for k, totals := range byKey {
+		rows = append(rows, SpendRow{Time: k.time, AgentID: k.agentID, Model: k.model, SpendTotals: *totals})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Time.Equal(rows[j].Time) {
+			return rows[i].Time.Before(rows[j].Time)
+		}
+		if rows[i].AgentID != rows[j].AgentID {
+			return rows[i].AgentID < rows[j].AgentID
+		}
+		return rows[i].Model < rows[j].Model
+	})
+	return rows
+}
+
+// Prune drops records for hours before cutoff
+func (t *spendTracker) Prune(cutoff time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.records {
+		if key.Hour.Add(time.Hour).Before(cutoff) {
+			delete(t.records, key)
+		}
+	}
+}
+
+// writeSpendCSV writes rows as CSV with a header line, starting each row
+// with its bucket's time if withTime is set
+func writeSpendCSV(w io.Writer, rows []SpendRow, withTime bool) error {
+	cw := csv.NewWriter(w)
+	header := []string{"agent_id", "model", "requests", "input_tokens", "output_tokens",
+		"cache_creation_input_tokens", "cache_read_input_tokens", "cost_usd"}
+	if withTime {
+		header = append([]string{"time"}, header...)
+	}
+	cw.Write(header)
+	for _, r := range rows {
+		var record []string
+		if withTime {
+			record = append(record, r.Time.Format(time.RFC3339))
+		}
+		cw.Write(append(record,
+			r.AgentID,
+			r.Model,
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.InputTokens, 10),
+			strconv.FormatInt(r.OutputTokens, 10),
+			strconv.FormatInt(r.CacheCreationInputTokens, 10),
+			strconv.FormatInt(r.CacheReadInputTokens, 10),
+			strconv.FormatFloat(r.CostUSD, 'f', 6, 64),
+		))
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxSSEEvent bounds how much of one event is buffered; a longer event is
+// passed on in pieces, which hooks will not be able to parse
+const maxSSEEvent = 4 << 20
+
+// streamBufferSize is the size of the buffers streams are read and copied
+// through
+const streamBufferSize = 32 << 10
+
+// Stream buffers are pooled, so many concurrent streams, most of them idle
+// while the model thinks, do not each allocate their own
+var (
+	sseReaderPool = sync.Pool{New: func() any {
+		return bufio.NewReaderSize(nil, streamBufferSize)
+	}}
+	copyBufferPool = sync.Pool{New: func() any {
+		buf := make([]byte, streamBufferSize)
+		return &buf
+	}}
+)
+
+// sseEvent is one server-sent event as received: Raw holds its bytes up to
+// and including the blank line that ends it, ready to forward unchanged
+type sseEvent struct {
+	Raw   []byte
+	Event string // the event field, e.g. message_start
+	Data  []byte // data lines joined with "\n"
+}
+
+// sseHook processes each event of a stream before it is forwarded
+type sseHook func(ev *sseEvent)
+
+// streamOptions controls how event streams are forwarded
+type streamOptions struct {
+	// Check may stop the stream before an event is forwarded by returning
+	// an error, which copyResponse returns
+	Check func(ev *sseEvent) error
+	Hooks []sseHook // called with each event as received from upstream
+	// Transform rewrites an event before it is forwarded, or drops it by
+	// returning nil
+	Transform func(ev *sseEvent) *sseEvent
+	Sent      []sseHook // called with each event as forwarded to the client
+	// KeepAlive is how long the client may go without an event before it
+	// is sent a keepalive comment (0 = never)
+	KeepAlive time.Duration
+	// WriteTimeout is how long one write may wait on a slow client before
+	// it is treated as gone (0 = no limit)
+	WriteTimeout time.Duration
+}
+
+// keepAliveComment is sent to clients while upstream is silent; SSE
+// parsers ignore comments
+var keepAliveComment = []byte(": ping\n\n")
+
+// sseReader splits a text/event-stream body into events, however they are
+// split across reads
+type sseReader struct {
+	r *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	br := sseReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return &sseReader{r: br}
+}
+
+// release returns the reader's buffer to the pool; events already returned
+// do not share it, but the reader must not be used again
+func (s *sseReader) release() {
+	s.r.Reset(nil)
+	sseReaderPool.Put(s.r)
+	s.r = nil
+}
+
+// Next returns the next event. At the end of the stream, a final event
+// without its blank line is returned before io.EOF; if reading failed
+// instead, the incomplete event is dropped so nothing appended to the
+// stream can run into it.
+func (s *sseReader) Next() (*sseEvent, error) {
+	ev := &sseEvent{}
+	lineStart := true
+	for {
+		line, err := s.r.ReadSlice('\n')
+		full := err == bufio.ErrBufferFull
+		if full {
+			err = nil // the rest of the line follows on the next read
+		}
+		ev.Raw = append(ev.Raw, line...)
+		if err != nil {
+			if len(ev.Raw) == 0 || err != io.EOF {
+				return nil, err
+			}
+			ev.parse()
+			return ev, nil
+		}
+		if len(ev.Raw) > maxSSEEvent {
+			return ev, nil
+		}
+		// A blank line ends the event
+		if lineStart && !full && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			ev.parse()
+			return ev, nil
+		}
+		lineStart = !full
+	}
+}
+
+// parse sets the event's fields from its raw lines; comments (lines
+// starting with ":") and unknown fields are ignored
+func (ev *sseEvent) parse() {
+	var data [][]byte
+	for _, line := range bytes.Split(ev.Raw, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "event":
+			ev.Event = string(value)
+		case "data":
+			data = append(data, value)
+		}
+	}
+	ev.Data = bytes.Join(data, []byte("\n"))
+}
+
+// writeStreamError ends an event stream with an error event, in the form
+// Anthropic uses for errors after a stream has started
+func writeStreamError(w http.ResponseWriter, errType, message string) error {
+	data, _ := json.Marshal(map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+	return writeSSE(w, fmt.Appendf(nil, "event: error\ndata: %s\n\n", data))
+}
+
+// writeSSE writes raw events to a stream and flushes them
+func writeSSE(w http.ResponseWriter, raw []byte) error {
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
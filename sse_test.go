@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSSEReader(t *testing.T) {
+	long := strings.Repeat("x", 5000) // longer than the read buffer
+	stream := ": comment\n\n" +
+		"event: message_start\r\ndata: {\"a\":1}\r\n\r\n" +
+		"data: line one\ndata:line two\n\n" +
+		"event: content_block_delta\ndata: " + long + "\n\n" +
+		"event: message_stop\ndata: {}"
+
+	events := newSSEReader(iotest.OneByteReader(strings.NewReader(stream)))
+	var got []*sseEvent
+	for {
+		ev, err := events.Next()
+		if ev != nil {
+			got = append(got, ev)
+		}
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("Next() error: %v", err)
+			}
+			break
+		}
+	}
+
+	want := []struct{ event, data string }{
+		{"", ""},
+		{"message_start", `{"a":1}`},
+		{"", "line one\nline two"},
+		{"content_block_delta", long},
+		{"message_stop", "{}"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	var raw strings.Builder
+	for i, ev := range got {
+		if ev.Event != want[i].event || string(ev.Data) != want[i].data {
+			t.Errorf("event %d = %q %.20q, want %q %.20q", i, ev.Event, ev.Data, want[i].event, want[i].data)
+		}
+		raw.Write(ev.Raw)
+	}
+	if raw.String() != stream {
+		t.Error("raw events do not reassemble the stream")
+	}
+}
+
+func TestCopyResponse_SSEEvents(t *testing.T) {
+	stream := "event: a\ndata: 1\n\nevent: b\ndata: 2\n\n"
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"text/event-stream"}},
+		Body:   io.NopCloser(iotest.HalfReader(strings.NewReader(stream))),
+	}
+	w := httptest.NewRecorder()
+	var seen []string
+	n, _ := copyResponse(w, resp, nil, streamOptions{Hooks: []sseHook{func(ev *sseEvent) {
+		// Each event is whole when the hook sees it, before it is written
+		seen = append(seen, ev.Event+"="+string(ev.Data))
+		if strings.Count(w.Body.String(), "\n\n") != len(seen)-1 {
+			t.Errorf("event %s written before its hook ran", ev.Event)
+		}
+	}}})
+	if n != int64(len(stream)) || w.Body.String() != stream {
+		t.Errorf("copied %d bytes %q, want %q", n, w.Body.String(), stream)
+	}
+	if strings.Join(seen, ",") != "a=1,b=2" {
+		t.Errorf("hooks saw %v", seen)
+	}
+}
+
+func TestCopyResponse_KeepAlive(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		// Stall in the middle of an event, then between events
+		io.WriteString(pw, "event: a\ndata: ")
+		time.Sleep(120 * time.Millisecond)
+		io.WriteString(pw, "1\n\n")
+		time.Sleep(120 * time.Millisecond)
+		io.WriteString(pw, "event: b\ndata: 2\n\n")
+		pw.Close()
+	}()
+	resp := &http.Response{Header: http.Header{"Content-Type": {"text/event-stream"}}, Body: pr}
+	w := httptest.NewRecorder()
+	copyResponse(w, resp, nil, streamOptions{KeepAlive: 50 * time.Millisecond})
+
+	// Pings come between whole events, so the events themselves are intact
+	body := w.Body.String()
+	if strings.Count(body, ": ping\n\n") < 2 {
+		t.Errorf("body = %q, want keepalives during the stalls", body)
+	}
+	if rest := strings.ReplaceAll(body, ": ping\n\n", ""); rest != "event: a\ndata: 1\n\nevent: b\ndata: 2\n\n" {
+		t.Errorf("events = %q", rest)
+	}
+}
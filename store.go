@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenStore persists issued crd_xxx tokens and their metadata.
+// Implementations must be safe for concurrent use. The plugin keys entries
+// by token hash (see hashToken); stores never see plaintext tokens.
+type TokenStore interface {
+	// Add stores a token, replacing any existing entry
+	Add(token string, info *TokenInfo) error
+
+	// Get returns the token's metadata, or false if unknown or expired
+	Get(token string) (*TokenInfo, bool)
+
+	// Remove deletes a token; removing an unknown token is not an error
+	Remove(token string) error
+
+	// Update atomically applies fn to an unexpired token's metadata and
+	// stores the result. It returns ErrTokenNotFound for unknown or expired
+	// tokens; an error from fn aborts the update.
+	Update(token string, fn func(info *TokenInfo) error) (*TokenInfo, error)
+
+	// Cleanup deletes expired tokens and returns how many were removed
+	Cleanup() int
+
+	// List returns unexpired tokens matching filter
+	List(filter TokenFilter) []*TokenInfo
+
+	// Snapshot writes every unexpired token to w (see writeSnapshot)
+	Snapshot(w io.Writer) error
+
+	// Restore adds the unexpired tokens from a snapshot read from r
+	Restore(r io.Reader) error
+
+	// AgentPolicies returns every agent's policy override
+	AgentPolicies() (map[string]*AgentPolicy, error)
+
+	// SetAgentPolicy stores agentID's policy override, or removes it if
+	// policy is nil
+	SetAgentPolicy(agentID string, policy *AgentPolicy) error
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// TokenInfo holds metadata about an issued token
+type TokenInfo struct {
+	ID        string    `json:"id"` // SHA-256 of the token; also the credential's ExternalID
+	AgentID   string    `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	Scope     string    `json:"scope"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	ClientIP  string    `json:"client_ip,omitempty"` // Bound client address (bind_ip)
+	MaxUses   int64     `json:"max_uses,omitempty"`  // Request limit (0 = unlimited)
+
+	// Usage, updated by the proxy after each request
+	LastUsedAt   time.Time `json:"last_used_at,omitzero"`
+	RequestCount int64     `json:"request_count,omitempty"`
+	BytesIn      int64     `json:"bytes_in,omitempty"`
+	BytesOut     int64     `json:"bytes_out,omitempty"`
+	SpentUSD     float64   `json:"spent_usd,omitempty"` // Estimated cost of proxied requests
+}
+
+// ErrTokenNotFound is returned by TokenStore.Update for unknown or expired tokens
+var ErrTokenNotFound = errors.New("token not found or expired")
+
+// TokenFilter narrows TokenStore.List results. Zero-value fields match
+// everything.
+type TokenFilter struct {
+	AgentID string
+	Scope   string
+	// ExpiresBefore matches tokens expiring before it
+	ExpiresBefore time.Time
+}
+
+// Match reports whether info satisfies the filter
+func (f TokenFilter) Match(info *TokenInfo) bool {
+	if f.AgentID != "" && info.AgentID != f.AgentID {
+		return false
+	}
+	if f.Scope != "" && info.Scope != f.Scope {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && !info.ExpiresAt.Before(f.ExpiresBefore) {
+		return false
+	}
+	return true
+}
+
+// snapshotEntry is one line of a token store snapshot: a token, or an
+// agent's policy override
+type snapshotEntry struct {
+	Key  string     `json:"key,omitempty"`
+	Info *TokenInfo `json:"info,omitempty"`
+
+	AgentID     string       `json:"agent_id,omitempty"`
+	AgentPolicy *AgentPolicy `json:"agent_policy,omitempty"`
+}
+
+// writeSnapshot writes tokens and agent policies as JSON lines, one
+// snapshotEntry each. The format is the same for every backend, so a
+// snapshot taken from one store can be restored into another.
+func writeSnapshot(w io.Writer, tokens map[string]*TokenInfo, policies map[string]*AgentPolicy) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	now := time.Now()
+	for key, info := range tokens {
+		if now.After(info.ExpiresAt) {
+			continue
+		}
+		if err := enc.Encode(snapshotEntry{Key: key, Info: info}); err != nil {
+			return err
+		}
+	}
+	for agentID, policy := range policies {
+		if err := enc.Encode(snapshotEntry{AgentID: agentID, AgentPolicy: policy}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// restoreSnapshot reads a snapshot written by writeSnapshot and adds each
+// unexpired token and agent policy to s
+func restoreSnapshot(s TokenStore, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	now := time.Now()
+	for {
+		var entry snapshotEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read snapshot: %w", err)
+		}
+		if entry.AgentID != "" && entry.AgentPolicy != nil {
+			if err := s.SetAgentPolicy(entry.AgentID, entry.AgentPolicy); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.Key == "" || entry.Info == nil || now.After(entry.Info.ExpiresAt) {
+			continue
+		}
+		if err := s.Add(entry.Key, entry.Info); err != nil {
+			return err
+		}
+	}
+}
+
+// saveSnapshotFile writes a snapshot of s to path, replacing it atomically
+func saveSnapshotFile(s TokenStore, path string) error {
+	return writeFileAtomic(path, s.Snapshot)
+}
+
+// writeFileAtomic writes a private file at path with write, replacing it
+// only once the new contents are complete
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshotFile restores the snapshot at path into s. A missing file is
+// not an error: there is nothing to restore on first start.
+func loadSnapshotFile(s TokenStore, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer f.Close()
+	return s.Restore(f)
+}
+
+// tokenStoreBackends maps token_store config values to constructors
+var tokenStoreBackends = map[string]func(cfg *AnthropicConfig) (TokenStore, error){
+	"memory": func(cfg *AnthropicConfig) (TokenStore, error) {
+		return NewTokenStore(), nil
+	},
+	"bolt": func(cfg *AnthropicConfig) (TokenStore, error) {
+		if cfg.TokenStorePath == "" {
+			return nil, fmt.Errorf("token_store_path is required for the bolt token store")
+		}
+		return NewBoltTokenStore(cfg.TokenStorePath)
+	},
+	"redis": func(cfg *AnthropicConfig) (TokenStore, error) {
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("redis_url is required for the redis token store")
+		}
+		return NewRedisTokenStore(cfg.RedisURL, cfg.RedisKeyPrefix)
+	},
+}
+
+// openTokenStore creates the token store selected by cfg.TokenStore
+func openTokenStore(cfg *AnthropicConfig) (TokenStore, error) {
+	open, ok := tokenStoreBackends[cfg.TokenStore]
+	if !ok {
+		names := make([]string, 0, len(tokenStoreBackends))
+		for name := range tokenStoreBackends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown token_store %q (supported: %s)", cfg.TokenStore, strings.Join(names, ", "))
+	}
+	return open(cfg)
+}
+
+// MemoryTokenStore keeps tokens in an in-memory map. Tokens are lost
+// when the plugin restarts.
+type MemoryTokenStore struct {
+	mu       sync.RWMutex
+	tokens   map[string]*TokenInfo
+	policies map[string]*AgentPolicy
+}
+
+func NewTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens:   make(map[string]*TokenInfo),
+		policies: make(map[string]*AgentPolicy),
+	}
+}
+
+func (s *MemoryTokenStore) Add(token string, info *TokenInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = info
+	return nil
+}
+
+func (s *MemoryTokenStore) Get(token string) (*TokenInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.tokens[token]
+	if !ok {
+		return nil, false
+	}
+	// Check expiry
+	if time.Now().After(info.ExpiresAt) {
+		return nil, false
+	}
+	return info, true
+}
+
+func (s *MemoryTokenStore) Remove(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, token)
+	return nil
+}
+
+func (s *MemoryTokenStore) Update(token string, fn func(info *TokenInfo) error) (*TokenInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.tokens[token]
+	if !ok || time.Now().After(info.ExpiresAt) {
+		return nil, ErrTokenNotFound
+	}
+	// Mutate a copy: callers of Get may still hold the old pointer
+	updated := *info
+	if err := fn(&updated); err != nil {
+		return nil, err
+	}
+	s.tokens[token] = &updated
+	return &updated, nil
+}
+
+// Cleanup removes expired tokens
+func (s *MemoryTokenStore) Cleanup() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for token, info := range s.tokens {
+		if now.After(info.ExpiresAt) {
+			delete(s.tokens, token)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *MemoryTokenStore) List(filter TokenFilter) []*TokenInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	list := make([]*TokenInfo, 0, len(s.tokens))
+	for _, info := range s.tokens {
+		if now.After(info.ExpiresAt) || !filter.Match(info) {
+			continue
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+func (s *MemoryTokenStore) Snapshot(w io.Writer) error {
+	s.mu.RLock()
+	tokens := make(map[string]*TokenInfo, len(s.tokens))
+	for token, info := range s.tokens {
+		tokens[token] = info
+	}
+	policies := maps.Clone(s.policies)
+	s.mu.RUnlock()
+	return writeSnapshot(w, tokens, policies)
+}
+
+func (s *MemoryTokenStore) Restore(r io.Reader) error {
+	return restoreSnapshot(s, r)
+}
+
+func (s *MemoryTokenStore) AgentPolicies() (map[string]*AgentPolicy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.policies), nil
+}
+
+func (s *MemoryTokenStore) SetAgentPolicy(agentID string, policy *AgentPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if policy == nil {
+		delete(s.policies, agentID)
+	} else {
+		s.policies[agentID] = policy
+	}
+	return nil
+}
+
+func (s *MemoryTokenStore) Close() error {
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	tokensBucket   = []byte("tokens")
+	policiesBucket = []byte("agent_policies")
+)
+
+// BoltTokenStore persists tokens in a BoltDB file so issued tokens,
+// expiries, and agent metadata survive plugin restarts.
+type BoltTokenStore struct {
+	db *bolt.DB
+}
+
+// NewBoltTokenStore opens (or creates) the BoltDB file at path
+func NewBoltTokenStore(path string) (*BoltTokenStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open token store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(tokensBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(policiesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init token store %s: %w", path, err)
+	}
+
+	return &BoltTokenStore{db: db}, nil
+}
+
+func (s *BoltTokenStore) Add(token string, info *TokenInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).Put([]byte(token), data)
+	})
+}
+
+func (s *BoltTokenStore) Get(token string) (*TokenInfo, bool) {
+	var info *TokenInfo
+	s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(tokensBucket).Get([]byte(token))
+		if data == nil {
+			return nil
+		}
+		var decoded TokenInfo
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return err
+		}
+		info = &decoded
+		return nil
+	})
+	if info == nil || time.Now().After(info.ExpiresAt) {
+		return nil, false
+	}
+	return info, true
+}
+
+func (s *BoltTokenStore) Remove(token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).Delete([]byte(token))
+	})
+}
+
+func (s *BoltTokenStore) Update(token string, fn func(info *TokenInfo) error) (*TokenInfo, error) {
+	var info TokenInfo
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokensBucket)
+		data := b.Get([]byte(token))
+		if data == nil {
+			return ErrTokenNotFound
+		}
+		if err := json.Unmarshal(data, &info); err != nil {
+			return err
+		}
+		if time.Now().After(info.ExpiresAt) {
+			return ErrTokenNotFound
+		}
+		if err := fn(&info); err != nil {
+			return err
+		}
+		data, err := json.Marshal(&info)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(token), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Cleanup removes expired tokens
+func (s *BoltTokenStore) Cleanup() int {
+	now := time.Now()
+	removed := 0
+	s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokensBucket)
+		// Collect first: deleting while iterating a bolt cursor skips keys
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			var info TokenInfo
+			if err := json.Unmarshal(v, &info); err != nil || now.After(info.ExpiresAt) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed
+}
+
+func (s *BoltTokenStore) List(filter TokenFilter) []*TokenInfo {
+	now := time.Now()
+	var list []*TokenInfo
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).ForEach(func(k, v []byte) error {
+			var info TokenInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return nil
+			}
+			if now.After(info.ExpiresAt) || !filter.Match(&info) {
+				return nil
+			}
+			list = append(list, &info)
+			return nil
+		})
+	})
+	return list
+}
+
+func (s *BoltTokenStore) Snapshot(w io.Writer) error {
+	policies, err := s.AgentPolicies()
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]*TokenInfo)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).ForEach(func(k, v []byte) error {
+			var info TokenInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return nil
+			}
+			tokens[string(k)] = &info
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(w, tokens, policies)
+}
+
+func (s *BoltTokenStore) Restore(r io.Reader) error {
+	return restoreSnapshot(s, r)
+}
+
+func (s *BoltTokenStore) AgentPolicies() (map[string]*AgentPolicy, error) {
+	policies := make(map[string]*AgentPolicy)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(policiesBucket).ForEach(func(k, v []byte) error {
+			var policy AgentPolicy
+			if err := json.Unmarshal(v, &policy); err != nil {
+				return fmt.Errorf("agent policy %s: %w", k, err)
+			}
+			policies[string(k)] = &policy
+			return nil
+		})
+	})
+	return policies, err
+}
+
+func (s *BoltTokenStore) SetAgentPolicy(agentID string, policy *AgentPolicy) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(policiesBucket)
+		if policy == nil {
+			return b.Delete([]byte(agentID))
+		}
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(agentID), data)
+	})
+}
+
+func (s *BoltTokenStore) Close() error {
+	return s.db.Close()
+}
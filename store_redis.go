@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRedisKeyPrefix = "creddy:anthropic:"
+	redisOpTimeout        = 5 * time.Second
+)
+
+// RedisTokenStore keeps tokens in Redis so several proxy replicas can share
+// validation and revocation state. Expiry is delegated to Redis key TTLs.
+type RedisTokenStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisTokenStore connects to the Redis server at url (redis://...)
+func NewRedisTokenStore(url, prefix string) (*RedisTokenStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis_url: %w", err)
+	}
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+
+	return &RedisTokenStore{client: client, prefix: prefix}, nil
+}
+
+func (s *RedisTokenStore) key(token string) string {
+	return s.prefix + "token:" + token
+}
+
+func (s *RedisTokenStore) Add(token string, info *TokenInfo) error {
+	ttl := time.Until(info.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return s.client.Set(ctx, s.key(token), data, ttl).Err()
+}
+
+func (s *RedisTokenStore) Get(token string) (*TokenInfo, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, s.key(token)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Error("Redis token lookup failed", "error", err)
+		}
+		return nil, false
+	}
+
+	var info TokenInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, false
+	}
+	if time.Now().After(info.ExpiresAt) {
+		return nil, false
+	}
+	return &info, true
+}
+
+func (s *RedisTokenStore) Remove(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return s.client.Del(ctx, s.key(token)).Err()
+}
+
+// Update applies fn inside an optimistic WATCH/MULTI transaction, retrying
+// if another instance modifies the token concurrently
+func (s *RedisTokenStore) Update(token string, fn func(info *TokenInfo) error) (*TokenInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	key := s.key(token)
+	var info TokenInfo
+	txf := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrTokenNotFound
+		}
+		if err != nil {
+			return err
+		}
+		info = TokenInfo{}
+		if err := json.Unmarshal(data, &info); err != nil {
+			return err
+		}
+		if time.Now().After(info.ExpiresAt) {
+			return ErrTokenNotFound
+		}
+		if err := fn(&info); err != nil {
+			return err
+		}
+		data, err = json.Marshal(&info)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, time.Until(info.ExpiresAt))
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		err := s.client.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &info, nil
+	}
+	return nil, fmt.Errorf("update token: too much contention")
+}
+
+// Cleanup is a no-op: Redis expires keys on its own
+func (s *RedisTokenStore) Cleanup() int {
+	return 0
+}
+
+func (s *RedisTokenStore) List(filter TokenFilter) []*TokenInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	var list []*TokenInfo
+	now := time.Now()
+	iter := s.client.Scan(ctx, 0, s.key("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		data, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var info TokenInfo
+		if err := json.Unmarshal(data, &info); err != nil || now.After(info.ExpiresAt) || !filter.Match(&info) {
+			continue
+		}
+		list = append(list, &info)
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("Redis token scan failed", "error", err)
+	}
+	return list
+}
+
+func (s *RedisTokenStore) Snapshot(w io.Writer) error {
+	policies, err := s.AgentPolicies()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	tokens := make(map[string]*TokenInfo)
+	keyPrefix := s.key("")
+	iter := s.client.Scan(ctx, 0, s.key("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		data, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var info TokenInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+		tokens[strings.TrimPrefix(iter.Val(), keyPrefix)] = &info
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("scan tokens: %w", err)
+	}
+	return writeSnapshot(w, tokens, policies)
+}
+
+func (s *RedisTokenStore) Restore(r io.Reader) error {
+	return restoreSnapshot(s, r)
+}
+
+// policiesKey is the hash of agent policy overrides, by agent ID
+func (s *RedisTokenStore) policiesKey() string {
+	return s.prefix + "agent_policies"
+}
+
+func (s *RedisTokenStore) AgentPolicies() (map[string]*AgentPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	fields, err := s.client.HGetAll(ctx, s.policiesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string]*AgentPolicy, len(fields))
+	for agentID, data := range fields {
+		var policy AgentPolicy
+		if err := json.Unmarshal([]byte(data), &policy); err != nil {
+			return nil, fmt.Errorf("agent policy %s: %w", agentID, err)
+		}
+		policies[agentID] = &policy
+	}
+	return policies, nil
+}
+
+func (s *RedisTokenStore) SetAgentPolicy(agentID string, policy *AgentPolicy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if policy == nil {
+		return s.client.HDel(ctx, s.policiesKey(), agentID).Err()
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(ctx, s.policiesKey(), agentID, data).Err()
+}
+
+// Ping checks that the Redis server is reachable
+func (s *RedisTokenStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *RedisTokenStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisTokenStore_SharedAcrossInstances(t *testing.T) {
+	srv := miniredis.RunT(t)
+	url := "redis://" + srv.Addr()
+
+	a, err := NewRedisTokenStore(url, "")
+	if err != nil {
+		t.Fatalf("NewRedisTokenStore() error: %v", err)
+	}
+	defer a.Close()
+	b, err := NewRedisTokenStore(url, "")
+	if err != nil {
+		t.Fatalf("NewRedisTokenStore() error: %v", err)
+	}
+	defer b.Close()
+
+	a.Add("crd_shared", &TokenInfo{
+		AgentID:   "agent1",
+		Scope:     "anthropic",
+		ExpiresAt: time.Now().Add(10 * time.Minute),
+	})
+
+	got, ok := b.Get("crd_shared")
+	if !ok {
+		t.Fatal("expected token issued on instance a to validate on instance b")
+	}
+	if got.AgentID != "agent1" {
+		t.Errorf("AgentID mismatch: got %q", got.AgentID)
+	}
+	if n := len(b.List(TokenFilter{AgentID: "agent1"})); n != 1 {
+		t.Errorf("expected 1 listed token, got %d", n)
+	}
+
+	b.Remove("crd_shared")
+	if _, ok := a.Get("crd_shared"); ok {
+		t.Error("expected revocation on instance b to apply to instance a")
+	}
+}
+
+func TestRedisTokenStore_TTLExpiry(t *testing.T) {
+	srv := miniredis.RunT(t)
+	store, err := NewRedisTokenStore("redis://"+srv.Addr(), "test:")
+	if err != nil {
+		t.Fatalf("NewRedisTokenStore() error: %v", err)
+	}
+	defer store.Close()
+
+	store.Add("crd_short", &TokenInfo{ExpiresAt: time.Now().Add(30 * time.Second)})
+	if !srv.Exists("test:token:crd_short") {
+		t.Fatal("expected prefixed key in redis")
+	}
+
+	srv.FastForward(31 * time.Second)
+	if _, ok := store.Get("crd_short"); ok {
+		t.Error("expected token to expire with its redis TTL")
+	}
+}
+
+func TestRedisTokenStore_Update(t *testing.T) {
+	srv := miniredis.RunT(t)
+	store, err := NewRedisTokenStore("redis://"+srv.Addr(), "")
+	if err != nil {
+		t.Fatalf("NewRedisTokenStore() error: %v", err)
+	}
+	defer store.Close()
+
+	store.Add("crd_renew", &TokenInfo{ExpiresAt: time.Now().Add(time.Minute)})
+	_, err = store.Update("crd_renew", func(info *TokenInfo) error {
+		info.ExpiresAt = time.Now().Add(10 * time.Minute)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error: %v", err)
+	}
+	if ttl := srv.TTL(store.key("crd_renew")); ttl < 9*time.Minute {
+		t.Errorf("expected redis TTL to follow the new expiry, got %v", ttl)
+	}
+
+	if _, err := store.Update("crd_missing", func(*TokenInfo) error { return nil }); err != ErrTokenNotFound {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestTokenStore_SnapshotRestore(t *testing.T) {
+	srv := miniredis.RunT(t)
+	redisStore, err := NewRedisTokenStore("redis://"+srv.Addr(), "")
+	if err != nil {
+		t.Fatalf("NewRedisTokenStore() error: %v", err)
+	}
+	defer redisStore.Close()
+	boltStore, err := NewBoltTokenStore(filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatalf("NewBoltTokenStore() error: %v", err)
+	}
+	defer boltStore.Close()
+
+	for name, src := range map[string]TokenStore{"memory": NewTokenStore(), "bolt": boltStore, "redis": redisStore} {
+		t.Run(name, func(t *testing.T) {
+			src.Add("live", &TokenInfo{ID: "live", AgentID: "agent1", Scope: "anthropic", ExpiresAt: time.Now().Add(10 * time.Minute), RequestCount: 3})
+			src.Add("expired", &TokenInfo{ID: "expired", AgentID: "agent1", ExpiresAt: time.Now().Add(-time.Minute)})
+			src.SetAgentPolicy("agent1", &AgentPolicy{Models: []string{"claude-haiku-*"}})
+			src.SetAgentPolicy("agent2", &AgentPolicy{Models: []string{"claude-opus-*"}})
+			if err := src.SetAgentPolicy("agent2", nil); err != nil {
+				t.Fatalf("SetAgentPolicy(nil) error: %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := src.Snapshot(&buf); err != nil {
+				t.Fatalf("Snapshot() error: %v", err)
+			}
+
+			// Restore into a different backend: the format is shared
+			dst := NewTokenStore()
+			if err := dst.Restore(&buf); err != nil {
+				t.Fatalf("Restore() error: %v", err)
+			}
+			got, ok := dst.Get("live")
+			if !ok {
+				t.Fatal("expected live token to be restored")
+			}
+			if got.AgentID != "agent1" || got.RequestCount != 3 {
+				t.Errorf("restored token = %+v", got)
+			}
+			if n := len(dst.List(TokenFilter{})); n != 1 {
+				t.Errorf("expected 1 restored token, got %d", n)
+			}
+			policies, err := dst.AgentPolicies()
+			if err != nil || len(policies) != 1 || policies["agent1"] == nil || policies["agent1"].Models[0] != "claude-haiku-*" {
+				t.Errorf("restored agent policies = %v, %v", policies, err)
+			}
+		})
+	}
+}
+
+func TestSnapshot_SavedOnShutdownAndRestored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.snapshot")
+	config := func(port int) string {
+		return fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": %d, "snapshot_path": %q}`, port, path)
+	}
+
+	first := newTestPlugin(t)
+	if err := first.Configure(context.Background(), config(19517)); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	cred := issueToken(t, first, "agent-1", "anthropic", 10*time.Minute)
+	if err := first.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error: %v", err)
+	}
+
+	second := newTestPlugin(t)
+	if err := second.Configure(context.Background(), config(19518)); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	info, ok := second.ValidateToken(cred.Value)
+	if !ok {
+		t.Fatal("expected token to survive a restart via the snapshot")
+	}
+	if info.AgentID != "agent-1" {
+		t.Errorf("AgentID = %q, want agent-1", info.AgentID)
+	}
+}
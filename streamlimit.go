@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// streamLimitError ends a stream that exceeded a scope's stream limits
+type streamLimitError struct {
+	msg string
+}
+
+func (e *streamLimitError) Error() string { return e.msg }
+
+// streamTokenLimiter stops a stream once its output passes a token cap.
+// Anthropic reports output tokens only at the end of a stream, so they are
+// estimated from the length of the deltas as they arrive.
+type streamTokenLimiter struct {
+	limit int64
+	chars int64
+}
+
+// Check is a streamOptions.Check enforcing the limit
+func (l *streamTokenLimiter) Check(ev *sseEvent) error {
+	var e transcriptEvent
+	if ev.Event != "content_block_delta" && ev.Event != "" || json.Unmarshal(ev.Data, &e) != nil ||
+		e.Type != "content_block_delta" || e.Delta == nil {
+		return nil
+	}
+	l.chars += int64(len(e.Delta.Text) + len(e.Delta.Thinking) + len(e.Delta.PartialJSON))
+	if l.chars/charsPerToken > l.limit {
+		return &streamLimitError{fmt.Sprintf("stream exceeded this token's limit of %d output tokens", l.limit)}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_StreamLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19558, "audit_log_path": %q,
+		"policies": {"anthropic:messages": {"max_stream_seconds": 1}}}`, path)
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// A runaway generation: 20 characters (5 tokens) every 50ms
+		for {
+			fmt.Fprint(w, "event: content_block_delta\n"+`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"aaaaaaaaaaaaaaaaaaaa"}}`+"\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	})
+
+	tests := []struct {
+		scope  string
+		deltas int // forwarded before the limit
+		limit  string
+	}{
+		{"anthropic:stream_tokens:12", 2, "limit of 12 output tokens"},
+		{"anthropic:messages", -1, "limit of 1 seconds"},
+	}
+	for _, tt := range tests {
+		cred := issueToken(t, plugin, "agent-1", tt.scope, 10*time.Minute)
+		started := time.Now()
+		resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5","stream":true}`)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if tt.deltas >= 0 && strings.Count(string(body), "text_delta") != tt.deltas {
+			t.Errorf("%s: forwarded %d deltas, want %d", tt.scope, strings.Count(string(body), "text_delta"), tt.deltas)
+		}
+		if elapsed := time.Since(started); elapsed > 3*time.Second {
+			t.Errorf("%s: stream ran %v", tt.scope, elapsed)
+		}
+		if !strings.HasSuffix(string(body), "\n\nevent: error\n"+`data: {"error":{"message":"stream exceeded this token's `+tt.limit+`","type":"stream_limit_error"},"type":"error"}`+"\n\n") {
+			t.Errorf("%s: stream did not end with a stream_limit_error event: ...%s", tt.scope, body[max(0, len(body)-200):])
+		}
+		events := readAuditLog(t, path)
+		if ev := events[len(events)-1]; !strings.Contains(ev.StreamLimit, tt.limit) {
+			t.Errorf("%s: stream_limit = %q", tt.scope, ev.StreamLimit)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// SystemPrompt is an organization system prompt, e.g. data-handling rules,
+// prepended to the Messages requests of the agents and scopes it selects
+type SystemPrompt struct {
+	Text   string     `json:"text"`
+	Agents stringList `json:"agents"` // Agent IDs it applies to (default: every agent)
+	Scopes stringList `json:"scopes"` // Scope capabilities it applies to, e.g. anthropic:ci (default: every scope)
+}
+
+// appliesTo reports whether the prompt selects requests from agentID with
+// a scope of the given capability
+func (sp *SystemPrompt) appliesTo(agentID, pattern string) bool {
+	return (len(sp.Agents) == 0 || slices.Contains(sp.Agents, agentID)) &&
+		(len(sp.Scopes) == 0 || slices.Contains(sp.Scopes, pattern))
+}
+
+// validateSystemPrompts checks each prompt has text and names only known
+// scopes
+func validateSystemPrompts(cfg *AnthropicConfig) error {
+	for i, sp := range cfg.SystemPrompts {
+		if sp == nil || sp.Text == "" {
+			return fmt.Errorf("system_prompts[%d]: text is required", i)
+		}
+		for _, pattern := range sp.Scopes {
+			if _, builtin := lookupScope(pattern); !builtin && cfg.Policies[pattern] == nil {
+				return fmt.Errorf("system_prompts[%d]: unknown scope %q", i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// prependSystemPrompts puts texts, as text blocks, before the system prompt
+// of a Messages request (each item's params for a batch). The client's own
+// system prompt is kept after them, converted to a block if it is a string.
+func prependSystemPrompts(body []byte, batch bool, texts []string) ([]byte, error) {
+	if len(body) == 0 || len(texts) == 0 {
+		return body, nil
+	}
+	return rewriteParams(body, batch, func(params map[string]any) {
+		blocks := make([]any, 0, len(texts)+1)
+		for _, text := range texts {
+			blocks = append(blocks, map[string]any{"type": "text", "text": text})
+		}
+		switch system := params["system"].(type) {
+		case string:
+			if system != "" {
+				blocks = append(blocks, map[string]any{"type": "text", "text": system})
+			}
+		case []any:
+			blocks = append(blocks, system...)
+		}
+		params["system"] = blocks
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrependSystemPrompts(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		batch bool
+		want  string
+	}{
+		{"no system", `{"model":"m"}`, false, `{"model":"m","system":[{"text":"org","type":"text"}]}`},
+		{"string system", `{"system":"mine"}`, false, `{"system":[{"text":"org","type":"text"},{"text":"mine","type":"text"}]}`},
+		{"block system", `{"system":[{"type":"text","text":"mine","cache_control":{"type":"ephemeral"}}]}`, false,
+			`{"system":[{"text":"org","type":"text"},{"cache_control":{"type":"ephemeral"},"text":"mine","type":"text"}]}`},
+		{"batch", `{"requests":[{"custom_id":"1","params":{"system":"mine"}}]}`, true,
+			`{"requests":[{"custom_id":"1","params":{"system":[{"text":"org","type":"text"},{"text":"mine","type":"text"}]}}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := prependSystemPrompts([]byte(tt.body), tt.batch, []string{"org"})
+			if err != nil {
+				t.Fatalf("prependSystemPrompts() error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxy_SystemPrompts(t *testing.T) {
+	var system []any
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19551, "system_prompts": [
+		{"text": "Follow the data-handling policy."},
+		{"text": "You are a CI agent.", "scopes": ["anthropic:messages"]},
+		{"text": "Never open pull requests.", "agents": ["agent-2"]}]}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				System []any `json:"system"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			system = body.System
+			w.Write([]byte(`{}`))
+		})
+
+	texts := func() string {
+		var out []string
+		for _, block := range system {
+			out = append(out, block.(map[string]any)["text"].(string))
+		}
+		return strings.Join(out, " | ")
+	}
+	for _, tt := range []struct {
+		agent, scope, want string
+	}{
+		{"agent-1", "anthropic", "Follow the data-handling policy. | mine"},
+		{"agent-1", "anthropic:messages", "Follow the data-handling policy. | You are a CI agent. | mine"},
+		{"agent-2", "anthropic:messages:max_tokens:100", "Follow the data-handling policy. | You are a CI agent. | Never open pull requests. | mine"},
+	} {
+		cred := issueToken(t, plugin, tt.agent, tt.scope, 10*time.Minute)
+		resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5","max_tokens":10,"system":"mine","messages":[]}`)
+		resp.Body.Close()
+		if got := texts(); got != tt.want {
+			t.Errorf("%s with %s: system = %q, want %q", tt.agent, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestConfigure_SystemPrompts(t *testing.T) {
+	for _, config := range []string{
+		`{"api_key": "sk-ant-test", "system_prompts": [{"scopes": ["anthropic"]}]}`,
+		`{"api_key": "sk-ant-test", "system_prompts": [{"text": "x", "scopes": ["anthropic:nope"]}]}`,
+	} {
+		if err := newTestPlugin(t).Configure(context.Background(), config); err == nil {
+			t.Errorf("Configure(%s) succeeded, want error", config)
+		}
+	}
+}
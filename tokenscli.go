@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// cliTimeout bounds the CLI's requests to a running proxy
+const cliTimeout = 30 * time.Second
+
+// tokensUsage summarizes the tokens subcommands
+const tokensUsage = `usage: creddy-anthropic tokens list [-agent ID] [-scope SCOPE] [-expiring-within 15m] [-json]
+       creddy-anthropic tokens issue -agent ID [-scope SCOPE] [-ttl 30m] [-max-uses N] [-base-url URL] [-json]
+       creddy-anthropic tokens revoke <token or ID> | -agent ID | -all
+All take -url URL and -admin-token TOKEN.`
+
+// runTokensCommand runs `creddy-anthropic tokens <subcommand>`, which
+// manages issued tokens through a running proxy's admin API
+func runTokensCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(tokensUsage)
+	}
+	switch args[0] {
+	case "list":
+		return runTokensList(args[1:], out)
+	case "issue":
+		return runTokensIssue(args[1:], out)
+	case "revoke":
+		return runTokensRevoke(args[1:], out)
+	default:
+		return errors.New(tokensUsage)
+	}
+}
+
+// adminAPI calls a running proxy's admin endpoints
+type adminAPI struct {
+	url, token string
+}
+
+// adminFlags adds the flags locating the proxy and its admin token
+func adminFlags(flags *flag.FlagSet) *adminAPI {
+	api := &adminAPI{}
+	flags.StringVar(&api.url, "url", envOr("CREDDY_ANTHROPIC_URL", "http://localhost:8401"), "base URL of the running proxy or its admin_listen, or unix:/path for a socket (env CREDDY_ANTHROPIC_URL)")
+	flags.StringVar(&api.token, "admin-token", os.Getenv("CREDDY_ANTHROPIC_ADMIN_TOKEN"), "the proxy's admin_token (env CREDDY_ANTHROPIC_ADMIN_TOKEN)")
+	return api
+}
+
+// do sends a request with body (if not nil) as JSON, decoding the response
+// into out
+func (api *adminAPI) do(method, path string, body, out any) error {
+	resp, err := api.send(context.Background(), method, path, body, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", resp.Request.URL, err)
+	}
+	return nil
+}
+
+// send sends a request with body (if not nil) as JSON, returning the
+// response if it succeeded. Requests time out after cliTimeout unless
+// streaming is set.
+func (api *adminAPI) send(ctx context.Context, method, path string, body any, streaming bool) (*http.Response, error) {
+	if api.token == "" {
+		return nil, errors.New("an admin token is required: pass -admin-token or set CREDDY_ANTHROPIC_ADMIN_TOKEN")
+	}
+	target := strings.TrimSuffix(api.url, "/") + path
+	endpoint := target
+	client := &http.Client{Timeout: cliTimeout}
+	if socket, ok := strings.CutPrefix(api.url, "unix:"); ok {
+		endpoint = "http://admin" + path
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", api.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if streaming {
+		client.Timeout = 0
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", target, upstreamErrorMessage(resp))
+	}
+	return resp, nil
+}
+
+// runTokensList prints active tokens
+func runTokensList(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("tokens list", flag.ContinueOnError)
+	api := adminFlags(flags)
+	agent := flags.String("agent", "", "only tokens of this agent ID")
+	scope := flags.String("scope", "", "only tokens with this scope")
+	expiring := flags.Duration("expiring-within", 0, "only tokens expiring within this long, e.g. 15m")
+	asJSON := flags.Bool("json", false, "print the tokens as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *expiring < 0 {
+		return errors.New("-expiring-within must be positive")
+	}
+
+	q := url.Values{}
+	if *agent != "" {
+		q.Set("agent_id", *agent)
+	}
+	if *scope != "" {
+		q.Set("scope", *scope)
+	}
+	if *expiring > 0 {
+		q.Set("expiring_within", expiring.String())
+	}
+	path := "/admin/tokens"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var list tokenListResponse
+	if err := api.do(http.MethodGet, path, nil, &list); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list.Tokens)
+	}
+	return printTokens(out, list.Tokens, time.Now())
+}
+
+// runTokensIssue issues a token without Creddy and prints it with the
+// environment an Anthropic SDK needs to use it
+func runTokensIssue(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("tokens issue", flag.ContinueOnError)
+	api := adminFlags(flags)
+	agent := flags.String("agent", "", "agent ID the token is issued to (required)")
+	scope := flags.String("scope", "anthropic", "scope of the token")
+	ttl := flags.Duration("ttl", 30*time.Minute, fmt.Sprintf("token lifetime, from %s to %s", minTokenTTL, maxTokenTTL))
+	maxUses := flags.Int64("max-uses", 0, "number of requests the token allows (default unlimited)")
+	baseURL := flags.String("base-url", "", "ANTHROPIC_BASE_URL to print, when -url is the admin listener (default: -url)")
+	asJSON := flags.Bool("json", false, "print the token as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *baseURL == "" {
+		*baseURL = api.url
+	}
+	if *agent == "" || flags.NArg() > 0 {
+		return errors.New("usage: creddy-anthropic tokens issue -agent ID [-scope SCOPE] [-ttl 30m] [-max-uses N]")
+	}
+	if *ttl < minTokenTTL || *ttl > maxTokenTTL {
+		return fmt.Errorf("-ttl must be between %s and %s", minTokenTTL, maxTokenTTL)
+	}
+
+	req := issueRequest{AgentID: *agent, Scope: *scope, TTLSeconds: int64(ttl.Seconds()), MaxUses: *maxUses}
+	var issued issueResponse
+	if err := api.do(http.MethodPost, "/v1/tokens/issue", req, &issued); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(issued)
+	}
+	printTokenEnv(out, strings.TrimSuffix(*baseURL, "/"), issued)
+	return nil
+}
+
+// printBootstrapToken issues a token from plugin, configured and serving,
+// and prints it for `proxy -print-token`
+func printBootstrapToken(ctx context.Context, plugin *AnthropicPlugin, out io.Writer, agent, scope string, ttl time.Duration) error {
+	if ttl < minTokenTTL || ttl > maxTokenTTL {
+		return fmt.Errorf("-token-ttl must be between %s and %s", minTokenTTL, maxTokenTTL)
+	}
+	cred, err := plugin.issueCredential(ctx, &sdk.CredentialRequest{
+		Scope: scope,
+		TTL:   ttl,
+		Agent: sdk.Agent{ID: agent, Name: agent},
+	}, "admin")
+	if err != nil {
+		return err
+	}
+	printTokenEnv(out, plugin.ProxyURL(), issueResponse{
+		Token:     cred.Value,
+		ID:        cred.ExternalID,
+		AgentID:   agent,
+		Scope:     cred.Metadata["scope"],
+		ExpiresAt: cred.ExpiresAt,
+	})
+	return nil
+}
+
+// printTokenEnv writes an issued token as the environment an Anthropic SDK
+// needs to use it through the proxy at baseURL
+func printTokenEnv(out io.Writer, baseURL string, issued issueResponse) {
+	fmt.Fprintf(out, "# Token %s for %s, scope %s, expires %s\n", issued.ID, issued.AgentID, issued.Scope, issued.ExpiresAt.Local().Format(time.RFC3339))
+	fmt.Fprintf(out, "export ANTHROPIC_BASE_URL=%s\n", baseURL)
+	fmt.Fprintf(out, "export ANTHROPIC_API_KEY=%s\n", issued.Token)
+}
+
+// runTokensRevoke revokes a token, an agent's tokens, or all tokens
+func runTokensRevoke(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("tokens revoke", flag.ContinueOnError)
+	api := adminFlags(flags)
+	agent := flags.String("agent", "", "revoke every token of this agent ID")
+	all := flags.Bool("all", false, "revoke every token")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// The token may come before or after the flags
+	if flags.NArg() > 0 {
+		token := flags.Arg(0)
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return err
+		}
+		args = append([]string{token}, flags.Args()...)
+	} else {
+		args = flags.Args()
+	}
+
+	req := revokeRequest{AgentID: *agent, All: *all}
+	if len(args) > 0 {
+		req.Token = args[0]
+	}
+	selectors := 0
+	for _, set := range []bool{req.Token != "", req.AgentID != "", req.All} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors != 1 || len(args) > 1 {
+		return errors.New("give exactly one of a token or token ID, -agent ID, or -all")
+	}
+
+	var resp struct {
+		Revoked int `json:"revoked"`
+	}
+	if err := api.do(http.MethodPost, "/v1/tokens/revoke", req, &resp); err != nil {
+		return err
+	}
+	if req.Token != "" && resp.Revoked == 0 {
+		fmt.Fprintln(out, "Token was not active on this proxy; its revocation was still recorded and broadcast to peers")
+		return nil
+	}
+	fmt.Fprintf(out, "Revoked %d token(s)\n", resp.Revoked)
+	return nil
+}
+
+// printTokens writes tokens as a table
+func printTokens(out io.Writer, tokens []introspectResponse, now time.Time) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tAGENT\tSCOPE\tEXPIRES IN\tREQUESTS\tLAST USED\tSPENT")
+	for _, t := range tokens {
+		expires, lastUsed := "-", "never"
+		if t.ExpiresAt != nil {
+			expires = t.ExpiresAt.Sub(now).Round(time.Second).String()
+		}
+		if t.LastUsedAt != nil {
+			lastUsed = now.Sub(*t.LastUsedAt).Round(time.Second).String() + " ago"
+		}
+		requests := fmt.Sprint(t.RequestCount)
+		if t.MaxUses > 0 {
+			requests += fmt.Sprintf("/%d", t.MaxUses)
+		}
+		id := t.ID
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t$%.4f\n", id, t.AgentID, t.Scope, expires, requests, lastUsed, t.SpentUSD)
+	}
+	return tw.Flush()
+}
+
+// envOr returns the environment variable name, or def if it is unset
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
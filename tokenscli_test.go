@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokensList(t *testing.T) {
+	plugin, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19575, "admin_token": "admin-secret"}`)
+	issueToken(t, plugin, "agent-a", "anthropic:messages", 10*time.Minute)
+	issueToken(t, plugin, "agent-b", "anthropic", time.Hour)
+
+	resp, err := http.Get(srv.URL + "/admin/tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /admin/tokens without the admin token: status %d, want 401", resp.StatusCode)
+	}
+
+	var out strings.Builder
+	if err := runTokensCommand([]string{"list", "-url", srv.URL, "-admin-token", "admin-secret"}, &out); err != nil {
+		t.Fatalf("tokens list error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "agent-a") || !strings.Contains(lines[1], "anthropic:messages") || !strings.Contains(lines[2], "agent-b") {
+		t.Errorf("tokens list output:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runTokensCommand([]string{"list", "-url", srv.URL, "-admin-token", "admin-secret", "-agent", "agent-b", "-json"}, &out); err != nil {
+		t.Fatalf("tokens list -json error: %v", err)
+	}
+	var tokens []introspectResponse
+	if err := json.Unmarshal([]byte(out.String()), &tokens); err != nil {
+		t.Fatalf("tokens list -json output is not JSON: %v\n%s", err, out.String())
+	}
+	if len(tokens) != 1 || tokens[0].AgentID != "agent-b" || tokens[0].Scope != "anthropic" || tokens[0].RemainingTTL <= 0 {
+		t.Errorf("tokens list -json = %+v", tokens)
+	}
+
+	out.Reset()
+	if err := runTokensCommand([]string{"list", "-url", srv.URL, "-admin-token", "admin-secret", "-expiring-within", "15m", "-json"}, &out); err != nil {
+		t.Fatalf("tokens list -expiring-within error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(out.String()), &tokens); err != nil || len(tokens) != 1 || tokens[0].AgentID != "agent-a" {
+		t.Errorf("tokens list -expiring-within 15m = %+v, %v", tokens, err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/tokens?expiring_within=soon", nil)
+	req.Header.Set("x-api-key", "admin-secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /admin/tokens?expiring_within=soon = %v, %v; want 400", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	if err := runTokensCommand([]string{"list", "-url", srv.URL, "-admin-token", "wrong"}, &out); err == nil || !strings.Contains(err.Error(), "admin token required") {
+		t.Errorf("tokens list with a wrong admin token = %v", err)
+	}
+}
+
+func TestTokensRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19576, "admin_token": "admin-secret", "audit_log_path": %q}`, path)
+	plugin, srv := newTestProxy(t, config)
+	leaked := issueToken(t, plugin, "agent-a", "anthropic", 10*time.Minute)
+	issueToken(t, plugin, "agent-a", "anthropic", 10*time.Minute)
+	issueToken(t, plugin, "agent-b", "anthropic", 10*time.Minute)
+	issueToken(t, plugin, "agent-c", "anthropic", 10*time.Minute)
+	revoke := func(args ...string) (string, error) {
+		var out strings.Builder
+		err := runTokensCommand(append([]string{"revoke"}, args...), &out)
+		return out.String(), err
+	}
+
+	out, err := revoke(leaked.Value, "-url", srv.URL, "-admin-token", "admin-secret")
+	if err != nil || out != "Revoked 1 token(s)\n" {
+		t.Errorf("revoke token = %q, %v", out, err)
+	}
+	if _, ok := plugin.ValidateToken(leaked.Value); ok {
+		t.Error("revoked token is still valid")
+	}
+	events := readAuditLog(t, path)
+	if ev := events[len(events)-1]; ev.Event != AuditRevoke || ev.Caller != "admin" || ev.AgentID != "agent-a" {
+		t.Errorf("audit = %+v, want a revoke by admin", ev)
+	}
+
+	if out, err = revoke("-url", srv.URL, "-admin-token", "admin-secret", "-agent", "agent-a"); err != nil || out != "Revoked 1 token(s)\n" {
+		t.Errorf("revoke -agent = %q, %v", out, err)
+	}
+	if out, err = revoke("-url", srv.URL, "-admin-token", "admin-secret", "-all"); err != nil || out != "Revoked 2 token(s)\n" {
+		t.Errorf("revoke -all = %q, %v", out, err)
+	}
+	if n := len(plugin.ListTokens(TokenFilter{})); n != 0 {
+		t.Errorf("%d tokens left after revoke -all", n)
+	}
+
+	if _, err = revoke("-url", srv.URL, "-admin-token", "admin-secret", "-all", "-agent", "agent-b"); err == nil {
+		t.Error("revoke with both -all and -agent should fail")
+	}
+	resp, err := http.Post(srv.URL+"/v1/tokens/revoke", "application/json", strings.NewReader(`{"all": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST /v1/tokens/revoke without the admin token: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestDeleteTokens(t *testing.T) {
+	plugin, srv := newTestProxy(t, `{"api_key": "sk-ant-test", "proxy_port": 19587, "admin_token": "admin-secret"}`)
+	leaked := issueToken(t, plugin, "agent-a", "anthropic", 10*time.Minute)
+	issueToken(t, plugin, "agent-b", "anthropic", 10*time.Minute)
+	issueToken(t, plugin, "agent-b", "anthropic:messages", 10*time.Minute)
+	del := func(path, token string) (int, int) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+path, nil)
+		req.Header.Set("x-api-key", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Revoked int `json:"revoked"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Revoked
+	}
+
+	if status, _ := del("/v1/tokens/"+leaked.ExternalID, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("DELETE /v1/tokens/{id} without the admin token: status %d, want 401", status)
+	}
+	if status, revoked := del("/admin/tokens/"+leaked.ExternalID, "admin-secret"); status != http.StatusOK || revoked != 1 {
+		t.Errorf("DELETE /admin/tokens/{id} = %d, revoked %d", status, revoked)
+	}
+	if _, ok := plugin.ValidateToken(leaked.Value); ok {
+		t.Error("deleted token is still valid")
+	}
+	if status, revoked := del("/admin/agents/agent-b/tokens", "admin-secret"); status != http.StatusOK || revoked != 2 {
+		t.Errorf("DELETE /admin/agents/{agent_id}/tokens = %d, revoked %d", status, revoked)
+	}
+	if status, revoked := del("/v1/agents/agent-b/tokens", "admin-secret"); status != http.StatusOK || revoked != 0 {
+		t.Errorf("DELETE /v1/agents/{agent_id}/tokens = %d, revoked %d", status, revoked)
+	}
+	if n := len(plugin.ListTokens(TokenFilter{})); n != 0 {
+		t.Errorf("%d tokens left", n)
+	}
+}
+
+func TestTokensIssue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19577, "admin_token": "admin-secret", "audit_log_path": %q}`, path)
+	plugin, srv := newTestProxy(t, config)
+	issue := func(args ...string) (string, error) {
+		var out strings.Builder
+		err := runTokensCommand(append([]string{"issue", "-url", srv.URL, "-admin-token", "admin-secret"}, args...), &out)
+		return out.String(), err
+	}
+
+	out, err := issue("-agent", "ci-bot", "-scope", "anthropic:model:claude-haiku-*", "-ttl", "30m", "-max-uses", "5")
+	if err != nil {
+		t.Fatalf("tokens issue error: %v", err)
+	}
+	var token string
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(line, "export ANTHROPIC_API_KEY="); ok {
+			token = v
+		}
+	}
+	if !strings.Contains(out, "export ANTHROPIC_BASE_URL="+srv.URL+"\n") || token == "" {
+		t.Fatalf("tokens issue output:\n%s", out)
+	}
+	info, ok := plugin.ValidateToken(token)
+	if !ok || info.AgentID != "ci-bot" || info.Scope != "anthropic:model:claude-haiku-*" || info.MaxUses != 5 {
+		t.Errorf("issued token = %+v, %v", info, ok)
+	}
+	if remaining := time.Until(info.ExpiresAt); remaining < 29*time.Minute || remaining > 30*time.Minute {
+		t.Errorf("issued token expires in %s, want 30m", remaining)
+	}
+	events := readAuditLog(t, path)
+	if ev := events[len(events)-1]; ev.Event != AuditIssue || ev.Caller != "admin" || ev.AgentID != "ci-bot" {
+		t.Errorf("audit = %+v, want an issue by admin", ev)
+	}
+
+	out, err = issue("-agent", "ci-bot", "-json")
+	var issued issueResponse
+	if err != nil || json.Unmarshal([]byte(out), &issued) != nil || issued.Scope != "anthropic" || issued.Token == "" {
+		t.Errorf("tokens issue -json = %q, %v", out, err)
+	}
+
+	for _, args := range [][]string{
+		{"-scope", "anthropic"},
+		{"-agent", "ci-bot", "-ttl", "2h"},
+		{"-agent", "ci-bot", "-scope", "openai"},
+	} {
+		if _, err := issue(args...); err == nil {
+			t.Errorf("tokens issue %v should fail", args)
+		}
+	}
+
+	resp, err := http.Post(srv.URL+"/v1/tokens/issue", "application/json", strings.NewReader(`{"agent_id": "x", "scope": "anthropic", "ttl_seconds": 600}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST /v1/tokens/issue without the admin token: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestPrintBootstrapToken(t *testing.T) {
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19582, "listen_addr": "127.0.0.1"}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+
+	var out strings.Builder
+	if err := printBootstrapToken(context.Background(), plugin, &out, "dev", "anthropic:messages", 10*time.Minute); err != nil {
+		t.Fatalf("printBootstrapToken() error: %v", err)
+	}
+	var token string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if v, ok := strings.CutPrefix(line, "export ANTHROPIC_API_KEY="); ok {
+			token = v
+		}
+	}
+	if !strings.Contains(out.String(), "export ANTHROPIC_BASE_URL=http://127.0.0.1:19582\n") || token == "" {
+		t.Fatalf("printBootstrapToken() output:\n%s", out.String())
+	}
+	info, ok := plugin.ValidateToken(token)
+	if !ok || info.AgentID != "dev" || info.Scope != "anthropic:messages" {
+		t.Errorf("printed token = %+v, %v", info, ok)
+	}
+
+	if err := printBootstrapToken(context.Background(), plugin, &out, "dev", "anthropic", 2*time.Hour); err == nil {
+		t.Error("printBootstrapToken() with a 2h TTL should fail")
+	}
+}
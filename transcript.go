@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// maxTranscript bounds the content kept in one transcript; the rest of a
+// longer response is dropped and the transcript marked truncated
+const maxTranscript = 1 << 20
+
+// streamTranscript is a streamed response reassembled from its events, in
+// the shape of a non-streaming Messages response
+type streamTranscript struct {
+	ID         string             `json:"id,omitempty"`
+	Model      string             `json:"model,omitempty"`
+	Role       string             `json:"role,omitempty"`
+	Content    []*transcriptBlock `json:"content"`
+	StopReason string             `json:"stop_reason,omitempty"`
+	Truncated  bool               `json:"truncated,omitempty"`
+}
+
+// transcriptBlock is one content block: text, thinking, a tool call with
+// its input, or a server tool's result
+type transcriptBlock struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	Thinking string          `json:"thinking,omitempty"`
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Input    json.RawMessage `json:"input,omitempty"`
+	// Content is the result carried by server tool result blocks
+	Content json.RawMessage `json:"content,omitempty"`
+
+	partialJSON []byte // tool input, accumulated from input_json_delta
+}
+
+// transcriptEvent holds the fields of the stream events a transcript is
+// built from
+type transcriptEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message *struct {
+		ID    string `json:"id"`
+		Model string `json:"model"`
+		Role  string `json:"role"`
+	} `json:"message"` // message_start
+	ContentBlock *transcriptBlock `json:"content_block"` // content_block_start
+	Delta        *struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		Thinking    string `json:"thinking"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"` // content_block_delta and message_delta
+}
+
+// transcriptRecorder reassembles a streamed response from its events
+type transcriptRecorder struct {
+	t    streamTranscript
+	size int
+}
+
+// ObserveEvent adds one event of the stream; it is an sseHook
+func (tr *transcriptRecorder) ObserveEvent(ev *sseEvent) {
+	var e transcriptEvent
+	if len(ev.Data) == 0 || json.Unmarshal(ev.Data, &e) != nil {
+		return
+	}
+	switch e.Type {
+	case "message_start":
+		if e.Message != nil {
+			tr.t.ID, tr.t.Model, tr.t.Role = e.Message.ID, e.Message.Model, e.Message.Role
+		}
+	case "content_block_start":
+		if e.ContentBlock == nil || e.Index != len(tr.t.Content) {
+			return
+		}
+		if n := len(e.ContentBlock.Content) + len(e.ContentBlock.Text); tr.size+n > maxTranscript {
+			e.ContentBlock.Content, e.ContentBlock.Text = nil, ""
+			tr.t.Truncated = true
+		} else {
+			tr.size += n
+		}
+		tr.t.Content = append(tr.t.Content, e.ContentBlock)
+	case "content_block_delta":
+		if e.Delta == nil || e.Index < 0 || e.Index >= len(tr.t.Content) {
+			return
+		}
+		n := len(e.Delta.Text) + len(e.Delta.Thinking) + len(e.Delta.PartialJSON)
+		if tr.size+n > maxTranscript {
+			tr.t.Truncated = true
+			return
+		}
+		tr.size += n
+		block := tr.t.Content[e.Index]
+		block.Text += e.Delta.Text
+		block.Thinking += e.Delta.Thinking
+		block.partialJSON = append(block.partialJSON, e.Delta.PartialJSON...)
+	case "message_delta":
+		if e.Delta != nil && e.Delta.StopReason != "" {
+			tr.t.StopReason = e.Delta.StopReason
+		}
+	}
+}
+
+// Transcript returns the response as assembled so far, or nil if no
+// message was seen
+func (tr *transcriptRecorder) Transcript() *streamTranscript {
+	if tr.t.ID == "" && len(tr.t.Content) == 0 {
+		return nil
+	}
+	for _, block := range tr.t.Content {
+		// Tool input streams as JSON fragments; an incomplete input is
+		// kept as a string so the record stays valid JSON
+		if len(block.partialJSON) == 0 {
+			continue
+		}
+		if json.Valid(block.partialJSON) {
+			block.Input = block.partialJSON
+		} else {
+			block.Input, _ = json.Marshal(string(block.partialJSON))
+		}
+	}
+	return &tr.t
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// toolStream is a streamed response with thinking, text, and a tool call
+var toolStream = strings.Join([]string{
+	`{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-5","role":"assistant","content":[]}}`,
+	`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+	`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Check the "}}`,
+	`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"weather."}}`,
+	`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+	`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Let me look"}}`,
+	`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":" that up."}}`,
+	`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+	`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"city\": "}}`,
+	`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+	`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":40}}`,
+	`{"type":"message_stop"}`,
+}, "\n")
+
+func TestTranscriptRecorder(t *testing.T) {
+	var tr transcriptRecorder
+	for _, data := range strings.Split(toolStream, "\n") {
+		tr.ObserveEvent(&sseEvent{Data: []byte(data)})
+	}
+	got := tr.Transcript()
+	if got == nil || got.ID != "msg_1" || got.Model != "claude-sonnet-4-5" || got.StopReason != "tool_use" || len(got.Content) != 3 {
+		t.Fatalf("transcript = %+v", got)
+	}
+	if got.Content[0].Thinking != "Check the weather." || got.Content[1].Text != "Let me look that up." {
+		t.Errorf("content = %+v, %+v", got.Content[0], got.Content[1])
+	}
+	if tool := got.Content[2]; tool.Name != "get_weather" || string(tool.Input) != `{"city": "Paris"}` {
+		t.Errorf("tool_use = %+v, input %s", tool, tool.Input)
+	}
+
+	// A stream cut off mid tool call keeps the input it had as a string
+	var cut transcriptRecorder
+	for _, data := range strings.Split(toolStream, "\n")[:9] {
+		cut.ObserveEvent(&sseEvent{Data: []byte(data)})
+	}
+	if input := string(cut.Transcript().Content[2].Input); input != `"{\"city\": "` {
+		t.Errorf("partial input = %s", input)
+	}
+}
+
+func TestProxy_Transcripts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19557, "audit_log_path": %q,
+		"policies": {"anthropic:reviewed": {"transcripts": true}}}`, path)
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range strings.Split(toolStream, "\n") {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	})
+
+	for _, scope := range []string{"anthropic", "anthropic:reviewed"} {
+		cred := issueToken(t, plugin, "agent-1", scope, 10*time.Minute)
+		resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-sonnet-4-5","stream":true}`)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		events := readAuditLog(t, path)
+		ev := events[len(events)-1]
+		if scope == "anthropic" && ev.Transcript != nil {
+			t.Errorf("%s: transcript recorded without a policy enabling it", scope)
+		}
+		if scope == "anthropic:reviewed" && (ev.Transcript == nil || len(ev.Transcript.Content) != 3 || ev.Transcript.Content[1].Text != "Let me look that up.") {
+			t.Errorf("%s: transcript = %+v", scope, ev.Transcript)
+		}
+	}
+}
+
+func TestConfigure_TranscriptsRequireAudit(t *testing.T) {
+	err := newTestPlugin(t).Configure(context.Background(), `{"api_key": "sk-ant-test", "policies": {"anthropic": {"transcripts": true}}}`)
+	if err == nil {
+		t.Error("Configure() should fail when transcripts have no audit destination")
+	}
+}
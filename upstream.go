@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// keyCheckTimeout bounds the request Validate makes to check the API key
+const keyCheckTimeout = 10 * time.Second
+
+// upstreamProxySchemes are the proxy URL schemes upstream_proxy accepts;
+// with socks5h, the proxy resolves Anthropic's hostname
+var upstreamProxySchemes = map[string]bool{"http": true, "https": true, "socks5": true, "socks5h": true}
+
+// parseUpstreamProxy checks an upstream_proxy URL; "" means none
+func parseUpstreamProxy(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		// The error would repeat the URL, which may hold a password
+		return nil, fmt.Errorf("upstream_proxy is not a valid URL")
+	}
+	if !upstreamProxySchemes[u.Scheme] || u.Host == "" {
+		return nil, fmt.Errorf("upstream_proxy must be an http://, https://, socks5://, or socks5h:// URL with a host")
+	}
+	return u, nil
+}
+
+// newUpstreamClient returns the client requests to Anthropic are made with.
+// They go through proxy if set, and otherwise through the proxy named by
+// HTTPS_PROXY (or HTTP_PROXY) unless NO_PROXY exempts the host.
+func newUpstreamClient(proxy *url.URL) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// defaultUpstreamClient is used before Configure
+var defaultUpstreamClient = newUpstreamClient(nil)
+
+// checkAPIKey lists models with key, the cheapest authenticated request, to
+// tell whether Anthropic accepts the key. A rate-limited key is accepted;
+// other failures are described well enough to act on.
+func checkAPIKey(ctx context.Context, client *http.Client, baseURL, key, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, keyCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/v1/models?limit=1", nil)
+	if err != nil {
+		return err
+	}
+	setUpstreamAuth(req.Header, key)
+	req.Header.Set("anthropic-version", version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("checking api_key: could not reach Anthropic: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300 || resp.StatusCode == http.StatusTooManyRequests:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("api_key was rejected by Anthropic; it is invalid, expired, or revoked (%s)", upstreamErrorMessage(resp))
+	case resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("api_key is not permitted to use the Anthropic API (%s)", upstreamErrorMessage(resp))
+	default:
+		return fmt.Errorf("checking api_key: Anthropic returned %s (%s)", resp.Status, upstreamErrorMessage(resp))
+	}
+}
+
+// upstreamErrorMessage returns the message of an Anthropic error response,
+// or its status if the body is not one
+func upstreamErrorMessage(resp *http.Response) string {
+	var body struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) != nil || body.Error.Message == "" {
+		return resp.Status
+	}
+	return body.Error.Type + ": " + body.Error.Message
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// maxUsageBody bounds how much of a non-streaming response is buffered to
+// read its usage block
+const maxUsageBody = 8 << 20
+
+// Usage is the token usage Anthropic reports for a request
+type Usage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// plus returns the sum of two usages
+func (u Usage) plus(o Usage) Usage {
+	return Usage{
+		InputTokens:              u.InputTokens + o.InputTokens,
+		OutputTokens:             u.OutputTokens + o.OutputTokens,
+		CacheCreationInputTokens: u.CacheCreationInputTokens + o.CacheCreationInputTokens,
+		CacheReadInputTokens:     u.CacheReadInputTokens + o.CacheReadInputTokens,
+	}
+}
+
+// ToolCall is a tool the model called in a response
+type ToolCall struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Type is tool_use, or server_tool_use or mcp_tool_use for tools run
+	// by Anthropic
+	Type string `json:"type"`
+	// InputBytes is the length of the tool input; streamed input arrives
+	// as input_json_delta fragments, which are counted as they pass
+	InputBytes int `json:"input_bytes"`
+}
+
+// usageBlock holds the fields of a content block that identify tool calls
+type usageBlock struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+}
+
+// usageMessage holds the fields of a Messages response, or of an SSE event,
+// that carry the model, usage, stop reason, and tool calls
+type usageMessage struct {
+	Type       string        `json:"type"`
+	Model      string        `json:"model"`
+	Usage      *Usage        `json:"usage"`
+	StopReason string        `json:"stop_reason"`
+	Content    []*usageBlock `json:"content"`
+	Message    *struct {
+		Model string `json:"model"`
+		Usage *Usage `json:"usage"`
+	} `json:"message"` // message_start events
+	Index        int         `json:"index"`
+	ContentBlock *usageBlock `json:"content_block"` // content_block_start events
+	Delta        *struct {
+		StopReason  string `json:"stop_reason"`
+		PartialJSON string `json:"partial_json"`
+	} `json:"delta"` // content_block_delta and message_delta events
+}
+
+// usageRecorder extracts the model, usage, stop reason, and tool calls
+// from a response. Plain responses are written through it and carry one
+// usage block. Streams are passed event by event to ObserveEvent: they
+// report input usage in message_start, tool calls in content_block_start,
+// and cumulative output usage and the stop reason in message_delta.
+type usageRecorder struct {
+	sse        bool
+	buf        bytes.Buffer
+	model      string
+	usage      Usage
+	prior      Usage // usage of the responses a resumed stream continues
+	stopReason string
+	toolCalls  []*ToolCall
+	// streamedTools maps the block index of each streamed tool call to it
+	streamedTools map[int]*ToolCall
+	// firstDelta is when a stream's first content_block_delta arrived
+	firstDelta time.Time
+}
+
+func newUsageRecorder(sse bool) *usageRecorder {
+	return &usageRecorder{sse: sse}
+}
+
+// Write buffers a plain response body; streams are read by ObserveEvent
+// instead
+func (u *usageRecorder) Write(p []byte) (int, error) {
+	if !u.sse && u.buf.Len()+len(p) <= maxUsageBody {
+		u.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// ObserveEvent reads the usage in one event of a stream; it is an sseHook
+func (u *usageRecorder) ObserveEvent(ev *sseEvent) {
+	if len(ev.Data) > 0 {
+		u.observe(ev.Data)
+	}
+}
+
+// observe merges the usage in one JSON document into the totals
+func (u *usageRecorder) observe(data []byte) {
+	var msg usageMessage
+	if json.Unmarshal(data, &msg) != nil {
+		return
+	}
+	if msg.Type == "content_block_delta" && u.firstDelta.IsZero() {
+		u.firstDelta = time.Now()
+	}
+	if msg.Message != nil {
+		u.merge(msg.Message.Model, msg.Message.Usage)
+	}
+	u.merge(msg.Model, msg.Usage)
+	if msg.StopReason != "" {
+		u.stopReason = msg.StopReason
+	}
+	if msg.Delta != nil && msg.Delta.StopReason != "" {
+		u.stopReason = msg.Delta.StopReason
+	}
+
+	for _, block := range msg.Content {
+		if call := toolCallFrom(block); call != nil {
+			call.InputBytes = len(block.Input)
+			u.toolCalls = append(u.toolCalls, call)
+		}
+	}
+	switch msg.Type {
+	case "content_block_start":
+		if call := toolCallFrom(msg.ContentBlock); call != nil {
+			if u.streamedTools == nil {
+				u.streamedTools = make(map[int]*ToolCall)
+			}
+			u.streamedTools[msg.Index] = call
+			u.toolCalls = append(u.toolCalls, call)
+		}
+	case "content_block_delta":
+		// With fine-grained tool streaming, fragments need not be valid
+		// JSON on their own, and are only counted
+		if call := u.streamedTools[msg.Index]; call != nil && msg.Delta != nil {
+			call.InputBytes += len(msg.Delta.PartialJSON)
+		}
+	}
+}
+
+// toolCallFrom returns the tool call a content block makes, or nil if it
+// is not a tool call
+func toolCallFrom(block *usageBlock) *ToolCall {
+	if block == nil || !strings.HasSuffix(block.Type, "tool_use") {
+		return nil
+	}
+	return &ToolCall{ID: block.ID, Name: block.Name, Type: block.Type}
+}
+
+// merge records fields that are set; counts are cumulative, so later
+// values replace earlier ones
+func (u *usageRecorder) merge(model string, usage *Usage) {
+	if model != "" {
+		u.model = model
+	}
+	if usage == nil {
+		return
+	}
+	if usage.InputTokens > 0 {
+		u.usage.InputTokens = usage.InputTokens
+	}
+	if usage.OutputTokens > 0 {
+		u.usage.OutputTokens = usage.OutputTokens
+	}
+	if usage.CacheCreationInputTokens > 0 {
+		u.usage.CacheCreationInputTokens = usage.CacheCreationInputTokens
+	}
+	if usage.CacheReadInputTokens > 0 {
+		u.usage.CacheReadInputTokens = usage.CacheReadInputTokens
+	}
+}
+
+// Result returns the model and usage seen in the response
+func (u *usageRecorder) Result() (string, Usage) {
+	if !u.sse && u.buf.Len() > 0 {
+		u.observe(u.buf.Bytes())
+		u.buf.Reset()
+	}
+	return u.model, u.prior.plus(u.usage)
+}
+
+// Resume starts recording a response that continues the stream recorded so
+// far; both are billed, so Result adds their usage
+func (u *usageRecorder) Resume() {
+	u.prior = u.prior.plus(u.usage)
+	u.usage = Usage{}
+	u.streamedTools = nil
+}
+
+// StopReason returns why the model stopped, e.g. end_turn or max_tokens,
+// or "" if the response did not say (such as a stream cut short)
+func (u *usageRecorder) StopReason() string {
+	return u.stopReason
+}
+
+// ToolCalls returns the tool calls in the response, in order
+func (u *usageRecorder) ToolCalls() []*ToolCall {
+	return u.toolCalls
+}
+
+// FirstTokenAt returns when the first content_block_delta of a stream was
+// received, or the zero time if there was none
+func (u *usageRecorder) FirstTokenAt() time.Time {
+	return u.firstDelta
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+func TestUsageRecorder_SSE(t *testing.T) {
+	stream := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"model":"claude-sonnet-4-5","usage":{"input_tokens":1200,"cache_read_input_tokens":300,"output_tokens":1}}}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"hi"}}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":450}}` + "\n\n"
+
+	rec := newUsageRecorder(true)
+	// Read in small chunks so events straddle reads
+	events := newSSEReader(iotest.HalfReader(strings.NewReader(stream)))
+	for {
+		ev, err := events.Next()
+		if ev != nil {
+			rec.Write(ev.Raw)
+			rec.ObserveEvent(ev)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	model, usage := rec.Result()
+	if model != "claude-sonnet-4-5" {
+		t.Errorf("model = %q", model)
+	}
+	want := Usage{InputTokens: 1200, OutputTokens: 450, CacheReadInputTokens: 300}
+	if usage != want {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+	if rec.StopReason() != "max_tokens" {
+		t.Errorf("stop reason = %q, want max_tokens", rec.StopReason())
+	}
+	if rec.FirstTokenAt().IsZero() {
+		t.Error("FirstTokenAt() should be set after a content_block_delta")
+	}
+}
+
+func TestUsageRecorder_JSON(t *testing.T) {
+	rec := newUsageRecorder(false)
+	rec.Write([]byte(`{"model":"claude-3-haiku-20240307","content":[],`))
+	rec.Write([]byte(`"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":20}}`))
+
+	model, usage := rec.Result()
+	if model != "claude-3-haiku-20240307" || usage.InputTokens != 10 || usage.OutputTokens != 20 || rec.StopReason() != "end_turn" {
+		t.Errorf("got model %q usage %+v stop reason %q", model, usage, rec.StopReason())
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	tests := []struct {
+		model string
+		usage Usage
+		want  float64
+	}{
+		{"claude-sonnet-4-5-20250929", Usage{InputTokens: 1_000_000, OutputTokens: 1_000_000}, 18},
+		{"claude-3-haiku-20240307", Usage{InputTokens: 1_000_000}, 0.25},
+		{"claude-opus-4-1", Usage{CacheReadInputTokens: 1_000_000, CacheCreationInputTokens: 1_000_000}, 1.5 + 18.75},
+		{"some-future-model", Usage{OutputTokens: 1_000_000}, 75},
+	}
+	for _, tt := range tests {
+		if got := defaultPricing.estimateCost(tt.model, tt.usage); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("estimateCost(%q, %+v) = %v, want %v", tt.model, tt.usage, got, tt.want)
+		}
+	}
+}
+
+func TestPricingOverrides(t *testing.T) {
+	table, err := newPricingTable(map[string]ModelPrice{
+		"claude-sonnet-4-5": {Input: 2, Output: 10},
+		"ft-":               {Input: 1, Output: 1},
+		"*":                 {Input: 0, Output: 1},
+	})
+	if err != nil {
+		t.Fatalf("newPricingTable() error: %v", err)
+	}
+	tests := []struct {
+		model string
+		want  float64
+	}{
+		{"claude-sonnet-4-5-20250929", 12}, // override beats built-in
+		{"claude-sonnet-4-20250514", 18},   // built-in still applies
+		{"ft-custom", 2},
+		{"some-future-model", 1},
+	}
+	for _, tt := range tests {
+		u := Usage{InputTokens: 1_000_000, OutputTokens: 1_000_000}
+		if got := table.estimateCost(tt.model, u); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("estimateCost(%q) = %v, want %v", tt.model, got, tt.want)
+		}
+	}
+
+	if _, err := newPricingTable(map[string]ModelPrice{"claude": {Input: -1}}); err == nil {
+		t.Error("newPricingTable() should reject negative prices")
+	}
+}
+
+func TestProxy_SpendReport(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19532, "admin_token": "admin-secret",
+		"pricing": {"claude-haiku-4-5": {"input": 1, "output": 2}}}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1000000,"output_tokens":1000000}}`))
+	})
+	for _, agent := range []string{"agent-1", "agent-1", "agent-2"} {
+		cred := issueToken(t, plugin, agent, "anthropic:messages", 10*time.Minute)
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+	}
+
+	get := func(token string, query ...string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/admin/usage"+strings.Join(query, ""), nil)
+		req.Header.Set("x-api-key", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("usage request failed: %v", err)
+		}
+		return resp
+	}
+
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	resp := get(cred.Value)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("non-admin status = %d, want 401", resp.StatusCode)
+	}
+
+	resp = get("admin-secret")
+	defer resp.Body.Close()
+	var report SpendReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if report.Total.Requests != 3 || math.Abs(report.Total.CostUSD-9) > 1e-9 {
+		t.Errorf("total = %+v, want 3 requests costing $9", report.Total)
+	}
+	if a := report.Agents["agent-1"]; a == nil || a.Requests != 2 || math.Abs(a.CostUSD-6) > 1e-9 {
+		t.Errorf("agent-1 = %+v", a)
+	}
+	if s := report.Scopes["anthropic:messages"]; s == nil || s.Requests != 3 {
+		t.Errorf("scope anthropic:messages = %+v", s)
+	}
+	if m := report.Models["claude-haiku-4-5"]; m == nil || m.OutputTokens != 3_000_000 {
+		t.Errorf("model claude-haiku-4-5 = %+v", m)
+	}
+
+	resp = get("admin-secret", "?format=csv")
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	want := "agent_id,model,requests,input_tokens,output_tokens,cache_creation_input_tokens,cache_read_input_tokens,cost_usd\n" +
+		"agent-1,claude-haiku-4-5,2,2000000,2000000,0,0,6.000000\n" +
+		"agent-2,claude-haiku-4-5,1,1000000,1000000,0,0,3.000000\n"
+	if resp.Header.Get("Content-Type") != "text/csv" || string(data) != want {
+		t.Errorf("CSV = %q (%s), want %q", data, resp.Header.Get("Content-Type"), want)
+	}
+
+	resp = get("admin-secret", "?bucket=hour")
+	defer resp.Body.Close()
+	var series SpendSeries
+	if err := json.NewDecoder(resp.Body).Decode(&series); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	hour := time.Now().UTC().Truncate(time.Hour)
+	if series.Bucket != "hour" || len(series.Series) != 2 || !series.Series[0].Time.Equal(hour) || series.Series[0].AgentID != "agent-1" || series.Series[0].Requests != 2 {
+		t.Errorf("bucket=hour series = %+v", series)
+	}
+
+	for _, query := range []string{"?start=yesterday", "?bucket=week"} {
+		resp = get("admin-secret", query)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestSpendTracker_Range(t *testing.T) {
+	tr := newSpendTracker()
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	tr.Record(day.Add(9*time.Hour+30*time.Minute), "agent-1", "anthropic", "claude-haiku-4-5", Usage{InputTokens: 10}, 1)
+	tr.Record(day.Add(26*time.Hour), "agent-1", "anthropic", "claude-haiku-4-5", Usage{InputTokens: 20}, 2)
+
+	tests := []struct {
+		start, end time.Time
+		want       float64
+	}{
+		{time.Time{}, time.Time{}, 3},
+		{day, day.AddDate(0, 0, 1), 1},
+		{day.Add(9*time.Hour + 45*time.Minute), time.Time{}, 3}, // ranges are to the hour
+		{day.AddDate(0, 0, 1), time.Time{}, 2},
+	}
+	for _, tt := range tests {
+		if got := tr.Report(tt.start, tt.end).Total.CostUSD; got != tt.want {
+			t.Errorf("Report(%v, %v) cost = %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+
+	rows := tr.Rows(time.Time{}, time.Time{}, 24*time.Hour)
+	if len(rows) != 2 || !rows[0].Time.Equal(day) || rows[0].CostUSD != 1 || !rows[1].Time.Equal(day.AddDate(0, 0, 1)) || rows[1].InputTokens != 20 {
+		t.Errorf("Rows() by day = %+v", rows)
+	}
+	var csv strings.Builder
+	writeSpendCSV(&csv, rows[:1], true)
+	if want := "time,agent_id,model,requests,input_tokens,output_tokens,cache_creation_input_tokens,cache_read_input_tokens,cost_usd\n" +
+		"2026-03-01T00:00:00Z,agent-1,claude-haiku-4-5,1,10,0,0,0,1.000000\n"; csv.String() != want {
+		t.Errorf("CSV by day = %q, want %q", csv.String(), want)
+	}
+
+	tr.Prune(day.Add(12 * time.Hour))
+	if got := tr.Report(time.Time{}, time.Time{}).Total.CostUSD; got != 2 {
+		t.Errorf("after Prune() cost = %v, want 2", got)
+	}
+}
+
+func TestProxy_BudgetExhausted(t *testing.T) {
+	// Each response costs $0.75 on Opus 4 list prices (10k output tokens)
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19527}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-opus-4-1","usage":{"input_tokens":0,"output_tokens":10000}}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic:budget:1usd", 10*time.Minute)
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusPaymentRequired} {
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+
+	_, info := introspect(t, srv, cred.Value, "")
+	if math.Abs(info.SpentUSD-1.5) > 1e-9 || info.BudgetUSD != 1 || info.BudgetLeft == nil || *info.BudgetLeft != 0 {
+		t.Errorf("introspection = spent %v, budget %v, left %v", info.SpentUSD, info.BudgetUSD, info.BudgetLeft)
+	}
+}
+
+func TestProxy_StreamingUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19554, "audit_log_path": %q}`, path)
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// Split events across flushes, as a slow stream would be
+		for _, chunk := range []string{
+			"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"claude-opus-4-1\",",
+			"\"usage\":{\"input_tokens\":1000,\"output_tokens\":1}}}\n\nevent: message_delta\ndata: {\"type\":\"message_delta\",",
+			"\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":10000}}\n\n",
+		} {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-opus-4-1","stream":true}`)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// 1k input at $15/M and 10k output at $75/M
+	if _, info := introspect(t, srv, cred.Value, ""); math.Abs(info.SpentUSD-0.765) > 1e-9 {
+		t.Errorf("spent = %v, want 0.765", info.SpentUSD)
+	}
+	events := readAuditLog(t, path)
+	if ev := events[len(events)-1]; ev.InputTokens != 1000 || ev.OutputTokens != 10000 || ev.StopReason != "end_turn" {
+		t.Errorf("request event = %+v", ev)
+	}
+}
+
+// fineGrainedToolStream is a stream with fine-grained tool streaming, whose
+// input fragments are not JSON on their own and which was cut off by
+// max_tokens before the input was complete
+var fineGrainedToolStream = strings.Join([]string{
+	"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"claude-sonnet-4-5\",\"usage\":{\"input_tokens\":50}}}\n\n",
+	"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"tool_use\",\"id\":\"toolu_1\",\"name\":\"write_file\",\"input\":{}}}\n\n",
+	"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"path\\\": \\\"a.t\"}}\n\n",
+	"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"xt\\\", \\\"body\\\": \\\"lo\"}}\n\n",
+	"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n",
+	"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"max_tokens\"},\"usage\":{\"output_tokens\":12}}\n\n",
+	"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+}, "")
+
+func TestUsageRecorder_ToolCalls(t *testing.T) {
+	u := newUsageRecorder(true)
+	events := newSSEReader(strings.NewReader(fineGrainedToolStream))
+	for {
+		ev, err := events.Next()
+		if ev != nil {
+			u.ObserveEvent(ev)
+		}
+		if err != nil {
+			break
+		}
+	}
+	calls := u.ToolCalls()
+	if len(calls) != 1 {
+		t.Fatalf("streamed tool calls = %d, want 1", len(calls))
+	}
+	if *calls[0] != (ToolCall{ID: "toolu_1", Name: "write_file", Type: "tool_use", InputBytes: 29}) {
+		t.Errorf("streamed tool calls = %+v", calls[0])
+	}
+
+	plain := newUsageRecorder(false)
+	plain.Write([]byte(`{"model":"claude-sonnet-4-5","content":[{"type":"text","text":"Searching."},` +
+		`{"type":"server_tool_use","id":"srvtoolu_1","name":"web_search","input":{"query":"go"}},` +
+		`{"type":"tool_use","id":"toolu_2","name":"f","input":{}}],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	plain.Result()
+	calls = plain.ToolCalls()
+	if len(calls) != 2 || calls[0].Type != "server_tool_use" || calls[0].InputBytes != 14 || calls[1].Name != "f" {
+		t.Errorf("tool calls = %+v", calls)
+	}
+}
+
+func TestProxy_FineGrainedToolStreaming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"api_key": "sk-ant-test", "proxy_port": 19560, "audit_log_path": %q}`, path)
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		if beta := r.Header.Get("anthropic-beta"); beta != "fine-grained-tool-streaming-2025-05-14" {
+			http.Error(w, "missing beta header "+beta, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		// Fragments arrive split mid-event, as they do over a slow link
+		for chunk := range slices.Chunk([]byte(fineGrainedToolStream), 37) {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(`{"model":"claude-sonnet-4-5","stream":true,"tools":[{"name":"write_file","input_schema":{"type":"object"}}]}`))
+	req.Header.Set("x-api-key", cred.Value)
+	req.Header.Set("anthropic-beta", "fine-grained-tool-streaming-2025-05-14")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != fineGrainedToolStream {
+		t.Fatalf("status %d, stream = %q; want it forwarded unchanged", resp.StatusCode, body)
+	}
+
+	events := readAuditLog(t, path)
+	ev := events[len(events)-1]
+	if len(ev.ToolCalls) != 1 || ev.ToolCalls[0].Name != "write_file" || ev.ToolCalls[0].InputBytes != 29 ||
+		ev.StopReason != "max_tokens" || ev.OutputTokens != 12 {
+		t.Errorf("request event = %+v", ev)
+	}
+}
+
+func TestProxy_CountTokensExemptFromBudget(t *testing.T) {
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19547}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == countTokensPath {
+			w.Write([]byte(`{"input_tokens":42}`))
+			return
+		}
+		w.Write([]byte(`{"model":"claude-opus-4-1","usage":{"input_tokens":0,"output_tokens":20000}}`))
+	})
+	cred := issueToken(t, plugin, "agent-1", "anthropic:budget:1usd", 10*time.Minute)
+	resp := proxyRequest(t, srv, cred.Value, `{}`)
+	resp.Body.Close()
+
+	countTokens := func(token string) int {
+		req, _ := http.NewRequest("POST", srv.URL+countTokensPath, strings.NewReader(`{"model":"claude-opus-4-1","messages":[]}`))
+		req.Header.Set("x-api-key", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// The budget is exhausted, but counting tokens is free
+	if status := countTokens(cred.Value); status != http.StatusOK {
+		t.Errorf("count_tokens over budget: status = %d, want 200", status)
+	}
+	if resp := proxyRequest(t, srv, cred.Value, `{}`); resp.StatusCode != http.StatusPaymentRequired {
+		t.Errorf("messages over budget: status = %d, want 402", resp.StatusCode)
+	}
+	if _, info := introspect(t, srv, cred.Value, ""); math.Abs(info.SpentUSD-1.5) > 1e-9 {
+		t.Errorf("spent = %v, want 1.5: count_tokens must not add spend", info.SpentUSD)
+	}
+
+	// The readonly scope allows token counting but not messages
+	readonly := issueToken(t, plugin, "agent-1", "anthropic:readonly", 10*time.Minute)
+	if status := countTokens(readonly.Value); status != http.StatusOK {
+		t.Errorf("readonly count_tokens: status = %d, want 200", status)
+	}
+	if resp := proxyRequest(t, srv, readonly.Value, `{}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("readonly messages: status = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestGetCredential_BudgetRequiresStore(t *testing.T) {
+	plugin := newTestPlugin(t)
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19528, "token_mode": "stateless", "token_signing_key": "replica-secret"}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	_, err := plugin.GetCredential(context.Background(), &sdk.CredentialRequest{
+		Scope: "anthropic:budget:5usd",
+		TTL:   10 * time.Minute,
+		Agent: sdk.Agent{ID: "agent-1"},
+	})
+	if err == nil {
+		t.Error("GetCredential() should reject budget scopes in stateless mode")
+	}
+}
+
+func TestProxy_AgentBudget(t *testing.T) {
+	// Each response costs $0.75 on Opus 4 list prices (10k output tokens)
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19533,
+		"budgets": {"agent-1": "1.00", "*": 5}}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-opus-4-1","usage":{"input_tokens":0,"output_tokens":10000}}`))
+	})
+
+	// The budget spans all of the agent's tokens
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusPaymentRequired} {
+		cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+		resp := proxyRequest(t, srv, cred.Value, `{}`)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+
+	// Other agents fall under the "*" budget
+	cred := issueToken(t, plugin, "agent-2", "anthropic", 10*time.Minute)
+	resp := proxyRequest(t, srv, cred.Value, `{}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("agent-2: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestConfigure_BudgetValidation(t *testing.T) {
+	for _, config := range []string{
+		`{"api_key": "sk-ant-test", "budgets": {"agent-1": "ten"}}`,
+		`{"api_key": "sk-ant-test", "budgets": {"agent-1": -1}}`,
+		`{"api_key": "sk-ant-test", "budget_window": "week"}`,
+	} {
+		if err := newTestPlugin(t).Configure(context.Background(), config); err == nil {
+			t.Errorf("Configure(%s) should fail", config)
+		}
+	}
+}
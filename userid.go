@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxUserIDLength is the longest metadata.user_id Anthropic accepts
+const maxUserIDLength = 256
+
+// userIDPlaceholder matches the fields of a metadata_user_id template
+var userIDPlaceholder = regexp.MustCompile(`\{[a-z_]*\}`)
+
+// userIDFields are the placeholders metadata_user_id templates can use
+var userIDFields = []string{"{agent_id}", "{agent_name}", "{token_id}", "{scope}", "{workspace}"}
+
+// validateUserIDTemplate checks a metadata_user_id template uses only
+// known placeholders
+func validateUserIDTemplate(tmpl string) error {
+	for _, field := range userIDPlaceholder.FindAllString(tmpl, -1) {
+		known := false
+		for _, f := range userIDFields {
+			known = known || field == f
+		}
+		if !known {
+			return fmt.Errorf("metadata_user_id: unknown placeholder %s (use %s)", field, strings.Join(userIDFields, ", "))
+		}
+	}
+	return nil
+}
+
+// expandUserID fills in a metadata_user_id template for a request made
+// with info, truncating the result to the length Anthropic accepts
+func expandUserID(tmpl string, info *TokenInfo, scope *Scope) string {
+	workspace := scope.Workspace
+	if workspace == "" {
+		workspace = "default"
+	}
+	id := strings.NewReplacer(
+		"{agent_id}", info.AgentID,
+		"{agent_name}", info.AgentName,
+		"{token_id}", info.ID,
+		"{scope}", info.Scope,
+		"{workspace}", workspace,
+	).Replace(tmpl)
+	if len(id) > maxUserIDLength {
+		id = id[:maxUserIDLength]
+	}
+	return id
+}
+
+// setMetadataUserID sets metadata.user_id in a Messages request (each
+// item's params for a batch), replacing any the client sent
+func setMetadataUserID(body []byte, batch bool, userID string) ([]byte, error) {
+	if len(body) == 0 || userID == "" {
+		return body, nil
+	}
+	return rewriteParams(body, batch, func(params map[string]any) {
+		metadata, _ := params["metadata"].(map[string]any)
+		if metadata == nil {
+			metadata = make(map[string]any)
+		}
+		metadata["user_id"] = userID
+		params["metadata"] = metadata
+	})
+}
+
+// MetadataUserID returns the metadata.user_id to set in requests made
+// with info, or "" if metadata_user_id is not configured
+func (p *AnthropicPlugin) MetadataUserID(info *TokenInfo, scope *Scope) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.config == nil || p.config.MetadataUserID == "" {
+		return ""
+	}
+	return expandUserID(p.config.MetadataUserID, info, scope)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSetMetadataUserID(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		batch bool
+		want  string
+	}{
+		{"no metadata", `{"model":"m"}`, false, `{"metadata":{"user_id":"agent-1"},"model":"m"}`},
+		{"client user_id", `{"metadata":{"user_id":"agent-2"}}`, false, `{"metadata":{"user_id":"agent-1"}}`},
+		{"batch", `{"requests":[{"custom_id":"1","params":{"model":"m"}}]}`, true,
+			`{"requests":[{"custom_id":"1","params":{"metadata":{"user_id":"agent-1"},"model":"m"}}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setMetadataUserID([]byte(tt.body), tt.batch, "agent-1")
+			if err != nil {
+				t.Fatalf("setMetadataUserID() error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxy_MetadataUserID(t *testing.T) {
+	var userID string
+	plugin, srv, _ := newTestProxyWithUpstream(t, `{"api_key": "sk-ant-test", "proxy_port": 19600, "metadata_user_id": "{workspace}/{agent_id}"}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Metadata struct {
+					UserID string `json:"user_id"`
+				} `json:"metadata"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			userID = body.Metadata.UserID
+			w.Write([]byte(`{}`))
+		})
+
+	cred := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	resp := proxyRequest(t, srv, cred.Value, `{"model":"claude-haiku-4-5","max_tokens":10,"metadata":{"user_id":"agent-2"},"messages":[]}`)
+	resp.Body.Close()
+	if userID != "default/agent-1" {
+		t.Errorf("metadata.user_id = %q, want default/agent-1", userID)
+	}
+}
+
+func TestConfigure_MetadataUserID(t *testing.T) {
+	if err := newTestPlugin(t).Configure(context.Background(), `{"api_key": "sk-ant-test", "metadata_user_id": "{agent}"}`); err == nil {
+		t.Error("Configure() with an unknown placeholder succeeded, want error")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Build metadata, set at build time with
+//
+//	-ldflags "-X main.Version=... -X main.Commit=... -X main.BuildDate=... -X main.SDKVersion=..."
+//
+// (see the Makefile). Any left unset are taken from the module and version
+// control information Go records in the binary.
+var (
+	Version    string
+	Commit     string
+	BuildDate  string
+	SDKVersion string
+)
+
+// sdkModule is the module path of the Creddy plugin SDK
+const sdkModule = "github.com/getcreddy/creddy-plugin-sdk"
+
+// versionInfo describes the running build, for the version command,
+// Info, and GET /health
+type versionInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	BuildDate  string `json:"build_date,omitempty"`
+	SDKVersion string `json:"sdk_version,omitempty"`
+	GoVersion  string `json:"go_version"`
+}
+
+// buildVersion returns the running build's versionInfo
+var buildVersion = sync.OnceValue(func() versionInfo {
+	bi, _ := debug.ReadBuildInfo()
+	return newVersionInfo(bi)
+})
+
+// newVersionInfo combines the ldflags build metadata with bi, which may be
+// nil
+func newVersionInfo(bi *debug.BuildInfo) versionInfo {
+	v := versionInfo{
+		Version:    strings.TrimPrefix(Version, "v"),
+		Commit:     Commit,
+		BuildDate:  BuildDate,
+		SDKVersion: SDKVersion,
+		GoVersion:  runtime.Version(),
+	}
+	if v.Version == "" {
+		v.Version = PluginVersion
+	}
+	if bi == nil {
+		return v
+	}
+	if v.SDKVersion == "" {
+		for _, dep := range bi.Deps {
+			if dep.Path == sdkModule {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				v.SDKVersion = dep.Version
+			}
+		}
+	}
+	var revision, modified string
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		case "vcs.time":
+			if v.BuildDate == "" {
+				v.BuildDate = s.Value
+			}
+		}
+	}
+	if v.Commit == "" && revision != "" {
+		v.Commit = revision
+		if modified == "true" {
+			v.Commit += "-dirty"
+		}
+	}
+	if bi.GoVersion != "" {
+		v.GoVersion = bi.GoVersion
+	}
+	return v
+}
+
+// shortCommit abbreviates the commit hash
+func (v versionInfo) shortCommit() string {
+	hash, dirty := strings.CutSuffix(v.Commit, "-dirty")
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	if dirty {
+		hash += "-dirty"
+	}
+	return hash
+}
+
+// details summarizes the build metadata other than the version
+func (v versionInfo) details() string {
+	var parts []string
+	if v.Commit != "" {
+		parts = append(parts, "commit "+v.shortCommit())
+	}
+	if v.BuildDate != "" {
+		parts = append(parts, "built "+v.BuildDate)
+	}
+	if v.SDKVersion != "" {
+		parts = append(parts, "plugin SDK "+v.SDKVersion)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// String formats v for the version command
+func (v versionInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "creddy-anthropic %s\n", v.Version)
+	for _, field := range []struct{ name, value string }{
+		{"Commit", v.Commit},
+		{"Built", v.BuildDate},
+		{"Plugin SDK", v.SDKVersion},
+		{"Go", v.GoVersion},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&b, "  %-11s %s\n", field.name+":", field.value)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestNewVersionInfo(t *testing.T) {
+	bi := &debug.BuildInfo{
+		GoVersion: "go1.24.1",
+		Deps:      []*debug.Module{{Path: sdkModule, Version: "v0.1.0"}},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "0123456789abcdef0123456789abcdef01234567"},
+			{Key: "vcs.time", Value: "2026-01-02T03:04:05Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	v := newVersionInfo(bi)
+	want := versionInfo{
+		Version:    PluginVersion,
+		Commit:     "0123456789abcdef0123456789abcdef01234567-dirty",
+		BuildDate:  "2026-01-02T03:04:05Z",
+		SDKVersion: "v0.1.0",
+		GoVersion:  "go1.24.1",
+	}
+	if v != want {
+		t.Errorf("from build info = %+v, want %+v", v, want)
+	}
+	if got := v.details(); got != "commit 0123456789ab-dirty, built 2026-01-02T03:04:05Z, plugin SDK v0.1.0" {
+		t.Errorf("details() = %q", got)
+	}
+
+	// ldflags take precedence
+	Version, Commit, BuildDate, SDKVersion = "v1.2.3", "abc1234", "2026-02-03T00:00:00Z", "v0.2.0"
+	t.Cleanup(func() { Version, Commit, BuildDate, SDKVersion = "", "", "", "" })
+	v = newVersionInfo(bi)
+	if v.Version != "1.2.3" || v.Commit != "abc1234" || v.BuildDate != "2026-02-03T00:00:00Z" || v.SDKVersion != "v0.2.0" {
+		t.Errorf("with ldflags = %+v", v)
+	}
+	if out := v.String(); !strings.HasPrefix(out, "creddy-anthropic 1.2.3\n") || !strings.Contains(out, "Commit:     abc1234\n") {
+		t.Errorf("String() =\n%s", out)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// vertexAnthropicVersion is the anthropic_version Vertex AI expects in
+	// request bodies
+	vertexAnthropicVersion = "vertex-2023-10-16"
+	// gcpScope is the OAuth scope of Vertex AI access tokens
+	gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+	// gcpMetadataTokenURL serves access tokens for the service account of
+	// the GCE instance or GKE workload the plugin runs on
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// VertexConfig sends some Messages requests to Claude on Google Vertex AI
+// instead of the Anthropic API: those of tokens with Scopes, or for Models
+type VertexConfig struct {
+	ProjectID       string            `json:"project_id"`       // Google Cloud project (default: the credentials file's)
+	Region          string            `json:"region"`           // Vertex AI region, e.g. us-east5, or global
+	Endpoint        string            `json:"endpoint"`         // Base URL replacing the region's Vertex AI endpoint, e.g. for Private Service Connect
+	CredentialsFile string            `json:"credentials_file"` // Service account key file (default: GOOGLE_APPLICATION_CREDENTIALS, then the metadata server)
+	Scopes          []string          `json:"scopes"`           // Base scope glob patterns whose Messages requests go to Vertex AI
+	Models          []string          `json:"models"`           // Model glob patterns whose Messages requests go to Vertex AI
+	ModelIDs        map[string]string `json:"model_ids"`        // Vertex AI model IDs by Anthropic model name, e.g. "claude-sonnet-4-5": "claude-sonnet-4-5@20250929"
+
+	tokens *gcpTokenSource
+}
+
+// setupVertex checks the Vertex AI settings and loads their credentials
+func (cfg *AnthropicConfig) setupVertex() error {
+	v := cfg.Vertex
+	if v == nil {
+		return nil
+	}
+	if v.CredentialsFile == "" {
+		v.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	v.tokens = &gcpTokenSource{tokenURL: gcpMetadataTokenURL}
+	if v.CredentialsFile != "" {
+		key, err := loadServiceAccountKey(v.CredentialsFile)
+		if err != nil {
+			return fmt.Errorf("vertex: credentials_file: %w", err)
+		}
+		v.tokens = key.tokenSource()
+		if v.ProjectID == "" {
+			v.ProjectID = key.ProjectID
+		}
+	}
+	if v.ProjectID == "" {
+		return errors.New("vertex: project_id is required")
+	}
+	if v.Region == "" {
+		return errors.New("vertex: region is required")
+	}
+	if v.Endpoint == "" {
+		v.Endpoint = "https://" + v.Region + "-aiplatform.googleapis.com"
+		if v.Region == "global" {
+			v.Endpoint = "https://aiplatform.googleapis.com"
+		}
+	} else if err := checkSinkURL(v.Endpoint); err != nil {
+		return fmt.Errorf("vertex: endpoint: %w", err)
+	}
+	v.Endpoint = strings.TrimSuffix(v.Endpoint, "/")
+	if len(v.Scopes) == 0 && len(v.Models) == 0 && !cfg.routesTo(upstreamVertex) {
+		return errors.New("vertex: scopes, models, or routes must select the requests sent to Vertex AI")
+	}
+	for _, f := range []struct {
+		name     string
+		patterns []string
+	}{{"scopes", v.Scopes}, {"models", v.Models}} {
+		for _, pattern := range f.patterns {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("vertex: %s: invalid pattern %q", f.name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// wants reports whether the Messages requests of scope for model go to
+// Vertex AI
+func (v *VertexConfig) wants(scope *Scope, model string) bool {
+	return matchAny(v.Scopes, scope.def.Pattern) || matchAny(v.Models, model)
+}
+
+// route returns the Vertex AI URL and body for a Messages request body
+func (v *VertexConfig) route(body []byte) (string, []byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	var model string
+	var stream bool
+	json.Unmarshal(fields["model"], &model)
+	json.Unmarshal(fields["stream"], &stream)
+
+	// Vertex AI takes the model from the URL and the API version from
+	// the body
+	delete(fields, "model")
+	if _, ok := fields["anthropic_version"]; !ok {
+		fields["anthropic_version"], _ = json.Marshal(vertexAnthropicVersion)
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", nil, err
+	}
+	if id, ok := v.ModelIDs[model]; ok {
+		model = id
+	}
+	method := "rawPredict"
+	if stream {
+		method = "streamRawPredict"
+	}
+	u := fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:%s",
+		v.Endpoint, url.PathEscape(v.ProjectID), url.PathEscape(v.Region), url.PathEscape(model), method)
+	return u, data, nil
+}
+
+// AccessToken returns an access token for Vertex AI
+func (v *VertexConfig) AccessToken(ctx context.Context, client *http.Client) (string, error) {
+	return v.tokens.Token(ctx, client)
+}
+
+// serviceAccountKey is a Google Cloud service account key file
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+func loadServiceAccountKey(file string) (*serviceAccountKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var sa serviceAccountKey
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return nil, err
+	}
+	if sa.Type != "service_account" || sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, errors.New("not a service account key")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("private_key: %w", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	sa.key = key
+	return &sa, nil
+}
+
+func (sa *serviceAccountKey) tokenSource() *gcpTokenSource {
+	return &gcpTokenSource{tokenURL: sa.TokenURI, account: sa}
+}
+
+// gcpTokenSource fetches Google access tokens and caches them until
+// shortly before they expire
+type gcpTokenSource struct {
+	tokenURL string
+	// account signs token requests; nil fetches tokens from the metadata
+	// server
+	account *serviceAccountKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (s *gcpTokenSource) Token(ctx context.Context, client *http.Client) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Until(s.expires) > time.Minute {
+		return s.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if s.account == nil {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, s.tokenURL, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	} else {
+		var assertion string
+		if assertion, err = s.account.assertion(s.tokenURL, time.Now()); err != nil {
+			return "", err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetch access token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch access token: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", errors.New("fetch access token: no access_token in response")
+	}
+	s.token, s.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second)
+	return s.token, nil
+}
+
+// assertion returns a signed JWT exchanging the service account's
+// identity for an access token at aud
+func (sa *serviceAccountKey) assertion(aud string, now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": sa.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   sa.ClientEmail,
+		"scope": gcpScope,
+		"aud":   aud,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(nil, sa.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeServiceAccountKey writes a service account key file whose tokens
+// come from tokenURL
+func writeServiceAccountKey(t *testing.T, tokenURL string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	data, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test-project",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "creddy@test-project.iam.gserviceaccount.com",
+		"token_uri":      tokenURL,
+	})
+	file := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfigure_Vertex(t *testing.T) {
+	plugin := newTestPlugin(t)
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	keyFile := writeServiceAccountKey(t, "https://oauth2.googleapis.com/token")
+	for _, tt := range []struct{ vertex, wantErr string }{
+		{`{"region": "us-east5", "scopes": ["anthropic"]}`, "project_id is required"},
+		{`{"credentials_file": "` + keyFile + `", "scopes": ["anthropic"]}`, "region is required"},
+		{`{"credentials_file": "` + keyFile + `", "region": "us-east5"}`, "scopes, models, or routes"},
+		{`{"credentials_file": "` + keyFile + `", "region": "us-east5", "models": ["["]}`, "invalid pattern"},
+		{`{"credentials_file": "/nonexistent.json", "region": "us-east5", "scopes": ["anthropic"]}`, "credentials_file"},
+	} {
+		err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19596, "vertex": `+tt.vertex+`}`)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("vertex %s: Configure() = %v, want an error containing %q", tt.vertex, err, tt.wantErr)
+		}
+	}
+	// A route can select the requests instead of scopes or models
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19596, "vertex": {"credentials_file": "` + keyFile + `", "region": "global"},
+		"routes": [{"models": ["claude-opus-*"], "upstream": "vertex"}]}`
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if v := plugin.config.Vertex; v.ProjectID != "test-project" || v.Endpoint != "https://aiplatform.googleapis.com" {
+		t.Errorf("vertex defaults = project %q, endpoint %q", v.ProjectID, v.Endpoint)
+	}
+	if target := plugin.upstreamFor(&Scope{}, "claude-opus-4-1"); target.vertex == nil {
+		t.Error("claude-opus-4-1 is not routed to Vertex AI")
+	}
+}
+
+func TestProxy_Vertex(t *testing.T) {
+	var tokenFetches int
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || strings.Count(r.Form.Get("assertion"), ".") != 2 {
+			http.Error(w, "bad grant", http.StatusBadRequest)
+			return
+		}
+		tokenFetches++
+		w.Write([]byte(`{"access_token": "ya29.test", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer tokens.Close()
+
+	type vertexRequest struct {
+		path, auth string
+		body       map[string]any
+	}
+	var mu sync.Mutex
+	var requests []vertexRequest
+	vertex := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		mu.Lock()
+		requests = append(requests, vertexRequest{r.URL.Path, r.Header.Get("Authorization"), body})
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-sonnet-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer vertex.Close()
+
+	var anthropicRequests int
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	config, _ := json.Marshal(map[string]any{
+		"api_key":        "sk-ant-test",
+		"proxy_port":     19596,
+		"audit_log_path": auditPath,
+		"vertex": map[string]any{
+			"credentials_file": writeServiceAccountKey(t, tokens.URL),
+			"region":           "us-east5",
+			"endpoint":         vertex.URL,
+			"scopes":           []string{"anthropic:messages"},
+			"models":           []string{"claude-sonnet-*"},
+			"model_ids":        map[string]string{"claude-sonnet-4-5": "claude-sonnet-4-5@20250929"},
+		},
+	})
+	plugin, srv, _ := newTestProxyWithUpstream(t, string(config), func(w http.ResponseWriter, r *http.Request) {
+		anthropicRequests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	full := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	messages := issueToken(t, plugin, "agent-1", "anthropic:messages", 10*time.Minute)
+
+	send := func(token, body string) {
+		t.Helper()
+		resp := proxyRequest(t, srv, token, body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200", resp.StatusCode)
+		}
+	}
+	// Routed by model, with its Vertex AI model ID
+	send(full.Value, `{"model":"claude-sonnet-4-5","max_tokens":50}`)
+	// Routed by scope, streaming
+	send(messages.Value, `{"model":"claude-haiku-4-5","max_tokens":50,"stream":true}`)
+	// Neither: sent to Anthropic
+	send(full.Value, `{"model":"claude-haiku-4-5","max_tokens":50}`)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 || anthropicRequests != 1 {
+		t.Fatalf("vertex requests %d, anthropic requests %d, want 2 and 1", len(requests), anthropicRequests)
+	}
+	base := "/v1/projects/test-project/locations/us-east5/publishers/anthropic/models/"
+	for i, want := range []string{base + "claude-sonnet-4-5@20250929:rawPredict", base + "claude-haiku-4-5:streamRawPredict"} {
+		req := requests[i]
+		if req.path != want {
+			t.Errorf("vertex request %d: path %s, want %s", i+1, req.path, want)
+		}
+		if req.auth != "Bearer ya29.test" {
+			t.Errorf("vertex request %d: Authorization %q", i+1, req.auth)
+		}
+		if _, ok := req.body["model"]; ok || req.body["anthropic_version"] != vertexAnthropicVersion {
+			t.Errorf("vertex request %d: body %v, want no model and anthropic_version %s", i+1, req.body, vertexAnthropicVersion)
+		}
+	}
+	if tokenFetches != 1 {
+		t.Errorf("fetched %d access tokens, want 1 cached", tokenFetches)
+	}
+
+	var backends []string
+	for _, ev := range readAuditLog(t, auditPath) {
+		if ev.Event == AuditRequest {
+			backends = append(backends, ev.Backend)
+		}
+	}
+	if got := strings.Join(backends, ","); got != "vertex,vertex," {
+		t.Errorf("audited backends = %q", got)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"sort"
+	"strings"
+
+	sdk "github.com/getcreddy/creddy-plugin-sdk"
+)
+
+// WorkspaceConfig is a further Anthropic workspace served by the plugin.
+// Tokens whose scope starts with anthropic:<name> are for the workspace:
+// their requests use its API key and its policies, on the same proxy port.
+// Agents and Scopes route tokens whose scope names no workspace into it.
+type WorkspaceConfig struct {
+	Name          string                  `json:"name"`            // Scope namespace, e.g. "prod" for anthropic:prod[:capability]
+	APIKey        string                  `json:"api_key"`         // The workspace's Anthropic API key
+	APIKeyFile    string                  `json:"api_key_file"`    // File holding the API key, instead of api_key
+	APIKeyEnv     string                  `json:"api_key_env"`     // Environment variable holding the API key, instead of api_key
+	APIKeyKeyring string                  `json:"api_key_keyring"` // OS keyring entry ("service/account") holding the API key, instead of api_key
+	Policies      map[string]*ScopePolicy `json:"policies"`        // Scope policies for the workspace, replacing top-level ones of the same name
+	Agents        []string                `json:"agents"`          // Agent ID glob patterns whose tokens are issued in the workspace
+	Scopes        []string                `json:"scopes"`          // Base scope glob patterns (e.g. "anthropic:ci") issued in the workspace
+
+	// policies are the top-level policies with Policies applied over them
+	policies map[string]*ScopePolicy
+}
+
+// setupWorkspaces checks the configured workspaces, reads their API keys,
+// and indexes them by name
+func (cfg *AnthropicConfig) setupWorkspaces(ctx context.Context) error {
+	cfg.workspaces = make(map[string]*WorkspaceConfig, len(cfg.Workspaces))
+	for i, ws := range cfg.Workspaces {
+		if ws == nil {
+			return fmt.Errorf("workspaces[%d]: must be an object", i)
+		}
+		_, builtin := lookupScope("anthropic:" + ws.Name)
+		_, isKey := scopeConstraints[ws.Name]
+		switch {
+		case !policyNamePattern.MatchString(ws.Name):
+			return fmt.Errorf("workspaces[%d]: name %q must be lowercase letters, digits, _ and -", i, ws.Name)
+		case builtin || isKey || cfg.Policies["anthropic:"+ws.Name] != nil:
+			return fmt.Errorf("workspaces[%d]: name %q is already a scope or constraint name", i, ws.Name)
+		case cfg.workspaces[ws.Name] != nil:
+			return fmt.Errorf("workspaces[%d]: duplicate name %q", i, ws.Name)
+		}
+
+		key, err := readAPIKey(ctx, ws.APIKey, ws.APIKeyFile, ws.APIKeyEnv, ws.APIKeyKeyring)
+		if err != nil {
+			return fmt.Errorf("workspaces[%s]: %w", ws.Name, err)
+		}
+		ws.APIKey = key
+
+		for _, f := range []struct {
+			name     string
+			patterns []string
+		}{{"agents", ws.Agents}, {"scopes", ws.Scopes}} {
+			for _, pattern := range f.patterns {
+				if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+					return fmt.Errorf("workspaces[%s]: %s: invalid pattern %q", ws.Name, f.name, pattern)
+				}
+			}
+		}
+
+		if err := validatePolicies(ws.Policies); err != nil {
+			return fmt.Errorf("workspaces[%s]: %w", ws.Name, err)
+		}
+		ws.policies = maps.Clone(cfg.Policies)
+		if ws.policies == nil {
+			ws.policies = make(map[string]*ScopePolicy, len(ws.Policies))
+		}
+		maps.Copy(ws.policies, ws.Policies)
+		for pattern, pol := range ws.Policies {
+			if pol != nil && pol.Transcripts && cfg.AuditLogPath == "" && len(cfg.AuditSinks) == 0 {
+				return fmt.Errorf("workspaces[%s]: policies[%q]: transcripts require audit_log_path or audit_sinks", ws.Name, pattern)
+			}
+		}
+		cfg.workspaces[ws.Name] = ws
+	}
+	return nil
+}
+
+// splitWorkspace returns the workspace a scope is for and the scope
+// without its workspace segment; scopes for the default workspace are
+// returned unchanged with a nil workspace
+func (cfg *AnthropicConfig) splitWorkspace(scope string) (*WorkspaceConfig, string) {
+	rest, ok := strings.CutPrefix(scope, "anthropic:")
+	if !ok || cfg == nil {
+		return nil, scope
+	}
+	name, after, _ := strings.Cut(rest, ":")
+	ws := cfg.workspaces[name]
+	if ws == nil {
+		return nil, scope
+	}
+	if after == "" {
+		return ws, "anthropic"
+	}
+	return ws, "anthropic:" + after
+}
+
+// routeWorkspace returns the scope to issue an agent requesting scope: in
+// the first workspace whose agents or scopes match, if the scope names no
+// workspace itself, or otherwise unchanged
+func (p *AnthropicPlugin) routeWorkspace(cfg *AnthropicConfig, agentID, scope string) string {
+	if ws, _ := cfg.splitWorkspace(scope); ws != nil {
+		return scope
+	}
+	s, err := p.ResolveScope(scope)
+	if err != nil {
+		// Issuing reports the error
+		return scope
+	}
+	for _, ws := range cfg.Workspaces {
+		if matchAny(ws.Agents, agentID) || matchAny(ws.Scopes, s.def.Pattern) {
+			return withWorkspace(scope, ws.Name)
+		}
+	}
+	return scope
+}
+
+// scopeWorkspace returns the name of the workspace a scope is for, or ""
+// for the default workspace
+func (cfg *AnthropicConfig) scopeWorkspace(scope string) string {
+	if ws, _ := cfg.splitWorkspace(scope); ws != nil {
+		return ws.Name
+	}
+	return ""
+}
+
+// Tokens issued in a workspace carry its name after token_prefix
+// (crd_prod_...), so a token can only be redeemed in the workspace it was
+// issued for even if its stored scope or the workspaces change. JWTs
+// carry the scope in their signed claims instead.
+
+// namespaceToken moves a token minted with token_prefix into the
+// namespace of the workspace scope is for
+func (cfg *AnthropicConfig) namespaceToken(token, scope string) string {
+	ws := cfg.scopeWorkspace(scope)
+	if ws == "" || isJWT(token) {
+		return token
+	}
+	return cfg.TokenPrefix + ws + "_" + strings.TrimPrefix(token, cfg.TokenPrefix)
+}
+
+// tokenWorkspace returns the workspace whose namespace a token's prefix
+// names, or "" for the default workspace
+func (cfg *AnthropicConfig) tokenWorkspace(token string) string {
+	if cfg == nil || isJWT(token) {
+		return ""
+	}
+	rest, ok := strings.CutPrefix(token, cfg.TokenPrefix)
+	if !ok {
+		return ""
+	}
+	// Workspace names may prefix one another (prod and prod_eu)
+	var found string
+	for name := range cfg.workspaces {
+		if len(name) > len(found) && strings.HasPrefix(rest, name+"_") {
+			found = name
+		}
+	}
+	return found
+}
+
+// inNamespace reports whether token is in the namespace of the workspace
+// scope is for
+func (cfg *AnthropicConfig) inNamespace(token, scope string) bool {
+	return isJWT(token) || cfg.tokenWorkspace(token) == cfg.scopeWorkspace(scope)
+}
+
+// withoutNamespace returns a token as it was minted, before
+// namespaceToken
+func (cfg *AnthropicConfig) withoutNamespace(token string) string {
+	if ws := cfg.tokenWorkspace(token); ws != "" {
+		return cfg.TokenPrefix + strings.TrimPrefix(token, cfg.TokenPrefix+ws+"_")
+	}
+	return token
+}
+
+// mintToken mints tokens for scope until one is in its workspace's
+// namespace: a random token can happen to start with a workspace name
+func (cfg *AnthropicConfig) mintToken(scope string, mint func() (string, error)) (string, error) {
+	for {
+		token, err := mint()
+		if err != nil {
+			return "", err
+		}
+		if token = cfg.namespaceToken(token, scope); cfg.inNamespace(token, scope) {
+			return token, nil
+		}
+	}
+}
+
+// withWorkspace puts a workspace segment back into a scope split by
+// splitWorkspace
+func withWorkspace(scope, workspace string) string {
+	if workspace == "" {
+		return scope
+	}
+	return "anthropic:" + workspace + strings.TrimPrefix(scope, "anthropic")
+}
+
+// workspaceScopeSpecs describes the scope namespace of each workspace
+func workspaceScopeSpecs(workspaces []*WorkspaceConfig) []sdk.ScopeSpec {
+	specs := make([]sdk.ScopeSpec, 0, len(workspaces))
+	for _, ws := range workspaces {
+		pattern := "anthropic:" + ws.Name
+		specs = append(specs, sdk.ScopeSpec{
+			Pattern:     pattern,
+			Description: fmt.Sprintf("Access to the %s workspace; any scope may follow the workspace name", ws.Name),
+			Examples:    []string{pattern, pattern + ":messages", pattern + ":claude:model:claude-sonnet-*"},
+		})
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Pattern < specs[j].Pattern })
+	return specs
+}
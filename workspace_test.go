@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConfigure_Workspaces(t *testing.T) {
+	plugin := newTestPlugin(t)
+	for _, tt := range []struct{ workspaces, wantErr string }{
+		{`[{"name": "Prod", "api_key": "sk-ant-prod"}]`, "lowercase"},
+		{`[{"name": "messages", "api_key": "sk-ant-prod"}]`, "already a scope"},
+		{`[{"name": "model", "api_key": "sk-ant-prod"}]`, "already a scope"},
+		{`[{"name": "prod", "api_key": "sk-ant-prod"}, {"name": "prod", "api_key": "sk-ant-dev"}]`, "duplicate"},
+		{`[{"name": "prod"}]`, "workspaces[prod]: api_key is required"},
+		{`[{"name": "prod", "api_key": "sk-ant-prod", "policies": {"anthropic": {"max_tokens": -1}}}]`, "max_tokens must not be negative"},
+		{`[{"name": "prod", "api_key": "sk-ant-prod", "agents": ["prod-["]}]`, "workspaces[prod]: agents: invalid pattern"},
+	} {
+		err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19572, "workspaces": `+tt.workspaces+`}`)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("workspaces %s: Configure() = %v, want an error containing %q", tt.workspaces, err, tt.wantErr)
+		}
+	}
+}
+
+func TestResolveScope_Workspaces(t *testing.T) {
+	plugin := newTestPlugin(t)
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19572,
+		"allowed_scopes": ["anthropic:messages"], "scope_narrowing": {"anthropic": "anthropic:messages"},
+		"workspaces": [{"name": "prod", "api_key": "sk-ant-prod"}]}`
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	for scope, want := range map[string]string{
+		"anthropic:messages":                   "",
+		"anthropic:prod":                       "prod",
+		"anthropic:prod:messages:max_tokens:5": "prod",
+	} {
+		s, err := plugin.ResolveScope(scope)
+		if err != nil || s.Workspace != want {
+			t.Errorf("ResolveScope(%q) = %+v, %v; want workspace %q", scope, s, err, want)
+		}
+	}
+	if _, err := plugin.ResolveScope("anthropic:dev"); err == nil {
+		t.Error("ResolveScope() should reject an unknown workspace")
+	}
+
+	// Narrowing keeps the workspace
+	got, _, err := plugin.effectiveScope(plugin.config, "anthropic:prod:max_tokens:5")
+	if err != nil || got != "anthropic:prod:messages:max_tokens:5" {
+		t.Errorf("effectiveScope() = %q, %v; want anthropic:prod:messages:max_tokens:5", got, err)
+	}
+}
+
+func TestIssue_WorkspaceRouting(t *testing.T) {
+	plugin := newTestPlugin(t)
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19572,
+		"policies": {"anthropic:ci": {"models": ["claude-haiku-*"]}},
+		"workspaces": [
+			{"name": "prod", "api_key": "sk-ant-prod", "agents": ["prod-*"]},
+			{"name": "sandbox", "api_key": "sk-ant-sandbox", "agents": ["exp-*"], "scopes": ["anthropic:ci"]}
+		]}`
+	if err := plugin.Configure(context.Background(), config); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	for _, tt := range []struct{ agent, scope, want string }{
+		{"prod-api", "anthropic:messages", "anthropic:prod:messages"},
+		{"exp-1", "anthropic", "anthropic:sandbox"},
+		{"dev-1", "anthropic:ci:max_tokens:512", "anthropic:sandbox:ci:max_tokens:512"},
+		// The first matching workspace wins
+		{"prod-api", "anthropic:ci", "anthropic:prod:ci"},
+		// A scope naming a workspace keeps it
+		{"prod-api", "anthropic:sandbox:messages", "anthropic:sandbox:messages"},
+		{"dev-1", "anthropic:messages", "anthropic:messages"},
+	} {
+		cred := issueToken(t, plugin, tt.agent, tt.scope, 10*time.Minute)
+		if got := cred.Metadata["scope"]; got != tt.want {
+			t.Errorf("agent %s requesting %q: issued %q, want %q", tt.agent, tt.scope, got, tt.want)
+		}
+		var requested string
+		if tt.want != tt.scope {
+			requested = tt.scope
+		}
+		if cred.Metadata["requested_scope"] != requested {
+			t.Errorf("agent %s requesting %q: requested_scope %q, want %q", tt.agent, tt.scope, cred.Metadata["requested_scope"], requested)
+		}
+	}
+}
+
+func TestProxy_Workspaces(t *testing.T) {
+	var key atomic.Value
+	config := `{"api_key": "sk-ant-test", "proxy_port": 19572, "previous_api_key": "sk-ant-old",
+		"workspaces": [{"name": "prod", "api_key": "sk-ant-prod", "policies": {"anthropic": {"max_tokens": 100}}}]}`
+	plugin, srv, _ := newTestProxyWithUpstream(t, config, func(w http.ResponseWriter, r *http.Request) {
+		key.Store(r.Header.Get("x-api-key"))
+		if r.Header.Get("x-api-key") == "sk-ant-prod" {
+			// The previous key is only for the default workspace
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"claude-haiku-4-5","usage":{"input_tokens":1,"output_tokens":1}}`))
+	})
+	body := `{"model":"claude-haiku-4-5","max_tokens":500}`
+
+	prod := issueToken(t, plugin, "agent-1", "anthropic:prod", 10*time.Minute)
+	resp := proxyRequest(t, srv, prod.Value, body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("prod request over the workspace's max_tokens: status %d, want 403", resp.StatusCode)
+	}
+	resp = proxyRequest(t, srv, prod.Value, `{"model":"claude-haiku-4-5","max_tokens":50}`)
+	resp.Body.Close()
+	if got := key.Load(); resp.StatusCode != http.StatusUnauthorized || got != "sk-ant-prod" {
+		t.Errorf("prod request: status %d with key %v, want 401 with sk-ant-prod", resp.StatusCode, got)
+	}
+
+	def := issueToken(t, plugin, "agent-1", "anthropic", 10*time.Minute)
+	resp = proxyRequest(t, srv, def.Value, body)
+	resp.Body.Close()
+	if got := key.Load(); resp.StatusCode != http.StatusOK || got != "sk-ant-test" {
+		t.Errorf("default request: status %d with key %v, want 200 with sk-ant-test", resp.StatusCode, got)
+	}
+}
+
+func TestValidate_Workspaces(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "sk-ant-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`))
+			return
+		}
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	plugin := newTestPlugin(t)
+	plugin.upstreamURL = upstream.URL
+	if err := plugin.Configure(context.Background(), `{"api_key": "sk-ant-test", "proxy_port": 19572, "workspaces": [{"name": "prod", "api_key": "sk-ant-revoked"}]}`); err != nil {
+		t.Fatalf("Configure() error: %v", err)
+	}
+	if err := plugin.Validate(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "workspaces[prod]: api_key was rejected") {
+		t.Errorf("Validate() = %v, want the prod workspace's key rejected", err)
+	}
+}
+
+func TestValidate_WorkspaceTokenNamespaces(t *testing.T) {
+	for _, mode := range []string{"store", "stateless"} {
+		t.Run(mode, func(t *testing.T) {
+			plugin := newTestPlugin(t)
+			config := `{"api_key": "sk-ant-test", "proxy_port": 19572, "token_mode": "` + mode + `", "token_signing_key": "0123456789abcdef0123456789abcdef",
+				"workspaces": [{"name": "prod", "api_key": "sk-ant-prod"}, {"name": "prod_eu", "api_key": "sk-ant-prod-eu"}]}`
+			if err := plugin.Configure(context.Background(), config); err != nil {
+				t.Fatalf("Configure() error: %v", err)
+			}
+			for scope, prefix := range map[string]string{"anthropic": "crd_", "anthropic:prod": "crd_prod_", "anthropic:prod_eu:messages": "crd_prod_eu_"} {
+				token := issueToken(t, plugin, "agent-1", scope, 10*time.Minute).Value
+				if ws := plugin.config.tokenWorkspace(token); !strings.HasPrefix(token, prefix) || ws != plugin.config.scopeWorkspace(scope) {
+					t.Errorf("%s token %s is in workspace %q, want prefix %s", scope, token, ws, prefix)
+				}
+				if _, ok := plugin.ValidateToken(token); !ok {
+					t.Errorf("ValidateToken() rejected a %s token", scope)
+				}
+			}
+
+			// A token moved out of its namespace is not redeemed in another
+			// workspace
+			prod := issueToken(t, plugin, "agent-1", "anthropic:prod", 10*time.Minute).Value
+			if mode == "stateless" {
+				moved := "crd_" + strings.TrimPrefix(prod, "crd_prod_")
+				if _, ok := plugin.ValidateToken(moved); ok {
+					t.Error("ValidateToken() accepted a prod token without its namespace")
+				}
+				return
+			}
+			info, _ := plugin.ValidateToken(prod)
+			moved := *info
+			moved.Scope = "anthropic"
+			if err := plugin.tokenStore().Add(info.ID, &moved); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := plugin.ValidateToken(prod); ok {
+				t.Error("ValidateToken() accepted a prod token whose stored scope is for the default workspace")
+			}
+		})
+	}
+}